@@ -1,6 +1,20 @@
 package config
 
-import "github.com/spf13/viper"
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"github.com/TomaszDomagala/Allezon/src/pkg/idGetter/dictionary"
+)
+
+// Protocols of the id_getter client.
+const (
+	IDGetterProtocolHTTP     = "http"
+	IDGetterProtocolGRPC     = "grpc"
+	IDGetterProtocolEmbedded = "embedded"
+)
 
 type Config struct {
 	// Server options
@@ -11,19 +25,69 @@ type Config struct {
 	LogLevel string `mapstructure:"log_level"`
 
 	// Kafka options
-	KafkaNullProducer      bool     `mapstructure:"kafka_null_producer"`
-	KafkaAddresses         []string `mapstructure:"kafka_addresses"`
-	KafkaNumPartitions     int32    `mapstructure:"kafka_num_partitions"`
-	KafkaReplicationFactor int16    `mapstructure:"kafka_replication_factor"`
+	KafkaNullProducer bool     `mapstructure:"kafka_null_producer"`
+	KafkaAddresses    []string `mapstructure:"kafka_addresses"`
+	// KafkaNumPartitions is the number of partitions of the user tags topic, which all need watermarks before
+	// buckets are finalized.
+	KafkaNumPartitions     int32 `mapstructure:"kafka_num_partitions"`
+	KafkaReplicationFactor int16 `mapstructure:"kafka_replication_factor"`
+	// UserTagsBroadcast selects how accepted tags reach subscribers of all replicas, either "local" or "kafka".
+	// The local broadcast reaches only subscribers of the replica that accepted the tag.
+	UserTagsBroadcast string `mapstructure:"user_tags_broadcast"`
+	// UserTagsSubscribeSecret is the key of HMAC tokens authorizing subscriptions to tags of cookies,
+	// subscriptions are rejected if it's empty.
+	UserTagsSubscribeSecret string `mapstructure:"user_tags_subscribe_secret"`
+	// UserTagsSubscribeOrigins are origins of pages allowed to open subscriptions, like https://example.com.
+	UserTagsSubscribeOrigins []string `mapstructure:"user_tags_subscribe_origins"`
 
 	// DB options
 	DBProfilesAddresses   []string `mapstructure:"db_profiles_addresses"`
 	DBAggregatesAddresses []string `mapstructure:"db_aggregates_addresses"`
 	DBNullClient          bool     `mapstructure:"db_null_client"`
+	// AggregatesSetRefreshInterval is the period of reloading the active set of aggregates, switched after rebuilds.
+	AggregatesSetRefreshInterval time.Duration `mapstructure:"aggregates_set_refresh_interval"`
+
+	// UserProfileTombstoneTTL is the period in which tags of erased cookies are rejected. Zero disables rejecting.
+	UserProfileTombstoneTTL time.Duration `mapstructure:"user_profile_tombstone_ttl"`
+
+	// Product funnel options
+	// ProductFunnelTimeout and ProductFunnelMaxProfiles bound the scan of user profiles done by every request of
+	// the product funnel, requests exceeding them fail. Zero disables the bound.
+	ProductFunnelTimeout     time.Duration `mapstructure:"product_funnel_timeout"`
+	ProductFunnelMaxProfiles int           `mapstructure:"product_funnel_max_profiles"`
+
+	// Aggregates stream options
+	// AggregatesStreamRefreshInterval is the period of re-reading changed buckets of streamed aggregates.
+	AggregatesStreamRefreshInterval time.Duration `mapstructure:"aggregates_stream_refresh_interval"`
+	// AggregatesStreamSettleTime is how long a bucket is re-read after a tag of it was received,
+	// so that changes are streamed once the worker applies them.
+	AggregatesStreamSettleTime        time.Duration `mapstructure:"aggregates_stream_settle_time"`
+	AggregatesStreamHeartbeatInterval time.Duration `mapstructure:"aggregates_stream_heartbeat_interval"`
 
 	// ID Getter
-	IDGetterAddress    string `mapstructure:"id_getter_address"`
-	IDGetterNullClient bool   `mapstructure:"id_getter_null_client"`
+	// IDGetterProtocol selects the id_getter client, either "http", "grpc" or "embedded".
+	// The embedded client assigns ids in process, using the ids db directly.
+	IDGetterProtocol         string        `mapstructure:"id_getter_protocol"`
+	IDGetterAddresses        []string      `mapstructure:"id_getter_addresses"`
+	IDGetterMaxRetries       int           `mapstructure:"id_getter_max_retries"`
+	IDGetterBreakerThreshold int           `mapstructure:"id_getter_breaker_threshold"`
+	IDGetterBreakerCooldown  time.Duration `mapstructure:"id_getter_breaker_cooldown"`
+	// IDGetterWarmUp enables bootstrapping the ids cache from the id_getter snapshot and polling for deltas.
+	IDGetterWarmUp       bool          `mapstructure:"id_getter_warm_up"`
+	IDGetterPollInterval time.Duration `mapstructure:"id_getter_poll_interval"`
+	IDGetterNullClient   bool          `mapstructure:"id_getter_null_client"`
+
+	// Embedded ID Getter
+	// IDGetterDBAddresses are addresses of the ids db, required by the embedded client.
+	IDGetterDBAddresses []string `mapstructure:"id_getter_db_addresses"`
+	// IDGetterCollections are preloaded into the cache on warm up.
+	IDGetterCollections                 []string `mapstructure:"id_getter_collections"`
+	IDGetterDefaultMaxCardinality       int      `mapstructure:"id_getter_default_max_cardinality"`
+	IDGetterDefaultOverflowElement      string   `mapstructure:"id_getter_default_overflow_element"`
+	IDGetterCollectionLimitsJSON        string   `mapstructure:"id_getter_collection_limits"`
+	IDGetterCollectionNormalizationJSON string   `mapstructure:"id_getter_collection_normalization"`
+	// IDDictionary is parsed from the embedded id getter options.
+	IDDictionary dictionary.Config `mapstructure:"-"`
 }
 
 func field(name string, defaultValue any) {
@@ -41,15 +105,54 @@ func New() (*Config, error) {
 	field("kafka_addresses", []string{})
 	field("kafka_num_partitions", 1)
 	field("kafka_replication_factor", 1)
+	field("user_tags_broadcast", "local")
+	field("user_tags_subscribe_secret", "")
+	field("user_tags_subscribe_origins", []string{})
 
 	field("db_profiles_addresses", []string{})
 	field("db_aggregates_addresses", []string{})
 	field("db_null_client", false)
+	field("aggregates_set_refresh_interval", 10*time.Second)
+
+	field("user_profile_tombstone_ttl", 30*24*time.Hour)
+
+	field("product_funnel_timeout", 10*time.Second)
+	field("product_funnel_max_profiles", 1_000_000)
 
-	field("id_getter_address", "")
+	field("aggregates_stream_refresh_interval", time.Second)
+	field("aggregates_stream_settle_time", 10*time.Second)
+	field("aggregates_stream_heartbeat_interval", 15*time.Second)
+
+	field("id_getter_protocol", IDGetterProtocolHTTP)
+	field("id_getter_addresses", []string{})
+	field("id_getter_max_retries", 2)
+	field("id_getter_breaker_threshold", 5)
+	field("id_getter_breaker_cooldown", 5*time.Second)
+	field("id_getter_warm_up", false)
+	field("id_getter_poll_interval", 30*time.Second)
 	field("id_getter_null_client", false)
 
+	field("id_getter_db_addresses", []string{})
+	field("id_getter_collections", []string{"origin", "brand", "category", "country"})
+	field("id_getter_default_max_cardinality", dictionary.DefaultMaxCardinality)
+	field("id_getter_default_overflow_element", dictionary.DefaultOverflowElement)
+	field("id_getter_collection_limits", "")
+	field("id_getter_collection_normalization", "")
+
 	var c Config
 	_ = viper.Unmarshal(&c)
+
+	var err error
+	c.IDDictionary, err = dictionary.ParseConfig(c.IDGetterCollections, c.IDGetterDefaultMaxCardinality,
+		c.IDGetterDefaultOverflowElement, c.IDGetterCollectionLimitsJSON, c.IDGetterCollectionNormalizationJSON)
+	if err != nil {
+		return nil, err
+	}
+	if c.IDGetterProtocol != IDGetterProtocolHTTP && c.IDGetterProtocol != IDGetterProtocolGRPC && c.IDGetterProtocol != IDGetterProtocolEmbedded {
+		return nil, fmt.Errorf("unknown id getter protocol %s", c.IDGetterProtocol)
+	}
+	if c.AggregatesStreamRefreshInterval <= 0 || c.AggregatesStreamHeartbeatInterval <= 0 {
+		return nil, fmt.Errorf("aggregates stream refresh and heartbeat intervals must be positive")
+	}
 	return &c, nil
 }
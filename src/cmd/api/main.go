@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"time"
@@ -49,6 +50,18 @@ func main() {
 		}
 	}
 
+	var broadcast messaging.UserTagsBroadcast
+	if conf.UserTagsBroadcast == "kafka" {
+		logger.Info("Using kafka user tags broadcast", zap.Strings("addresses", conf.KafkaAddresses))
+		broadcast, err = messaging.NewKafkaBroadcast(logger, conf.KafkaAddresses)
+		if err != nil {
+			logger.Fatal("Error while creating user tags broadcast", zap.Error(err))
+		}
+	} else {
+		logger.Info("Using local user tags broadcast")
+		broadcast = messaging.NewLocalBroadcast()
+	}
+
 	var dbProfilesClient db.Client
 	if conf.DBNullClient {
 		logger.Info("Using null profiles database client")
@@ -71,20 +84,48 @@ func main() {
 			logger.Fatal("Error while creating database aggregates client", zap.Error(err))
 		}
 	}
+	if err := dbAggregatesClient.AggregatesSets().Follow(context.Background(), conf.AggregatesSetRefreshInterval); err != nil {
+		logger.Fatal("Error while loading active aggregates set", zap.Error(err))
+	}
 
 	var getter idGetter.Client
-	if conf.IDGetterNullClient {
+	policy := idGetter.DefaultPolicy()
+	policy.MaxRetries = conf.IDGetterMaxRetries
+	policy.BreakerThreshold = conf.IDGetterBreakerThreshold
+	policy.BreakerCooldown = conf.IDGetterBreakerCooldown
+	switch {
+	case conf.IDGetterNullClient:
 		logger.Info("Using null id getter client")
 		getter = idGetter.NewNullClient(logger)
-	} else {
-		logger.Info("Using id getter client", zap.String("address", conf.IDGetterAddress))
-		getter = idGetter.NewClient(http.Client{Timeout: 5 * time.Second}, conf.IDGetterAddress, logger)
+	case conf.IDGetterProtocol == config.IDGetterProtocolEmbedded:
+		logger.Info("Using embedded id getter client", zap.Strings("db_addresses", conf.IDGetterDBAddresses))
+		getter, err = idGetter.NewEmbeddedClientFromAddresses(conf.IDDictionary, logger, conf.IDGetterDBAddresses...)
+		if err != nil {
+			logger.Fatal("Error while creating embedded id getter client", zap.Error(err))
+		}
+	case conf.IDGetterProtocol == config.IDGetterProtocolGRPC:
+		logger.Info("Using id getter grpc client", zap.Strings("addresses", conf.IDGetterAddresses))
+		getter, err = idGetter.NewGRPCClient(conf.IDGetterAddresses, 5*time.Second, policy, logger)
+		if err != nil {
+			logger.Fatal("Error while creating id getter grpc client", zap.Error(err))
+		}
+	default: // config.IDGetterProtocolHTTP, other protocols are rejected by config.New.
+		logger.Info("Using id getter client", zap.Strings("addresses", conf.IDGetterAddresses))
+		getter = idGetter.NewClient(http.Client{Timeout: 5 * time.Second}, conf.IDGetterAddresses, policy, logger)
+		idGetter.PublishStats("id_getter_client", getter)
+	}
+	if w, ok := getter.(idGetter.Warmer); ok && conf.IDGetterWarmUp {
+		if err := w.WarmUp(); err != nil {
+			logger.Warn("Error while warming up id getter cache", zap.Error(err))
+		}
+		go w.PollDeltas(context.Background(), conf.IDGetterPollInterval)
 	}
 
 	srv := server.New(server.Dependencies{
 		Logger:       logger,
 		Cfg:          conf,
 		Producer:     producer,
+		Broadcast:    broadcast,
 		ProfilesDB:   dbProfilesClient,
 		AggregatesDB: dbAggregatesClient,
 		IDGetter:     getter,
@@ -29,7 +29,8 @@ var expectationValidatorEndpoints = []string{userProfilesFullPath, aggregatesFul
 // validates that the response body is the same as the request body and logs an error if it's not.
 func ExpectationValidator(logger *zap.Logger) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		if !slices.Contains(expectationValidatorEndpoints, c.FullPath()) {
+		// Other methods, like DELETE on user profiles, don't carry the expected response.
+		if c.Request.Method != http.MethodPost || !slices.Contains(expectationValidatorEndpoints, c.FullPath()) {
 			c.Next()
 			return
 		}
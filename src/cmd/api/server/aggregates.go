@@ -1,6 +1,7 @@
 package server
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
@@ -8,6 +9,8 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"go.uber.org/zap"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
 
 	"github.com/TomaszDomagala/Allezon/src/pkg/db"
 	"github.com/TomaszDomagala/Allezon/src/pkg/dto"
@@ -18,10 +21,15 @@ import (
 type aggregatesRequest struct {
 	TimeRange  string   `form:"time_range" binding:"required"`
 	Action     string   `form:"action" binding:"required,oneof=BUY VIEW"`
-	Aggregates []string `form:"aggregates" binding:"required,dive,oneof=SUM_PRICE COUNT"`
-	Origin     *string  `form:"origin" binding:"-"`
-	BrandId    *string  `form:"brand_id" binding:"-"`
-	CategoryId *string  `form:"category_id" binding:"-"`
+	Aggregates []string `form:"aggregates" binding:"required,dive,oneof=SUM_PRICE COUNT AVG_PRICE MIN_PRICE MAX_PRICE UNIQUE_COOKIES PRICE_P50 PRICE_P90 PRICE_P99"`
+	// Filters may be repeated to match any of the values, values prefixed with "!" are excluded.
+	Origin     []string `form:"origin" binding:"-"`
+	BrandId    []string `form:"brand_id" binding:"-"`
+	CategoryId []string `form:"category_id" binding:"-"`
+	Country    []string `form:"country" binding:"-"`
+	Device     []string `form:"device" binding:"dive,oneof=PC MOBILE TV !PC !MOBILE !TV"`
+	// Finalized adds the column telling whether the bucket is before the watermark of the worker.
+	Finalized bool `form:"finalized"`
 }
 
 func (s server) aggregatesHandler(c *gin.Context) {
@@ -60,6 +68,9 @@ func (s server) aggregatesHandler(c *gin.Context) {
 			origin:     req.Origin,
 			brandId:    req.BrandId,
 			categoryId: req.CategoryId,
+			country:    req.Country,
+			device:     req.Device,
+			finalized:  req.Finalized,
 		},
 	)
 	if err != nil {
@@ -67,15 +78,20 @@ func (s server) aggregatesHandler(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, resp)
+	s.renderAggregates(c, resp)
 }
 
 func validateAggregatesTimeRange(from, to time.Time) error {
+	return validateBucketsTimeRange(from, to, 10*time.Minute)
+}
+
+// validateBucketsTimeRange checks that the time range consists of at most maxRange of whole 1m buckets.
+func validateBucketsTimeRange(from, to time.Time, maxRange time.Duration) error {
 	if from.After(to) {
 		return fmt.Errorf("from is before to")
 	}
-	if to.Sub(from) > 10*time.Minute {
-		return fmt.Errorf("time range is larger than 10 minutes")
+	if to.Sub(from) > maxRange {
+		return fmt.Errorf("time range is larger than %s", maxRange)
 	}
 	if from.Second() > 0 {
 		return fmt.Errorf("from is not second aligned")
@@ -108,30 +124,94 @@ func (s server) convertAggregates(req []string) ([]types.Aggregate, error) {
 }
 
 func (s server) aggregates(aggregates []types.Aggregate, params fetchParams) (dto.AggregatesDTO, error) {
-	f, err := s.newFilters(params.origin, params.brandId, params.categoryId)
+	f, err := s.newFilters(params)
 	if err != nil {
 		return dto.AggregatesDTO{}, fmt.Errorf("error creating filters, %w", err)
 	}
 	res := newAggregatesResponseBuilder(aggregates, params)
+	if params.finalized {
+		watermarks, err := s.aggregatesDB.Watermarks().Get()
+		if err != nil {
+			return dto.AggregatesDTO{}, fmt.Errorf("error getting watermarks, %w", err)
+		}
+		res.watermark = db.MinWatermark(watermarks, s.conf.KafkaNumPartitions)
+	}
+	// Sketches of cookies are large, so they are fetched only when needed.
+	withCookies := slices.Contains(aggregates, types.UniqueCookies)
 	for t := params.from; t.Before(params.to); t = t.Add(time.Minute) {
-		aggs, err := s.aggregatesDB.Aggregates().Get(t, params.action)
+		var aggs []db.ActionAggregates
+		if withCookies {
+			aggs, err = s.aggregatesDB.Aggregates().GetWithCookies(t, params.action)
+		} else {
+			aggs, err = s.aggregatesDB.Aggregates().Get(t, params.action)
+		}
 		if err != nil {
 			return dto.AggregatesDTO{}, fmt.Errorf("error getting aggregates for time %s, %w", t, err)
 		}
-		sum, count := s.filterAggregates(aggs, f)
+		b, matched := s.filterAggregates(aggs, f)
+		if withCookies {
+			b.uniqueCookies, err = s.aggregatesDB.Aggregates().CountUniqueCookies(t, params.action, matched)
+			if err != nil {
+				return dto.AggregatesDTO{}, fmt.Errorf("error counting unique cookies for time %s, %w", t, err)
+			}
+		}
 
-		res.appendAggregates(t, sum, count)
+		res.appendAggregates(t, b)
 	}
 
 	return res.toResponse(), nil
 }
 
-func (s server) filterAggregates(aggs []db.ActionAggregates, f filters) (sum uint64, count uint64) {
+// bucket holds aggregates of a single minute merged over all matching keys.
+type bucket struct {
+	sum   uint64
+	count uint64
+	// minPrice and maxPrice are merged only from records tracking the price range.
+	minPrice      uint32
+	maxPrice      uint32
+	hasPriceRange bool
+	uniqueCookies uint64
+	// histogram is merged from histograms of all matching keys, records not tracking it are skipped.
+	histogram db.PriceHistogram
+}
+
+func (b bucket) avgPrice() uint64 {
+	if b.count == 0 {
+		return 0
+	}
+	return b.sum / b.count
+}
+
+// percentile returns the lower bound of the histogram bucket holding the percentile of prices, or 0 if there are none.
+func (b bucket) percentile(p float64) uint32 {
+	price, _ := b.histogram.Percentile(p)
+	return price
+}
+
+func (s server) filterAggregates(aggs []db.ActionAggregates, f filters) (b bucket, matched []db.ActionAggregates) {
 	for _, agg := range aggs {
-		if f.match(agg.Key) {
-			sum += agg.Sum
-			count += uint64(agg.Count)
+		if !f.match(agg.Key) {
+			continue
+		}
+		matched = append(matched, agg)
+		b.sum += agg.Sum
+		b.count += uint64(agg.Count)
+		if agg.PriceHistogram != nil {
+			if b.histogram == nil {
+				b.histogram = make(db.PriceHistogram)
+			}
+			b.histogram.Merge(agg.PriceHistogram)
 		}
+		if !agg.HasPriceRange {
+			continue
+		}
+		if !b.hasPriceRange || agg.MinPrice < b.minPrice {
+			b.minPrice = agg.MinPrice
+		}
+		if !b.hasPriceRange || agg.MaxPrice > b.maxPrice {
+			b.maxPrice = agg.MaxPrice
+		}
+		b.hasPriceRange = true
 	}
 	return
 }
@@ -142,6 +222,8 @@ type aggregatesResponseBuilder struct {
 
 	aggs   []types.Aggregate
 	params fetchParams
+	// watermark is the time before which buckets are finalized, zero if none is.
+	watermark time.Time
 }
 
 func (b *aggregatesResponseBuilder) toResponse() dto.AggregatesDTO {
@@ -151,43 +233,48 @@ func (b *aggregatesResponseBuilder) toResponse() dto.AggregatesDTO {
 	}
 }
 
-func (b *aggregatesResponseBuilder) appendAggregates(t time.Time, sum uint64, count uint64) {
+func (b *aggregatesResponseBuilder) appendAggregates(t time.Time, bucket bucket) {
 	row := make([]string, 0, len(b.columns))
 	row = append(row, t.Format(dto.TimeRangeSecPrecisionLayout), b.params.action.String())
-	if b.params.origin != nil {
-		row = append(row, *b.params.origin)
-	}
-	if b.params.brandId != nil {
-		row = append(row, *b.params.brandId)
-	}
-	if b.params.categoryId != nil {
-		row = append(row, *b.params.categoryId)
-	}
+	row = append(row, b.params.filterValues()...)
 	for _, a := range b.aggs {
 		switch a {
 		case types.Count:
-			row = append(row, fmt.Sprint(count))
+			row = append(row, fmt.Sprint(bucket.count))
 		case types.Sum:
-			row = append(row, fmt.Sprint(sum))
+			row = append(row, fmt.Sprint(bucket.sum))
+		case types.AvgPrice:
+			row = append(row, fmt.Sprint(bucket.avgPrice()))
+		case types.MinPrice:
+			row = append(row, fmt.Sprint(bucket.minPrice))
+		case types.MaxPrice:
+			row = append(row, fmt.Sprint(bucket.maxPrice))
+		case types.UniqueCookies:
+			row = append(row, fmt.Sprint(bucket.uniqueCookies))
+		case types.PriceP50:
+			row = append(row, fmt.Sprint(bucket.percentile(50)))
+		case types.PriceP90:
+			row = append(row, fmt.Sprint(bucket.percentile(90)))
+		case types.PriceP99:
+			row = append(row, fmt.Sprint(bucket.percentile(99)))
 		}
 	}
+	if b.params.finalized {
+		finalized := !b.watermark.IsZero() && !t.Add(time.Minute).After(b.watermark)
+		row = append(row, fmt.Sprint(finalized))
+	}
 	b.rows = append(b.rows, row)
 }
 
 func newAggregatesResponseBuilder(aggregates []types.Aggregate, params fetchParams) (res aggregatesResponseBuilder) {
 	res.columns = []string{"1m_bucket", "action"}
-	if params.origin != nil {
-		res.columns = append(res.columns, "origin")
-	}
-	if params.brandId != nil {
-		res.columns = append(res.columns, "brand_id")
-	}
-	if params.categoryId != nil {
-		res.columns = append(res.columns, "category_id")
-	}
+	res.columns = append(res.columns, params.filterColumns()...)
 	for _, a := range aggregates {
 		res.columns = append(res.columns, strings.ToLower(a.String()))
 	}
+	if params.finalized {
+		res.columns = append(res.columns, "finalized")
+	}
 
 	res.aggs = aggregates
 	res.params = params
@@ -195,51 +282,114 @@ func newAggregatesResponseBuilder(aggregates []types.Aggregate, params fetchPara
 	return res
 }
 
-func (s server) newFilters(origin, brandId, categoryId *string) (f filters, err error) {
-	f.originId, err = s.getId(idGetter.OriginCollection, origin)
+// newFilters resolves filter values to ids. The id_getter normalizes the values the same way it normalizes
+// elements of consumed tags, so filters match regardless of the spelling used by the client.
+func (s server) newFilters(params fetchParams) (f filters, err error) {
+	f.origin, err = s.newIdFilter(idGetter.OriginCollection, params.origin)
 	if err != nil {
 		return filters{}, err
 	}
-	f.categoryId, err = s.getId(idGetter.CategoryCollection, categoryId)
+	f.category, err = s.newIdFilter(idGetter.CategoryCollection, params.categoryId)
 	if err != nil {
 		return filters{}, err
 	}
-	f.brandId, err = s.getId(idGetter.BrandCollection, brandId)
+	f.brand, err = s.newIdFilter(idGetter.BrandCollection, params.brandId)
 	if err != nil {
 		return filters{}, err
 	}
-	s.logger.Debug("filters initialized", zap.Uint16p("originId", f.originId), zap.Uint16p("categoryId", f.categoryId), zap.Uint16p("brandId", f.brandId))
+	f.country, err = s.newIdFilter(idGetter.CountryCollection, params.country)
+	if err != nil {
+		return filters{}, err
+	}
+	for _, v := range params.device {
+		element, negated := parseFilterValue(v)
+		device, err := dto.ToDevice(element)
+		if err != nil {
+			return filters{}, err
+		}
+		f.device.add(db.DeviceKey(device), negated)
+	}
+	s.logger.Debug("filters initialized", zap.Stringer("origin", f.origin), zap.Stringer("category", f.category), zap.Stringer("brand", f.brand),
+		zap.Stringer("country", f.country), zap.Stringer("device", f.device))
 	return f, nil
 }
 
-func (s server) getId(collection string, elementPtr *string) (*uint16, error) {
-	if elementPtr == nil {
-		return nil, nil
+func (s server) newIdFilter(collection string, values []string) (f filter[uint16], err error) {
+	for _, v := range values {
+		element, negated := parseFilterValue(v)
+		id, err := idGetter.GetU16ID(s.idGetter, collection, element, false)
+		if errors.Is(err, idGetter.ErrNotFound) {
+			// Elements never seen by the id_getter can't be in any aggregate, so there is nothing to exclude,
+			// and nothing matches them when included.
+			if !negated && f.included == nil {
+				f.included = make(map[uint16]struct{})
+			}
+			continue
+		}
+		if err != nil {
+			return filter[uint16]{}, fmt.Errorf("error getting %s id of filter, %w", collection, err)
+		}
+		if collection == idGetter.CountryCollection {
+			// Countries are filtered by the key they are aggregated under, like the worker stores them.
+			id = db.CountryKey(id)
+		}
+		f.add(id, negated)
 	}
-	id, err := idGetter.GetU16ID(s.idGetter, collection, *elementPtr, false)
-	if err != nil {
-		return nil, fmt.Errorf("error getting %s id of filter, %w", collection, err)
+	return f, nil
+}
+
+// parseFilterValue strips the negation prefix of the filter value.
+func parseFilterValue(v string) (element string, negated bool) {
+	if strings.HasPrefix(v, "!") {
+		return v[1:], true
 	}
-	return &id, nil
+	return v, false
 }
 
 type filters struct {
-	originId   *uint16
-	brandId    *uint16
-	categoryId *uint16
+	origin   filter[uint16]
+	brand    filter[uint16]
+	category filter[uint16]
+	country  filter[uint16]
+	device   filter[uint8]
 }
 
 func (f filters) match(key db.AggregateKey) bool {
-	return checkFilter(f.originId, key.Origin) &&
-		checkFilter(f.brandId, key.BrandId) &&
-		checkFilter(f.categoryId, key.CategoryId)
+	return f.origin.match(key.Origin) &&
+		f.brand.match(key.BrandId) &&
+		f.category.match(key.CategoryId) &&
+		f.country.match(key.CountryId) &&
+		f.device.match(key.Device)
+}
+
+// filter matches values that are in the included set, or any value if there is no included set, and are not
+// excluded. An empty included set matches nothing.
+type filter[T comparable] struct {
+	included map[T]struct{}
+	excluded map[T]struct{}
+}
+
+func (f *filter[T]) add(v T, negated bool) {
+	set := &f.included
+	if negated {
+		set = &f.excluded
+	}
+	if *set == nil {
+		*set = make(map[T]struct{})
+	}
+	(*set)[v] = struct{}{}
 }
 
-func checkFilter(f *uint16, k uint16) bool {
-	if f == nil {
-		return true
+func (f filter[T]) match(v T) bool {
+	if _, ok := f.included[v]; f.included != nil && !ok {
+		return false
 	}
-	return *f == k
+	_, ok := f.excluded[v]
+	return !ok
+}
+
+func (f filter[T]) String() string {
+	return fmt.Sprintf("included: %v, excluded: %v", maps.Keys(f.included), maps.Keys(f.excluded))
 }
 
 type fetchParams struct {
@@ -247,7 +397,42 @@ type fetchParams struct {
 	to     time.Time
 	action types.Action
 
-	origin     *string
-	brandId    *string
-	categoryId *string
+	origin     []string
+	brandId    []string
+	categoryId []string
+	country    []string
+	device     []string
+
+	finalized bool
+}
+
+// filterColumns returns the response columns of the filters in use.
+func (p fetchParams) filterColumns() (columns []string) {
+	if len(p.origin) > 0 {
+		columns = append(columns, "origin")
+	}
+	if len(p.brandId) > 0 {
+		columns = append(columns, "brand_id")
+	}
+	if len(p.categoryId) > 0 {
+		columns = append(columns, "category_id")
+	}
+	if len(p.country) > 0 {
+		columns = append(columns, "country")
+	}
+	if len(p.device) > 0 {
+		columns = append(columns, "device")
+	}
+	return columns
+}
+
+// filterValues returns the values of filterColumns. Multi-value filters are represented by their values
+// joined with commas, in the order of the query.
+func (p fetchParams) filterValues() (values []string) {
+	for _, v := range [][]string{p.origin, p.brandId, p.categoryId, p.country, p.device} {
+		if len(v) > 0 {
+			values = append(values, strings.Join(v, ","))
+		}
+	}
+	return values
 }
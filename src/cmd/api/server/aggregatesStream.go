@@ -0,0 +1,199 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+
+	"github.com/TomaszDomagala/Allezon/src/pkg/dto"
+	"github.com/TomaszDomagala/Allezon/src/pkg/types"
+)
+
+// aggregatesStreamWindow is the range of the most recent buckets whose changes are streamed.
+const aggregatesStreamWindow = 10 * time.Minute
+
+const (
+	aggregateEvent = "aggregate"
+	heartbeatEvent = "heartbeat"
+)
+
+// aggregateChangesBuffer is the number of changes buffered for every stream. Streams still re-read the latest
+// buckets periodically, so a dropped change delays only streaming of older buckets.
+const aggregateChangesBuffer = 1024
+
+// aggregateChange notifies streams that a tag of the bucket was received, the worker updates its aggregates shortly.
+type aggregateChange struct {
+	bucket time.Time
+	action types.Action
+}
+
+// aggregatesStreamRequest is aggregatesRequest without the time range, which is given by the stream window.
+type aggregatesStreamRequest struct {
+	Action     string   `form:"action" binding:"required,oneof=BUY VIEW"`
+	Aggregates []string `form:"aggregates" binding:"required,dive,oneof=SUM_PRICE COUNT AVG_PRICE MIN_PRICE MAX_PRICE UNIQUE_COOKIES PRICE_P50 PRICE_P90 PRICE_P99"`
+	// Filters are the same as those of aggregatesRequest.
+	Origin     []string `form:"origin" binding:"-"`
+	BrandId    []string `form:"brand_id" binding:"-"`
+	CategoryId []string `form:"category_id" binding:"-"`
+	Country    []string `form:"country" binding:"-"`
+	Device     []string `form:"device" binding:"dive,oneof=PC MOBILE TV !PC !MOBILE !TV"`
+}
+
+// aggregatesStreamHandler streams rows of buckets as server-sent events. Every event holds a single row,
+// its id is the bucket, so a client reconnecting with Last-Event-ID gets all buckets since then again.
+func (s server) aggregatesStreamHandler(c *gin.Context) {
+	var req aggregatesStreamRequest
+	if err := c.BindQuery(&req); err != nil {
+		_ = c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	action, err := dto.ToAction(req.Action)
+	if err != nil {
+		_ = c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	aggregates, err := s.convertAggregates(req.Aggregates)
+	if err != nil {
+		_ = c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	var resumeFrom time.Time
+	if id := c.GetHeader("Last-Event-ID"); id != "" {
+		resumeFrom, err = time.Parse(dto.TimeRangeSecPrecisionLayout, id)
+		if err != nil {
+			err = fmt.Errorf("error parsing Last-Event-ID, %w", err)
+			_ = c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Content-Type", "text/event-stream")
+	send := func(event sse.Event) error {
+		if err := sse.Encode(c.Writer, event); err != nil {
+			return err
+		}
+		c.Writer.Flush()
+		return nil
+	}
+
+	err = s.streamAggregates(
+		c.Request.Context(),
+		aggregates,
+		fetchParams{
+			action:     action,
+			origin:     req.Origin,
+			brandId:    req.BrandId,
+			categoryId: req.CategoryId,
+			country:    req.Country,
+			device:     req.Device,
+		},
+		resumeFrom,
+		send,
+	)
+	if err != nil {
+		s.logger.Error("error streaming aggregates", zap.Error(err))
+		if !c.Writer.Written() {
+			_ = c.AbortWithError(http.StatusInternalServerError, err)
+		}
+	}
+}
+
+// streamAggregates sends rows of all buckets of the window newer than resumeFrom, then keeps sending rows of
+// buckets that changed until ctx is done. The latest two buckets are re-read periodically, as they may be changed
+// by tags received by other replicas, older ones only for the settle time after this replica received their tags.
+func (s server) streamAggregates(ctx context.Context, aggregates []types.Aggregate, params fetchParams, resumeFrom time.Time, send func(sse.Event) error) error {
+	changes, cancel := s.aggregateChanges.Subscribe()
+	defer cancel()
+
+	// sent holds the last row sent of every bucket in the window.
+	sent := make(map[time.Time][]string)
+	push := func(from, to time.Time) error {
+		p := params
+		p.from, p.to = from, to
+		resp, err := s.aggregates(aggregates, p)
+		if err != nil {
+			return err
+		}
+		for i, row := range resp.Rows {
+			t := from.Add(time.Duration(i) * time.Minute)
+			if slices.Equal(sent[t], row) {
+				continue
+			}
+			data, err := json.Marshal(dto.AggregatesDTO{Columns: resp.Columns, Rows: [][]string{row}})
+			if err != nil {
+				return fmt.Errorf("error marshalling row, %w", err)
+			}
+			if err := send(sse.Event{Id: row[0], Event: aggregateEvent, Data: string(data)}); err != nil {
+				return fmt.Errorf("error sending row, %w", err)
+			}
+			sent[t] = row
+		}
+		return nil
+	}
+
+	current := time.Now().UTC().Truncate(time.Minute)
+	from := current.Add(time.Minute - aggregatesStreamWindow)
+	if resumeFrom.After(from) {
+		from = resumeFrom.Truncate(time.Minute)
+	}
+	if !from.After(current) {
+		if err := push(from, current.Add(time.Minute)); err != nil {
+			return err
+		}
+	}
+
+	refresh := time.NewTicker(s.conf.AggregatesStreamRefreshInterval)
+	defer refresh.Stop()
+	heartbeat := time.NewTicker(s.conf.AggregatesStreamHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	// dirty holds buckets to re-read, until the end of their settle time.
+	dirty := make(map[time.Time]time.Time)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case change := <-changes:
+			if change.action == params.action {
+				dirty[change.bucket] = time.Now().Add(s.conf.AggregatesStreamSettleTime)
+			}
+		case now := <-refresh.C:
+			current := now.UTC().Truncate(time.Minute)
+			oldest := current.Add(time.Minute - aggregatesStreamWindow)
+			for t := range sent {
+				if t.Before(oldest) {
+					delete(sent, t)
+				}
+			}
+			buckets := map[time.Time]struct{}{current: {}, current.Add(-time.Minute): {}}
+			for t, until := range dirty {
+				if !t.Before(oldest) && !t.After(current) {
+					buckets[t] = struct{}{}
+				}
+				if until.Before(now) || t.Before(oldest) {
+					delete(dirty, t)
+				}
+			}
+			ordered := maps.Keys(buckets)
+			slices.SortFunc(ordered, func(a, b time.Time) bool { return a.Before(b) })
+			for _, t := range ordered {
+				if err := push(t, t.Add(time.Minute)); err != nil {
+					return err
+				}
+			}
+		case now := <-heartbeat.C:
+			if err := send(sse.Event{Event: heartbeatEvent, Data: now.UTC().Format(dto.TimeRangeSecPrecisionLayout)}); err != nil {
+				return fmt.Errorf("error sending heartbeat, %w", err)
+			}
+		}
+	}
+}
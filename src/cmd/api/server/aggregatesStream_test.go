@@ -0,0 +1,111 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-contrib/sse"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/TomaszDomagala/Allezon/src/pkg/db"
+	"github.com/TomaszDomagala/Allezon/src/pkg/dto"
+	"github.com/TomaszDomagala/Allezon/src/pkg/types"
+)
+
+func newStreamTestServer(aggs *memoryAggregates) server {
+	s := newTestServer(newMemoryProfiles())
+	s.conf.AggregatesStreamRefreshInterval = 10 * time.Millisecond
+	s.conf.AggregatesStreamSettleTime = time.Minute
+	s.conf.AggregatesStreamHeartbeatInterval = 50 * time.Millisecond
+	s.aggregatesDB = memoryAggregatesDB{Client: s.aggregatesDB, aggregates: aggs}
+	return s
+}
+
+// startStream streams counts of views in the background until the test ends.
+func startStream(t *testing.T, s server, resumeFrom time.Time) <-chan sse.Event {
+	ctx, cancel := context.WithCancel(context.Background())
+	events := make(chan sse.Event, 100)
+	done := make(chan error)
+	go func() {
+		done <- s.streamAggregates(ctx, []types.Aggregate{types.Count}, fetchParams{action: types.View}, resumeFrom, func(e sse.Event) error {
+			events <- e
+			return nil
+		})
+	}()
+	t.Cleanup(func() {
+		cancel()
+		assert.NoError(t, <-done)
+	})
+	return events
+}
+
+// waitForEvent returns the first event matching fn, skipping the others.
+func waitForEvent(t *testing.T, events <-chan sse.Event, fn func(sse.Event) bool) sse.Event {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e := <-events:
+			if fn(e) {
+				return e
+			}
+		case <-timeout:
+			require.FailNow(t, "timeout waiting for event")
+		}
+	}
+}
+
+func eventRow(t *testing.T, e sse.Event) []string {
+	var resp dto.AggregatesDTO
+	require.NoError(t, json.Unmarshal([]byte(e.Data.(string)), &resp))
+	require.Len(t, resp.Rows, 1)
+	return resp.Rows[0]
+}
+
+func TestStreamAggregates(t *testing.T) {
+	bucket := time.Now().UTC().Truncate(time.Minute).Add(-5 * time.Minute)
+	id := bucket.Format(dto.TimeRangeSecPrecisionLayout)
+	aggs := &memoryAggregates{aggs: map[time.Time][]db.ActionAggregates{
+		bucket: {{Key: db.AggregateKey{Origin: 1}, Sum: 10, Count: 1}},
+	}}
+	s := newStreamTestServer(aggs)
+	events := startStream(t, s, time.Time{})
+
+	e := waitForEvent(t, events, func(e sse.Event) bool { return e.Id == id })
+	assert.Equal(t, aggregateEvent, e.Event)
+	assert.Equal(t, []string{id, "VIEW", "1"}, eventRow(t, e))
+
+	aggs.set(bucket, []db.ActionAggregates{{Key: db.AggregateKey{Origin: 1}, Sum: 30, Count: 2}})
+	// Changes of other actions don't make the stream re-read the bucket.
+	s.aggregateChanges.Publish(aggregateChange{bucket: bucket, action: types.Buy})
+	s.aggregateChanges.Publish(aggregateChange{bucket: bucket, action: types.View})
+
+	e = waitForEvent(t, events, func(e sse.Event) bool { return e.Id == id })
+	assert.Equal(t, []string{id, "VIEW", "2"}, eventRow(t, e))
+
+	e = waitForEvent(t, events, func(e sse.Event) bool { return e.Event == heartbeatEvent })
+	assert.Empty(t, e.Id, "heartbeats don't change the id to resume from")
+}
+
+func TestStreamAggregatesResume(t *testing.T) {
+	resumeFrom := time.Now().UTC().Truncate(time.Minute).Add(-time.Minute)
+	s := newStreamTestServer(&memoryAggregates{aggs: map[time.Time][]db.ActionAggregates{}})
+	events := startStream(t, s, resumeFrom)
+
+	e := waitForEvent(t, events, func(sse.Event) bool { return true })
+	assert.Equal(t, resumeFrom.Format(dto.TimeRangeSecPrecisionLayout), e.Id, "buckets before the last event id are skipped")
+	assert.Equal(t, []string{e.Id, "VIEW", "0"}, eventRow(t, e))
+}
+
+func TestAggregatesStreamHandlerInvalidLastEventID(t *testing.T) {
+	s := newTestServer(newMemoryProfiles())
+	req := httptest.NewRequest(http.MethodGet, "/aggregates/stream?action=VIEW&aggregates=COUNT", nil)
+	req.Header.Set("Last-Event-ID", "yesterday")
+	w := httptest.NewRecorder()
+	s.engine.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
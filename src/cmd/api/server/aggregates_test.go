@@ -0,0 +1,329 @@
+package server
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/TomaszDomagala/Allezon/src/pkg/db"
+	"github.com/TomaszDomagala/Allezon/src/pkg/dto"
+	"github.com/TomaszDomagala/Allezon/src/pkg/idGetter"
+	"github.com/TomaszDomagala/Allezon/src/pkg/types"
+)
+
+// mapIDGetter is an idGetter.Client with fixed ids of elements of all collections.
+type mapIDGetter map[string]int32
+
+func (m mapIDGetter) GetID(_ string, element string, _ bool) (int32, error) {
+	id, ok := m[element]
+	if !ok {
+		return 0, idGetter.ErrNotFound
+	}
+	return id, nil
+}
+
+// memoryAggregates is a fake of db.AggregatesClient. Its sketches of cookies are newline separated cookies,
+// so unique cookies are counted exactly.
+type memoryAggregates struct {
+	mu   sync.Mutex
+	aggs map[time.Time][]db.ActionAggregates
+}
+
+func (m *memoryAggregates) set(t time.Time, aggs []db.ActionAggregates) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.aggs[t] = aggs
+}
+
+func (m *memoryAggregates) Get(t time.Time, _ types.Action) ([]db.ActionAggregates, error) {
+	return m.get(t, false, false), nil
+}
+
+func (m *memoryAggregates) GetWithCookies(t time.Time, _ types.Action) ([]db.ActionAggregates, error) {
+	return m.get(t, true, false), nil
+}
+
+func (m *memoryAggregates) GetWithTop(t time.Time, _ types.Action) ([]db.ActionAggregates, error) {
+	return m.get(t, false, true), nil
+}
+
+func (m *memoryAggregates) get(t time.Time, withCookies bool, withTop bool) []db.ActionAggregates {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	aggs := append([]db.ActionAggregates(nil), m.aggs[t]...)
+	for i := range aggs {
+		if !withCookies {
+			aggs[i].Cookies = nil
+		}
+		if !withTop {
+			aggs[i].ProductCounts, aggs[i].ProductSums, aggs[i].BrandName, aggs[i].CategoryName = nil, nil, "", ""
+		}
+	}
+	return aggs
+}
+
+func (m *memoryAggregates) CountUniqueCookies(_ time.Time, _ types.Action, aggs []db.ActionAggregates) (uint64, error) {
+	cookies := make(map[string]struct{})
+	for _, agg := range aggs {
+		for _, c := range bytes.Fields(agg.Cookies) {
+			cookies[string(c)] = struct{}{}
+		}
+	}
+	return uint64(len(cookies)), nil
+}
+
+func (m *memoryAggregates) Add(db.AggregateKey, types.UserTag) error {
+	return nil
+}
+
+func (m *memoryAggregates) AddCorrection(db.AggregateKey, types.UserTag) error {
+	return nil
+}
+
+type memoryAggregatesDB struct {
+	db.Client
+	aggregates db.AggregatesClient
+	watermarks memoryWatermarks
+}
+
+func (m memoryAggregatesDB) Aggregates() db.AggregatesClient {
+	return m.aggregates
+}
+
+func (m memoryAggregatesDB) Watermarks() db.WatermarkClient {
+	return m.watermarks
+}
+
+// memoryWatermarks is a read only db.WatermarkClient.
+type memoryWatermarks map[int32]time.Time
+
+func (m memoryWatermarks) Put(int32, time.Time) error {
+	return nil
+}
+
+func (m memoryWatermarks) Get() (map[int32]time.Time, error) {
+	return m, nil
+}
+
+func TestAggregates(t *testing.T) {
+	from := time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC)
+	s := newTestServer(newMemoryProfiles())
+	s.aggregatesDB = memoryAggregatesDB{
+		Client: s.aggregatesDB,
+		aggregates: &memoryAggregates{aggs: map[time.Time][]db.ActionAggregates{
+			from: {
+				{Key: db.AggregateKey{Origin: 1}, Sum: 60, Count: 3, MinPrice: 10, MaxPrice: 30, HasPriceRange: true, Cookies: db.HLL("foo\nbar")},
+				{Key: db.AggregateKey{Origin: 2}, Sum: 45, Count: 2, MinPrice: 5, MaxPrice: 40, HasPriceRange: true, Cookies: db.HLL("bar\nbaz")},
+				// Records written before the price range was tracked are skipped by MIN_PRICE and MAX_PRICE.
+				{Key: db.AggregateKey{Origin: 3}, Sum: 1, Count: 1},
+			},
+		}},
+	}
+
+	aggregates := []types.Aggregate{types.Count, types.Sum, types.AvgPrice, types.MinPrice, types.MaxPrice, types.UniqueCookies}
+	resp, err := s.aggregates(aggregates, fetchParams{from: from, to: from.Add(2 * time.Minute), action: types.View})
+	require.NoError(t, err)
+
+	assert.Equal(t, dto.AggregatesDTO{
+		Columns: []string{"1m_bucket", "action", "count", "sum_price", "avg_price", "min_price", "max_price", "unique_cookies"},
+		Rows: [][]string{
+			{"2022-03-01T00:00:00", "VIEW", "6", "106", "17", "5", "40", "3"},
+			{"2022-03-01T00:01:00", "VIEW", "0", "0", "0", "0", "0", "0"},
+		},
+	}, resp)
+}
+
+func TestAggregatesCountryAndDevice(t *testing.T) {
+	from := time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC)
+	s := newTestServer(newMemoryProfiles())
+	s.aggregatesDB = memoryAggregatesDB{
+		Client: s.aggregatesDB,
+		aggregates: &memoryAggregates{aggs: map[time.Time][]db.ActionAggregates{
+			from: {
+				{Key: db.AggregateKey{Device: db.DeviceKey(types.Pc)}, Sum: 10, Count: 1},
+				{Key: db.AggregateKey{Device: db.DeviceKey(types.Mobile)}, Sum: 20, Count: 2},
+				{Key: db.AggregateKey{CountryId: 1, Device: db.DeviceKey(types.Mobile)}, Sum: 40, Count: 4},
+			},
+		}},
+	}
+
+	// The null id getter resolves every country to id 0.
+	resp, err := s.aggregates([]types.Aggregate{types.Count, types.Sum}, fetchParams{
+		from: from, to: from.Add(time.Minute), action: types.Buy, country: []string{"PL"}, device: []string{"MOBILE"},
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, dto.AggregatesDTO{
+		Columns: []string{"1m_bucket", "action", "country", "device", "count", "sum_price"},
+		Rows: [][]string{
+			{"2022-03-01T00:00:00", "BUY", "PL", "MOBILE", "2", "20"},
+		},
+	}, resp)
+}
+
+func TestAggregatesCountryOutsideOfKey(t *testing.T) {
+	from := time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC)
+	s := newTestServer(newMemoryProfiles())
+	s.idGetter = mapIDGetter{"PL": 1, "XX": db.MaxCountryId + 1}
+	s.aggregatesDB = memoryAggregatesDB{
+		Client: s.aggregatesDB,
+		aggregates: &memoryAggregates{aggs: map[time.Time][]db.ActionAggregates{
+			from: {
+				{Key: db.AggregateKey{CountryId: 0}, Sum: 10, Count: 1},
+				{Key: db.AggregateKey{CountryId: 1}, Sum: 20, Count: 2},
+			},
+		}},
+	}
+
+	// The worker stores countries that don't fit in the key as unknown, so they are filtered the same way.
+	resp, err := s.aggregates([]types.Aggregate{types.Count}, fetchParams{
+		from: from, to: from.Add(time.Minute), action: types.Buy, country: []string{"XX"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{{"2022-03-01T00:00:00", "BUY", "XX", "1"}}, resp.Rows)
+}
+
+func TestAggregatesUnknownFilterValues(t *testing.T) {
+	from := time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC)
+	s := newTestServer(newMemoryProfiles())
+	s.idGetter = mapIDGetter{"nike": 1}
+	s.aggregatesDB = memoryAggregatesDB{
+		Client: s.aggregatesDB,
+		aggregates: &memoryAggregates{aggs: map[time.Time][]db.ActionAggregates{
+			from: {
+				{Key: db.AggregateKey{BrandId: 1}, Sum: 10, Count: 1},
+				{Key: db.AggregateKey{BrandId: 2}, Sum: 20, Count: 2},
+			},
+		}},
+	}
+
+	tests := []struct {
+		name  string
+		brand []string
+		want  string
+	}{
+		{name: "unknown included", brand: []string{"puma"}, want: "0"},
+		{name: "unknown and known included", brand: []string{"puma", "nike"}, want: "1"},
+		{name: "unknown excluded", brand: []string{"!puma"}, want: "3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := s.aggregates([]types.Aggregate{types.Count}, fetchParams{
+				from: from, to: from.Add(time.Minute), action: types.Buy, brandId: tt.brand,
+			})
+			require.NoError(t, err)
+			require.Len(t, resp.Rows, 1)
+			assert.Equal(t, tt.want, resp.Rows[0][len(resp.Rows[0])-1])
+		})
+	}
+}
+
+func TestAggregatesMultiValueFilters(t *testing.T) {
+	from := time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC)
+	s := newTestServer(newMemoryProfiles())
+	s.aggregatesDB = memoryAggregatesDB{
+		Client: s.aggregatesDB,
+		aggregates: &memoryAggregates{aggs: map[time.Time][]db.ActionAggregates{
+			from: {
+				{Key: db.AggregateKey{Device: db.DeviceKey(types.Pc)}, Sum: 1, Count: 1},
+				{Key: db.AggregateKey{Device: db.DeviceKey(types.Mobile)}, Sum: 2, Count: 1},
+				{Key: db.AggregateKey{Device: db.DeviceKey(types.Tv)}, Sum: 4, Count: 1},
+			},
+		}},
+	}
+
+	tests := []struct {
+		name   string
+		device []string
+		want   []string
+	}{
+		{name: "any of", device: []string{"PC", "TV"}, want: []string{"2022-03-01T00:00:00", "BUY", "PC,TV", "5"}},
+		{name: "negated", device: []string{"!MOBILE"}, want: []string{"2022-03-01T00:00:00", "BUY", "!MOBILE", "5"}},
+		{name: "included and negated", device: []string{"PC", "MOBILE", "!PC"}, want: []string{"2022-03-01T00:00:00", "BUY", "PC,MOBILE,!PC", "2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := s.aggregates([]types.Aggregate{types.Sum}, fetchParams{
+				from: from, to: from.Add(time.Minute), action: types.Buy, device: tt.device,
+			})
+			require.NoError(t, err)
+			assert.Equal(t, dto.AggregatesDTO{
+				Columns: []string{"1m_bucket", "action", "device", "sum_price"},
+				Rows:    [][]string{tt.want},
+			}, resp)
+		})
+	}
+}
+
+func TestAggregatesPricePercentiles(t *testing.T) {
+	from := time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC)
+	histogram := func(prices ...uint32) db.PriceHistogram {
+		h := make(db.PriceHistogram)
+		for _, p := range prices {
+			h.Add(p)
+		}
+		return h
+	}
+	s := newTestServer(newMemoryProfiles())
+	s.aggregatesDB = memoryAggregatesDB{
+		Client: s.aggregatesDB,
+		aggregates: &memoryAggregates{aggs: map[time.Time][]db.ActionAggregates{
+			from: {
+				{Key: db.AggregateKey{Origin: 1}, Count: 8, PriceHistogram: histogram(10, 10, 10, 10, 10, 10, 10, 10)},
+				{Key: db.AggregateKey{Origin: 2}, Count: 2, PriceHistogram: histogram(100, 1000)},
+				// Records written before the histogram was tracked are skipped.
+				{Key: db.AggregateKey{Origin: 3}, Sum: 5000, Count: 1},
+			},
+		}},
+	}
+
+	resp, err := s.aggregates([]types.Aggregate{types.PriceP50, types.PriceP90, types.PriceP99}, fetchParams{
+		from: from, to: from.Add(2 * time.Minute), action: types.Buy,
+	})
+	require.NoError(t, err)
+
+	// Percentiles are lower bounds of the buckets of the histogram.
+	assert.Equal(t, dto.AggregatesDTO{
+		Columns: []string{"1m_bucket", "action", "price_p50", "price_p90", "price_p99"},
+		Rows: [][]string{
+			{"2022-03-01T00:00:00", "BUY", "10", "91", "862"},
+			{"2022-03-01T00:01:00", "BUY", "0", "0", "0"},
+		},
+	}, resp)
+}
+
+func TestAggregatesFinalized(t *testing.T) {
+	from := time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC)
+	s := newTestServer(newMemoryProfiles())
+	s.conf.KafkaNumPartitions = 2
+	s.aggregatesDB = memoryAggregatesDB{
+		Client:     s.aggregatesDB,
+		aggregates: &memoryAggregates{aggs: map[time.Time][]db.ActionAggregates{}},
+		// The earliest watermark, of partition 1, decides.
+		watermarks: memoryWatermarks{0: from.Add(3 * time.Minute), 1: from.Add(90 * time.Second)},
+	}
+
+	resp, err := s.aggregates([]types.Aggregate{types.Count}, fetchParams{from: from, to: from.Add(3 * time.Minute), action: types.View, finalized: true})
+	require.NoError(t, err)
+
+	assert.Equal(t, dto.AggregatesDTO{
+		Columns: []string{"1m_bucket", "action", "count", "finalized"},
+		Rows: [][]string{
+			{"2022-03-01T00:00:00", "VIEW", "0", "true"},
+			{"2022-03-01T00:01:00", "VIEW", "0", "false"},
+			{"2022-03-01T00:02:00", "VIEW", "0", "false"},
+		},
+	}, resp)
+
+	// Partition 2 has no watermark yet, so no bucket is final.
+	s.conf.KafkaNumPartitions = 3
+	resp, err = s.aggregates([]types.Aggregate{types.Count}, fetchParams{from: from, to: from.Add(time.Minute), action: types.View, finalized: true})
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{{"2022-03-01T00:00:00", "VIEW", "0", "false"}}, resp.Rows)
+}
@@ -0,0 +1,210 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/TomaszDomagala/Allezon/src/pkg/db"
+	"github.com/TomaszDomagala/Allezon/src/pkg/dto"
+	"github.com/TomaszDomagala/Allezon/src/pkg/types"
+)
+
+const (
+	// conversionBuckets mode returns view and buy counts of every 1m bucket, as /aggregates does.
+	conversionBuckets = "BUCKETS"
+	// conversionProduct mode returns the funnel of a single product, computed from user profiles.
+	conversionProduct = "PRODUCT"
+
+	// maxFunnelRange and maxFunnelWindow bound the product funnel. Profiles keep only the newest tags,
+	// so older views and buys are not counted anyway.
+	maxFunnelRange  = 24 * time.Hour
+	maxFunnelWindow = 24 * time.Hour
+)
+
+// errFunnelTooLarge is returned when the product funnel would scan more profiles than allowed.
+var errFunnelTooLarge = errors.New("too many user profiles to compute the product funnel")
+
+type conversionRequest struct {
+	TimeRange string `form:"time_range" binding:"required"`
+	Mode      string `form:"mode,default=BUCKETS" binding:"oneof=BUCKETS PRODUCT"`
+	// ProductId and Window are used only in the product mode. Cookies convert if they buy the product
+	// within the window after viewing it.
+	ProductId *int          `form:"product_id" binding:"required_if=Mode PRODUCT"`
+	Window    time.Duration `form:"window,default=1h" binding:"-"`
+	// Filters are the same as those of aggregatesRequest, they are not supported in the product mode.
+	Origin     []string `form:"origin" binding:"-"`
+	BrandId    []string `form:"brand_id" binding:"-"`
+	CategoryId []string `form:"category_id" binding:"-"`
+	Country    []string `form:"country" binding:"-"`
+	Device     []string `form:"device" binding:"dive,oneof=PC MOBILE TV !PC !MOBILE !TV"`
+}
+
+func (s server) conversionHandler(c *gin.Context) {
+	var req conversionRequest
+	if err := c.BindQuery(&req); err != nil {
+		_ = c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	from, to, err := parseTimeRange(dto.TimeRangeSecPrecisionLayout, req.TimeRange)
+	if err != nil {
+		_ = c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	params := fetchParams{
+		from:       from,
+		to:         to,
+		origin:     req.Origin,
+		brandId:    req.BrandId,
+		categoryId: req.CategoryId,
+		country:    req.Country,
+		device:     req.Device,
+	}
+
+	var resp dto.AggregatesDTO
+	switch req.Mode {
+	case conversionProduct:
+		if err := validateFunnelRequest(from, to, req.Window, params); err != nil {
+			_ = c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+		resp, err = s.productFunnel(c.Request.Context(), *req.ProductId, from, to, req.Window)
+		if errors.Is(err, errFunnelTooLarge) || errors.Is(err, context.DeadlineExceeded) {
+			_ = c.AbortWithError(http.StatusServiceUnavailable, err)
+			return
+		}
+	default:
+		if err := validateAggregatesTimeRange(from, to); err != nil {
+			err = fmt.Errorf("error validating time range %s-%s, %w", from, to, err)
+			_ = c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+		resp, err = s.conversion(params)
+	}
+	if err != nil {
+		_ = c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+func validateFunnelRequest(from, to time.Time, window time.Duration, params fetchParams) error {
+	if from.After(to) {
+		return fmt.Errorf("from is before to")
+	}
+	if to.Sub(from) > maxFunnelRange {
+		return fmt.Errorf("time range is larger than %s", maxFunnelRange)
+	}
+	if window <= 0 || window > maxFunnelWindow {
+		return fmt.Errorf("window %s is not in range (0, %s]", window, maxFunnelWindow)
+	}
+	if len(params.filterColumns()) > 0 {
+		return errors.New("filters are not supported by the product funnel")
+	}
+	return nil
+}
+
+// conversion returns view and buy counts of matching aggregates in every bucket, and the ratio of buys to views.
+func (s server) conversion(params fetchParams) (dto.AggregatesDTO, error) {
+	f, err := s.newFilters(params)
+	if err != nil {
+		return dto.AggregatesDTO{}, fmt.Errorf("error creating filters, %w", err)
+	}
+	columns := []string{"1m_bucket"}
+	columns = append(columns, params.filterColumns()...)
+	columns = append(columns, "view_count", "buy_count", "conversion_rate")
+
+	var rows [][]string
+	for t := params.from; t.Before(params.to); t = t.Add(time.Minute) {
+		var counts [2]uint64
+		for i, action := range []types.Action{types.View, types.Buy} {
+			aggs, err := s.aggregatesDB.Aggregates().Get(t, action)
+			if err != nil {
+				return dto.AggregatesDTO{}, fmt.Errorf("error getting %s aggregates for time %s, %w", action, t, err)
+			}
+			b, _ := s.filterAggregates(aggs, f)
+			counts[i] = b.count
+		}
+
+		row := []string{t.Format(dto.TimeRangeSecPrecisionLayout)}
+		row = append(row, params.filterValues()...)
+		row = append(row, fmt.Sprint(counts[0]), fmt.Sprint(counts[1]), conversionRate(counts[0], counts[1]))
+		rows = append(rows, row)
+	}
+
+	return dto.AggregatesDTO{Columns: columns, Rows: rows}, nil
+}
+
+// productFunnel counts profiles that viewed the product in the time range, and those of them that bought it
+// within the window after one of these views. Profiles are scanned on every request, so the scan is bounded
+// by ProductFunnelTimeout and ProductFunnelMaxProfiles.
+func (s server) productFunnel(ctx context.Context, productId int, from, to time.Time, window time.Duration) (dto.AggregatesDTO, error) {
+	if s.conf.ProductFunnelTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.conf.ProductFunnelTimeout)
+		defer cancel()
+	}
+
+	var scanned int
+	var viewed, converted uint64
+	err := s.profilesDB.UserProfiles().Scan(func(up db.UserProfile) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		scanned++
+		if limit := s.conf.ProductFunnelMaxProfiles; limit > 0 && scanned > limit {
+			return fmt.Errorf("%w, limit is %d", errFunnelTooLarge, limit)
+		}
+		v, c := funnel(up, productId, from, to, window)
+		if v {
+			viewed++
+		}
+		if c {
+			converted++
+		}
+		return nil
+	})
+	if err != nil {
+		return dto.AggregatesDTO{}, fmt.Errorf("error scanning user profiles, %w", err)
+	}
+
+	return dto.AggregatesDTO{
+		Columns: []string{"product_id", "window", "viewed_cookies", "converted_cookies", "conversion_rate"},
+		Rows: [][]string{{
+			strconv.Itoa(productId), window.String(), fmt.Sprint(viewed), fmt.Sprint(converted), conversionRate(viewed, converted),
+		}},
+	}, nil
+}
+
+// funnel reports whether the profile viewed the product in the time range, and whether it bought it within
+// the window after such a view.
+func funnel(up db.UserProfile, productId int, from, to time.Time, window time.Duration) (viewed bool, converted bool) {
+	for _, view := range up.Views {
+		if view.ProductInfo.ProductId != productId || view.Time.Before(from) || !view.Time.Before(to) {
+			continue
+		}
+		viewed = true
+		for _, buy := range up.Buys {
+			if buy.ProductInfo.ProductId != productId || buy.Time.Before(view.Time) || buy.Time.Sub(view.Time) > window {
+				continue
+			}
+			return true, true
+		}
+	}
+	return viewed, false
+}
+
+// conversionRate formats the ratio of buys to views with 4 decimal places, it is zero if there are no views.
+func conversionRate(views, buys uint64) string {
+	var rate float64
+	if views > 0 {
+		rate = float64(buys) / float64(views)
+	}
+	return strconv.FormatFloat(rate, 'f', 4, 64)
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/TomaszDomagala/Allezon/src/pkg/db"
+	"github.com/TomaszDomagala/Allezon/src/pkg/dto"
+	"github.com/TomaszDomagala/Allezon/src/pkg/types"
+)
+
+// actionAggregates is a fake of db.AggregatesClient keeping aggregates of every action separately.
+type actionAggregates struct {
+	memoryAggregates
+	buys map[time.Time][]db.ActionAggregates
+}
+
+func (a *actionAggregates) Get(t time.Time, action types.Action) ([]db.ActionAggregates, error) {
+	if action == types.Buy {
+		return a.buys[t], nil
+	}
+	return a.memoryAggregates.Get(t, action)
+}
+
+func TestConversion(t *testing.T) {
+	from := time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC)
+	s := newTestServer(newMemoryProfiles())
+	s.aggregatesDB = memoryAggregatesDB{
+		Client: s.aggregatesDB,
+		aggregates: &actionAggregates{
+			memoryAggregates: memoryAggregates{aggs: map[time.Time][]db.ActionAggregates{
+				from: {
+					{Key: db.AggregateKey{Device: db.DeviceKey(types.Pc)}, Count: 3},
+					{Key: db.AggregateKey{Device: db.DeviceKey(types.Tv)}, Count: 5},
+				},
+				from.Add(time.Minute): {
+					{Key: db.AggregateKey{Device: db.DeviceKey(types.Pc)}, Count: 4},
+				},
+			}},
+			buys: map[time.Time][]db.ActionAggregates{
+				from: {
+					{Key: db.AggregateKey{Device: db.DeviceKey(types.Pc)}, Count: 1},
+					{Key: db.AggregateKey{Device: db.DeviceKey(types.Tv)}, Count: 5},
+				},
+			},
+		},
+	}
+
+	resp, err := s.conversion(fetchParams{from: from, to: from.Add(3 * time.Minute), device: []string{"PC"}})
+	require.NoError(t, err)
+
+	assert.Equal(t, dto.AggregatesDTO{
+		Columns: []string{"1m_bucket", "device", "view_count", "buy_count", "conversion_rate"},
+		Rows: [][]string{
+			{"2022-03-01T00:00:00", "PC", "3", "1", "0.3333"},
+			{"2022-03-01T00:01:00", "PC", "4", "0", "0.0000"},
+			{"2022-03-01T00:02:00", "PC", "0", "0", "0.0000"},
+		},
+	}, resp)
+}
+
+func TestProductFunnel(t *testing.T) {
+	from := time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC)
+	profiles := newMemoryProfiles()
+	add := func(cookie string, action types.Action, productId int, at time.Duration) {
+		_, err := profiles.Add(cookie, &types.UserTag{Cookie: cookie, Action: action, Time: from.Add(at), ProductInfo: types.ProductInfo{ProductId: productId}})
+		require.NoError(t, err)
+	}
+	// Bought within the window.
+	add("a", types.View, 1, 0)
+	add("a", types.Buy, 1, 30*time.Minute)
+	// Bought after the window.
+	add("b", types.View, 1, 0)
+	add("b", types.Buy, 1, 2*time.Hour)
+	// Bought before viewing.
+	add("c", types.Buy, 1, 0)
+	add("c", types.View, 1, time.Minute)
+	// Bought another product.
+	add("d", types.View, 1, 0)
+	add("d", types.Buy, 2, time.Minute)
+	// Viewed outside of the time range.
+	add("e", types.View, 1, -time.Minute)
+	add("e", types.Buy, 1, 0)
+	s := newTestServer(profiles)
+
+	resp, err := s.productFunnel(context.Background(), 1, from, from.Add(time.Hour), time.Hour)
+	require.NoError(t, err)
+
+	assert.Equal(t, dto.AggregatesDTO{
+		Columns: []string{"product_id", "window", "viewed_cookies", "converted_cookies", "conversion_rate"},
+		Rows:    [][]string{{"1", "1h0m0s", "4", "1", "0.2500"}},
+	}, resp)
+}
+
+func TestProductFunnelBounds(t *testing.T) {
+	from := time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC)
+	profiles := newMemoryProfiles()
+	for _, cookie := range []string{"a", "b", "c"} {
+		_, err := profiles.Add(cookie, &types.UserTag{Cookie: cookie, Action: types.View, Time: from, ProductInfo: types.ProductInfo{ProductId: 1}})
+		require.NoError(t, err)
+	}
+	s := newTestServer(profiles)
+	const query = "/conversion?time_range=2022-03-01T00:00:00_2022-03-01T01:00:00&mode=PRODUCT&product_id=1"
+
+	s.conf.ProductFunnelMaxProfiles = 3
+	w := serve(s, http.MethodPost, query, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	s.conf.ProductFunnelMaxProfiles = 2
+	w = serve(s, http.MethodPost, query, nil)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	_, err := s.productFunnel(ctx, 1, from, from.Add(time.Hour), time.Hour)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestProductFunnelValidation(t *testing.T) {
+	s := newTestServer(newMemoryProfiles())
+	const timeRange = "time_range=2022-03-01T00:00:00_2022-03-01T01:00:00"
+
+	tests := []struct {
+		name  string
+		query string
+		code  int
+	}{
+		{name: "valid", query: "mode=PRODUCT&product_id=1&window=30m", code: http.StatusOK},
+		{name: "missing product", query: "mode=PRODUCT", code: http.StatusBadRequest},
+		{name: "window too large", query: "mode=PRODUCT&product_id=1&window=48h", code: http.StatusBadRequest},
+		{name: "filters", query: "mode=PRODUCT&product_id=1&origin=foo", code: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(s, http.MethodPost, "/conversion?"+timeRange+"&"+tt.query, nil)
+			assert.Equal(t, tt.code, w.Code)
+		})
+	}
+}
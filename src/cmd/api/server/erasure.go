@@ -0,0 +1,132 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"github.com/TomaszDomagala/Allezon/src/pkg/db"
+	"github.com/TomaszDomagala/Allezon/src/pkg/dto"
+)
+
+// eraseUserProfileHandler removes the profile of a single cookie and returns the audit receipt.
+func (s server) eraseUserProfileHandler(c *gin.Context) {
+	receipt, err := s.eraseUserProfile(c.Param("cookie"))
+	if err != nil {
+		s.logger.Error("error erasing user profile", zap.Error(err))
+		_ = c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, receipt)
+}
+
+// bulkEraseUserProfilesHandler removes profiles of all cookies from the request. Erasure is idempotent,
+// so on error the whole request can be retried.
+func (s server) bulkEraseUserProfilesHandler(c *gin.Context) {
+	var req dto.BulkErasureRequestDTO
+	if err := c.BindJSON(&req); err != nil {
+		_ = c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	resp := dto.BulkErasureDTO{Receipts: make([]dto.ErasureReceiptDTO, 0, len(req.Cookies))}
+	for _, cookie := range req.Cookies {
+		receipt, err := s.eraseUserProfile(cookie)
+		if err != nil {
+			s.logger.Error("error erasing user profiles", zap.Error(err), zap.Int("erased", len(resp.Receipts)))
+			_ = c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		resp.Receipts = append(resp.Receipts, receipt)
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s server) eraseUserProfile(cookie string) (dto.ErasureReceiptDTO, error) {
+	receiptID, err := newReceiptID()
+	if err != nil {
+		return dto.ErasureReceiptDTO{}, err
+	}
+	erasedAt := time.Now().UTC()
+
+	erasure, aliases, err := s.eraseProfileOf(cookie, receiptID)
+	if err != nil {
+		return dto.ErasureReceiptDTO{}, err
+	}
+	// Webhook outboxes and delivery logs keep cookies of delivered tags.
+	if err := s.aggregatesDB.Webhooks().EraseCookies(append([]string{cookie}, aliases...)); err != nil {
+		return dto.ErasureReceiptDTO{}, fmt.Errorf("error erasing webhook deliveries of cookie %s, %w", cookie, err)
+	}
+
+	receipt := dto.ErasureReceiptDTO{
+		ReceiptID:     receiptID,
+		Cookie:        cookie,
+		ErasedAt:      erasedAt.Format(dto.UserTagTimeLayout),
+		ProfileFound:  erasure.Found,
+		ViewsErased:   erasure.Views,
+		BuysErased:    erasure.Buys,
+		AliasesErased: aliases,
+	}
+	if s.conf.UserProfileTombstoneTTL > 0 {
+		receipt.TagsRejectedUntil = erasedAt.Add(s.conf.UserProfileTombstoneTTL).Format(dto.UserTagTimeLayout)
+	}
+	// The log is the audit trail of erasures, the receipt id is also stored in the tombstone.
+	s.logger.Info("user profile erased", zap.Any("receipt", receipt))
+	return receipt, nil
+}
+
+// eraseProfileOf erases the profile holding tags of cookie together with all cookies linked to it, as they all
+// belong to the same person, and returns the linked cookies other than cookie. Aliases get their tombstones
+// before the profile is erased, so none of them can recreate it, and are unlinked afterwards.
+func (s server) eraseProfileOf(cookie string, receiptID string) (db.Erasure, []string, error) {
+	profiles := s.profilesDB.UserProfiles()
+
+	profileCookie, err := profiles.Resolve(cookie)
+	if err != nil {
+		return db.Erasure{}, nil, fmt.Errorf("error resolving cookie %s, %w", cookie, err)
+	}
+	aliases, err := profiles.Aliases(profileCookie)
+	if err != nil {
+		return db.Erasure{}, nil, fmt.Errorf("error listing aliases of cookie %s, %w", profileCookie, err)
+	}
+
+	// Aliases have no profiles of their own, erasing them only leaves the tombstones.
+	for _, alias := range aliases {
+		if _, err := profiles.Erase(alias, receiptID, s.conf.UserProfileTombstoneTTL); err != nil {
+			return db.Erasure{}, nil, fmt.Errorf("error erasing alias %s, %w", alias, err)
+		}
+	}
+	erasure, err := profiles.Erase(profileCookie, receiptID, s.conf.UserProfileTombstoneTTL)
+	if err != nil {
+		return db.Erasure{}, nil, fmt.Errorf("error erasing profile of cookie %s, %w", profileCookie, err)
+	}
+	for _, alias := range aliases {
+		if err := profiles.Unlink(alias); err != nil {
+			return db.Erasure{}, nil, err
+		}
+	}
+
+	linked := make([]string, 0, len(aliases)+1)
+	if profileCookie != cookie {
+		linked = append(linked, profileCookie)
+	}
+	for _, alias := range aliases {
+		if alias != cookie {
+			linked = append(linked, alias)
+		}
+	}
+	return erasure, linked, nil
+}
+
+func newReceiptID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("error generating receipt id, %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
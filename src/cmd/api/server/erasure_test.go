@@ -0,0 +1,140 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/TomaszDomagala/Allezon/src/pkg/db"
+	"github.com/TomaszDomagala/Allezon/src/pkg/dto"
+)
+
+func TestEraseUserProfile(t *testing.T) {
+	profiles := newMemoryProfiles()
+	s := newTestServer(profiles)
+
+	for _, action := range []string{"VIEW", "VIEW", "BUY"} {
+		w := serve(s, http.MethodPost, "/user_tags", testTag("foo", action))
+		require.Equal(t, http.StatusNoContent, w.Code)
+	}
+
+	w := serve(s, http.MethodDelete, "/user_profiles/foo", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var receipt dto.ErasureReceiptDTO
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &receipt))
+	assert.Equal(t, "foo", receipt.Cookie)
+	assert.True(t, receipt.ProfileFound)
+	assert.Equal(t, 2, receipt.ViewsErased)
+	assert.Equal(t, 1, receipt.BuysErased)
+	assert.NotEmpty(t, receipt.TagsRejectedUntil)
+	assert.Equal(t, receipt.ReceiptID, profiles.tombstones["foo"], "receipt id should be stored in the tombstone")
+
+	_, err := profiles.Get("foo")
+	assert.ErrorIs(t, err, db.KeyNotFoundError)
+
+	// Late tags of the erased cookie are rejected, other cookies are not affected.
+	w = serve(s, http.MethodPost, "/user_tags", testTag("foo", "VIEW"))
+	assert.Equal(t, http.StatusGone, w.Code)
+	w = serve(s, http.MethodPost, "/user_tags", testTag("bar", "VIEW"))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+}
+
+func TestBulkEraseUserProfiles(t *testing.T) {
+	profiles := newMemoryProfiles()
+	s := newTestServer(profiles)
+
+	w := serve(s, http.MethodPost, "/user_tags", testTag("foo", "BUY"))
+	require.Equal(t, http.StatusNoContent, w.Code)
+
+	w = serve(s, http.MethodDelete, "/user_profiles", dto.BulkErasureRequestDTO{Cookies: []string{"foo", "bar"}})
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var resp dto.BulkErasureDTO
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Len(t, resp.Receipts, 2)
+	assert.Equal(t, "foo", resp.Receipts[0].Cookie)
+	assert.True(t, resp.Receipts[0].ProfileFound)
+	assert.Equal(t, 1, resp.Receipts[0].BuysErased)
+	assert.Equal(t, "bar", resp.Receipts[1].Cookie)
+	assert.False(t, resp.Receipts[1].ProfileFound)
+	assert.NotEqual(t, resp.Receipts[0].ReceiptID, resp.Receipts[1].ReceiptID)
+
+	erased, err := profiles.IsErased("bar")
+	require.NoError(t, err)
+	assert.True(t, erased, "cookies without profile get a tombstone too")
+
+	w = serve(s, http.MethodDelete, "/user_profiles", dto.BulkErasureRequestDTO{})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestUserTagsOfAliasOfErasedProfileAreRejected(t *testing.T) {
+	profiles := newMemoryProfiles()
+	s := newTestServer(profiles)
+	require.NoError(t, profiles.Link("alias", "foo"))
+	profiles.tombstones["foo"] = "receipt"
+
+	w := serve(s, http.MethodPost, "/user_tags", testTag("alias", "VIEW"))
+	assert.Equal(t, http.StatusGone, w.Code)
+	_, err := profiles.Get("foo")
+	assert.ErrorIs(t, err, db.KeyNotFoundError, "erased profile is not recreated")
+}
+
+// erasedWebhooks records cookies erased from webhook deliveries.
+type erasedWebhooks struct {
+	db.WebhookClient
+	cookies []string
+}
+
+func (e *erasedWebhooks) EraseCookies(cookies []string) error {
+	e.cookies = append(e.cookies, cookies...)
+	return nil
+}
+
+type webhooksDB struct {
+	db.Client
+	webhooks db.WebhookClient
+}
+
+func (w webhooksDB) Webhooks() db.WebhookClient {
+	return w.webhooks
+}
+
+func TestEraseUserProfileErasesWebhookDeliveries(t *testing.T) {
+	profiles := newMemoryProfiles()
+	require.NoError(t, profiles.Link("alias", "foo"))
+	s := newTestServer(profiles)
+	webhooks := &erasedWebhooks{}
+	s.aggregatesDB = webhooksDB{Client: s.aggregatesDB, webhooks: webhooks}
+
+	_, err := s.eraseUserProfile("alias")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"foo", "alias"}, webhooks.cookies, "webhook deliveries of all linked cookies should be erased")
+}
+
+func TestEraseUserProfileErasesAllAliases(t *testing.T) {
+	profiles := newMemoryProfiles()
+	s := newTestServer(profiles)
+	require.NoError(t, profiles.Link("alias", "foo"))
+	require.NoError(t, profiles.Link("alias2", "alias"))
+	w := serve(s, http.MethodPost, "/user_tags", testTag("alias2", "VIEW"))
+	require.Equal(t, http.StatusNoContent, w.Code)
+
+	w = serve(s, http.MethodDelete, "/user_profiles/alias", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var receipt dto.ErasureReceiptDTO
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &receipt))
+	assert.True(t, receipt.ProfileFound)
+	assert.ElementsMatch(t, []string{"foo", "alias2"}, receipt.AliasesErased)
+	for _, cookie := range []string{"foo", "alias", "alias2"} {
+		assert.Equal(t, receipt.ReceiptID, profiles.tombstones[cookie], "cookie %s should have a tombstone", cookie)
+	}
+	assert.Empty(t, profiles.aliases, "aliases should be unlinked")
+
+	w = serve(s, http.MethodPost, "/user_tags", testTag("alias2", "VIEW"))
+	assert.Equal(t, http.StatusGone, w.Code)
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"github.com/TomaszDomagala/Allezon/src/pkg/db"
+	"github.com/TomaszDomagala/Allezon/src/pkg/dto"
+)
+
+// linkCookiesHandler makes the cookie from the path an alias of the target cookie and merges their profiles.
+func (s server) linkCookiesHandler(c *gin.Context) {
+	var req dto.CookieLinkRequestDTO
+	if err := c.BindJSON(&req); err != nil {
+		_ = c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	resp, err := s.linkCookies(c.Param("cookie"), req.Target)
+	if err != nil {
+		if errors.Is(err, db.ErrAliasCycle) {
+			_ = c.AbortWithError(http.StatusConflict, err)
+			return
+		}
+		s.logger.Error("error linking cookies", zap.Error(err))
+		_ = c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// linkCookies links the profile holding tags of cookie to the profile of target. The alias is stored before
+// merging, so tags added during the merge already go to the canonical profile.
+func (s server) linkCookies(cookie string, target string) (dto.CookieLinkDTO, error) {
+	profiles := s.profilesDB.UserProfiles()
+
+	canonical, err := profiles.Resolve(target)
+	if err != nil {
+		return dto.CookieLinkDTO{}, fmt.Errorf("error resolving cookie %s, %w", target, err)
+	}
+	// If cookie is already an alias, its whole profile is linked.
+	from, err := profiles.Resolve(cookie)
+	if err != nil {
+		return dto.CookieLinkDTO{}, fmt.Errorf("error resolving cookie %s, %w", cookie, err)
+	}
+	resp := dto.CookieLinkDTO{Cookie: cookie, Canonical: canonical}
+	if from == canonical {
+		return resp, nil
+	}
+
+	if err := profiles.Link(from, canonical); err != nil {
+		return dto.CookieLinkDTO{}, err
+	}
+
+	bo := backoff.NewExponentialBackOff()
+	bo.InitialInterval = 50 * time.Millisecond
+	bo.MaxElapsedTime = 5 * time.Second
+
+	var merged db.Merged
+	err = backoff.Retry(func() error {
+		merged, err = profiles.Merge(from, canonical, userTagLimit)
+		if err != nil && !errors.Is(err, db.GenerationMismatch) {
+			return backoff.Permanent(err)
+		}
+		return err
+	}, bo)
+	if err != nil {
+		return dto.CookieLinkDTO{}, fmt.Errorf("error merging profile of cookie %s into %s, %w", from, canonical, err)
+	}
+
+	resp.ViewsMerged = merged.Views
+	resp.BuysMerged = merged.Buys
+	s.logger.Debug("cookies linked", zap.Any("link", resp))
+	return resp, nil
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/TomaszDomagala/Allezon/src/pkg/dto"
+)
+
+func TestLinkCookies(t *testing.T) {
+	profiles := newMemoryProfiles()
+	s := newTestServer(profiles)
+
+	for i, cookie := range []string{"old", "new", "old"} {
+		tag := testTag(cookie, "VIEW")
+		tag.Time = fmt.Sprintf("2022-03-01T00:00:0%d.000Z", i)
+		w := serve(s, http.MethodPost, "/user_tags", tag)
+		require.Equal(t, http.StatusNoContent, w.Code)
+	}
+
+	w := serve(s, http.MethodPost, "/user_profiles/old/link", dto.CookieLinkRequestDTO{Target: "new"})
+	require.Equal(t, http.StatusOK, w.Code)
+	var link dto.CookieLinkDTO
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &link))
+	assert.Equal(t, dto.CookieLinkDTO{Cookie: "old", Canonical: "new", ViewsMerged: 2}, link)
+
+	// Writes of the alias go to the canonical profile.
+	tag := testTag("old", "BUY")
+	w = serve(s, http.MethodPost, "/user_tags", tag)
+	require.Equal(t, http.StatusNoContent, w.Code)
+
+	// Reads of both cookies return the merged profile, newest tags first.
+	for _, cookie := range []string{"old", "new"} {
+		w = serve(s, http.MethodPost, "/user_profiles/"+cookie+"?time_range=2022-03-01T00:00:00.000_2022-03-02T00:00:00.000", nil)
+		require.Equal(t, http.StatusOK, w.Code)
+		var profile dto.UserProfileDTO
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &profile))
+		assert.Equal(t, cookie, profile.Cookie)
+		require.Len(t, profile.Views, 3)
+		assert.Equal(t, []string{"old", "new", "old"}, []string{profile.Views[0].Cookie, profile.Views[1].Cookie, profile.Views[2].Cookie})
+		assert.Equal(t, "2022-03-01T00:00:02Z", profile.Views[0].Time)
+		require.Len(t, profile.Buys, 1)
+	}
+
+	// Linking again is a no-op.
+	w = serve(s, http.MethodPost, "/user_profiles/old/link", dto.CookieLinkRequestDTO{Target: "new"})
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &link))
+	assert.Equal(t, dto.CookieLinkDTO{Cookie: "old", Canonical: "new"}, link)
+}
+
+func TestLinkCookies_RespectsLimit(t *testing.T) {
+	profiles := newMemoryProfiles()
+	s := newTestServer(profiles)
+
+	for i := 0; i < userTagLimit; i++ {
+		for _, cookie := range []string{"a", "b"} {
+			tag := testTag(cookie, "VIEW")
+			tag.Time = fmt.Sprintf("2022-03-01T00:%02d:%02d.000Z", i/60, i%60)
+			if cookie == "b" {
+				tag.Time = fmt.Sprintf("2022-03-01T01:%02d:%02d.000Z", i/60, i%60)
+			}
+			w := serve(s, http.MethodPost, "/user_tags", tag)
+			require.Equal(t, http.StatusNoContent, w.Code)
+		}
+	}
+
+	w := serve(s, http.MethodPost, "/user_profiles/b/link", dto.CookieLinkRequestDTO{Target: "a"})
+	require.Equal(t, http.StatusOK, w.Code)
+
+	up, err := profiles.Get("a")
+	require.NoError(t, err)
+	require.Len(t, up.Views, userTagLimit)
+	for _, tag := range up.Views {
+		assert.Equal(t, "b", tag.Cookie, "only the newest tags should be kept")
+	}
+}
+
+func TestLinkCookies_Cycle(t *testing.T) {
+	profiles := newMemoryProfiles()
+	s := newTestServer(profiles)
+
+	w := serve(s, http.MethodPost, "/user_profiles/a/link", dto.CookieLinkRequestDTO{Target: "b"})
+	require.Equal(t, http.StatusOK, w.Code)
+
+	// b is already the canonical cookie of a, linking it back only resolves to the same profile.
+	w = serve(s, http.MethodPost, "/user_profiles/b/link", dto.CookieLinkRequestDTO{Target: "a"})
+	require.Equal(t, http.StatusOK, w.Code)
+	var link dto.CookieLinkDTO
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &link))
+	assert.Equal(t, "b", link.Canonical)
+
+	w = serve(s, http.MethodPost, "/user_profiles/a/link", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+
+	"github.com/TomaszDomagala/Allezon/src/pkg/dto"
+)
+
+const mimeCSV = "text/csv"
+
+// offeredFormats are the response formats negotiated with the Accept header, JSON is used if it's missing.
+var offeredFormats = []string{binding.MIMEJSON, mimeCSV, binding.MIMEPROTOBUF}
+
+// renderAggregates writes the aggregates in the negotiated format. CSV has a header row with the columns.
+func (s server) renderAggregates(c *gin.Context, resp dto.AggregatesDTO) {
+	switch c.NegotiateFormat(offeredFormats...) {
+	case binding.MIMEJSON:
+		c.JSON(http.StatusOK, resp)
+	case mimeCSV:
+		s.renderCSV(c, append([][]string{resp.Columns}, resp.Rows...))
+	case binding.MIMEPROTOBUF:
+		c.ProtoBuf(http.StatusOK, dto.IntoAggregatesProto(resp))
+	default:
+		_ = c.AbortWithError(http.StatusNotAcceptable, fmt.Errorf("none of the formats %v is accepted", offeredFormats))
+	}
+}
+
+// userProfileColumns are the columns of user profiles in CSV, views are followed by buys.
+var userProfileColumns = []string{"time", "cookie", "country", "device", "action", "origin", "product_id", "brand_id", "category_id", "price"}
+
+// nextCursorHeader holds the cursor of the next page of the profile, as CSV has no place for it.
+const nextCursorHeader = "X-Next-Cursor"
+
+// renderUserProfile writes the profile in the negotiated format.
+func (s server) renderUserProfile(c *gin.Context, resp dto.UserProfileDTO) {
+	if resp.NextCursor != "" {
+		c.Header(nextCursorHeader, resp.NextCursor)
+	}
+	switch c.NegotiateFormat(offeredFormats...) {
+	case binding.MIMEJSON:
+		c.JSON(http.StatusOK, resp)
+	case mimeCSV:
+		records := [][]string{userProfileColumns}
+		for _, tags := range [][]dto.UserTagDTO{resp.Views, resp.Buys} {
+			for _, t := range tags {
+				var productId string
+				if t.ProductInfo.ProductID != nil {
+					productId = strconv.Itoa(*t.ProductInfo.ProductID)
+				}
+				records = append(records, []string{
+					t.Time, t.Cookie, t.Country, t.Device, t.Action, t.Origin,
+					productId, t.ProductInfo.BrandID, t.ProductInfo.CategoryID, strconv.FormatUint(uint64(t.ProductInfo.Price), 10),
+				})
+			}
+		}
+		s.renderCSV(c, records)
+	case binding.MIMEPROTOBUF:
+		profile, err := dto.IntoUserProfileProto(resp)
+		if err != nil {
+			_ = c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		c.ProtoBuf(http.StatusOK, profile)
+	default:
+		_ = c.AbortWithError(http.StatusNotAcceptable, fmt.Errorf("none of the formats %v is accepted", offeredFormats))
+	}
+}
+
+func (s server) renderCSV(c *gin.Context, records [][]string) {
+	var buf bytes.Buffer
+	if err := csv.NewWriter(&buf).WriteAll(records); err != nil {
+		_ = c.AbortWithError(http.StatusInternalServerError, fmt.Errorf("error writing csv, %w", err))
+		return
+	}
+	c.Data(http.StatusOK, mimeCSV, buf.Bytes())
+}
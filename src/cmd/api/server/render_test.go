@@ -0,0 +1,92 @@
+package server
+
+import (
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/TomaszDomagala/Allezon/src/pkg/dto"
+)
+
+// update rewrites golden files with the current output, run `go test ./cmd/api/server -run Render -update`.
+var update = flag.Bool("update", false, "update golden files")
+
+func testAggregatesDTO() dto.AggregatesDTO {
+	return dto.AggregatesDTO{
+		Columns: []string{"1m_bucket", "action", "origin", "count", "sum_price"},
+		Rows: [][]string{
+			{"2022-03-01T00:00:00", "BUY", "foo,!bar", "3", "60"},
+			{"2022-03-01T00:01:00", "BUY", "foo,!bar", "0", "0"},
+		},
+	}
+}
+
+func testUserProfileDTO() dto.UserProfileDTO {
+	view := testTag("foo", "VIEW")
+	buy := testTag("foo", "BUY")
+	buy.Time = "2022-03-01T00:00:01.500Z"
+	return dto.UserProfileDTO{
+		Cookie: "foo",
+		Views:  []dto.UserTagDTO{view},
+		Buys:   []dto.UserTagDTO{buy},
+	}
+}
+
+func TestRender(t *testing.T) {
+	s := newTestServer(newMemoryProfiles())
+
+	tests := []struct {
+		golden      string
+		accept      string
+		contentType string
+		render      func(c *gin.Context)
+	}{
+		{golden: "aggregates.json", accept: "application/json", contentType: "application/json; charset=utf-8", render: func(c *gin.Context) { s.renderAggregates(c, testAggregatesDTO()) }},
+		{golden: "aggregates.csv", accept: "text/csv", contentType: "text/csv", render: func(c *gin.Context) { s.renderAggregates(c, testAggregatesDTO()) }},
+		{golden: "aggregates.pb", accept: "application/x-protobuf", contentType: "application/x-protobuf", render: func(c *gin.Context) { s.renderAggregates(c, testAggregatesDTO()) }},
+		{golden: "user_profile.json", accept: "", contentType: "application/json; charset=utf-8", render: func(c *gin.Context) { s.renderUserProfile(c, testUserProfileDTO()) }},
+		{golden: "user_profile.csv", accept: "text/html;q=0.9, text/csv", contentType: "text/csv", render: func(c *gin.Context) { s.renderUserProfile(c, testUserProfileDTO()) }},
+		{golden: "user_profile.pb", accept: "application/x-protobuf", contentType: "application/x-protobuf", render: func(c *gin.Context) { s.renderUserProfile(c, testUserProfileDTO()) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.golden, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.accept != "" {
+				c.Request.Header.Set("Accept", tt.accept)
+			}
+			tt.render(c)
+
+			require.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, tt.contentType, w.Header().Get("Content-Type"))
+
+			path := filepath.Join("testdata", tt.golden)
+			if *update {
+				require.NoError(t, os.WriteFile(path, w.Body.Bytes(), 0644))
+			}
+			golden, err := os.ReadFile(path)
+			require.NoError(t, err)
+			assert.Equal(t, golden, w.Body.Bytes())
+		})
+	}
+}
+
+func TestRenderNotAcceptable(t *testing.T) {
+	s := newTestServer(newMemoryProfiles())
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+	c.Request.Header.Set("Accept", "application/xml")
+
+	s.renderAggregates(c, testAggregatesDTO())
+
+	assert.Equal(t, http.StatusNotAcceptable, w.Code)
+}
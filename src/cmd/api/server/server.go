@@ -1,6 +1,7 @@
 package server
 
 import (
+	"expvar"
 	"fmt"
 	"time"
 
@@ -13,6 +14,8 @@ import (
 	"github.com/TomaszDomagala/Allezon/src/pkg/db"
 	"github.com/TomaszDomagala/Allezon/src/pkg/idGetter"
 	"github.com/TomaszDomagala/Allezon/src/pkg/messaging"
+	"github.com/TomaszDomagala/Allezon/src/pkg/pubsub"
+	"github.com/TomaszDomagala/Allezon/src/pkg/types"
 )
 
 type Server interface {
@@ -23,6 +26,7 @@ type Dependencies struct {
 	Logger       *zap.Logger
 	Cfg          *config.Config
 	Producer     messaging.UserTagsProducer
+	Broadcast    messaging.UserTagsBroadcast
 	ProfilesDB   db.Client
 	AggregatesDB db.Client
 	IDGetter     idGetter.Client
@@ -33,9 +37,16 @@ type server struct {
 	logger       *zap.Logger
 	engine       *gin.Engine
 	producer     messaging.UserTagsProducer
+	broadcast    messaging.UserTagsBroadcast
 	profilesDB   db.Client
 	aggregatesDB db.Client
 	idGetter     idGetter.Client
+	// aggregateChanges notifies streams of aggregates about received tags.
+	aggregateChanges *pubsub.Hub[aggregateChange]
+	// userTagSubscriptions delivers broadcast tags to subscribers of their cookies.
+	userTagSubscriptions *pubsub.KeyedHub[string, types.UserTag]
+	// userTagsReceiver receives broadcast tags while there are subscriptions.
+	userTagsReceiver *userTagsReceiver
 }
 
 func (s server) Run() error {
@@ -53,18 +64,31 @@ func New(deps Dependencies) Server {
 	s := server{
 		engine:       router,
 		producer:     deps.Producer,
+		broadcast:    deps.Broadcast,
 		logger:       deps.Logger,
 		conf:         deps.Cfg,
 		profilesDB:   deps.ProfilesDB,
 		aggregatesDB: deps.AggregatesDB,
 		idGetter:     deps.IDGetter,
+
+		aggregateChanges:     pubsub.NewHub[aggregateChange](aggregateChangesBuffer),
+		userTagSubscriptions: pubsub.NewKeyedHub[string, types.UserTag](userTagSubscriptionBuffer),
 	}
+	s.userTagsReceiver = newUserTagsReceiver(s.receiveUserTags)
 
 	router.GET("/health", s.health)
+	router.GET("/debug/vars", gin.WrapH(expvar.Handler()))
 
 	router.POST("/user_tags", s.userTagsHandler)
+	router.GET("/user_tags/subscribe", s.userTagsSubscribeHandler)
 	router.POST("/user_profiles/:cookie", s.userProfilesHandler)
+	router.DELETE("/user_profiles/:cookie", s.eraseUserProfileHandler)
+	router.POST("/user_profiles/:cookie/link", s.linkCookiesHandler)
+	router.DELETE("/user_profiles", s.bulkEraseUserProfilesHandler)
 	router.POST("/aggregates", s.aggregatesHandler)
+	router.GET("/aggregates/stream", s.aggregatesStreamHandler)
+	router.GET("/top", s.topHandler)
+	router.POST("/conversion", s.conversionHandler)
 
 	return s
 }
@@ -0,0 +1,269 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/TomaszDomagala/Allezon/src/cmd/api/config"
+	"github.com/TomaszDomagala/Allezon/src/pkg/db"
+	"github.com/TomaszDomagala/Allezon/src/pkg/dto"
+	"github.com/TomaszDomagala/Allezon/src/pkg/idGetter"
+	"github.com/TomaszDomagala/Allezon/src/pkg/messaging"
+	"github.com/TomaszDomagala/Allezon/src/pkg/types"
+)
+
+// memoryProfiles is an in-memory db.UserProfileClient, tombstones never expire.
+type memoryProfiles struct {
+	mu         sync.Mutex
+	profiles   map[string]*db.UserProfile
+	tombstones map[string]string
+	aliases    map[string]string
+}
+
+func newMemoryProfiles() *memoryProfiles {
+	return &memoryProfiles{
+		profiles:   make(map[string]*db.UserProfile),
+		tombstones: make(map[string]string),
+		aliases:    make(map[string]string),
+	}
+}
+
+func (m *memoryProfiles) Get(cookie string) (db.UserProfile, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	up, ok := m.profiles[cookie]
+	if !ok {
+		return db.UserProfile{}, db.KeyNotFoundError
+	}
+	return *up, nil
+}
+
+func (m *memoryProfiles) GetPages(cookie string, reqs []db.PageRequest, limit int) ([]db.TagsPage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	pages := make([]db.TagsPage, len(reqs))
+	up, ok := m.profiles[cookie]
+	if !ok {
+		return pages, nil
+	}
+	for i, req := range reqs {
+		all := up.Views
+		if req.Action == types.Buy {
+			all = up.Buys
+		}
+		var tags []types.UserTag
+		for _, t := range all {
+			if !t.Time.Before(req.From) && t.Time.Before(req.To) {
+				tags = append(tags, t)
+			}
+		}
+		pages[i] = db.NewTagsPage(tags, req.To, limit)
+	}
+	return pages, nil
+}
+
+func (m *memoryProfiles) Add(cookie string, tag *types.UserTag) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	up, ok := m.profiles[cookie]
+	if !ok {
+		up = &db.UserProfile{}
+		m.profiles[cookie] = up
+	}
+	if tag.Action == types.Buy {
+		up.Buys = append(up.Buys, *tag)
+		return len(up.Buys), nil
+	}
+	up.Views = append(up.Views, *tag)
+	return len(up.Views), nil
+}
+
+func (m *memoryProfiles) RemoveOverLimit(string, types.Action, int) error {
+	return nil
+}
+
+func (m *memoryProfiles) Erase(cookie string, receipt string, tombstoneTTL time.Duration) (db.Erasure, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if tombstoneTTL > 0 {
+		m.tombstones[cookie] = receipt
+	}
+	up, ok := m.profiles[cookie]
+	if !ok {
+		return db.Erasure{}, nil
+	}
+	delete(m.profiles, cookie)
+	return db.Erasure{Found: true, Views: len(up.Views), Buys: len(up.Buys)}, nil
+}
+
+func (m *memoryProfiles) IsErased(cookie string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, ok := m.tombstones[cookie]
+	return ok, nil
+}
+
+func (m *memoryProfiles) Resolve(cookie string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for {
+		canonical, ok := m.aliases[cookie]
+		if !ok {
+			return cookie, nil
+		}
+		cookie = canonical
+	}
+}
+
+func (m *memoryProfiles) Lookup(cookie string) (string, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for {
+		if _, ok := m.tombstones[cookie]; ok {
+			return cookie, true, nil
+		}
+		canonical, ok := m.aliases[cookie]
+		if !ok {
+			return cookie, false, nil
+		}
+		cookie = canonical
+	}
+}
+
+func (m *memoryProfiles) Link(alias string, canonical string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.aliases[alias] = canonical
+	return nil
+}
+
+func (m *memoryProfiles) Unlink(alias string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.aliases, alias)
+	return nil
+}
+
+func (m *memoryProfiles) Aliases(cookie string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var aliases []string
+	level := []string{cookie}
+	for len(level) > 0 {
+		var next []string
+		for alias, canonical := range m.aliases {
+			for _, c := range level {
+				if canonical == c {
+					next = append(next, alias)
+				}
+			}
+		}
+		aliases = append(aliases, next...)
+		level = next
+	}
+	return aliases, nil
+}
+
+func (m *memoryProfiles) Merge(from string, into string, limit int) (db.Merged, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	src, ok := m.profiles[from]
+	if !ok {
+		return db.Merged{}, nil
+	}
+	dst, ok := m.profiles[into]
+	if !ok {
+		dst = &db.UserProfile{}
+		m.profiles[into] = dst
+	}
+	dst.Views = mergeTags(dst.Views, src.Views, limit)
+	dst.Buys = mergeTags(dst.Buys, src.Buys, limit)
+	delete(m.profiles, from)
+	return db.Merged{Views: len(src.Views), Buys: len(src.Buys)}, nil
+}
+
+func (m *memoryProfiles) Scan(fn func(db.UserProfile) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, up := range m.profiles {
+		if err := fn(*up); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeTags merges tags sorted by time, keeping the newest limit of them.
+func mergeTags(a, b []types.UserTag, limit int) []types.UserTag {
+	merged := make([]types.UserTag, 0, len(a)+len(b))
+	merged = append(merged, a...)
+	merged = append(merged, b...)
+	sort.SliceStable(merged, func(i, j int) bool { return merged[i].Time.Before(merged[j].Time) })
+	if len(merged) > limit {
+		merged = merged[len(merged)-limit:]
+	}
+	return merged
+}
+
+type memoryProfilesDB struct {
+	db.Client
+	profiles *memoryProfiles
+}
+
+func (m memoryProfilesDB) UserProfiles() db.UserProfileClient {
+	return m.profiles
+}
+
+func newTestServer(profiles *memoryProfiles) server {
+	logger := zap.NewNop()
+	return New(Dependencies{
+		Logger:       logger,
+		Cfg:          &config.Config{UserProfileTombstoneTTL: time.Hour},
+		Producer:     messaging.NewNullProducer(logger),
+		Broadcast:    messaging.NewLocalBroadcast(),
+		ProfilesDB:   memoryProfilesDB{Client: db.NewNullClient(logger), profiles: profiles},
+		AggregatesDB: db.NewNullClient(logger),
+		IDGetter:     idGetter.NewNullClient(logger),
+	}).(server)
+}
+
+func serve(s server, method string, path string, body any) *httptest.ResponseRecorder {
+	var buf bytes.Buffer
+	if body != nil {
+		_ = json.NewEncoder(&buf).Encode(body)
+	}
+	w := httptest.NewRecorder()
+	s.engine.ServeHTTP(w, httptest.NewRequest(method, path, &buf))
+	return w
+}
+
+func testTag(cookie string, action string) dto.UserTagDTO {
+	productID := 1
+	return dto.UserTagDTO{
+		Time:        "2022-03-01T00:00:00.000Z",
+		Cookie:      cookie,
+		Country:     "PL",
+		Device:      "PC",
+		Action:      action,
+		Origin:      "origin",
+		ProductInfo: dto.ProductInfo{ProductID: &productID, BrandID: "brand", CategoryID: "category", Price: 100},
+	}
+}
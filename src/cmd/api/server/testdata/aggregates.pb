@@ -0,0 +1,16 @@
+
+	1m_bucket
+action
+origin
+count
+	sum_price+
+2022-03-01T00:00:00
+BUY
+foo,!bar
+3
+60*
+2022-03-01T00:01:00
+BUY
+foo,!bar
+0
+0
\ No newline at end of file
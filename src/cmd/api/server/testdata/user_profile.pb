@@ -0,0 +1,4 @@
+
+foo0
+fooPL2origin:brandcategory d8
+ʵfooPL(2origin:brandcategory d
\ No newline at end of file
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/TomaszDomagala/Allezon/src/pkg/db"
+	"github.com/TomaszDomagala/Allezon/src/pkg/dto"
+	"github.com/TomaszDomagala/Allezon/src/pkg/types"
+)
+
+const (
+	topProducts   = "PRODUCT"
+	topBrands     = "BRAND"
+	topCategories = "CATEGORY"
+)
+
+type topRequest struct {
+	TimeRange string `form:"time_range" binding:"required"`
+	Action    string `form:"action" binding:"required,oneof=BUY VIEW"`
+	Dimension string `form:"dimension" binding:"required,oneof=PRODUCT BRAND CATEGORY"`
+	Aggregate string `form:"aggregate" binding:"required,oneof=SUM_PRICE COUNT"`
+	// Limit can't exceed db.TopSketchCapacity, as sketches don't hold more products.
+	Limit *int `form:"limit,default=10" binding:"required,gte=1,lte=100"`
+	// Filters are the same as those of aggregatesRequest.
+	Origin     []string `form:"origin" binding:"-"`
+	BrandId    []string `form:"brand_id" binding:"-"`
+	CategoryId []string `form:"category_id" binding:"-"`
+	Country    []string `form:"country" binding:"-"`
+	Device     []string `form:"device" binding:"dive,oneof=PC MOBILE TV !PC !MOBILE !TV"`
+}
+
+func (s server) topHandler(c *gin.Context) {
+	var req topRequest
+	if err := c.BindQuery(&req); err != nil {
+		_ = c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	action, err := dto.ToAction(req.Action)
+	if err != nil {
+		_ = c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	aggregate, err := dto.ToAggregate(req.Aggregate)
+	if err != nil {
+		_ = c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	from, to, err := parseTimeRange(dto.TimeRangeSecPrecisionLayout, req.TimeRange)
+	if err != nil {
+		_ = c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	if err := validateBucketsTimeRange(from, to, time.Hour); err != nil {
+		err = fmt.Errorf("error validating time range %s-%s, %w", from, to, err)
+		_ = c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	resp, err := s.top(req.Dimension, aggregate, *req.Limit, fetchParams{
+		from:       from,
+		to:         to,
+		action:     action,
+		origin:     req.Origin,
+		brandId:    req.BrandId,
+		categoryId: req.CategoryId,
+		country:    req.Country,
+		device:     req.Device,
+	})
+	if err != nil {
+		_ = c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// top returns the limit items of the dimension with the largest aggregate. Products are ranked using the merged
+// heavy hitter sketches, so their values are approximate. Brands and categories are dimensions of the aggregates,
+// so their values are exact.
+func (s server) top(dimension string, aggregate types.Aggregate, limit int, params fetchParams) (dto.TopDTO, error) {
+	f, err := s.newFilters(params)
+	if err != nil {
+		return dto.TopDTO{}, fmt.Errorf("error creating filters, %w", err)
+	}
+	totals := newTopTotals(dimension, aggregate)
+	for t := params.from; t.Before(params.to); t = t.Add(time.Minute) {
+		aggs, err := s.aggregatesDB.Aggregates().GetWithTop(t, params.action)
+		if err != nil {
+			return dto.TopDTO{}, fmt.Errorf("error getting aggregates for time %s, %w", t, err)
+		}
+		for _, agg := range aggs {
+			if f.match(agg.Key) {
+				totals.add(agg)
+			}
+		}
+	}
+
+	return dto.TopDTO{
+		Dimension: dimension,
+		Aggregate: aggregate.String(),
+		Items:     totals.top(limit),
+	}, nil
+}
+
+// topTotals sums values of items of the dimension. Brands and categories are summed by their ids, as names
+// with different spellings may normalize to the same id. They are named after the first name seen.
+type topTotals struct {
+	dimension string
+	aggregate types.Aggregate
+
+	values map[uint64]uint64
+	names  map[uint64]string
+}
+
+func newTopTotals(dimension string, aggregate types.Aggregate) topTotals {
+	return topTotals{
+		dimension: dimension,
+		aggregate: aggregate,
+		values:    make(map[uint64]uint64),
+		names:     make(map[uint64]string),
+	}
+}
+
+// add adds the values of the aggregate. Records written before top items were tracked have no sketches
+// nor names and are skipped.
+func (t topTotals) add(agg db.ActionAggregates) {
+	value := agg.Sum
+	sketch := agg.ProductSums
+	if t.aggregate == types.Count {
+		value = uint64(agg.Count)
+		sketch = agg.ProductCounts
+	}
+
+	switch t.dimension {
+	case topProducts:
+		for productId, v := range sketch {
+			t.addItem(uint64(productId), strconv.Itoa(productId), v)
+		}
+	case topBrands:
+		if agg.BrandName != "" {
+			t.addItem(uint64(agg.Key.BrandId), agg.BrandName, value)
+		}
+	case topCategories:
+		if agg.CategoryName != "" {
+			t.addItem(uint64(agg.Key.CategoryId), agg.CategoryName, value)
+		}
+	}
+}
+
+func (t topTotals) addItem(id uint64, name string, value uint64) {
+	if _, ok := t.names[id]; !ok {
+		t.names[id] = name
+	}
+	t.values[id] += value
+}
+
+// top returns at most limit items with the largest values, ties are ordered by name.
+func (t topTotals) top(limit int) []dto.TopItemDTO {
+	items := make([]dto.TopItemDTO, 0, len(t.values))
+	for id, value := range t.values {
+		items = append(items, dto.TopItemDTO{Id: t.names[id], Value: value})
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Value != items[j].Value {
+			return items[i].Value > items[j].Value
+		}
+		return items[i].Id < items[j].Id
+	})
+	if len(items) > limit {
+		items = items[:limit]
+	}
+	return items
+}
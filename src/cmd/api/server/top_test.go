@@ -0,0 +1,85 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/TomaszDomagala/Allezon/src/pkg/db"
+	"github.com/TomaszDomagala/Allezon/src/pkg/dto"
+	"github.com/TomaszDomagala/Allezon/src/pkg/types"
+)
+
+func TestTop(t *testing.T) {
+	from := time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC)
+	s := newTestServer(newMemoryProfiles())
+	s.aggregatesDB = memoryAggregatesDB{
+		Client: s.aggregatesDB,
+		aggregates: &memoryAggregates{aggs: map[time.Time][]db.ActionAggregates{
+			from: {
+				{
+					Key: db.AggregateKey{BrandId: 1, CategoryId: 1, Device: db.DeviceKey(types.Pc)}, Sum: 60, Count: 3,
+					ProductCounts: map[int]uint64{1: 2, 2: 1}, ProductSums: map[int]uint64{1: 20, 2: 40},
+					BrandName: "Nike", CategoryName: "shoes",
+				},
+				{
+					Key: db.AggregateKey{BrandId: 2, CategoryId: 1, Device: db.DeviceKey(types.Tv)}, Sum: 30, Count: 1,
+					ProductCounts: map[int]uint64{3: 1}, ProductSums: map[int]uint64{3: 30},
+					BrandName: "Adidas", CategoryName: "shoes",
+				},
+				// Records written before top items were tracked are skipped.
+				{Key: db.AggregateKey{BrandId: 3, CategoryId: 2}, Sum: 1000, Count: 100},
+			},
+			from.Add(time.Minute): {
+				{
+					Key: db.AggregateKey{BrandId: 1, CategoryId: 2, Device: db.DeviceKey(types.Pc)}, Sum: 5, Count: 1,
+					ProductCounts: map[int]uint64{3: 1}, ProductSums: map[int]uint64{3: 5},
+					BrandName: "NIKE", CategoryName: "socks",
+				},
+			},
+		}},
+	}
+	params := fetchParams{from: from, to: from.Add(2 * time.Minute), action: types.Buy}
+
+	tests := []struct {
+		name      string
+		dimension string
+		aggregate types.Aggregate
+		limit     int
+		device    []string
+		want      []dto.TopItemDTO
+	}{
+		{
+			name: "products by sum", dimension: topProducts, aggregate: types.Sum, limit: 10,
+			want: []dto.TopItemDTO{{Id: "2", Value: 40}, {Id: "3", Value: 35}, {Id: "1", Value: 20}},
+		},
+		{
+			name: "products by count limited", dimension: topProducts, aggregate: types.Count, limit: 2,
+			want: []dto.TopItemDTO{{Id: "1", Value: 2}, {Id: "3", Value: 2}},
+		},
+		{
+			// Brands are summed by ids, so different spellings of a brand are merged.
+			name: "brands by sum", dimension: topBrands, aggregate: types.Sum, limit: 10,
+			want: []dto.TopItemDTO{{Id: "Nike", Value: 65}, {Id: "Adidas", Value: 30}},
+		},
+		{
+			name: "categories by count", dimension: topCategories, aggregate: types.Count, limit: 10,
+			want: []dto.TopItemDTO{{Id: "shoes", Value: 4}, {Id: "socks", Value: 1}},
+		},
+		{
+			name: "filtered", dimension: topProducts, aggregate: types.Sum, limit: 10, device: []string{"!PC"},
+			want: []dto.TopItemDTO{{Id: "3", Value: 30}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := params
+			p.device = tt.device
+			resp, err := s.top(tt.dimension, tt.aggregate, tt.limit, p)
+			require.NoError(t, err)
+			assert.Equal(t, dto.TopDTO{Dimension: tt.dimension, Aggregate: tt.aggregate.String(), Items: tt.want}, resp)
+		})
+	}
+}
@@ -1,7 +1,8 @@
 package server
 
 import (
-	"errors"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"strings"
@@ -12,6 +13,7 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"go.uber.org/zap"
+	"golang.org/x/exp/slices"
 
 	"github.com/TomaszDomagala/Allezon/src/pkg/types"
 )
@@ -19,12 +21,16 @@ import (
 type userProfilesRequest struct {
 	TimeRange string `form:"time_range" binding:"required"`
 	Limit     *int   `form:"limit,default=200" binding:"required,gte=0,lte=200"`
+	// Actions selects the actions of returned tags, both are returned if it's empty.
+	Actions []string `form:"actions" binding:"dive,oneof=VIEW BUY"`
+	// Cursor is the next_cursor of the previous page, pages go back in time.
+	Cursor string `form:"cursor" binding:"-"`
 }
 
 func (s server) userProfilesHandler(c *gin.Context) {
 	var req userProfilesRequest
 	if err := c.BindQuery(&req); err != nil {
-		_ = c.AbortWithError(http.StatusBadRequest, errors.New("request must contain a time range"))
+		_ = c.AbortWithError(http.StatusBadRequest, fmt.Errorf("request must contain a time range and valid actions, %w", err))
 		return
 	}
 	from, to, err := parseTimeRange(dto.TimeRangeMilliPrecisionLayout, req.TimeRange)
@@ -33,17 +39,82 @@ func (s server) userProfilesHandler(c *gin.Context) {
 		_ = c.AbortWithError(http.StatusBadRequest, err)
 		return
 	}
+	actions := []types.Action{types.View, types.Buy}
+	if len(req.Actions) > 0 {
+		actions = actions[:0]
+		for _, a := range req.Actions {
+			action, err := dto.ToAction(a)
+			if err != nil {
+				_ = c.AbortWithError(http.StatusBadRequest, err)
+				return
+			}
+			if !slices.Contains(actions, action) {
+				actions = append(actions, action)
+			}
+		}
+	}
+	var cursor *profileCursor
+	if req.Cursor != "" {
+		cursor, err = decodeProfileCursor(req.Cursor)
+		if err != nil {
+			_ = c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+	}
 
 	cookie := c.Param("cookie")
 	s.logger.Debug("parsed", zap.String("cookie", cookie), zap.Time("from", from), zap.Time("to", to))
 
-	resp, err := s.userProfiles(cookie, from, to, *req.Limit)
+	resp, err := s.userProfiles(cookie, from, to, *req.Limit, actions, cursor)
 	if err != nil {
 		s.logger.Error("error handling user profiles", zap.Error(err))
 		_ = c.AbortWithError(http.StatusInternalServerError, err)
 		return
 	}
-	c.JSON(http.StatusOK, resp)
+	s.renderUserProfile(c, resp)
+}
+
+// profileCursor holds, for every action with older tags, the exclusive end of the time range of its next page.
+// Actions missing from the cursor have no more tags.
+type profileCursor struct {
+	Views *int64 `json:"v,omitempty"`
+	Buys  *int64 `json:"b,omitempty"`
+}
+
+func (p *profileCursor) end(action types.Action) *int64 {
+	if action == types.Buy {
+		return p.Buys
+	}
+	return p.Views
+}
+
+func (p *profileCursor) setEnd(action types.Action, end int64) {
+	if action == types.Buy {
+		p.Buys = &end
+	} else {
+		p.Views = &end
+	}
+}
+
+// encode returns the opaque representation of the cursor, an empty string if there are no more pages.
+func (p *profileCursor) encode() string {
+	if p.Views == nil && p.Buys == nil {
+		return ""
+	}
+	b, _ := json.Marshal(p)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeProfileCursor(s string) (*profileCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor, %w", err)
+	}
+	var p profileCursor
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, fmt.Errorf("invalid cursor, %w", err)
+	}
+	return &p, nil
 }
 
 func parseTimeRange(layout, str string) (time.Time, time.Time, error) {
@@ -62,39 +133,68 @@ func parseTimeRange(layout, str string) (time.Time, time.Time, error) {
 	return from, to, nil
 }
 
-func convertTags(tags []types.UserTag, from, to time.Time, limit int) []dto.UserTagDTO {
-	if limit == 0 {
-		return []dto.UserTagDTO{}
-	}
-	toMilli := to.UnixMilli()
-	fromMilli := from.UnixMilli()
-	selected := make([]dto.UserTagDTO, 0, limit)
-	// Tags we get from DB are sorted in ascending order.
-	for i := len(tags) - 1; i >= 0 && len(selected) < limit; i-- {
-		milli := tags[i].Time.UnixMilli()
-		if fromMilli <= milli && milli < toMilli {
-			selected = append(selected, dto.IntoUserTagDTO(tags[i]))
-		}
+// convertTags returns tags of the page in descending order relative to time, and the end of the next page.
+func convertTags(page db.TagsPage) (tags []dto.UserTagDTO, next *int64) {
+	tags = make([]dto.UserTagDTO, 0, len(page.Tags))
+	// Tags of pages are sorted in ascending order.
+	for i := len(page.Tags) - 1; i >= 0; i-- {
+		tags = append(tags, dto.IntoUserTagDTO(page.Tags[i]))
+	}
+	if !page.Next.IsZero() {
+		end := page.Next.UnixMilli()
+		next = &end
 	}
-	return selected
+	return tags, next
 }
 
-func (s server) userProfiles(cookie string, from, to time.Time, limit int) (dto.UserProfileDTO, error) {
-	res, err := s.profilesDB.UserProfiles().Get(cookie)
+// userProfiles returns a page of the profile of cookie. Profiles of aliases are read from their canonical cookie.
+// The cursor narrows the time range of every action to tags older than those of the previous page.
+func (s server) userProfiles(cookie string, from, to time.Time, limit int, actions []types.Action, cursor *profileCursor) (dto.UserProfileDTO, error) {
+	profileCookie, err := s.profilesDB.UserProfiles().Resolve(cookie)
+	if err != nil {
+		return dto.UserProfileDTO{}, fmt.Errorf("error resolving cookie, %w", err)
+	}
+
+	resp := dto.UserProfileDTO{Cookie: cookie}
+	var reqs []db.PageRequest
+	for _, action := range actions {
+		end := to
+		if cursor != nil {
+			e := cursor.end(action)
+			if e == nil {
+				// The action has no more tags.
+				setTags(&resp, action, []dto.UserTagDTO{})
+				continue
+			}
+			if t := time.UnixMilli(*e); t.Before(end) {
+				end = t
+			}
+		}
+		reqs = append(reqs, db.PageRequest{Action: action, From: from, To: end})
+	}
+	pages, err := s.profilesDB.UserProfiles().GetPages(profileCookie, reqs, limit)
 	if err != nil {
-		if errors.Is(err, db.KeyNotFoundError) {
-			s.logger.Debug("key not found", zap.String("cookie", cookie))
-			return dto.UserProfileDTO{
-				Cookie: cookie,
-			}, nil
+		return dto.UserProfileDTO{}, fmt.Errorf("error getting user profile from db, %w", err)
+	}
+
+	var next profileCursor
+	for i, page := range pages {
+		tags, nextEnd := convertTags(page)
+		setTags(&resp, reqs[i].Action, tags)
+		if nextEnd != nil {
+			next.setEnd(reqs[i].Action, *nextEnd)
 		}
-		return dto.UserProfileDTO{}, fmt.Errorf("error getting user profiles from db, %w", err)
 	}
-	s.logger.Debug("got user profiles from db", zap.Any("views", res.Views), zap.Any("buys", res.Buys))
+	resp.NextCursor = next.encode()
+	s.logger.Debug("got user profile page", zap.String("cookie", cookie), zap.Int("views", len(resp.Views)), zap.Int("buys", len(resp.Buys)))
+
+	return resp, nil
+}
 
-	return dto.UserProfileDTO{
-		Cookie: cookie,
-		Views:  convertTags(res.Views, from, to, limit),
-		Buys:   convertTags(res.Buys, from, to, limit),
-	}, nil
+func setTags(resp *dto.UserProfileDTO, action types.Action, tags []dto.UserTagDTO) {
+	if action == types.Buy {
+		resp.Buys = tags
+	} else {
+		resp.Views = tags
+	}
 }
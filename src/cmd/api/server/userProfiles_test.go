@@ -0,0 +1,98 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/TomaszDomagala/Allezon/src/pkg/dto"
+	"github.com/TomaszDomagala/Allezon/src/pkg/types"
+)
+
+func TestUserProfilesPagination(t *testing.T) {
+	from := time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC)
+	profiles := newMemoryProfiles()
+	add := func(action types.Action, at time.Duration) {
+		_, err := profiles.Add("foo", &types.UserTag{Cookie: "foo", Action: action, Time: from.Add(at)})
+		require.NoError(t, err)
+	}
+	for i := 0; i < 5; i++ {
+		add(types.View, time.Duration(i)*time.Second)
+	}
+	add(types.Buy, 0)
+	s := newTestServer(profiles)
+
+	get := func(query url.Values) dto.UserProfileDTO {
+		query.Set("time_range", "2022-03-01T00:00:00.000_2022-03-01T01:00:00.000")
+		query.Set("limit", "2")
+		w := serve(s, http.MethodPost, "/user_profiles/foo?"+query.Encode(), nil)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var resp dto.UserProfileDTO
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		return resp
+	}
+	times := func(tags []dto.UserTagDTO) (res []string) {
+		for _, tag := range tags {
+			res = append(res, tag.Time)
+		}
+		return res
+	}
+
+	first := get(url.Values{})
+	assert.Equal(t, []string{"2022-03-01T00:00:04Z", "2022-03-01T00:00:03Z"}, times(first.Views))
+	assert.Equal(t, []string{"2022-03-01T00:00:00Z"}, times(first.Buys))
+	require.NotEmpty(t, first.NextCursor)
+
+	// Tags arriving in the meantime don't shift the following pages.
+	add(types.View, 10*time.Second)
+	add(types.Buy, 10*time.Second)
+
+	second := get(url.Values{"cursor": {first.NextCursor}})
+	assert.Equal(t, []string{"2022-03-01T00:00:02Z", "2022-03-01T00:00:01Z"}, times(second.Views))
+	assert.Empty(t, second.Buys, "buys were exhausted on the first page")
+	require.NotEmpty(t, second.NextCursor)
+
+	third := get(url.Values{"cursor": {second.NextCursor}})
+	assert.Equal(t, []string{"2022-03-01T00:00:00Z"}, times(third.Views))
+	assert.Empty(t, third.NextCursor, "last page has no cursor")
+}
+
+func TestUserProfilesActions(t *testing.T) {
+	profiles := newMemoryProfiles()
+	for _, action := range []types.Action{types.View, types.Buy} {
+		_, err := profiles.Add("foo", &types.UserTag{Cookie: "foo", Action: action, Time: time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC)})
+		require.NoError(t, err)
+	}
+	s := newTestServer(profiles)
+
+	w := serve(s, http.MethodPost, "/user_profiles/foo?time_range=2022-03-01T00:00:00.000_2022-03-02T00:00:00.000&actions=BUY", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var resp dto.UserProfileDTO
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	assert.Nil(t, resp.Views, "views were not requested")
+	assert.Len(t, resp.Buys, 1)
+
+	w = serve(s, http.MethodPost, "/user_profiles/foo?time_range=2022-03-01T00:00:00.000_2022-03-02T00:00:00.000&actions=CLICK", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = serve(s, http.MethodPost, "/user_profiles/foo?time_range=2022-03-01T00:00:00.000_2022-03-02T00:00:00.000&cursor=!", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestUserProfilesZeroLimit(t *testing.T) {
+	profiles := newMemoryProfiles()
+	_, err := profiles.Add("foo", &types.UserTag{Cookie: "foo", Action: types.View, Time: time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC)})
+	require.NoError(t, err)
+	s := newTestServer(profiles)
+
+	w := serve(s, http.MethodPost, "/user_profiles/foo?time_range=2022-03-01T00:00:00.000_2022-03-02T00:00:00.000&limit=0", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var resp dto.UserProfileDTO
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	assert.Empty(t, resp.Views)
+	assert.Empty(t, resp.NextCursor, "pages of zero tags never end, so there is no next page")
+}
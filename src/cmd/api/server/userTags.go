@@ -32,10 +32,23 @@ func (s server) userTagsHandler(c *gin.Context) {
 		_ = c.AbortWithError(http.StatusBadRequest, err)
 		return
 	}
+	profileCookie, erased, err := s.profilesDB.UserProfiles().Lookup(userTag.Cookie)
+	if err != nil {
+		s.logger.Error("can't look up cookie", zap.Error(err), zap.String("cookie", userTag.Cookie))
+		_ = c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	// Tags of aliases of an erased profile are rejected too, they would recreate it.
+	if erased && s.conf.UserProfileTombstoneTTL > 0 {
+		s.logger.Debug("rejecting tag of erased cookie", zap.String("cookie", userTag.Cookie), zap.String("profile", profileCookie))
+		_ = c.AbortWithError(http.StatusGone, fmt.Errorf("profile of cookie %s was erased", userTag.Cookie))
+		return
+	}
+
 	var errGrp errgroup.Group
 
 	errGrp.Go(func() error {
-		return s.addUserTag(&userTag)
+		return s.addUserTag(profileCookie, &userTag)
 	})
 	errGrp.Go(func() error {
 		return s.producer.Send(userTag)
@@ -45,6 +58,10 @@ func (s server) userTagsHandler(c *gin.Context) {
 		_ = c.AbortWithError(http.StatusInternalServerError, err)
 		return
 	}
+	s.aggregateChanges.Publish(aggregateChange{bucket: userTag.Time.Truncate(time.Minute), action: userTag.Action})
+	if err := s.broadcast.Publish(userTag); err != nil {
+		s.logger.Error("can't broadcast user tag", zap.Error(err), zap.String("cookie", userTag.Cookie))
+	}
 
 	c.Status(http.StatusNoContent)
 }
@@ -53,13 +70,14 @@ const userTagLimit = 200
 
 const userTagGCThreshold = int(userTagLimit * float32(1.1))
 
-func (s server) addUserTag(tag *types.UserTag) error {
-	newLen, err := s.profilesDB.UserProfiles().Add(tag)
+// addUserTag adds tag to the profile of cookie, which differs from the cookie of the tag if it's an alias.
+func (s server) addUserTag(cookie string, tag *types.UserTag) error {
+	newLen, err := s.profilesDB.UserProfiles().Add(cookie, tag)
 	if err != nil {
 		return fmt.Errorf("error updating userTags, %w", err)
 	}
 	if newLen > userTagGCThreshold {
-		go s.removeOldUserTags(tag.Cookie, tag.Action)
+		go s.removeOldUserTags(cookie, tag.Action)
 	}
 	return nil
 }
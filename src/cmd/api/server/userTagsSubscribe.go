@@ -0,0 +1,191 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"golang.org/x/exp/slices"
+	"golang.org/x/net/websocket"
+
+	"github.com/TomaszDomagala/Allezon/src/pkg/dto"
+	"github.com/TomaszDomagala/Allezon/src/pkg/types"
+)
+
+// userTagSubscriptionBuffer is the number of tags buffered for every subscriber,
+// tags of a subscriber that doesn't keep up are dropped.
+const userTagSubscriptionBuffer = 256
+
+type userTagsSubscribeRequest struct {
+	Cookies []string `form:"cookie" binding:"required,min=1,max=100,dive,required"`
+	// Expires is the unix time in seconds until which the token is valid.
+	Expires int64  `form:"expires" binding:"required"`
+	Token   string `form:"token" binding:"required"`
+}
+
+// userTagsSubscribeHandler upgrades the connection to a WebSocket, which receives every tag of the cookies
+// accepted by any replica as a dto.UserTagDTO JSON message. Messages of the client are ignored.
+// The subscriber must present a token issued for the cookies, and the page opening the connection must be of
+// an allowed origin.
+func (s server) userTagsSubscribeHandler(c *gin.Context) {
+	var req userTagsSubscribeRequest
+	if err := c.BindQuery(&req); err != nil {
+		_ = c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	if s.conf.UserTagsSubscribeSecret == "" {
+		_ = c.AbortWithError(http.StatusForbidden, errors.New("subscriptions are disabled"))
+		return
+	}
+	if err := checkSubscriptionToken(s.conf.UserTagsSubscribeSecret, req, time.Now()); err != nil {
+		_ = c.AbortWithError(http.StatusUnauthorized, err)
+		return
+	}
+
+	websocket.Server{
+		Handshake: s.checkSubscriptionOrigin,
+		Handler: func(ws *websocket.Conn) {
+			s.sendUserTags(ws, req.Cookies)
+		},
+	}.ServeHTTP(c.Writer, c.Request)
+}
+
+// subscriptionToken returns the hex encoded HMAC-SHA256 of the expiry time, a dot and the sorted cookies joined
+// with commas. Tokens are issued by backends of the pages embedding subscriptions, which share the secret.
+func subscriptionToken(secret string, expires int64, cookies []string) string {
+	sorted := slices.Clone(cookies)
+	sort.Strings(sorted)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(expires, 10) + "." + strings.Join(sorted, ",")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func checkSubscriptionToken(secret string, req userTagsSubscribeRequest, now time.Time) error {
+	if now.Unix() > req.Expires {
+		return fmt.Errorf("subscription token expired at %s", time.Unix(req.Expires, 0).UTC())
+	}
+	want := subscriptionToken(secret, req.Expires, req.Cookies)
+	if !hmac.Equal([]byte(want), []byte(req.Token)) {
+		return errors.New("invalid subscription token")
+	}
+	return nil
+}
+
+// checkSubscriptionOrigin accepts WebSocket handshakes of pages of allowed origins only.
+func (s server) checkSubscriptionOrigin(config *websocket.Config, req *http.Request) (err error) {
+	config.Origin, err = websocket.Origin(config, req)
+	if err != nil {
+		return err
+	}
+	if config.Origin == nil {
+		return errors.New("missing origin")
+	}
+	origin := config.Origin.Scheme + "://" + config.Origin.Host
+	if !slices.Contains(s.conf.UserTagsSubscribeOrigins, origin) {
+		return fmt.Errorf("origin %s is not allowed", origin)
+	}
+	return nil
+}
+
+func (s server) sendUserTags(ws *websocket.Conn, cookies []string) {
+	tags, cancel := s.userTagSubscriptions.Subscribe(cookies...)
+	defer cancel()
+	s.userTagsReceiver.acquire()
+	defer s.userTagsReceiver.release()
+
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		// Reading fails once the client closes the connection.
+		var msg []byte
+		for websocket.Message.Receive(ws, &msg) == nil {
+		}
+	}()
+
+	for {
+		select {
+		case tag := <-tags:
+			if err := websocket.JSON.Send(ws, dto.IntoUserTagDTO(tag)); err != nil {
+				s.logger.Debug("can't send user tag to subscriber", zap.Error(err))
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
+
+// userTagsReceiver receives broadcast tags only while there are subscribers, so replicas without subscribers
+// don't consume the broadcast.
+type userTagsReceiver struct {
+	receive func(ctx context.Context)
+
+	mu          sync.Mutex
+	subscribers int
+	cancel      context.CancelFunc
+	done        chan struct{}
+}
+
+func newUserTagsReceiver(receive func(ctx context.Context)) *userTagsReceiver {
+	return &userTagsReceiver{receive: receive}
+}
+
+// acquire starts receiving tags if this is the first subscriber.
+func (r *userTagsReceiver) acquire() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.subscribers++
+	if r.subscribers > 1 {
+		return
+	}
+	if r.done != nil {
+		// Tags would be delivered twice while the previous receive is still running.
+		<-r.done
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	r.cancel, r.done = cancel, done
+	go func() {
+		defer close(done)
+		r.receive(ctx)
+	}()
+}
+
+// release stops receiving tags if this was the last subscriber.
+func (r *userTagsReceiver) release() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.subscribers--
+	if r.subscribers == 0 {
+		r.cancel()
+	}
+}
+
+// receiveUserTags passes broadcast tags to their subscribers until ctx is done, reconnecting to the broadcast on errors.
+func (s server) receiveUserTags(ctx context.Context) {
+	bo := backoff.NewExponentialBackOff()
+	bo.MaxInterval = 30 * time.Second
+	bo.MaxElapsedTime = 0
+
+	_ = backoff.RetryNotify(func() error {
+		return s.broadcast.Receive(ctx, func(tag types.UserTag) {
+			s.userTagSubscriptions.Publish(tag.Cookie, tag)
+		})
+	}, backoff.WithContext(bo, ctx), func(err error, d time.Duration) {
+		s.logger.Error("error receiving broadcast user tags", zap.Error(err), zap.Duration("retry_in", d))
+	})
+}
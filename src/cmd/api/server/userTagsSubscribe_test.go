@@ -0,0 +1,119 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/websocket"
+
+	"github.com/TomaszDomagala/Allezon/src/pkg/dto"
+)
+
+const testSubscribeSecret = "secret"
+
+// subscribeURL returns the url of a subscription to cookies authorized by a valid token.
+func subscribeURL(httpServer *httptest.Server, cookies ...string) string {
+	expires := time.Now().Add(time.Hour).Unix()
+	query := url.Values{
+		"cookie":  cookies,
+		"expires": {strconv.FormatInt(expires, 10)},
+		"token":   {subscriptionToken(testSubscribeSecret, expires, cookies)},
+	}
+	return "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/user_tags/subscribe?" + query.Encode()
+}
+
+func newTestSubscribeServer() (server, *httptest.Server) {
+	s := newTestServer(newMemoryProfiles())
+	httpServer := httptest.NewServer(s.engine)
+	s.conf.UserTagsSubscribeSecret = testSubscribeSecret
+	s.conf.UserTagsSubscribeOrigins = []string{httpServer.URL}
+	return s, httpServer
+}
+
+func TestUserTagsSubscribe(t *testing.T) {
+	s, httpServer := newTestSubscribeServer()
+	defer httpServer.Close()
+	ws, err := websocket.Dial(subscribeURL(httpServer, "foo", "bar"), "", httpServer.URL)
+	require.NoError(t, err)
+	defer ws.Close()
+
+	received := make(chan dto.UserTagDTO, 100)
+	go func() {
+		var tag dto.UserTagDTO
+		for websocket.JSON.Receive(ws, &tag) == nil {
+			received <- tag
+		}
+	}()
+
+	want := testTag("foo", "BUY")
+	want.Time = "2022-03-01T00:00:00Z"
+	// Tags accepted before the subscription and the broadcast receiver are set up are not delivered.
+	require.Eventually(t, func() bool {
+		assert.Equal(t, http.StatusNoContent, serve(s, http.MethodPost, "/user_tags", testTag("baz", "VIEW")).Code)
+		assert.Equal(t, http.StatusNoContent, serve(s, http.MethodPost, "/user_tags", testTag("foo", "BUY")).Code)
+		select {
+		case tag := <-received:
+			assert.Equal(t, want, tag, "only tags of subscribed cookies are received")
+			return true
+		case <-time.After(10 * time.Millisecond):
+			return false
+		}
+	}, 5*time.Second, time.Millisecond)
+
+	require.NoError(t, ws.Close())
+	require.Eventually(t, func() bool { return s.userTagSubscriptions.Keys() == 0 }, 5*time.Second, time.Millisecond,
+		"subscription is cancelled after the connection is closed")
+	require.Eventually(t, func() bool {
+		s.userTagsReceiver.mu.Lock()
+		defer s.userTagsReceiver.mu.Unlock()
+		select {
+		case <-s.userTagsReceiver.done:
+			return true
+		default:
+			return false
+		}
+	}, 5*time.Second, time.Millisecond, "broadcast is received only while there are subscribers")
+}
+
+func TestUserTagsSubscribeRejected(t *testing.T) {
+	s, httpServer := newTestSubscribeServer()
+	defer httpServer.Close()
+
+	_, err := websocket.Dial(subscribeURL(httpServer, "foo"), "", "http://example.com")
+	assert.Error(t, err, "pages of other origins can't subscribe")
+
+	expires := time.Now().Add(time.Hour).Unix()
+	tests := []struct {
+		name  string
+		query string
+		code  int
+	}{
+		{name: "missing token", query: "cookie=foo", code: http.StatusBadRequest},
+		{name: "token of other cookies", query: fmt.Sprintf("cookie=foo&expires=%d&token=%s", expires, subscriptionToken(testSubscribeSecret, expires, []string{"bar"})), code: http.StatusUnauthorized},
+		{name: "expired token", query: fmt.Sprintf("cookie=foo&expires=1&token=%s", subscriptionToken(testSubscribeSecret, 1, []string{"foo"})), code: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(s, http.MethodGet, "/user_tags/subscribe?"+tt.query, nil)
+			assert.Equal(t, tt.code, w.Code)
+		})
+	}
+
+	s.conf.UserTagsSubscribeSecret = ""
+	w := serve(s, http.MethodGet, "/user_tags/subscribe?"+fmt.Sprintf("cookie=foo&expires=%d&token=%s", expires, subscriptionToken("", expires, []string{"foo"})), nil)
+	assert.Equal(t, http.StatusForbidden, w.Code, "subscriptions are disabled without a secret")
+}
+
+func TestUserTagsSubscribeWithoutCookies(t *testing.T) {
+	s := newTestServer(newMemoryProfiles())
+	w := serve(s, http.MethodGet, "/user_tags/subscribe", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -2,6 +2,16 @@ package api
 
 const GetIDUrl = "/get_id"
 
+// SnapshotUrl streams all known elements of all collections as newline delimited SnapshotEntry objects.
+const SnapshotUrl = "/snapshot"
+
+// DeltaUrl returns elements added to collections after given versions.
+const DeltaUrl = "/delta"
+
+// ConfigVersionHeader holds the version of the dictionary config in responses of snapshots, deltas and watch streams.
+// Clients clear cached ids when it changes, as elements may be mapped to other ids.
+const ConfigVersionHeader = "Dictionary-Config-Version"
+
 type GetIDRequest struct {
 	CollectionName string `json:"collection_name"`
 	Element        string `json:"element"`
@@ -11,3 +21,21 @@ type GetIDRequest struct {
 type GetIdResponse struct {
 	ID int32 `json:"id"`
 }
+
+// SnapshotEntry is a single element of a collection with its id.
+// Ids are assigned sequentially, so the highest id seen in a collection is its version.
+type SnapshotEntry struct {
+	CollectionName string `json:"collection_name"`
+	Element        string `json:"element"`
+	ID             int32  `json:"id"`
+}
+
+// DeltaRequest holds the version of each collection known to the client.
+type DeltaRequest struct {
+	Versions map[string]int32 `json:"versions"`
+}
+
+// DeltaResponse holds elements with ids greater than the requested versions.
+type DeltaResponse struct {
+	Entries []SnapshotEntry `json:"entries"`
+}
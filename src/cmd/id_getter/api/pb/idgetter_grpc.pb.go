@@ -0,0 +1,213 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.2.0
+// - protoc             v3.12.4
+// source: idgetter.proto
+
+package pb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// IDGetterClient is the client API for IDGetter service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type IDGetterClient interface {
+	// GetID returns the id of a single element.
+	GetID(ctx context.Context, in *GetIDRequest, opts ...grpc.CallOption) (*GetIDResponse, error)
+	// GetIDs returns ids of many elements. It fails if any of the lookups fails.
+	GetIDs(ctx context.Context, in *GetIDsRequest, opts ...grpc.CallOption) (*GetIDsResponse, error)
+	// Watch streams elements with ids greater than the requested versions. The first response holds all
+	// such elements that already exist, following responses hold elements as they are created.
+	Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (IDGetter_WatchClient, error)
+}
+
+type iDGetterClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewIDGetterClient(cc grpc.ClientConnInterface) IDGetterClient {
+	return &iDGetterClient{cc}
+}
+
+func (c *iDGetterClient) GetID(ctx context.Context, in *GetIDRequest, opts ...grpc.CallOption) (*GetIDResponse, error) {
+	out := new(GetIDResponse)
+	err := c.cc.Invoke(ctx, "/idgetter.IDGetter/GetID", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *iDGetterClient) GetIDs(ctx context.Context, in *GetIDsRequest, opts ...grpc.CallOption) (*GetIDsResponse, error) {
+	out := new(GetIDsResponse)
+	err := c.cc.Invoke(ctx, "/idgetter.IDGetter/GetIDs", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *iDGetterClient) Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (IDGetter_WatchClient, error) {
+	stream, err := c.cc.NewStream(ctx, &IDGetter_ServiceDesc.Streams[0], "/idgetter.IDGetter/Watch", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &iDGetterWatchClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type IDGetter_WatchClient interface {
+	Recv() (*WatchResponse, error)
+	grpc.ClientStream
+}
+
+type iDGetterWatchClient struct {
+	grpc.ClientStream
+}
+
+func (x *iDGetterWatchClient) Recv() (*WatchResponse, error) {
+	m := new(WatchResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// IDGetterServer is the server API for IDGetter service.
+// All implementations must embed UnimplementedIDGetterServer
+// for forward compatibility
+type IDGetterServer interface {
+	// GetID returns the id of a single element.
+	GetID(context.Context, *GetIDRequest) (*GetIDResponse, error)
+	// GetIDs returns ids of many elements. It fails if any of the lookups fails.
+	GetIDs(context.Context, *GetIDsRequest) (*GetIDsResponse, error)
+	// Watch streams elements with ids greater than the requested versions. The first response holds all
+	// such elements that already exist, following responses hold elements as they are created.
+	Watch(*WatchRequest, IDGetter_WatchServer) error
+	mustEmbedUnimplementedIDGetterServer()
+}
+
+// UnimplementedIDGetterServer must be embedded to have forward compatible implementations.
+type UnimplementedIDGetterServer struct {
+}
+
+func (UnimplementedIDGetterServer) GetID(context.Context, *GetIDRequest) (*GetIDResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetID not implemented")
+}
+func (UnimplementedIDGetterServer) GetIDs(context.Context, *GetIDsRequest) (*GetIDsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetIDs not implemented")
+}
+func (UnimplementedIDGetterServer) Watch(*WatchRequest, IDGetter_WatchServer) error {
+	return status.Errorf(codes.Unimplemented, "method Watch not implemented")
+}
+func (UnimplementedIDGetterServer) mustEmbedUnimplementedIDGetterServer() {}
+
+// UnsafeIDGetterServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to IDGetterServer will
+// result in compilation errors.
+type UnsafeIDGetterServer interface {
+	mustEmbedUnimplementedIDGetterServer()
+}
+
+func RegisterIDGetterServer(s grpc.ServiceRegistrar, srv IDGetterServer) {
+	s.RegisterService(&IDGetter_ServiceDesc, srv)
+}
+
+func _IDGetter_GetID_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetIDRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(IDGetterServer).GetID(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/idgetter.IDGetter/GetID",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(IDGetterServer).GetID(ctx, req.(*GetIDRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _IDGetter_GetIDs_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetIDsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(IDGetterServer).GetIDs(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/idgetter.IDGetter/GetIDs",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(IDGetterServer).GetIDs(ctx, req.(*GetIDsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _IDGetter_Watch_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(IDGetterServer).Watch(m, &iDGetterWatchServer{stream})
+}
+
+type IDGetter_WatchServer interface {
+	Send(*WatchResponse) error
+	grpc.ServerStream
+}
+
+type iDGetterWatchServer struct {
+	grpc.ServerStream
+}
+
+func (x *iDGetterWatchServer) Send(m *WatchResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// IDGetter_ServiceDesc is the grpc.ServiceDesc for IDGetter service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var IDGetter_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "idgetter.IDGetter",
+	HandlerType: (*IDGetterServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetID",
+			Handler:    _IDGetter_GetID_Handler,
+		},
+		{
+			MethodName: "GetIDs",
+			Handler:    _IDGetter_GetIDs_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Watch",
+			Handler:       _IDGetter_Watch_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "idgetter.proto",
+}
@@ -1,20 +1,60 @@
 package config
 
-import "github.com/spf13/viper"
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"github.com/TomaszDomagala/Allezon/src/pkg/idGetter/dictionary"
+)
 
 type Config struct {
 	// Server options
 	Port     int  `mapstructure:"port"`
 	EchoMode bool `mapstructure:"echo_mode"`
+	// GRPCPort is the port of the grpc service, zero disables it.
+	GRPCPort int `mapstructure:"grpc_port"`
+	// WatchPollInterval is the period of loading elements created by other replicas, streamed to grpc watchers.
+	WatchPollInterval time.Duration `mapstructure:"watch_poll_interval"`
 
 	// LogLevel controls the log level of the application.
 	LogLevel string `mapstructure:"log_level"`
 
+	// Collections are preloaded into the cache at startup and served in snapshots.
+	Collections []string `mapstructure:"collections"`
+
+	// Collection limits options
+	// DefaultMaxCardinality applies to collections without their own limits.
+	DefaultMaxCardinality int `mapstructure:"default_max_cardinality"`
+	// DefaultOverflowElement applies to collections without their own limits.
+	DefaultOverflowElement string `mapstructure:"default_overflow_element"`
+	// CollectionLimitsJSON is a json object mapping collection names to dictionary.CollectionLimits.
+	CollectionLimitsJSON string `mapstructure:"collection_limits"`
+	// CollectionLimits is parsed from CollectionLimitsJSON.
+	CollectionLimits map[string]dictionary.CollectionLimits `mapstructure:"-"`
+
+	// CollectionNormalizationJSON is a json object mapping collection names to dictionary.NormalizationRules.
+	CollectionNormalizationJSON string `mapstructure:"collection_normalization"`
+	// CollectionNormalization is parsed from CollectionNormalizationJSON.
+	CollectionNormalization map[string]dictionary.NormalizationRules `mapstructure:"-"`
+
 	// DB options
 	DBNullClient bool     `mapstructure:"db_null_client"`
 	DBAddresses  []string `mapstructure:"db_addresses"`
 }
 
+// Dictionary returns the config of the ids dictionary.
+func (c *Config) Dictionary() dictionary.Config {
+	return dictionary.Config{
+		Collections:             c.Collections,
+		DefaultMaxCardinality:   c.DefaultMaxCardinality,
+		DefaultOverflowElement:  c.DefaultOverflowElement,
+		CollectionLimits:        c.CollectionLimits,
+		CollectionNormalization: c.CollectionNormalization,
+	}
+}
+
 func field(name string, defaultValue any) {
 	_ = viper.BindEnv(name)
 	viper.SetDefault(name, defaultValue)
@@ -23,13 +63,34 @@ func field(name string, defaultValue any) {
 func New() (*Config, error) {
 	field("port", 8080)
 	field("echo_mode", false)
+	field("grpc_port", 9090)
+	field("watch_poll_interval", time.Second)
 
 	field("log_level", "debug")
 
+	field("collections", []string{"origin", "brand", "category", "country"})
+
+	field("default_max_cardinality", dictionary.DefaultMaxCardinality)
+	field("default_overflow_element", dictionary.DefaultOverflowElement)
+	field("collection_limits", "")
+
+	field("collection_normalization", "")
+
 	field("db_null_client", false)
 	field("db_addresses", []string{})
 
 	var c Config
 	_ = viper.Unmarshal(&c)
+
+	var err error
+	if c.CollectionLimits, err = dictionary.ParseCollectionLimits(c.CollectionLimitsJSON, c.DefaultOverflowElement); err != nil {
+		return nil, err
+	}
+	if c.CollectionNormalization, err = dictionary.ParseCollectionNormalization(c.CollectionNormalizationJSON); err != nil {
+		return nil, err
+	}
+	if c.GRPCPort != 0 && c.WatchPollInterval <= 0 {
+		return nil, fmt.Errorf("watch poll interval must be positive")
+	}
 	return &c, nil
 }
@@ -5,7 +5,7 @@ import (
 
 	"go.uber.org/zap"
 
-	"github.com/TomaszDomagala/Allezon/src/cmd/id_getter/db"
+	"github.com/TomaszDomagala/Allezon/src/pkg/idGetter/db"
 	"github.com/TomaszDomagala/Allezon/src/pkg/logutils"
 
 	"github.com/TomaszDomagala/Allezon/src/cmd/id_getter/config"
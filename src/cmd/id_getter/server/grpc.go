@@ -0,0 +1,120 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/TomaszDomagala/Allezon/src/cmd/id_getter/api"
+	"github.com/TomaszDomagala/Allezon/src/cmd/id_getter/api/pb"
+	"github.com/TomaszDomagala/Allezon/src/pkg/idGetter/dictionary"
+)
+
+// grpcServer serves the pb.IDGetterServer interface using the same logic as the http endpoints.
+type grpcServer struct {
+	pb.UnimplementedIDGetterServer
+	s server
+}
+
+func (s server) runGRPC() error {
+	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", s.conf.GRPCPort))
+	if err != nil {
+		return fmt.Errorf("failed to listen on grpc port, %w", err)
+	}
+	srv := grpc.NewServer()
+	pb.RegisterIDGetterServer(srv, grpcServer{s: s})
+
+	s.logger.Info("Starting grpc server", zap.Int("port", s.conf.GRPCPort))
+	return srv.Serve(lis)
+}
+
+func (g grpcServer) GetID(_ context.Context, req *pb.GetIDRequest) (*pb.GetIDResponse, error) {
+	id, err := g.s.dict.GetID(req.CollectionName, req.Element, req.CreateMissing)
+	if err != nil {
+		return nil, g.toStatus(err, req)
+	}
+	return &pb.GetIDResponse{Id: int32(id)}, nil
+}
+
+func (g grpcServer) GetIDs(_ context.Context, req *pb.GetIDsRequest) (*pb.GetIDsResponse, error) {
+	resp := &pb.GetIDsResponse{Ids: make([]int32, len(req.Requests))}
+	for i, r := range req.Requests {
+		id, err := g.s.dict.GetID(r.CollectionName, r.Element, r.CreateMissing)
+		if err != nil {
+			return nil, g.toStatus(err, r)
+		}
+		resp.Ids[i] = int32(id)
+	}
+	return resp, nil
+}
+
+func (g grpcServer) Watch(req *pb.WatchRequest, stream pb.IDGetter_WatchServer) error {
+	// Subscribe before loading the backlog, so no element created in between is missed.
+	ch := g.s.dict.Subscribe()
+	defer g.s.dict.Unsubscribe(ch)
+
+	versions := make(map[string]int32, len(req.Versions))
+	for collection, version := range req.Versions {
+		versions[collection] = version
+	}
+
+	backlog, err := g.s.dict.EntriesSince(versions)
+	if err != nil {
+		g.s.logger.Error("can't load collections for watch", zap.Error(err))
+		return status.Error(codes.Internal, err.Error())
+	}
+	if err := stream.SendHeader(metadata.Pairs(api.ConfigVersionHeader, g.s.dict.ConfigVersion())); err != nil {
+		return err
+	}
+	resp := &pb.WatchResponse{Entries: make([]*pb.Entry, 0, len(backlog))}
+	for _, e := range backlog {
+		resp.Entries = append(resp.Entries, toPBEntry(e))
+		bumpVersion(versions, e)
+	}
+	if err := stream.Send(resp); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case e, ok := <-ch:
+			if !ok {
+				return status.Error(codes.ResourceExhausted, "watcher can't keep up, resubscribe from the last version")
+			}
+			if e.ID <= versions[e.CollectionName] {
+				continue
+			}
+			bumpVersion(versions, e)
+			if err := stream.Send(&pb.WatchResponse{Entries: []*pb.Entry{toPBEntry(e)}}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (g grpcServer) toStatus(err error, req *pb.GetIDRequest) error {
+	if errors.Is(err, dictionary.ErrorNotFound) {
+		return status.Error(codes.NotFound, err.Error())
+	}
+	g.s.logger.Error("can't get id", zap.Error(err), zap.String("collection", req.CollectionName), zap.String("element", req.Element))
+	return status.Error(codes.Internal, err.Error())
+}
+
+func bumpVersion(versions map[string]int32, e api.SnapshotEntry) {
+	if e.ID > versions[e.CollectionName] {
+		versions[e.CollectionName] = e.ID
+	}
+}
+
+func toPBEntry(e api.SnapshotEntry) *pb.Entry {
+	return &pb.Entry{CollectionName: e.CollectionName, Element: e.Element, Id: e.ID}
+}
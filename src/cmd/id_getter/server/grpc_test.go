@@ -0,0 +1,124 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/TomaszDomagala/Allezon/src/cmd/id_getter/api/pb"
+	"github.com/TomaszDomagala/Allezon/src/cmd/id_getter/config"
+	"github.com/TomaszDomagala/Allezon/src/pkg/idGetter/db"
+)
+
+func newTestServer(conf *config.Config) server {
+	return newTestServerWithDB(conf, db.NewMemoryClient())
+}
+
+func newTestServerWithDB(conf *config.Config, client db.Client) server {
+	return New(Dependencies{
+		Logger: zap.NewNop(),
+		Cfg:    conf,
+		DB:     client,
+	}).(server)
+}
+
+func newTestGRPCClient(t *testing.T, s server) pb.IDGetterClient {
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer()
+	pb.RegisterIDGetterServer(srv, grpcServer{s: s})
+	go func() { _ = srv.Serve(lis) }()
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	return pb.NewIDGetterClient(conn)
+}
+
+func TestGRPC_GetIDs(t *testing.T) {
+	cl := newTestGRPCClient(t, newTestServer(&config.Config{}))
+	ctx := context.Background()
+
+	resp, err := cl.GetIDs(ctx, &pb.GetIDsRequest{Requests: []*pb.GetIDRequest{
+		{CollectionName: "brand", Element: "nike", CreateMissing: true},
+		{CollectionName: "brand", Element: "adidas", CreateMissing: true},
+		{CollectionName: "origin", Element: "internal", CreateMissing: true},
+	}})
+	require.NoError(t, err)
+	assert.Equal(t, []int32{1, 2, 1}, resp.Ids)
+
+	single, err := cl.GetID(ctx, &pb.GetIDRequest{CollectionName: "brand", Element: "adidas"})
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), single.Id)
+
+	_, err = cl.GetID(ctx, &pb.GetIDRequest{CollectionName: "brand", Element: "puma"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestGRPC_Watch(t *testing.T) {
+	s := newTestServer(&config.Config{Collections: []string{"brand"}})
+	cl := newTestGRPCClient(t, s)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for _, el := range []string{"nike", "adidas"} {
+		_, err := s.dict.GetID("brand", el, true)
+		require.NoError(t, err)
+	}
+
+	stream, err := cl.Watch(ctx, &pb.WatchRequest{Versions: map[string]int32{"brand": 1}})
+	require.NoError(t, err)
+
+	backlog, err := stream.Recv()
+	require.NoError(t, err)
+	require.Len(t, backlog.Entries, 1)
+	assert.Equal(t, "adidas", backlog.Entries[0].Element)
+
+	_, err = s.dict.GetID("brand", "puma", true)
+	require.NoError(t, err)
+
+	update, err := stream.Recv()
+	require.NoError(t, err)
+	require.Len(t, update.Entries, 1)
+	assert.Equal(t, "puma", update.Entries[0].Element)
+	assert.Equal(t, int32(3), update.Entries[0].Id)
+}
+
+func TestGRPC_WatchOtherReplicas(t *testing.T) {
+	client := db.NewMemoryClient()
+	conf := &config.Config{Collections: []string{"brand"}}
+	s := newTestServerWithDB(conf, client)
+	other := newTestServerWithDB(conf, client)
+	cl := newTestGRPCClient(t, s)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := cl.Watch(ctx, &pb.WatchRequest{})
+	require.NoError(t, err)
+	backlog, err := stream.Recv()
+	require.NoError(t, err)
+	assert.Empty(t, backlog.Entries)
+
+	_, err = other.dict.GetID("brand", "nike", true)
+	require.NoError(t, err)
+	go s.dict.Poll(ctx, time.Millisecond)
+
+	update, err := stream.Recv()
+	require.NoError(t, err)
+	require.Len(t, update.Entries, 1)
+	assert.Equal(t, "nike", update.Entries[0].Element)
+	assert.Equal(t, int32(1), update.Entries[0].Id)
+}
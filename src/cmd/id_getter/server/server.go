@@ -1,20 +1,22 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"expvar"
 	"fmt"
 	"net/http"
-	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"go.uber.org/zap"
-	"golang.org/x/exp/slices"
+	"golang.org/x/sync/errgroup"
 
 	"github.com/TomaszDomagala/Allezon/src/cmd/id_getter/api"
 	"github.com/TomaszDomagala/Allezon/src/cmd/id_getter/config"
-	"github.com/TomaszDomagala/Allezon/src/cmd/id_getter/db"
+	"github.com/TomaszDomagala/Allezon/src/pkg/idGetter/db"
+	"github.com/TomaszDomagala/Allezon/src/pkg/idGetter/dictionary"
 
 	ginzap "github.com/gin-contrib/zap"
 )
@@ -30,19 +32,27 @@ type Dependencies struct {
 }
 
 type server struct {
-	conf          *config.Config
-	logger        *zap.Logger
-	engine        *gin.Engine
-	db            db.Client
-	idsCache      map[string]map[string]int
-	idsCacheMutex *sync.RWMutex
+	conf   *config.Config
+	logger *zap.Logger
+	engine *gin.Engine
+	dict   *dictionary.Dictionary
 }
 
-var ErrorNotFound = errors.New("not found")
-
+// Run serves the http endpoints and, if grpc port is set, the grpc service. It returns when either of them fails.
 func (s server) Run() error {
-	s.logger.Info("Starting server", zap.Int("port", s.conf.Port))
-	return s.engine.Run(fmt.Sprintf(":%d", s.conf.Port))
+	s.dict.Preload()
+
+	var errGrp errgroup.Group
+	if s.conf.GRPCPort != 0 {
+		// Watchers of every replica get elements created by the others.
+		go s.dict.Poll(context.Background(), s.conf.WatchPollInterval)
+		errGrp.Go(s.runGRPC)
+	}
+	errGrp.Go(func() error {
+		s.logger.Info("Starting server", zap.Int("port", s.conf.Port))
+		return s.engine.Run(fmt.Sprintf(":%d", s.conf.Port))
+	})
+	return errGrp.Wait()
 }
 
 func (s server) health(c *gin.Context) {
@@ -63,8 +73,13 @@ func (s server) getIDHandler(c *gin.Context) {
 		return
 	}
 
-	id, err := s.getID(req.CollectionName, req.Element, req.CreateMissing)
+	id, err := s.dict.GetID(req.CollectionName, req.Element, req.CreateMissing)
 	if err != nil {
+		if errors.Is(err, dictionary.ErrorNotFound) {
+			s.logger.Debug("id not found", zap.String("collection", req.CollectionName), zap.String("element", req.Element))
+			_ = c.AbortWithError(http.StatusNotFound, err)
+			return
+		}
 		s.logger.Error("can't get id", zap.Error(err), zap.String("collection", req.CollectionName), zap.String("element", req.Element))
 		_ = c.AbortWithError(http.StatusInternalServerError, err)
 		return
@@ -73,87 +88,6 @@ func (s server) getIDHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, api.GetIdResponse{ID: int32(id)})
 }
 
-// getID returns id of element in collection. It tries to find it in cache first, then in database.
-// If it's not found in db, it generates new id and caches it.
-func (s server) getID(collection string, element string, createMissing bool) (int, error) {
-	if id, inCache := s.checkInCache(collection, element); inCache {
-		return id, nil
-	}
-
-	id, err := s.getIDFromDB(collection, element)
-	if err != nil {
-		if errors.Is(err, ErrorNotFound) {
-			if createMissing {
-				// element not found in db, save it and return new id.
-				id, err = s.saveIDInDB(collection, element)
-				if err != nil {
-					return 0, fmt.Errorf("error while saving id in db: %w", err)
-				}
-			} else {
-				return 0, fmt.Errorf("id in collection %s for element %s not found(createMissing=disable) : %w", collection, element, err)
-			}
-		} else {
-			return 0, fmt.Errorf("error while getting id from db: %w", err)
-		}
-	}
-
-	s.saveInCache(collection, element, id)
-	return id, nil
-}
-
-// getIDFromDB returns id of element in collection.
-// It fetches the whole list from db and then searches for element in it.
-// Index of element in list is returned as its id.
-func (s server) getIDFromDB(collection string, element string) (int, error) {
-	list, err := s.db.GetElements(collection)
-	if err != nil {
-		if errors.Is(err, db.KeyNotFoundError) {
-			return 0, fmt.Errorf("error while getting elements from db: %w", ErrorNotFound)
-		}
-		return 0, fmt.Errorf("error while getting elements from db: %w", err)
-	}
-	idx := slices.Index(list, element)
-	if idx == -1 {
-		return 0, fmt.Errorf("element not found in list, %w: (%v, %v)", ErrorNotFound, collection, element)
-	}
-	s.logger.Debug("found id in db", zap.String("collection", collection), zap.String("element", element), zap.Int("id", idx))
-	return idx, nil
-}
-
-// saveIDInDB saves element in category and returns its id.
-func (s server) saveIDInDB(category string, element string) (int, error) {
-	id, err := s.db.AppendElement(category, element)
-	if err != nil {
-		return 0, fmt.Errorf("error while appending record, %w", err)
-	}
-	s.logger.Debug("saved id in db", zap.String("category", category), zap.String("element", element), zap.Int("id", id))
-	return id, nil
-
-}
-
-func (s server) checkInCache(category string, element string) (int, bool) {
-	s.idsCacheMutex.RLock()
-	defer s.idsCacheMutex.RUnlock()
-
-	if cache, ok := s.idsCache[category]; ok {
-		if id, ok := cache[element]; ok {
-			s.logger.Debug("found id in cache", zap.String("category", category), zap.String("element", element), zap.Int("id", id))
-			return id, true
-		}
-	}
-	return 0, false
-}
-
-func (s server) saveInCache(category string, element string, colLen int) {
-	s.idsCacheMutex.Lock()
-	defer s.idsCacheMutex.Unlock()
-
-	if _, ok := s.idsCache[category]; !ok {
-		s.idsCache[category] = make(map[string]int)
-	}
-	s.idsCache[category][element] = colLen
-}
-
 func New(deps Dependencies) Server {
 	router := gin.New()
 
@@ -161,17 +95,18 @@ func New(deps Dependencies) Server {
 	router.Use(ginzap.RecoveryWithZap(deps.Logger, true))
 
 	s := server{
-		engine:        router,
-		logger:        deps.Logger,
-		conf:          deps.Cfg,
-		db:            deps.DB,
-		idsCache:      make(map[string]map[string]int),
-		idsCacheMutex: &sync.RWMutex{},
+		engine: router,
+		logger: deps.Logger,
+		conf:   deps.Cfg,
+		dict:   dictionary.New(deps.Cfg.Dictionary(), deps.DB, deps.Logger),
 	}
 
 	router.GET("/health", s.health)
+	router.GET("/debug/vars", gin.WrapH(expvar.Handler()))
 
 	router.POST(api.GetIDUrl, s.getIDHandler)
+	router.GET(api.SnapshotUrl, s.snapshotHandler)
+	router.POST(api.DeltaUrl, s.deltaHandler)
 
 	return s
 }
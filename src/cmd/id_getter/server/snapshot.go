@@ -0,0 +1,62 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"github.com/TomaszDomagala/Allezon/src/cmd/id_getter/api"
+	"github.com/TomaszDomagala/Allezon/src/pkg/idGetter/dictionary"
+)
+
+// snapshotHandler streams all cacheable elements of all collections, one json encoded api.SnapshotEntry per line.
+func (s server) snapshotHandler(c *gin.Context) {
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Header(api.ConfigVersionHeader, s.dict.ConfigVersion())
+	c.Status(http.StatusOK)
+
+	enc := json.NewEncoder(c.Writer)
+	for _, collection := range s.dict.Collections() {
+		elements, err := s.dict.LoadCollection(collection)
+		if err != nil {
+			// Headers are already sent, the client detects the error by the broken stream.
+			s.logger.Error("can't load collection for snapshot", zap.String("collection", collection), zap.Error(err))
+			c.Abort()
+			return
+		}
+		for idx := range elements {
+			if !s.dict.Cacheable(collection, elements[idx]) {
+				continue
+			}
+			entry := dictionary.Entry(collection, elements, idx)
+			if err := enc.Encode(entry); err != nil {
+				s.logger.Warn("can't write snapshot entry", zap.Error(err))
+				c.Abort()
+				return
+			}
+		}
+		c.Writer.Flush()
+	}
+}
+
+// deltaHandler returns elements with ids greater than the versions known to the client.
+// Collections missing from the request are returned in full.
+func (s server) deltaHandler(c *gin.Context) {
+	var req api.DeltaRequest
+	if err := c.BindJSON(&req); err != nil {
+		_ = c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	entries, err := s.dict.EntriesSince(req.Versions)
+	if err != nil {
+		s.logger.Error("can't load collections for delta", zap.Error(err))
+		_ = c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	c.Header(api.ConfigVersionHeader, s.dict.ConfigVersion())
+	c.JSON(http.StatusOK, api.DeltaResponse{Entries: entries})
+}
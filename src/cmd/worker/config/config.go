@@ -1,22 +1,127 @@
 package config
 
-import "github.com/spf13/viper"
+import (
+	"fmt"
+	"runtime"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"github.com/TomaszDomagala/Allezon/src/pkg/idGetter/dictionary"
+)
+
+// Policies of late tags.
+const (
+	LateTagsPolicyCorrection = "correction"
+	LateTagsPolicyTopic      = "topic"
+)
+
+// Protocols of the id_getter client.
+const (
+	IDGetterProtocolHTTP     = "http"
+	IDGetterProtocolGRPC     = "grpc"
+	IDGetterProtocolEmbedded = "embedded"
+)
 
 type Config struct {
 	// Server options
 	Port int `mapstructure:"port"`
+	// AdminToken is the bearer token required by the admin api, which is disabled if it's empty.
+	AdminToken string `mapstructure:"admin_token"`
 
 	// LogLevel controls the log level of the application.
 	LogLevel string `mapstructure:"log_level"`
 
 	// Kafka options
 	KafkaAddresses []string `mapstructure:"kafka_addresses"`
+	// KafkaNumPartitions and KafkaReplicationFactor are used to create the rule matches topic.
+	KafkaNumPartitions     int32 `mapstructure:"kafka_num_partitions"`
+	KafkaReplicationFactor int16 `mapstructure:"kafka_replication_factor"`
+	// KafkaNullProducer disables sending rule matches, they are only logged.
+	KafkaNullProducer bool `mapstructure:"kafka_null_producer"`
 
 	// DB options
 	DBAggregatesAddresses []string `mapstructure:"db_aggregates_addresses"`
+	// AggregatesSetRefreshInterval is the period of reloading the active set of aggregates, switched after rebuilds.
+	AggregatesSetRefreshInterval time.Duration `mapstructure:"aggregates_set_refresh_interval"`
+	// RebuildProgressInterval is the period of reporting progress of the rebuild command.
+	RebuildProgressInterval time.Duration `mapstructure:"rebuild_progress_interval"`
+
+	// Pipeline options
+	// NumProcessors is the default number of shards of stages, like aggregates.
+	NumProcessors int `mapstructure:"num_processors"`
+	// ChanSize is the size of the buffer of consumed tags and the default size of queues of shards of stages.
+	ChanSize int `mapstructure:"chan_size"`
+	// Stages are names of processors run independently over every consumed tag.
+	Stages []string `mapstructure:"stages"`
+	// StageOptionsJSON overrides options of stages, like {"aggregates": {"concurrency": 8, "error_policy": "retry"}}.
+	StageOptionsJSON string `mapstructure:"stage_options"`
+	// StageOptions are parsed from StageOptionsJSON.
+	StageOptions map[string]StageOptions `mapstructure:"-"`
+
+	// Event time options
+	// AllowedLateness is how far behind the latest tag of its partition a tag may be, later ones are late.
+	// Zero disables tracking watermarks.
+	AllowedLateness time.Duration `mapstructure:"allowed_lateness"`
+	// LateTagsPolicy selects where late tags go instead of the pipeline, either "correction", the correction bin of
+	// their aggregate, or "topic", the late user tags topic.
+	LateTagsPolicy string `mapstructure:"late_tags_policy"`
+	// WatermarkFlushInterval is the period of writing watermarks to the db.
+	WatermarkFlushInterval time.Duration `mapstructure:"watermark_flush_interval"`
+
+	// Webhooks options
+	// WebhookRefreshInterval is the period of reloading webhook subscriptions from the db.
+	WebhookRefreshInterval time.Duration `mapstructure:"webhook_refresh_interval"`
+	// WebhookTimeout bounds a single attempt of a delivery, WebhookMaxElapsedTime all of its retries.
+	WebhookTimeout        time.Duration `mapstructure:"webhook_timeout"`
+	WebhookMaxElapsedTime time.Duration `mapstructure:"webhook_max_elapsed_time"`
+	// WebhookDeliveryLogLimit is the number of newest deliveries kept in the log of every subscription.
+	WebhookDeliveryLogLimit int `mapstructure:"webhook_delivery_log_limit"`
+	// WebhookOutboxLimit is the number of deliveries of a subscription waiting to be sent, further ones are dropped
+	// and logged as failed.
+	WebhookOutboxLimit int `mapstructure:"webhook_outbox_limit"`
+	// WebhookAllowPrivateAddresses allows urls of webhooks pointing to private, loopback and link-local addresses.
+	WebhookAllowPrivateAddresses bool `mapstructure:"webhook_allow_private_addresses"`
+
+	// Rules options
+	// RulesFile is a JSON array of rules, put into the db on start, replacing rules with the same ids.
+	RulesFile string `mapstructure:"rules_file"`
+	// RulesRefreshInterval is the period of reloading rules from the db.
+	RulesRefreshInterval time.Duration `mapstructure:"rules_refresh_interval"`
+
+	// Archive options
+	// ArchiveDir is the directory of the archive of raw tags, empty disables archiving.
+	ArchiveDir string `mapstructure:"archive_dir"`
+	// ArchiveBatchSize is the number of tags of a partition in a batch of archive files, batches are also
+	// committed every ArchiveFlushInterval.
+	ArchiveBatchSize     int           `mapstructure:"archive_batch_size"`
+	ArchiveFlushInterval time.Duration `mapstructure:"archive_flush_interval"`
+	// ArchiveMaxOpenFiles is the limit of hour files of a batch, a tag of another hour commits the batch early.
+	ArchiveMaxOpenFiles int `mapstructure:"archive_max_open_files"`
 
 	// ID Getter
-	IDGetterAddress string `mapstructure:"id_getter_address"`
+	// IDGetterProtocol selects the id_getter client, either "http", "grpc" or "embedded".
+	// The embedded client assigns ids in process, using the ids db directly.
+	IDGetterProtocol         string        `mapstructure:"id_getter_protocol"`
+	IDGetterAddresses        []string      `mapstructure:"id_getter_addresses"`
+	IDGetterMaxRetries       int           `mapstructure:"id_getter_max_retries"`
+	IDGetterBreakerThreshold int           `mapstructure:"id_getter_breaker_threshold"`
+	IDGetterBreakerCooldown  time.Duration `mapstructure:"id_getter_breaker_cooldown"`
+	// IDGetterWarmUp enables bootstrapping the ids cache from the id_getter snapshot and polling for deltas.
+	IDGetterWarmUp       bool          `mapstructure:"id_getter_warm_up"`
+	IDGetterPollInterval time.Duration `mapstructure:"id_getter_poll_interval"`
+
+	// Embedded ID Getter
+	// IDGetterDBAddresses are addresses of the ids db, required by the embedded client.
+	IDGetterDBAddresses []string `mapstructure:"id_getter_db_addresses"`
+	// IDGetterCollections are preloaded into the cache on warm up.
+	IDGetterCollections                 []string `mapstructure:"id_getter_collections"`
+	IDGetterDefaultMaxCardinality       int      `mapstructure:"id_getter_default_max_cardinality"`
+	IDGetterDefaultOverflowElement      string   `mapstructure:"id_getter_default_overflow_element"`
+	IDGetterCollectionLimitsJSON        string   `mapstructure:"id_getter_collection_limits"`
+	IDGetterCollectionNormalizationJSON string   `mapstructure:"id_getter_collection_normalization"`
+	// IDDictionary is parsed from the embedded id getter options.
+	IDDictionary dictionary.Config `mapstructure:"-"`
 }
 
 func field(name string, defaultValue any) {
@@ -26,14 +131,82 @@ func field(name string, defaultValue any) {
 
 func New() (*Config, error) {
 	field("port", 8080)
+	field("admin_token", "")
 
 	field("log_level", "debug")
 
 	field("kafka_addresses", []string{})
+	field("kafka_num_partitions", 1)
+	field("kafka_replication_factor", 1)
+	field("kafka_null_producer", false)
 	field("db_aggregates_addresses", []string{})
-	field("id_getter_address", "")
+	field("aggregates_set_refresh_interval", 10*time.Second)
+	field("rebuild_progress_interval", 10*time.Second)
+
+	field("num_processors", runtime.NumCPU())
+	field("chan_size", 1024)
+	field("stages", []string{"aggregates", "webhooks", "rules"})
+	field("stage_options", "")
+
+	field("allowed_lateness", 5*time.Minute)
+	field("late_tags_policy", "correction")
+	field("watermark_flush_interval", 5*time.Second)
+
+	field("webhook_refresh_interval", 10*time.Second)
+	field("webhook_timeout", 5*time.Second)
+	field("webhook_max_elapsed_time", time.Minute)
+	field("webhook_delivery_log_limit", 100)
+	field("webhook_outbox_limit", 10000)
+	field("webhook_allow_private_addresses", false)
+
+	field("rules_file", "")
+	field("rules_refresh_interval", 10*time.Second)
+
+	field("archive_dir", "")
+	field("archive_batch_size", 10000)
+	field("archive_flush_interval", time.Minute)
+	field("archive_max_open_files", 24)
+
+	field("id_getter_protocol", IDGetterProtocolHTTP)
+	field("id_getter_addresses", []string{})
+	field("id_getter_max_retries", 2)
+	field("id_getter_breaker_threshold", 5)
+	field("id_getter_breaker_cooldown", 5*time.Second)
+	field("id_getter_warm_up", false)
+	field("id_getter_poll_interval", 30*time.Second)
+
+	field("id_getter_db_addresses", []string{})
+	field("id_getter_collections", []string{"origin", "brand", "category", "country"})
+	field("id_getter_default_max_cardinality", dictionary.DefaultMaxCardinality)
+	field("id_getter_default_overflow_element", dictionary.DefaultOverflowElement)
+	field("id_getter_collection_limits", "")
+	field("id_getter_collection_normalization", "")
 
 	var c Config
 	_ = viper.Unmarshal(&c)
+
+	var err error
+	c.IDDictionary, err = dictionary.ParseConfig(c.IDGetterCollections, c.IDGetterDefaultMaxCardinality,
+		c.IDGetterDefaultOverflowElement, c.IDGetterCollectionLimitsJSON, c.IDGetterCollectionNormalizationJSON)
+	if err != nil {
+		return nil, err
+	}
+	options, err := ParseStageOptions(c.Stages, c.StageOptionsJSON, c.NumProcessors, c.ChanSize)
+	if err != nil {
+		return nil, err
+	}
+	c.StageOptions = options
+	if c.LateTagsPolicy != LateTagsPolicyCorrection && c.LateTagsPolicy != LateTagsPolicyTopic {
+		return nil, fmt.Errorf("unknown late tags policy %s", c.LateTagsPolicy)
+	}
+	if c.IDGetterProtocol != IDGetterProtocolHTTP && c.IDGetterProtocol != IDGetterProtocolGRPC && c.IDGetterProtocol != IDGetterProtocolEmbedded {
+		return nil, fmt.Errorf("unknown id getter protocol %s", c.IDGetterProtocol)
+	}
+	if c.WebhookRefreshInterval <= 0 || c.WebhookOutboxLimit <= 0 {
+		return nil, fmt.Errorf("webhook refresh interval and outbox limit must be positive")
+	}
+	if c.ArchiveDir != "" && (c.ArchiveBatchSize <= 0 || c.ArchiveFlushInterval <= 0 || c.ArchiveMaxOpenFiles <= 0) {
+		return nil, fmt.Errorf("archive batch size, flush interval and max open files must be positive")
+	}
 	return &c, nil
 }
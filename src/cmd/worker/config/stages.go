@@ -0,0 +1,171 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Error policies of stages, applied to tags that still fail after retries.
+const (
+	// ErrorPolicyDrop logs and skips the tag.
+	ErrorPolicyDrop = "drop"
+	// ErrorPolicyRetry retries the tag until it succeeds, ignoring MaxElapsedTime and stalling the stage.
+	ErrorPolicyRetry = "retry"
+	// ErrorPolicyFail stops the worker.
+	ErrorPolicyFail = "fail"
+)
+
+// StageOptions control how a stage of the worker pipeline runs its processor.
+type StageOptions struct {
+	// Concurrency is the number of shards of the stage, each processing its tags in order in a single goroutine.
+	Concurrency int
+	// QueueSize is the number of tags pending processing in each shard, consuming blocks when any of them is full.
+	QueueSize   int
+	ErrorPolicy string
+	// InitialInterval, MaxInterval and MaxElapsedTime configure the exponential backoff of retries.
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+	MaxElapsedTime  time.Duration
+}
+
+// defaultStageOptions returns options of the stage, unless they are overridden. Aggregates only fail if the db is
+// down, hence larger backoff. Webhooks retry storing tags in outboxes until they succeed, as offsets of tags are
+// committed once all stages are done with them.
+func defaultStageOptions(name string, numProcessors int, queueSize int) StageOptions {
+	switch name {
+	case "aggregates":
+		return StageOptions{
+			Concurrency:     numProcessors,
+			QueueSize:       queueSize,
+			ErrorPolicy:     ErrorPolicyDrop,
+			InitialInterval: time.Second,
+			MaxInterval:     300 * time.Second,
+			MaxElapsedTime:  30 * time.Second,
+		}
+	case "webhooks":
+		return StageOptions{
+			Concurrency:     16,
+			QueueSize:       queueSize,
+			ErrorPolicy:     ErrorPolicyRetry,
+			InitialInterval: 500 * time.Millisecond,
+			MaxInterval:     time.Minute,
+			MaxElapsedTime:  time.Minute,
+		}
+	case "rules":
+		return StageOptions{
+			Concurrency:     numProcessors,
+			QueueSize:       queueSize,
+			ErrorPolicy:     ErrorPolicyDrop,
+			InitialInterval: 100 * time.Millisecond,
+			MaxInterval:     5 * time.Second,
+			MaxElapsedTime:  30 * time.Second,
+		}
+	}
+	return StageOptions{
+		Concurrency:     1,
+		QueueSize:       queueSize,
+		ErrorPolicy:     ErrorPolicyDrop,
+		InitialInterval: 500 * time.Millisecond,
+		MaxInterval:     time.Minute,
+		MaxElapsedTime:  time.Minute,
+	}
+}
+
+// stageOptionsJSON overrides the non-empty options of a stage, durations are strings like "30s".
+type stageOptionsJSON struct {
+	Concurrency     int    `json:"concurrency"`
+	QueueSize       int    `json:"queue_size"`
+	ErrorPolicy     string `json:"error_policy"`
+	InitialInterval string `json:"initial_interval"`
+	MaxInterval     string `json:"max_interval"`
+	MaxElapsedTime  string `json:"max_elapsed_time"`
+}
+
+// ParseStageOptions returns options of the stages, defaults overridden by the JSON object keyed by names of stages.
+// Stages default to numProcessors goroutines and queues of queueSize tags.
+func ParseStageOptions(stages []string, raw string, numProcessors int, queueSize int) (map[string]StageOptions, error) {
+	overrides := make(map[string]stageOptionsJSON)
+	if raw != "" {
+		if err := json.Unmarshal([]byte(raw), &overrides); err != nil {
+			return nil, fmt.Errorf("error parsing stage options, %w", err)
+		}
+	}
+	for name := range overrides {
+		if !contains(stages, name) {
+			return nil, fmt.Errorf("options of stage %s which is not in the pipeline", name)
+		}
+	}
+
+	options := make(map[string]StageOptions, len(stages))
+	for _, name := range stages {
+		opts := defaultStageOptions(name, numProcessors, queueSize)
+		if o, ok := overrides[name]; ok {
+			if err := o.apply(&opts); err != nil {
+				return nil, fmt.Errorf("invalid options of stage %s, %w", name, err)
+			}
+		}
+		if err := opts.validate(); err != nil {
+			return nil, fmt.Errorf("invalid options of stage %s, %w", name, err)
+		}
+		options[name] = opts
+	}
+	return options, nil
+}
+
+func (o stageOptionsJSON) apply(opts *StageOptions) error {
+	if o.Concurrency != 0 {
+		opts.Concurrency = o.Concurrency
+	}
+	if o.QueueSize != 0 {
+		opts.QueueSize = o.QueueSize
+	}
+	if o.ErrorPolicy != "" {
+		opts.ErrorPolicy = o.ErrorPolicy
+	}
+	for _, d := range []struct {
+		raw string
+		dst *time.Duration
+	}{
+		{o.InitialInterval, &opts.InitialInterval},
+		{o.MaxInterval, &opts.MaxInterval},
+		{o.MaxElapsedTime, &opts.MaxElapsedTime},
+	} {
+		if d.raw == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.raw)
+		if err != nil {
+			return err
+		}
+		*d.dst = v
+	}
+	return nil
+}
+
+func (o StageOptions) validate() error {
+	switch o.ErrorPolicy {
+	case ErrorPolicyDrop, ErrorPolicyRetry, ErrorPolicyFail:
+	default:
+		return fmt.Errorf("unknown error policy %s", o.ErrorPolicy)
+	}
+	if o.Concurrency < 1 {
+		return fmt.Errorf("concurrency must be positive")
+	}
+	if o.QueueSize < 0 {
+		return fmt.Errorf("queue size must not be negative")
+	}
+	if o.InitialInterval <= 0 || o.MaxInterval < o.InitialInterval {
+		return fmt.Errorf("invalid backoff intervals %s and %s", o.InitialInterval, o.MaxInterval)
+	}
+	return nil
+}
+
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,37 @@
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseStageOptions(t *testing.T) {
+	options, err := ParseStageOptions([]string{"aggregates", "rules", "custom"}, `{"aggregates": {"concurrency": 3, "error_policy": "retry", "max_elapsed_time": "1m"}}`, 8, 100)
+	require.NoError(t, err)
+
+	aggregates := defaultStageOptions("aggregates", 8, 100)
+	aggregates.Concurrency = 3
+	aggregates.ErrorPolicy = ErrorPolicyRetry
+	aggregates.MaxElapsedTime = time.Minute
+	assert.Equal(t, aggregates, options["aggregates"])
+	assert.Equal(t, 8, options["rules"].Concurrency)
+	assert.Equal(t, 100, options["rules"].QueueSize)
+	assert.Equal(t, 1, options["custom"].Concurrency)
+}
+
+func TestParseStageOptionsErrors(t *testing.T) {
+	for _, raw := range []string{
+		`{"webhooks": {}}`,
+		`{"aggregates": {"error_policy": "ignore"}}`,
+		`{"aggregates": {"concurrency": -1}}`,
+		`{"aggregates": {"initial_interval": "1h"}}`,
+		`{"aggregates": {"max_interval": "soon"}}`,
+		`[]`,
+	} {
+		_, err := ParseStageOptions([]string{"aggregates"}, raw, 8, 100)
+		assert.Error(t, err, raw)
+	}
+}
@@ -0,0 +1,85 @@
+// Package egress guards requests the worker sends to urls given through its admin api, like urls of webhooks,
+// against reaching internal services, such as the db or metadata endpoints of the cloud.
+package egress
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+// reservedNetworks are not covered by methods of net.IP, but are not reachable on the internet either.
+var reservedNetworks = []*net.IPNet{
+	mustParseCIDR("0.0.0.0/8"),
+	mustParseCIDR("100.64.0.0/10"),
+	mustParseCIDR("192.0.0.0/24"),
+	mustParseCIDR("198.18.0.0/15"),
+	mustParseCIDR("240.0.0.0/4"),
+	mustParseCIDR("64:ff9b::/96"),
+}
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// IsPublic reports whether ip is a public unicast address.
+func IsPublic(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() || ip.IsMulticast() {
+		return false
+	}
+	for _, n := range reservedNetworks {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// CheckURL returns an error unless rawURL is an absolute http or https url without credentials, whose host is
+// public if it's an ip address. Host names are checked by Dialer, as they may resolve to other addresses by the time
+// requests are sent.
+func CheckURL(rawURL string, allowPrivate bool) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid url, %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("url scheme must be http or https, got %q", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return errors.New("url has no host")
+	}
+	if u.User != nil {
+		return errors.New("url must not have credentials")
+	}
+	if ip := net.ParseIP(u.Hostname()); ip != nil && !allowPrivate && !IsPublic(ip) {
+		return fmt.Errorf("address %s is not public", ip)
+	}
+	return nil
+}
+
+// Dialer returns a dialer refusing to connect to addresses that are not public, unless allowPrivate.
+// Addresses are checked after host names are resolved.
+func Dialer(timeout time.Duration, allowPrivate bool) *net.Dialer {
+	d := &net.Dialer{Timeout: timeout}
+	if !allowPrivate {
+		d.Control = func(_, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !IsPublic(ip) {
+				return fmt.Errorf("address %s is not public", host)
+			}
+			return nil
+		}
+	}
+	return d
+}
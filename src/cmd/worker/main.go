@@ -4,11 +4,14 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"os"
 	"sync"
 	"time"
 
+	"github.com/Shopify/sarama"
 	"go.uber.org/zap"
 
+	"github.com/TomaszDomagala/Allezon/src/cmd/worker/rules"
 	"github.com/TomaszDomagala/Allezon/src/cmd/worker/server"
 	"github.com/TomaszDomagala/Allezon/src/cmd/worker/worker"
 	"github.com/TomaszDomagala/Allezon/src/pkg/db"
@@ -28,16 +31,63 @@ func main() {
 	if err != nil {
 		panic(fmt.Errorf("failed to create logger: %w", err))
 	}
+	aggClient, err := db.NewClientFromAddresses(logger, conf.DBAggregatesAddresses...)
+	if err != nil {
+		logger.Fatal("Error while creating database client", zap.Error(err))
+	}
+	getter := newIDGetter(conf, logger)
+
+	if len(os.Args) > 1 && os.Args[1] == "rebuild" {
+		rebuildMain(conf, logger, aggClient, getter, os.Args[2:])
+		return
+	}
+	if err := aggClient.AggregatesSets().Follow(context.Background(), conf.AggregatesSetRefreshInterval); err != nil {
+		logger.Fatal("Error while loading active aggregates set", zap.Error(err))
+	}
+
 	consumer, err := messaging.NewConsumer(logger, conf.KafkaAddresses)
 	if err != nil {
 		logger.Fatal("Error while creating producer", zap.Error(err))
 	}
 
-	aggClient, err := db.NewClientFromAddresses(logger, conf.DBAggregatesAddresses...)
-	if err != nil {
-		logger.Fatal("Error while creating database client", zap.Error(err))
+	var producer messaging.MessageProducer
+	if conf.KafkaNullProducer {
+		logger.Info("Using null producer")
+		producer = messaging.NewNullMessageProducer(logger)
+	} else {
+		topics := []string{messaging.RuleMatchesTopic}
+		if conf.AllowedLateness > 0 && conf.LateTagsPolicy == config.LateTagsPolicyTopic {
+			topics = append(topics, messaging.LateUserTagsTopic)
+		}
+		for _, topic := range topics {
+			err = messaging.InitializeTopic(logger, conf.KafkaAddresses, topic, &sarama.TopicDetail{
+				NumPartitions:     conf.KafkaNumPartitions,
+				ReplicationFactor: conf.KafkaReplicationFactor,
+			})
+			if err != nil {
+				logger.Fatal("Error while initializing topic", zap.String("topic", topic), zap.Error(err))
+			}
+		}
+		producer, err = messaging.NewProducer(logger, conf.KafkaAddresses)
+		if err != nil {
+			logger.Fatal("Error while creating producer", zap.Error(err))
+		}
+	}
+
+	if conf.RulesFile != "" {
+		loaded, err := rules.LoadFile(conf.RulesFile, aggClient.Rules())
+		if err != nil {
+			logger.Fatal("Error while loading rules", zap.Error(err))
+		}
+		logger.Info("Rules loaded", zap.String("file", conf.RulesFile), zap.Int("rules", len(loaded)))
+	}
+	var archiveConsumer worker.ArchiveConsumer
+	if conf.ArchiveDir != "" {
+		archiveConsumer, err = messaging.NewGroupConsumer(logger, conf.KafkaAddresses, messaging.UserTagsArchiveGroup)
+		if err != nil {
+			logger.Fatal("Error while creating archive consumer", zap.Error(err))
+		}
 	}
-	getter := idGetter.NewClient(http.Client{Timeout: 5 * time.Second}, conf.IDGetterAddress, logger)
 
 	var wg sync.WaitGroup
 	wg.Add(2)
@@ -45,12 +95,19 @@ func main() {
 	go func() {
 		defer wg.Done()
 
-		wrk := worker.New(worker.Dependencies{
-			Logger:       logger,
-			Consumer:     consumer,
-			AggregatesDB: aggClient,
-			IDGetter:     getter,
+		wrk, err := worker.New(worker.Dependencies{
+			Cfg:             conf,
+			Logger:          logger,
+			Consumer:        consumer,
+			Producer:        producer,
+			AggregatesDB:    aggClient,
+			IDGetter:        getter,
+			ArchiveConsumer: archiveConsumer,
 		})
+		if err != nil {
+			logger.Fatal("Error while creating a worker", zap.Error(err))
+		}
+		worker.PublishStats("worker_stages", wrk)
 
 		if err := wrk.Run(context.Background()); err != nil {
 			logger.Fatal("Error while running a worker", zap.Error(err))
@@ -61,8 +118,13 @@ func main() {
 		defer wg.Done()
 
 		srv := server.New(server.Dependencies{
-			Logger: logger,
-			Port:   conf.Port,
+			Logger:               logger,
+			Port:                 conf.Port,
+			AdminToken:           conf.AdminToken,
+			AllowPrivateWebhooks: conf.WebhookAllowPrivateAddresses,
+			Webhooks:             aggClient.Webhooks(),
+			Rules:                aggClient.Rules(),
+			AggregatesSets:       aggClient.AggregatesSets(),
 		})
 
 		if err := srv.Run(); err != nil {
@@ -72,3 +134,37 @@ func main() {
 
 	wg.Wait()
 }
+
+func newIDGetter(conf *config.Config, logger *zap.Logger) idGetter.Client {
+	var getter idGetter.Client
+	var err error
+	policy := idGetter.DefaultPolicy()
+	policy.MaxRetries = conf.IDGetterMaxRetries
+	policy.BreakerThreshold = conf.IDGetterBreakerThreshold
+	policy.BreakerCooldown = conf.IDGetterBreakerCooldown
+	switch conf.IDGetterProtocol {
+	case config.IDGetterProtocolEmbedded:
+		logger.Info("Using embedded id getter client", zap.Strings("db_addresses", conf.IDGetterDBAddresses))
+		getter, err = idGetter.NewEmbeddedClientFromAddresses(conf.IDDictionary, logger, conf.IDGetterDBAddresses...)
+		if err != nil {
+			logger.Fatal("Error while creating embedded id getter client", zap.Error(err))
+		}
+	case config.IDGetterProtocolGRPC:
+		logger.Info("Using id getter grpc client", zap.Strings("addresses", conf.IDGetterAddresses))
+		getter, err = idGetter.NewGRPCClient(conf.IDGetterAddresses, 5*time.Second, policy, logger)
+		if err != nil {
+			logger.Fatal("Error while creating id getter grpc client", zap.Error(err))
+		}
+	default: // config.IDGetterProtocolHTTP, other protocols are rejected by config.New.
+		logger.Info("Using id getter client", zap.Strings("addresses", conf.IDGetterAddresses))
+		getter = idGetter.NewClient(http.Client{Timeout: 5 * time.Second}, conf.IDGetterAddresses, policy, logger)
+		idGetter.PublishStats("id_getter_client", getter)
+	}
+	if w, ok := getter.(idGetter.Warmer); ok && conf.IDGetterWarmUp {
+		if err := w.WarmUp(); err != nil {
+			logger.Warn("Error while warming up id getter cache", zap.Error(err))
+		}
+		go w.PollDeltas(context.Background(), conf.IDGetterPollInterval)
+	}
+	return getter
+}
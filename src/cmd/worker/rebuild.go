@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"go.uber.org/zap"
+
+	"github.com/TomaszDomagala/Allezon/src/cmd/worker/config"
+	"github.com/TomaszDomagala/Allezon/src/cmd/worker/worker"
+	"github.com/TomaszDomagala/Allezon/src/pkg/db"
+	"github.com/TomaszDomagala/Allezon/src/pkg/idGetter"
+	"github.com/TomaszDomagala/Allezon/src/pkg/messaging"
+)
+
+// rebuildMain runs the rebuild command, replaying the user tags topic into a shadow set of aggregates:
+//
+//	worker rebuild -set aggregates_v2 -from 2022-03-01T00:00:00Z -switch
+func rebuildMain(conf *config.Config, logger *zap.Logger, aggClient db.Client, getter idGetter.Client, args []string) {
+	flags := flag.NewFlagSet("rebuild", flag.ExitOnError)
+	set := flags.String("set", "", "shadow set of aggregates to rebuild, named "+db.ShadowAggregatesSetPrefix+"<name>, it's cleared first and must not be active")
+	from := flags.String("from", "", "start of the replayed range, an RFC3339 time or partition:offset pairs separated by commas, the oldest offsets by default")
+	to := flags.String("to", "", "exclusive end of the replayed range, like -from, the newest offsets by default")
+	doSwitch := flags.Bool("switch", false, "make the set active once the rebuild is done")
+	_ = flags.Parse(args)
+
+	opts := worker.RebuildOptions{Set: *set, Switch: *doSwitch, ProgressInterval: conf.RebuildProgressInterval}
+	var err error
+	if opts.From, err = worker.ParseBound(*from); err != nil {
+		logger.Fatal("Error while parsing start of the range", zap.Error(err))
+	}
+	if opts.To, err = worker.ParseBound(*to); err != nil {
+		logger.Fatal("Error while parsing end of the range", zap.Error(err))
+	}
+
+	replayer, err := messaging.NewReplayer(logger, conf.KafkaAddresses, messaging.UserTagsReplayGroupPrefix+opts.Set)
+	if err != nil {
+		logger.Fatal("Error while creating replayer", zap.Error(err))
+	}
+	defer replayer.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	progress, err := worker.Rebuild(ctx, worker.RebuildDependencies{
+		Cfg:          conf,
+		Logger:       logger,
+		Replayer:     replayer,
+		AggregatesDB: aggClient,
+		IDGetter:     getter,
+	}, opts)
+	if err != nil {
+		logger.Fatal("Error while rebuilding aggregates", zap.Error(err))
+	}
+	logger.Info("Aggregates rebuilt", zap.String("set", progress.Set), zap.Uint64("tags", progress.Tags), zap.Bool("switched", progress.Switched))
+}
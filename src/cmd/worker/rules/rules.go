@@ -0,0 +1,243 @@
+// Package rules evaluates declarative rules over sliding windows of tags of cookies.
+package rules
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/TomaszDomagala/Allezon/src/pkg/db"
+	"github.com/TomaszDomagala/Allezon/src/pkg/dto"
+	"github.com/TomaszDomagala/Allezon/src/pkg/types"
+)
+
+// Fields of products that rules can group tags by.
+const (
+	GroupByProduct  = "product_id"
+	GroupByBrand    = "brand_id"
+	GroupByCategory = "category_id"
+)
+
+// Rule matches a tag of Action that makes the number of such tags of the cookie in the Window ending at it reach
+// Count. It's evaluated when the tag arrives, so it matches at most once until older tags leave the window.
+type Rule struct {
+	Id     string
+	Action types.Action
+	// GroupBy restricts counted tags to the ones with the same product field as the tag, empty counts all tags.
+	GroupBy string
+	Count   int
+	Window  time.Duration
+	// Without suppresses the match if the window holds a tag of this action of the same group.
+	Without *types.Action
+}
+
+// Match is a tag of Cookie which matched the rule, Tags are the counted tags, the matching one included.
+type Match struct {
+	RuleId string
+	Cookie string
+	Time   time.Time
+	Group  string
+	Tags   []types.UserTag
+}
+
+// Evaluate checks whether tag matches the rule. Window holds tags of the cookie of tag, the tag included,
+// from at least r.Window before it.
+func (r Rule) Evaluate(tag types.UserTag, window []types.UserTag) (Match, bool) {
+	if tag.Action != r.Action {
+		return Match{}, false
+	}
+	group := groupOf(r.GroupBy, tag)
+	start := tag.Time.Add(-r.Window)
+	var counted []types.UserTag
+	for _, t := range window {
+		if !t.Time.After(start) || t.Time.After(tag.Time) || groupOf(r.GroupBy, t) != group {
+			continue
+		}
+		if r.Without != nil && t.Action == *r.Without {
+			return Match{}, false
+		}
+		if t.Action == r.Action {
+			counted = append(counted, t)
+		}
+	}
+	if len(counted) != r.Count {
+		return Match{}, false
+	}
+	return Match{RuleId: r.Id, Cookie: tag.Cookie, Time: tag.Time, Group: group, Tags: counted}, true
+}
+
+func groupOf(groupBy string, tag types.UserTag) string {
+	switch groupBy {
+	case GroupByProduct:
+		return strconv.Itoa(tag.ProductInfo.ProductId)
+	case GroupByBrand:
+		return tag.ProductInfo.BrandId
+	case GroupByCategory:
+		return tag.ProductInfo.CategoryId
+	}
+	return ""
+}
+
+// Set is an immutable set of rules, evaluated together over the same windows.
+type Set struct {
+	rules  []Rule
+	window time.Duration
+}
+
+// NewSet returns the set of rules sorted by their ids.
+func NewSet(rules []Rule) *Set {
+	s := &Set{rules: append([]Rule(nil), rules...)}
+	sort.Slice(s.rules, func(i, j int) bool { return s.rules[i].Id < s.rules[j].Id })
+	for _, r := range rules {
+		if r.Window > s.window {
+			s.window = r.Window
+		}
+	}
+	return s
+}
+
+func (s *Set) Rules() []Rule {
+	return s.rules
+}
+
+// Window is the longest window of rules of the set.
+func (s *Set) Window() time.Duration {
+	return s.window
+}
+
+// Evaluate returns matches of tag by all rules of the set.
+func (s *Set) Evaluate(tag types.UserTag, window []types.UserTag) []Match {
+	var matches []Match
+	for _, r := range s.rules {
+		if m, ok := r.Evaluate(tag, window); ok {
+			matches = append(matches, m)
+		}
+	}
+	return matches
+}
+
+// FromDTO converts and validates the rule.
+func FromDTO(d dto.RuleDTO) (Rule, error) {
+	if d.Id == "" {
+		return Rule{}, fmt.Errorf("rule without id")
+	}
+	action, err := dto.ToAction(d.Action)
+	if err != nil {
+		return Rule{}, fmt.Errorf("invalid action of rule %s, %w", d.Id, err)
+	}
+	switch d.GroupBy {
+	case "", GroupByProduct, GroupByBrand, GroupByCategory:
+	default:
+		return Rule{}, fmt.Errorf("invalid group_by of rule %s: %s", d.Id, d.GroupBy)
+	}
+	if d.Count < 1 {
+		return Rule{}, fmt.Errorf("count of rule %s must be positive", d.Id)
+	}
+	window, err := time.ParseDuration(d.Window)
+	if err != nil {
+		return Rule{}, fmt.Errorf("invalid window of rule %s, %w", d.Id, err)
+	}
+	if window <= 0 {
+		return Rule{}, fmt.Errorf("window of rule %s must be positive", d.Id)
+	}
+	r := Rule{Id: d.Id, Action: action, GroupBy: d.GroupBy, Count: d.Count, Window: window}
+	if d.Without != "" {
+		without, err := dto.ToAction(d.Without)
+		if err != nil {
+			return Rule{}, fmt.Errorf("invalid without of rule %s, %w", d.Id, err)
+		}
+		if without == action {
+			return Rule{}, fmt.Errorf("rule %s counts tags of the action it's suppressed by", d.Id)
+		}
+		r.Without = &without
+	}
+	return r, nil
+}
+
+func IntoDTO(r Rule) dto.RuleDTO {
+	d := dto.RuleDTO{
+		Id:      r.Id,
+		Action:  r.Action.String(),
+		GroupBy: r.GroupBy,
+		Count:   r.Count,
+		Window:  r.Window.String(),
+	}
+	if r.Without != nil {
+		d.Without = r.Without.String()
+	}
+	return d
+}
+
+func IntoMatchDTO(m Match) dto.RuleMatchDTO {
+	tags := make([]dto.UserTagDTO, len(m.Tags))
+	for i, t := range m.Tags {
+		tags[i] = dto.IntoUserTagDTO(t)
+	}
+	return dto.RuleMatchDTO{
+		RuleId: m.RuleId,
+		Cookie: m.Cookie,
+		Time:   m.Time.Format(dto.UserTagTimeLayout),
+		Group:  m.Group,
+		Tags:   tags,
+	}
+}
+
+// Marshal encodes the rule as its definition stored in the db.
+func Marshal(r Rule) ([]byte, error) {
+	definition, err := json.Marshal(IntoDTO(r))
+	if err != nil {
+		return nil, fmt.Errorf("error marshalling rule %s, %w", r.Id, err)
+	}
+	return definition, nil
+}
+
+// Unmarshal decodes the definition of a rule stored in the db.
+func Unmarshal(definition []byte) (Rule, error) {
+	var d dto.RuleDTO
+	if err := json.Unmarshal(definition, &d); err != nil {
+		return Rule{}, fmt.Errorf("error unmarshalling rule %s, %w", string(definition), err)
+	}
+	return FromDTO(d)
+}
+
+// Parse parses a JSON array of rules, like the contents of a rules file.
+func Parse(data []byte) ([]Rule, error) {
+	var ds []dto.RuleDTO
+	if err := json.Unmarshal(data, &ds); err != nil {
+		return nil, fmt.Errorf("error unmarshalling rules, %w", err)
+	}
+	rules := make([]Rule, len(ds))
+	for i, d := range ds {
+		r, err := FromDTO(d)
+		if err != nil {
+			return nil, err
+		}
+		rules[i] = r
+	}
+	return rules, nil
+}
+
+// LoadFile puts rules from the file into the db, replacing rules with the same ids.
+func LoadFile(path string, store db.RuleClient) ([]Rule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading rules file %s, %w", path, err)
+	}
+	rules, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing rules file %s, %w", path, err)
+	}
+	for _, r := range rules {
+		definition, err := Marshal(r)
+		if err != nil {
+			return nil, err
+		}
+		if err := store.Put(r.Id, definition); err != nil {
+			return nil, err
+		}
+	}
+	return rules, nil
+}
@@ -0,0 +1,107 @@
+package rules
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/TomaszDomagala/Allezon/src/pkg/types"
+)
+
+func TestRuleEvaluate(t *testing.T) {
+	rules, err := Parse([]byte(`[{"id": "views-without-buy", "action": "VIEW", "group_by": "category_id", "count": 3, "window": "10m", "without": "BUY"}]`))
+	require.NoError(t, err)
+	require.Len(t, rules, 1)
+	rule := rules[0]
+
+	t0 := time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC)
+	tag := func(minute int, action types.Action, category string) types.UserTag {
+		return types.UserTag{
+			Time:        t0.Add(time.Duration(minute) * time.Minute),
+			Cookie:      "cookie",
+			Action:      action,
+			ProductInfo: types.ProductInfo{ProductId: minute, CategoryId: category},
+		}
+	}
+
+	tests := []struct {
+		name   string
+		window []types.UserTag
+		match  bool
+	}{
+		{
+			name:   "three views of the same category",
+			window: []types.UserTag{tag(0, types.View, "a"), tag(1, types.View, "b"), tag(5, types.View, "a"), tag(9, types.View, "a")},
+			match:  true,
+		},
+		{
+			name:   "views of other categories are not counted",
+			window: []types.UserTag{tag(0, types.View, "b"), tag(5, types.View, "a"), tag(9, types.View, "a")},
+		},
+		{
+			name:   "views out of the window are not counted",
+			window: []types.UserTag{tag(-1, types.View, "a"), tag(5, types.View, "a"), tag(9, types.View, "a")},
+		},
+		{
+			name:   "buy of the same category suppresses the match",
+			window: []types.UserTag{tag(0, types.View, "a"), tag(3, types.Buy, "a"), tag(5, types.View, "a"), tag(9, types.View, "a")},
+		},
+		{
+			name:   "buy of another category doesn't suppress the match",
+			window: []types.UserTag{tag(0, types.View, "a"), tag(3, types.Buy, "b"), tag(5, types.View, "a"), tag(9, types.View, "a")},
+			match:  true,
+		},
+		{
+			name:   "rule matches once, when the count is reached",
+			window: []types.UserTag{tag(0, types.View, "a"), tag(2, types.View, "a"), tag(5, types.View, "a"), tag(9, types.View, "a")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			current := tt.window[len(tt.window)-1]
+			m, ok := rule.Evaluate(current, tt.window)
+			assert.Equal(t, tt.match, ok)
+			if ok {
+				assert.Equal(t, Match{
+					RuleId: "views-without-buy",
+					Cookie: "cookie",
+					Time:   current.Time,
+					Group:  "a",
+					Tags:   []types.UserTag{tt.window[0], tt.window[len(tt.window)-2], current},
+				}, m)
+			}
+		})
+	}
+}
+
+func TestFromDTOValidation(t *testing.T) {
+	for _, definition := range []string{
+		`[{"id": "", "action": "VIEW", "count": 1, "window": "1m"}]`,
+		`[{"id": "a", "action": "CLICK", "count": 1, "window": "1m"}]`,
+		`[{"id": "a", "action": "VIEW", "group_by": "price", "count": 1, "window": "1m"}]`,
+		`[{"id": "a", "action": "VIEW", "count": 0, "window": "1m"}]`,
+		`[{"id": "a", "action": "VIEW", "count": 1, "window": "-1m"}]`,
+		`[{"id": "a", "action": "VIEW", "count": 1, "window": "1m", "without": "VIEW"}]`,
+	} {
+		_, err := Parse([]byte(definition))
+		assert.Error(t, err, definition)
+	}
+}
+
+func TestMarshalRoundTrip(t *testing.T) {
+	buy := types.Buy
+	rule := Rule{Id: "a", Action: types.View, GroupBy: GroupByBrand, Count: 2, Window: 90 * time.Second, Without: &buy}
+	definition, err := Marshal(rule)
+	require.NoError(t, err)
+	res, err := Unmarshal(definition)
+	require.NoError(t, err)
+	assert.Equal(t, rule, res)
+}
+
+func TestSetWindow(t *testing.T) {
+	s := NewSet([]Rule{{Id: "b", Window: time.Minute}, {Id: "a", Window: time.Hour}})
+	assert.Equal(t, time.Hour, s.Window())
+	assert.Equal(t, "a", s.Rules()[0].Id)
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"github.com/TomaszDomagala/Allezon/src/pkg/db"
+	"github.com/TomaszDomagala/Allezon/src/pkg/dto"
+)
+
+func (s server) activeAggregatesSetHandler(c *gin.Context) {
+	set, err := s.aggregatesSets.Active()
+	if err != nil {
+		_ = c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, dto.AggregatesSetDTO{Set: set})
+}
+
+// switchAggregatesSetHandler makes the set active. Only the default set and shadow sets with a finished rebuild can
+// be switched to, so it also rolls back to the default set. Replicas pick the set up when they reload the active one,
+// tags the worker consumes until then and since the end of the rebuild are missing from the set.
+func (s server) switchAggregatesSetHandler(c *gin.Context) {
+	var req dto.AggregatesSetDTO
+	if err := c.BindJSON(&req); err != nil {
+		_ = c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	if req.Set != db.DefaultAggregatesSet {
+		if err := db.CheckShadowAggregatesSet(req.Set); err != nil {
+			_ = c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+		progress, err := s.aggregatesSets.Progress(req.Set)
+		if errors.Is(err, db.KeyNotFoundError) {
+			_ = c.AbortWithError(http.StatusConflict, fmt.Errorf("set %s was never rebuilt", req.Set))
+			return
+		}
+		if err != nil {
+			_ = c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		if !progress.Done {
+			_ = c.AbortWithError(http.StatusConflict, fmt.Errorf("rebuild of set %s is not done", req.Set))
+			return
+		}
+	}
+	if err := s.aggregatesSets.Switch(req.Set); err != nil {
+		_ = c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	s.logger.Info("aggregates set switched", zap.String("set", req.Set))
+	c.JSON(http.StatusOK, req)
+}
+
+func (s server) aggregatesRebuildHandler(c *gin.Context) {
+	progress, err := s.aggregatesSets.Progress(c.Param("set"))
+	if err != nil {
+		_ = c.AbortWithError(dbErrorStatus(err), err)
+		return
+	}
+	c.JSON(http.StatusOK, dto.AggregatesRebuildDTO{
+		Set:       progress.Set,
+		Offsets:   progress.Offsets,
+		Ends:      progress.Ends,
+		Tags:      progress.Tags,
+		StartedAt: progress.StartedAt.Format(dto.UserTagTimeLayout),
+		UpdatedAt: progress.UpdatedAt.Format(dto.UserTagTimeLayout),
+		Done:      progress.Done,
+		Switched:  progress.Switched,
+	})
+}
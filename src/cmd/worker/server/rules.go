@@ -0,0 +1,68 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"github.com/TomaszDomagala/Allezon/src/cmd/worker/rules"
+	"github.com/TomaszDomagala/Allezon/src/pkg/dto"
+)
+
+// putRuleHandler creates the rule or replaces the one with the same id.
+func (s server) putRuleHandler(c *gin.Context) {
+	var req dto.RuleDTO
+	if err := c.BindJSON(&req); err != nil {
+		_ = c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	rule, err := rules.FromDTO(req)
+	if err != nil {
+		_ = c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	definition, err := rules.Marshal(rule)
+	if err != nil {
+		_ = c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	if err := s.rules.Put(rule.Id, definition); err != nil {
+		_ = c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	s.logger.Info("rule saved", zap.String("id", rule.Id))
+	c.JSON(http.StatusCreated, rules.IntoDTO(rule))
+}
+
+func (s server) listRulesHandler(c *gin.Context) {
+	definitions, err := s.rules.List()
+	if err != nil {
+		_ = c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	var rs []rules.Rule
+	for _, definition := range definitions {
+		r, err := rules.Unmarshal(definition)
+		if err != nil {
+			_ = c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		rs = append(rs, r)
+	}
+	sorted := rules.NewSet(rs).Rules()
+	resp := make([]dto.RuleDTO, len(sorted))
+	for i, r := range sorted {
+		resp[i] = rules.IntoDTO(r)
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s server) deleteRuleHandler(c *gin.Context) {
+	if err := s.rules.Delete(c.Param("id")); err != nil {
+		_ = c.AbortWithError(dbErrorStatus(err), err)
+		return
+	}
+	s.logger.Info("rule deleted", zap.String("id", c.Param("id")))
+	c.Status(http.StatusNoContent)
+}
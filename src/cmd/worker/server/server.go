@@ -1,14 +1,20 @@
 package server
 
 import (
+	"crypto/subtle"
+	"errors"
+	"expvar"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"go.uber.org/zap"
 
 	ginzap "github.com/gin-contrib/zap"
+
+	"github.com/TomaszDomagala/Allezon/src/pkg/db"
 )
 
 type Server interface {
@@ -18,12 +24,24 @@ type Server interface {
 type Dependencies struct {
 	Logger *zap.Logger
 	Port   int
+	// AdminToken is the bearer token required by all routes but health and metrics, which are rejected if it's empty.
+	AdminToken string
+	// AllowPrivateWebhooks allows urls of webhooks with private, loopback and link-local addresses.
+	AllowPrivateWebhooks bool
+	Webhooks             db.WebhookClient
+	Rules                db.RuleClient
+	AggregatesSets       db.AggregatesSetClient
 }
 
 type server struct {
-	logger *zap.Logger
-	engine *gin.Engine
-	port   int
+	logger               *zap.Logger
+	engine               *gin.Engine
+	port                 int
+	adminToken           string
+	allowPrivateWebhooks bool
+	webhooks             db.WebhookClient
+	rules                db.RuleClient
+	aggregatesSets       db.AggregatesSetClient
 }
 
 func (s server) Run() error {
@@ -35,15 +53,56 @@ func (s server) health(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"status": "ok"})
 }
 
+// authorize lets requests through only with the admin token as their bearer token.
+func (s server) authorize(c *gin.Context) {
+	if s.adminToken == "" {
+		_ = c.AbortWithError(http.StatusForbidden, errors.New("admin api is disabled, admin token is not set"))
+		return
+	}
+	header := c.GetHeader("Authorization")
+	token := strings.TrimPrefix(header, "Bearer ")
+	if token == header || subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) != 1 {
+		c.Header("WWW-Authenticate", "Bearer")
+		_ = c.AbortWithError(http.StatusUnauthorized, errors.New("invalid admin token"))
+		return
+	}
+}
+
 func New(deps Dependencies) Server {
 	router := gin.New()
 
 	router.Use(ginzap.Ginzap(deps.Logger, time.RFC3339, true))
 	router.Use(ginzap.RecoveryWithZap(deps.Logger, true))
 
-	s := server{engine: router, logger: deps.Logger, port: deps.Port}
+	s := server{
+		engine:               router,
+		logger:               deps.Logger,
+		port:                 deps.Port,
+		adminToken:           deps.AdminToken,
+		allowPrivateWebhooks: deps.AllowPrivateWebhooks,
+		webhooks:             deps.Webhooks,
+		rules:                deps.Rules,
+		aggregatesSets:       deps.AggregatesSets,
+	}
 
 	router.GET("/health", s.health)
+	router.GET("/debug/vars", gin.WrapH(expvar.Handler()))
+
+	admin := router.Group("/", s.authorize)
+
+	admin.POST("/webhooks", s.createWebhookHandler)
+	admin.GET("/webhooks", s.listWebhooksHandler)
+	admin.GET("/webhooks/:id", s.getWebhookHandler)
+	admin.DELETE("/webhooks/:id", s.deleteWebhookHandler)
+	admin.GET("/webhooks/:id/deliveries", s.webhookDeliveriesHandler)
+
+	admin.POST("/rules", s.putRuleHandler)
+	admin.GET("/rules", s.listRulesHandler)
+	admin.DELETE("/rules/:id", s.deleteRuleHandler)
+
+	admin.GET("/aggregates/active", s.activeAggregatesSetHandler)
+	admin.PUT("/aggregates/active", s.switchAggregatesSetHandler)
+	admin.GET("/aggregates/rebuilds/:set", s.aggregatesRebuildHandler)
 
 	return s
 }
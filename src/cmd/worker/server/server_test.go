@@ -0,0 +1,66 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/TomaszDomagala/Allezon/src/pkg/db"
+)
+
+func newTestServer(adminToken string) server {
+	client := db.NewNullClient(zap.NewNop())
+	return New(Dependencies{
+		Logger:         zap.NewNop(),
+		AdminToken:     adminToken,
+		Webhooks:       client.Webhooks(),
+		Rules:          client.Rules(),
+		AggregatesSets: client.AggregatesSets(),
+	}).(server)
+}
+
+func serve(s server, method, path, token, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	s.engine.ServeHTTP(w, req)
+	return w
+}
+
+func TestAdminToken(t *testing.T) {
+	s := newTestServer("token")
+	assert.Equal(t, http.StatusOK, serve(s, http.MethodGet, "/health", "", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, serve(s, http.MethodGet, "/webhooks", "", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, serve(s, http.MethodGet, "/webhooks", "wrong", "").Code)
+	assert.Equal(t, http.StatusOK, serve(s, http.MethodGet, "/webhooks", "token", "").Code)
+
+	disabled := newTestServer("")
+	assert.Equal(t, http.StatusForbidden, serve(disabled, http.MethodGet, "/rules", "", "").Code)
+}
+
+func TestCreateWebhookRejectsPrivateAddresses(t *testing.T) {
+	s := newTestServer("token")
+	for _, url := range []string{"http://169.254.169.254/latest/meta-data", "http://127.0.0.1:3000", "file:///etc/passwd"} {
+		w := serve(s, http.MethodPost, "/webhooks", "token", `{"url": "`+url+`"}`)
+		assert.Equal(t, http.StatusBadRequest, w.Code, url)
+	}
+	w := serve(s, http.MethodPost, "/webhooks", "token", `{"url": "https://example.com/hook"}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+}
+
+func TestSwitchAggregatesSetRejectsOtherSets(t *testing.T) {
+	s := newTestServer("token")
+	w := serve(s, http.MethodPut, "/aggregates/active", "token", `{"set": "user_profiles"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	// The null client has no rebuilds.
+	w = serve(s, http.MethodPut, "/aggregates/active", "token", `{"set": "aggregates_v2"}`)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	w = serve(s, http.MethodPut, "/aggregates/active", "token", `{"set": "aggregates"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"github.com/TomaszDomagala/Allezon/src/cmd/worker/egress"
+	"github.com/TomaszDomagala/Allezon/src/pkg/db"
+	"github.com/TomaszDomagala/Allezon/src/pkg/dto"
+)
+
+func (s server) createWebhookHandler(c *gin.Context) {
+	var req dto.WebhookSubscriptionRequestDTO
+	if err := c.BindJSON(&req); err != nil {
+		_ = c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	if err := egress.CheckURL(req.Url, s.allowPrivateWebhooks); err != nil {
+		_ = c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	filter, err := fromWebhookFilterDTO(req.Filter)
+	if err != nil {
+		_ = c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	id, err := randomHex(16)
+	if err != nil {
+		_ = c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	secret := req.Secret
+	if secret == "" {
+		if secret, err = randomHex(32); err != nil {
+			_ = c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	sub := db.WebhookSubscription{
+		Id:        id,
+		Url:       req.Url,
+		Secret:    secret,
+		Filter:    filter,
+		CreatedAt: time.Now().UTC(),
+	}
+	if err := s.webhooks.Put(sub); err != nil {
+		_ = c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	s.logger.Info("webhook subscription created", zap.String("id", sub.Id), zap.String("url", sub.Url))
+
+	resp := intoWebhookSubscriptionDTO(sub)
+	resp.Secret = sub.Secret
+	c.JSON(http.StatusCreated, resp)
+}
+
+func (s server) listWebhooksHandler(c *gin.Context) {
+	subs, err := s.webhooks.List()
+	if err != nil {
+		_ = c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	resp := make([]dto.WebhookSubscriptionDTO, len(subs))
+	for i, sub := range subs {
+		resp[i] = intoWebhookSubscriptionDTO(sub)
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s server) getWebhookHandler(c *gin.Context) {
+	sub, err := s.webhooks.Get(c.Param("id"))
+	if err != nil {
+		_ = c.AbortWithError(dbErrorStatus(err), err)
+		return
+	}
+	c.JSON(http.StatusOK, intoWebhookSubscriptionDTO(sub))
+}
+
+func (s server) deleteWebhookHandler(c *gin.Context) {
+	if err := s.webhooks.Delete(c.Param("id")); err != nil {
+		_ = c.AbortWithError(dbErrorStatus(err), err)
+		return
+	}
+	s.logger.Info("webhook subscription deleted", zap.String("id", c.Param("id")))
+	c.Status(http.StatusNoContent)
+}
+
+func (s server) webhookDeliveriesHandler(c *gin.Context) {
+	if _, err := s.webhooks.Get(c.Param("id")); err != nil {
+		_ = c.AbortWithError(dbErrorStatus(err), err)
+		return
+	}
+	deliveries, err := s.webhooks.Deliveries(c.Param("id"))
+	if err != nil {
+		_ = c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	resp := make([]dto.WebhookDeliveryDTO, len(deliveries))
+	for i, d := range deliveries {
+		resp[i] = dto.WebhookDeliveryDTO{
+			Id:         d.Id,
+			Time:       d.Time.Format(dto.UserTagTimeLayout),
+			Cookie:     d.Cookie,
+			StatusCode: d.StatusCode,
+			Attempts:   d.Attempts,
+			Error:      d.Error,
+		}
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func dbErrorStatus(err error) int {
+	if errors.Is(err, db.KeyNotFoundError) {
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+func fromWebhookFilterDTO(f dto.WebhookFilterDTO) (db.WebhookFilter, error) {
+	filter := db.WebhookFilter{
+		ProductIds:  f.ProductIds,
+		BrandIds:    f.BrandIds,
+		CategoryIds: f.CategoryIds,
+		MinPrice:    f.MinPrice,
+		MaxPrice:    f.MaxPrice,
+	}
+	for _, a := range f.Actions {
+		action, err := dto.ToAction(a)
+		if err != nil {
+			return db.WebhookFilter{}, err
+		}
+		filter.Actions = append(filter.Actions, action)
+	}
+	return filter, nil
+}
+
+// intoWebhookSubscriptionDTO converts the subscription without its secret.
+func intoWebhookSubscriptionDTO(sub db.WebhookSubscription) dto.WebhookSubscriptionDTO {
+	var actions []string
+	for _, a := range sub.Filter.Actions {
+		actions = append(actions, a.String())
+	}
+	return dto.WebhookSubscriptionDTO{
+		Id:  sub.Id,
+		Url: sub.Url,
+		Filter: dto.WebhookFilterDTO{
+			Actions:     actions,
+			ProductIds:  sub.Filter.ProductIds,
+			BrandIds:    sub.Filter.BrandIds,
+			CategoryIds: sub.Filter.CategoryIds,
+			MinPrice:    sub.Filter.MinPrice,
+			MaxPrice:    sub.Filter.MaxPrice,
+		},
+		CreatedAt: sub.CreatedAt.Format(dto.UserTagTimeLayout),
+	}
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("error generating random id, %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -1,80 +1,62 @@
 package worker
 
 import (
+	"context"
 	"fmt"
 	"time"
 
-	"github.com/cenkalti/backoff/v4"
-	"go.uber.org/zap"
-
+	"github.com/TomaszDomagala/Allezon/src/cmd/id_getter/api"
 	"github.com/TomaszDomagala/Allezon/src/pkg/db"
 	"github.com/TomaszDomagala/Allezon/src/pkg/idGetter"
 	"github.com/TomaszDomagala/Allezon/src/pkg/types"
 )
 
-// aggregatesBackoff is a backoff strategy used to update aggregates.
-// aggregates only fail if db is down hence larger backoff.
-var aggregatesBackoff = backoff.ExponentialBackOff{
-	InitialInterval:     1 * time.Second,
-	RandomizationFactor: backoff.DefaultRandomizationFactor,
-	Multiplier:          backoff.DefaultMultiplier,
-	MaxInterval:         300 * time.Second,
-	MaxElapsedTime:      30 * time.Second,
-	Stop:                backoff.Stop,
-	Clock:               backoff.SystemClock,
+// aggregatesProcessor updates aggregates of buckets of tags, late tags go to corrections or the late tags topic.
+type aggregatesProcessor struct {
+	ids        idGetter.Client
+	aggregates db.AggregatesClient
+	late       *lateTags
 }
 
-func runAggregatesProcessor(tagsChan <-chan types.UserTag, idsClient idGetter.Client, aggregates db.AggregatesClient, logger *zap.Logger) {
-	for tag := range tagsChan {
-		logger.Debug("processing tag", zap.Any("tag", tag))
-		if err := updateAggregatesBackoff(tag, idsClient, aggregates, aggregatesBackoff, logger); err != nil {
-			logger.Error("error updating aggregates", zap.Error(err))
-		}
-		logger.Debug("processed tag", zap.Any("tag", tag))
-	}
+// Key keeps updates of the same aggregate in order, its id lookups included.
+func (p *aggregatesProcessor) Key(tag types.UserTag) string {
+	return fmt.Sprintf("%d|%s|%s|%s|%s|%s|%s", tag.Time.Truncate(time.Minute).Unix(), tag.Action, tag.Origin,
+		tag.ProductInfo.BrandId, tag.ProductInfo.CategoryId, tag.Country, tag.Device)
 }
 
-// updateAggregatesBackoff updates aggregates with the given tag and retries on error according to the given backoff strategy.
-func updateAggregatesBackoff(tag types.UserTag, idsClient idGetter.Client, aggregates db.AggregatesClient, bo backoff.ExponentialBackOff, logger *zap.Logger) error {
-	err := backoff.Retry(func() error {
-		if err := updateAggregates(tag, idsClient, aggregates); err != nil {
-			logger.Warn("error processing tag", zap.Any("tag", tag), zap.Error(err))
-			return err
-		}
-		return nil
-	}, &bo)
-	if err != nil {
-		return fmt.Errorf("error backoff updating aggregates, %w", err)
-	}
-	return nil
+func (p *aggregatesProcessor) Process(_ context.Context, tag types.UserTag) error {
+	return updateAggregates(tag, p.ids, p.aggregates)
 }
 
-func getId(idsClient idGetter.Client, collection string, element string) (uint16, error) {
-	id, err := idGetter.GetU16ID(idsClient, collection, element, true)
-	if err != nil {
-		return 0, fmt.Errorf("error getting %s id of tag, %w", collection, err)
-	}
-	return id, nil
+func (p *aggregatesProcessor) ProcessLate(_ context.Context, tag types.UserTag) error {
+	return p.late.handle(tag)
 }
 
 // updateAggregates updates aggregates with the given tag.
-func updateAggregates(tag types.UserTag, idsClient idGetter.Client, aggregates db.AggregatesClient) (err error) {
-	var key db.AggregateKey
-	key.CategoryId, err = getId(idsClient, idGetter.CategoryCollection, tag.ProductInfo.CategoryId)
-	if err != nil {
-		return err
-	}
-	key.BrandId, err = getId(idsClient, idGetter.BrandCollection, tag.ProductInfo.BrandId)
+func updateAggregates(tag types.UserTag, idsClient idGetter.Client, aggregates db.AggregatesClient) error {
+	key, err := aggregateKey(tag, idsClient)
 	if err != nil {
 		return err
 	}
-	key.Origin, err = getId(idsClient, idGetter.OriginCollection, tag.Origin)
-	if err != nil {
-		return err
-	}
-
 	if err := aggregates.Add(key, tag); err != nil {
 		return fmt.Errorf("error updating aggregates, %w", err)
 	}
 	return nil
 }
+
+// aggregateKey returns the key of the aggregate of the tag, assigning ids to its new elements.
+func aggregateKey(tag types.UserTag, idsClient idGetter.Client) (key db.AggregateKey, err error) {
+	ids, err := idGetter.GetU16IDs(idsClient, []api.GetIDRequest{
+		{CollectionName: idGetter.CategoryCollection, Element: tag.ProductInfo.CategoryId, CreateMissing: true},
+		{CollectionName: idGetter.BrandCollection, Element: tag.ProductInfo.BrandId, CreateMissing: true},
+		{CollectionName: idGetter.OriginCollection, Element: tag.Origin, CreateMissing: true},
+		{CollectionName: idGetter.CountryCollection, Element: tag.Country, CreateMissing: true},
+	})
+	if err != nil {
+		return db.AggregateKey{}, fmt.Errorf("error getting ids of tag, %w", err)
+	}
+	key.CategoryId, key.BrandId, key.Origin = ids[0], ids[1], ids[2]
+	key.CountryId = db.CountryKey(ids[3])
+	key.Device = db.DeviceKey(tag.Device)
+	return key, nil
+}
@@ -0,0 +1,104 @@
+package worker
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/TomaszDomagala/Allezon/src/cmd/worker/config"
+	"github.com/TomaszDomagala/Allezon/src/pkg/archive"
+	"github.com/TomaszDomagala/Allezon/src/pkg/messaging"
+)
+
+// ArchiveConsumer consumes partitions of the user tags topic assigned to the archiver, see messaging.GroupConsumer.
+type ArchiveConsumer interface {
+	Consume(ctx context.Context, handler messaging.PartitionsHandler) error
+}
+
+// archiver writes consumed tags to the archive in batches. It consumes the user tags topic as its own consumer group
+// rather than as a stage, so replicas archive different partitions. Partitions start at offsets committed by the
+// archive, so batches are finalized exactly once, and offsets of the group only show the progress.
+type archiver struct {
+	logger        *zap.Logger
+	consumer      ArchiveConsumer
+	dir           string
+	batchSize     int
+	flushInterval time.Duration
+	maxOpenFiles  int
+
+	// archive is opened for partitions assigned to the archiver.
+	archive *archive.Archive
+}
+
+func newArchiver(conf *config.Config, logger *zap.Logger, consumer ArchiveConsumer) *archiver {
+	return &archiver{
+		logger:        logger,
+		consumer:      consumer,
+		dir:           conf.ArchiveDir,
+		batchSize:     conf.ArchiveBatchSize,
+		flushInterval: conf.ArchiveFlushInterval,
+		maxOpenFiles:  conf.ArchiveMaxOpenFiles,
+	}
+}
+
+// run archives tags in the archive directory until ctx is done, committing open batches before returning.
+func (a *archiver) run(ctx context.Context) error {
+	return a.consumer.Consume(ctx, a)
+}
+
+// Assigned opens the archive for the partitions, resuming from offsets of their last committed batches.
+func (a *archiver) Assigned(partitions []int32) (map[int32]int64, error) {
+	arch, err := archive.Open(a.dir, partitions, a.maxOpenFiles)
+	if err != nil {
+		return nil, err
+	}
+	a.archive = arch
+	offsets := arch.Offsets()
+	a.logger.Info("archiving tags", zap.Int32s("partitions", partitions), zap.Any("offsets", offsets))
+	return offsets, nil
+}
+
+// Handle archives tags of the assigned partitions, committing open batches once they are revoked.
+func (a *archiver) Handle(messages <-chan messaging.Message, commit func(partition int32, offset int64)) error {
+	defer a.archive.Close()
+
+	ticker := time.NewTicker(a.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case msg, ok := <-messages:
+			if !ok {
+				return a.flushAll(commit)
+			}
+			if err := a.archive.Add(msg.Partition, msg.Offset, msg.Tag); err != nil {
+				return err
+			}
+			if a.archive.Pending(msg.Partition) >= a.batchSize {
+				if err := a.archive.Flush(msg.Partition); err != nil {
+					return err
+				}
+				a.commit(commit)
+			}
+		case <-ticker.C:
+			if err := a.flushAll(commit); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (a *archiver) flushAll(commit func(partition int32, offset int64)) error {
+	if err := a.archive.FlushAll(); err != nil {
+		return err
+	}
+	a.commit(commit)
+	return nil
+}
+
+// commit passes offsets of committed batches to the group.
+func (a *archiver) commit(commit func(partition int32, offset int64)) {
+	for p, o := range a.archive.Offsets() {
+		commit(p, o)
+	}
+}
@@ -0,0 +1,119 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/TomaszDomagala/Allezon/src/cmd/worker/config"
+	"github.com/TomaszDomagala/Allezon/src/pkg/archive"
+	"github.com/TomaszDomagala/Allezon/src/pkg/messaging"
+	"github.com/TomaszDomagala/Allezon/src/pkg/types"
+)
+
+// memoryGroupConsumer assigns the partitions to the handler and consumes tags of the replayer until their ends.
+type memoryGroupConsumer struct {
+	replayer   *memoryReplayer
+	partitions []int32
+	committed  map[int32]int64
+}
+
+func (m *memoryGroupConsumer) Consume(ctx context.Context, handler messaging.PartitionsHandler) error {
+	offsets, err := handler.Assigned(m.partitions)
+	if err != nil {
+		return err
+	}
+	ranges := make(map[int32]messaging.OffsetRange)
+	for _, p := range m.partitions {
+		ranges[p] = messaging.OffsetRange{Start: offsets[p], End: messaging.OffsetEnd}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	messages := make(chan messaging.Message)
+	handled := make(chan error, 1)
+	go func() {
+		err := handler.Handle(messages, func(partition int32, offset int64) {
+			m.committed[partition] = offset
+		})
+		cancel()
+		handled <- err
+	}()
+	err = m.replayer.Replay(ctx, ranges, messages)
+	close(messages)
+	if err != nil {
+		return err
+	}
+	return <-handled
+}
+
+func TestArchiver(t *testing.T) {
+	t0 := time.Date(2022, 3, 1, 10, 0, 0, 0, time.UTC)
+	tag := func(cookie string, minutes int) types.UserTag {
+		return types.UserTag{Cookie: cookie, Time: t0.Add(time.Duration(minutes) * time.Minute)}
+	}
+	replayer := &memoryReplayer{partitions: map[int32][]types.UserTag{
+		0: {tag("a", 0), tag("b", 61), tag("c", 2)},
+		1: {tag("d", 0)},
+	}}
+	conf := &config.Config{ArchiveDir: t.TempDir(), ArchiveBatchSize: 2, ArchiveFlushInterval: time.Hour, ArchiveMaxOpenFiles: 24}
+	readAll := func() []string {
+		var cookies []string
+		require.NoError(t, archive.Read(conf.ArchiveDir, t0, t0.Add(2*time.Hour), func(tag types.UserTag) error {
+			cookies = append(cookies, tag.Cookie)
+			return nil
+		}))
+		return cookies
+	}
+	run := func(partitions ...int32) map[int32]int64 {
+		consumer := &memoryGroupConsumer{replayer: replayer, partitions: partitions, committed: make(map[int32]int64)}
+		require.NoError(t, newArchiver(conf, zap.NewNop(), consumer).run(context.Background()))
+		return consumer.committed
+	}
+
+	// Replicas archive the partitions assigned to them.
+	assert.Equal(t, map[int32]int64{0: 3}, run(0))
+	assert.ElementsMatch(t, []string{"a", "b", "c"}, readAll())
+	assert.Equal(t, map[int32]int64{1: 1}, run(1))
+	assert.ElementsMatch(t, []string{"a", "b", "c", "d"}, readAll())
+
+	// Archiving again resumes from committed offsets, without duplicating tags.
+	replayer.partitions[1] = append(replayer.partitions[1], tag("e", 3))
+	assert.Equal(t, map[int32]int64{0: 3, 1: 2}, run(0, 1))
+	assert.ElementsMatch(t, []string{"a", "b", "c", "d", "e"}, readAll())
+}
+
+// blockingConsumer consumes no tags until ctx is done.
+type blockingConsumer struct{}
+
+func (blockingConsumer) Consume(ctx context.Context, _ chan<- messaging.Message) error {
+	<-ctx.Done()
+	return nil
+}
+
+// failingConsumer fails to consume tags.
+type failingConsumer struct{}
+
+func (failingConsumer) Consume(context.Context, messaging.PartitionsHandler) error {
+	return errors.New("can't consume tags")
+}
+
+func TestWorkerReturnsArchiverErrors(t *testing.T) {
+	conf := &config.Config{ArchiveDir: t.TempDir(), ArchiveBatchSize: 2, ArchiveFlushInterval: time.Hour, ArchiveMaxOpenFiles: 24}
+	w := worker{
+		logger:   zap.NewNop(),
+		consumer: blockingConsumer{},
+		pipeline: &pipeline{},
+		archiver: newArchiver(conf, zap.NewNop(), failingConsumer{}),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := w.Run(ctx)
+	assert.ErrorContains(t, err, "can't consume tags")
+	assert.NoError(t, ctx.Err(), "the worker stops once the archiver fails")
+}
@@ -0,0 +1,60 @@
+package worker
+
+import (
+	"fmt"
+
+	"go.uber.org/zap"
+
+	"github.com/TomaszDomagala/Allezon/src/cmd/worker/config"
+	"github.com/TomaszDomagala/Allezon/src/pkg/db"
+	"github.com/TomaszDomagala/Allezon/src/pkg/idGetter"
+	"github.com/TomaszDomagala/Allezon/src/pkg/messaging"
+	"github.com/TomaszDomagala/Allezon/src/pkg/types"
+)
+
+// lateTags handles tags that arrived after the allowed lateness, instead of the aggregates stage.
+type lateTags struct {
+	logger     *zap.Logger
+	policy     string
+	producer   messaging.MessageProducer
+	ids        idGetter.Client
+	aggregates db.AggregatesClient
+}
+
+func newLateTags(deps Dependencies) *lateTags {
+	return &lateTags{
+		logger:     deps.Logger,
+		policy:     deps.Cfg.LateTagsPolicy,
+		producer:   deps.Producer,
+		ids:        deps.IDGetter,
+		aggregates: deps.AggregatesDB.Aggregates(),
+	}
+}
+
+// handle sends the tag to the late user tags topic or records it in the correction bin of its aggregate. Failures
+// are retried by the aggregates stage, according to its options.
+func (l *lateTags) handle(tag types.UserTag) error {
+	if l.policy == config.LateTagsPolicyTopic {
+		return l.send(tag)
+	}
+	return l.correct(tag)
+}
+
+func (l *lateTags) send(tag types.UserTag) error {
+	value, err := types.MarshalUserTag(&tag)
+	if err != nil {
+		return fmt.Errorf("error marshalling tag %#v, %w", tag, err)
+	}
+	return l.producer.SendMessage(messaging.LateUserTagsTopic, tag.Cookie, value)
+}
+
+func (l *lateTags) correct(tag types.UserTag) error {
+	key, err := aggregateKey(tag, l.ids)
+	if err != nil {
+		return err
+	}
+	if err := l.aggregates.AddCorrection(key, tag); err != nil {
+		return fmt.Errorf("error correcting aggregates, %w", err)
+	}
+	return nil
+}
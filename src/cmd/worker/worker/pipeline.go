@@ -0,0 +1,318 @@
+package worker
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/cenkalti/backoff/v4"
+	"go.uber.org/zap"
+
+	"github.com/TomaszDomagala/Allezon/src/cmd/worker/config"
+	"github.com/TomaszDomagala/Allezon/src/pkg/types"
+)
+
+// Processor is a stage of the worker pipeline. Every consumed tag is processed by all stages, independently of each other.
+type Processor interface {
+	// Process handles a single tag, failures are retried according to options of the stage.
+	Process(ctx context.Context, tag types.UserTag) error
+}
+
+// Runner is implemented by processors doing background work, like refreshing their state.
+// Run is started with the stage and should return when ctx is done.
+type Runner interface {
+	Run(ctx context.Context)
+}
+
+// LateProcessor is implemented by processors handling late tags differently, like the aggregates stage, as buckets
+// of late tags may already be final. Other processors get late tags like any other.
+type LateProcessor interface {
+	ProcessLate(ctx context.Context, tag types.UserTag) error
+}
+
+// admittedTag is a consumed tag, marked late if it arrived after the allowed lateness of its partition.
+type admittedTag struct {
+	types.UserTag
+	late bool
+	// ack is called once all stages are done with the tag, it may be nil.
+	ack func()
+}
+
+// stagesAck calls ack once every stage is done with a tag.
+type stagesAck struct {
+	remaining int32
+	ack       func()
+}
+
+func (a *stagesAck) done() {
+	if atomic.AddInt32(&a.remaining, -1) == 0 {
+		a.ack()
+	}
+}
+
+// Keyer is implemented by processors that need tags with the same key processed in order. Tags with the same key go
+// to the same shard of the stage, processing them one by one. Tags of the same cookie do by default.
+type Keyer interface {
+	Key(tag types.UserTag) string
+}
+
+// ProcessorFactory creates the processor of a stage.
+type ProcessorFactory func(deps Dependencies) (Processor, error)
+
+var processors = map[string]ProcessorFactory{
+	"aggregates": func(deps Dependencies) (Processor, error) {
+		return &aggregatesProcessor{ids: deps.IDGetter, aggregates: deps.AggregatesDB.Aggregates(), late: newLateTags(deps)}, nil
+	},
+	"webhooks": func(deps Dependencies) (Processor, error) {
+		return newWebhookDispatcher(deps.Logger, deps.Cfg, deps.AggregatesDB.Webhooks())
+	},
+	"rules": func(deps Dependencies) (Processor, error) {
+		return newRulesProcessor(deps.Logger, deps.Cfg, deps.AggregatesDB.Rules(), deps.Producer), nil
+	},
+}
+
+// RegisterProcessor makes the processor available to stages configured with the name, replacing the previous one.
+// It must be called before the worker is created.
+func RegisterProcessor(name string, factory ProcessorFactory) {
+	processors[name] = factory
+}
+
+// StageStats is a snapshot of the state of a stage, exposed for metrics.
+type StageStats struct {
+	Name string `json:"name"`
+	// Processed is the number of tags the stage is done with, including failed ones.
+	Processed uint64 `json:"processed"`
+	Retries   uint64 `json:"retries"`
+	// Failures is the number of tags that failed after retries.
+	Failures uint64 `json:"failures"`
+	// Queued is the number of tags pending processing in each shard.
+	Queued []int `json:"queued"`
+}
+
+type stage struct {
+	name      string
+	processor Processor
+	opts      config.StageOptions
+	logger    *zap.Logger
+	shards    []chan admittedTag
+
+	processed uint64
+	retries   uint64
+	failures  uint64
+}
+
+func newStage(name string, processor Processor, opts config.StageOptions, logger *zap.Logger) *stage {
+	s := &stage{name: name, processor: processor, opts: opts, logger: logger}
+	for i := 0; i < opts.Concurrency; i++ {
+		s.shards = append(s.shards, make(chan admittedTag, opts.QueueSize))
+	}
+	return s
+}
+
+func (s *stage) stats() StageStats {
+	queued := make([]int, len(s.shards))
+	for i, shard := range s.shards {
+		queued[i] = len(shard)
+	}
+	return StageStats{
+		Name:      s.name,
+		Processed: atomic.LoadUint64(&s.processed),
+		Retries:   atomic.LoadUint64(&s.retries),
+		Failures:  atomic.LoadUint64(&s.failures),
+		Queued:    queued,
+	}
+}
+
+// shard returns the queue of the shard of the tag, chosen by the hash of its key.
+func (s *stage) shard(tag types.UserTag) chan<- admittedTag {
+	key := tag.Cookie
+	if k, ok := s.processor.(Keyer); ok {
+		key = k.Key(tag)
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return s.shards[h.Sum32()%uint32(len(s.shards))]
+}
+
+// run processes tags of the shard until it's closed, ctx is done or a tag fails under the fail policy.
+func (s *stage) run(ctx context.Context, shard <-chan admittedTag, errs chan<- error) {
+	for {
+		select {
+		case tag, ok := <-shard:
+			if !ok {
+				return
+			}
+			if err := s.process(ctx, tag); err != nil {
+				// Only the first error stops the pipeline.
+				select {
+				case errs <- err:
+				default:
+				}
+				return
+			}
+			// Tags left when ctx is done are consumed again.
+			if tag.ack != nil && ctx.Err() == nil {
+				tag.ack()
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *stage) process(ctx context.Context, tag admittedTag) error {
+	process := s.processor.Process
+	if lp, ok := s.processor.(LateProcessor); ok && tag.late {
+		process = lp.ProcessLate
+	}
+	bo := &backoff.ExponentialBackOff{
+		InitialInterval:     s.opts.InitialInterval,
+		RandomizationFactor: backoff.DefaultRandomizationFactor,
+		Multiplier:          backoff.DefaultMultiplier,
+		MaxInterval:         s.opts.MaxInterval,
+		MaxElapsedTime:      s.opts.MaxElapsedTime,
+		Stop:                backoff.Stop,
+		Clock:               backoff.SystemClock,
+	}
+	if s.opts.ErrorPolicy == config.ErrorPolicyRetry {
+		bo.MaxElapsedTime = 0
+	}
+	bo.Reset()
+
+	attempts := 0
+	err := backoff.Retry(func() error {
+		if attempts > 0 {
+			atomic.AddUint64(&s.retries, 1)
+		}
+		attempts++
+		if err := process(ctx, tag.UserTag); err != nil {
+			s.logger.Warn("error processing tag", zap.String("stage", s.name), zap.Any("tag", tag.UserTag), zap.Error(err))
+			return err
+		}
+		return nil
+	}, backoff.WithContext(bo, ctx))
+	atomic.AddUint64(&s.processed, 1)
+	if err == nil || ctx.Err() != nil {
+		return nil
+	}
+
+	atomic.AddUint64(&s.failures, 1)
+	if s.opts.ErrorPolicy == config.ErrorPolicyFail {
+		return fmt.Errorf("error processing tag in stage %s, %w", s.name, err)
+	}
+	s.logger.Error("dropping tag", zap.String("stage", s.name), zap.Any("tag", tag.UserTag), zap.Error(err))
+	return nil
+}
+
+// pipeline runs the stages over every tag.
+type pipeline struct {
+	stages []*stage
+}
+
+// newPipeline creates the stages configured in deps.Cfg, in order.
+func newPipeline(deps Dependencies) (*pipeline, error) {
+	p := &pipeline{}
+	for _, name := range deps.Cfg.Stages {
+		factory, ok := processors[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown processor %s", name)
+		}
+		processor, err := factory(deps)
+		if err != nil {
+			return nil, fmt.Errorf("error creating processor %s, %w", name, err)
+		}
+		opts, ok := deps.Cfg.StageOptions[name]
+		if !ok {
+			return nil, fmt.Errorf("no options of stage %s", name)
+		}
+		p.stages = append(p.stages, newStage(name, processor, opts, deps.Logger))
+	}
+	return p, nil
+}
+
+// Run passes tags to all stages until tags is closed, ctx is done or a stage fails. Tags are acked once all stages
+// processed or dropped them. Once tags is closed, it waits for the stages to process queued tags. A full queue of any shard blocks the whole pipeline, so the slowest shard
+// limits the pace of consuming. The pipeline can be run only once.
+func (p *pipeline) Run(ctx context.Context, tags <-chan admittedTag) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errs := make(chan error, 1)
+	var shards sync.WaitGroup
+	for _, s := range p.stages {
+		if r, ok := s.processor.(Runner); ok {
+			go r.Run(ctx)
+		}
+		for _, shard := range s.shards {
+			s, shard := s, shard
+			shards.Add(1)
+			go func() {
+				defer shards.Done()
+				s.run(ctx, shard, errs)
+			}()
+		}
+	}
+
+	for {
+		select {
+		case tag, ok := <-tags:
+			if !ok {
+				return p.drain(&shards, errs)
+			}
+			if tag.ack != nil {
+				if len(p.stages) == 0 {
+					tag.ack()
+				}
+				a := &stagesAck{remaining: int32(len(p.stages)), ack: tag.ack}
+				tag.ack = a.done
+			}
+			for _, s := range p.stages {
+				select {
+				case s.shard(tag.UserTag) <- tag:
+				case err := <-errs:
+					return err
+				case <-ctx.Done():
+					return nil
+				}
+			}
+		case err := <-errs:
+			return err
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// drain closes queues of shards and waits until they are processed.
+func (p *pipeline) drain(shards *sync.WaitGroup, errs <-chan error) error {
+	for _, s := range p.stages {
+		for _, shard := range s.shards {
+			close(shard)
+		}
+	}
+	shards.Wait()
+	select {
+	case err := <-errs:
+		return err
+	default:
+		return nil
+	}
+}
+
+func (p *pipeline) Stats() []StageStats {
+	stats := make([]StageStats, len(p.stages))
+	for i, s := range p.stages {
+		stats[i] = s.stats()
+	}
+	return stats
+}
+
+// PublishStats publishes stats of stages of the worker as an expvar variable with the given name.
+func PublishStats(name string, w Worker) {
+	if p, ok := w.(worker); ok {
+		expvar.Publish(name, expvar.Func(func() any { return p.pipeline.Stats() }))
+	}
+}
@@ -0,0 +1,290 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/TomaszDomagala/Allezon/src/cmd/worker/config"
+	"github.com/TomaszDomagala/Allezon/src/pkg/types"
+)
+
+// flakyProcessor fails the first failures attempts of every tag.
+type flakyProcessor struct {
+	mu        sync.Mutex
+	failures  int
+	attempts  map[string]int
+	processed []string
+}
+
+func (f *flakyProcessor) Process(_ context.Context, tag types.UserTag) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.attempts[tag.Cookie]++
+	if f.attempts[tag.Cookie] <= f.failures {
+		return errors.New("flaky")
+	}
+	f.processed = append(f.processed, tag.Cookie)
+	return nil
+}
+
+func (f *flakyProcessor) Processed() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]string(nil), f.processed...)
+}
+
+func testStageOptions(policy string) config.StageOptions {
+	return config.StageOptions{
+		Concurrency:     1,
+		QueueSize:       10,
+		ErrorPolicy:     policy,
+		InitialInterval: time.Millisecond,
+		MaxInterval:     time.Millisecond,
+		MaxElapsedTime:  100 * time.Millisecond,
+	}
+}
+
+func testPipeline(t *testing.T, stages map[string]*flakyProcessor, options map[string]config.StageOptions) *pipeline {
+	conf := &config.Config{StageOptions: options}
+	for name, p := range stages {
+		p := p
+		RegisterProcessor(name, func(Dependencies) (Processor, error) { return p, nil })
+		conf.Stages = append(conf.Stages, name)
+	}
+	p, err := newPipeline(Dependencies{Cfg: conf, Logger: zap.NewNop()})
+	require.NoError(t, err)
+	return p
+}
+
+func TestPipeline(t *testing.T) {
+	retried := &flakyProcessor{failures: 2, attempts: make(map[string]int)}
+	dropping := &flakyProcessor{failures: 1000, attempts: make(map[string]int)}
+	p := testPipeline(t, map[string]*flakyProcessor{"test_retried": retried, "test_dropping": dropping}, map[string]config.StageOptions{
+		"test_retried":  testStageOptions(config.ErrorPolicyDrop),
+		"test_dropping": testStageOptions(config.ErrorPolicyDrop),
+	})
+
+	tags := make(chan admittedTag)
+	done := make(chan error)
+	go func() { done <- p.Run(context.Background(), tags) }()
+	tags <- admittedTag{UserTag: types.UserTag{Cookie: "foo"}}
+	tags <- admittedTag{UserTag: types.UserTag{Cookie: "bar"}}
+
+	require.Eventually(t, func() bool {
+		stats := p.Stats()
+		return stats[0].Processed == 2 && stats[1].Processed == 2
+	}, 5*time.Second, time.Millisecond)
+	close(tags)
+	require.NoError(t, <-done)
+
+	assert.ElementsMatch(t, []string{"foo", "bar"}, retried.Processed(), "tags are retried")
+	assert.Empty(t, dropping.Processed())
+	for _, s := range p.Stats() {
+		switch s.Name {
+		case "test_retried":
+			assert.Equal(t, StageStats{Name: s.Name, Processed: 2, Retries: 4, Queued: []int{0}}, s)
+		case "test_dropping":
+			assert.Equal(t, uint64(2), s.Failures, "stages are independent")
+		}
+	}
+}
+
+func TestPipelineFailPolicy(t *testing.T) {
+	failing := &flakyProcessor{failures: 1000, attempts: make(map[string]int)}
+	p := testPipeline(t, map[string]*flakyProcessor{"test_failing": failing}, map[string]config.StageOptions{
+		"test_failing": testStageOptions(config.ErrorPolicyFail),
+	})
+
+	tags := make(chan admittedTag, 1)
+	acked := false
+	tags <- admittedTag{UserTag: types.UserTag{Cookie: "foo"}, ack: func() { acked = true }}
+	err := p.Run(context.Background(), tags)
+	assert.ErrorContains(t, err, "error processing tag in stage test_failing")
+	assert.False(t, acked, "failed tags are consumed again")
+}
+
+func TestPipelineAcks(t *testing.T) {
+	fast := &flakyProcessor{attempts: make(map[string]int)}
+	slow := &flakyProcessor{failures: 3, attempts: make(map[string]int)}
+	dropping := &flakyProcessor{failures: 1000, attempts: make(map[string]int)}
+	p := testPipeline(t, map[string]*flakyProcessor{"test_fast": fast, "test_slow": slow, "test_dropping_acks": dropping}, map[string]config.StageOptions{
+		"test_fast":          testStageOptions(config.ErrorPolicyDrop),
+		"test_slow":          testStageOptions(config.ErrorPolicyDrop),
+		"test_dropping_acks": testStageOptions(config.ErrorPolicyDrop),
+	})
+
+	var mu sync.Mutex
+	acks := make(map[string]int)
+	tags := make(chan admittedTag)
+	done := make(chan error)
+	go func() { done <- p.Run(context.Background(), tags) }()
+	for _, cookie := range []string{"foo", "bar"} {
+		cookie := cookie
+		tags <- admittedTag{UserTag: types.UserTag{Cookie: cookie}, ack: func() {
+			mu.Lock()
+			defer mu.Unlock()
+			acks[cookie]++
+			assert.Contains(t, slow.Processed(), cookie, "tags are acked once all stages are done")
+		}}
+	}
+	close(tags)
+	require.NoError(t, <-done)
+	assert.Equal(t, map[string]int{"foo": 1, "bar": 1}, acks, "dropped tags are acked too")
+}
+
+// orderedProcessor records the sequence numbers of tags of every cookie, kept in their product ids.
+type orderedProcessor struct {
+	mu       sync.Mutex
+	sequence map[string][]int
+	release  chan struct{}
+}
+
+func (o *orderedProcessor) Process(_ context.Context, tag types.UserTag) error {
+	if o.release != nil {
+		<-o.release
+	}
+	// Give other shards a chance to overtake this one.
+	time.Sleep(time.Duration(tag.ProductInfo.ProductId%3) * time.Millisecond)
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.sequence[tag.Cookie] = append(o.sequence[tag.Cookie], tag.ProductInfo.ProductId)
+	return nil
+}
+
+func TestPipelineKeyAffinity(t *testing.T) {
+	ordered := &orderedProcessor{sequence: make(map[string][]int)}
+	RegisterProcessor("test_ordered", func(Dependencies) (Processor, error) { return ordered, nil })
+	opts := testStageOptions(config.ErrorPolicyDrop)
+	opts.Concurrency = 4
+	p, err := newPipeline(Dependencies{
+		Cfg:    &config.Config{Stages: []string{"test_ordered"}, StageOptions: map[string]config.StageOptions{"test_ordered": opts}},
+		Logger: zap.NewNop(),
+	})
+	require.NoError(t, err)
+
+	cookies := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	tags := make(chan admittedTag, 100)
+	for i := 0; i < 100; i++ {
+		tags <- admittedTag{UserTag: types.UserTag{Cookie: cookies[i%len(cookies)], ProductInfo: types.ProductInfo{ProductId: i}}}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = p.Run(ctx, tags) }()
+
+	require.Eventually(t, func() bool { return p.Stats()[0].Processed == 100 }, 10*time.Second, time.Millisecond)
+	ordered.mu.Lock()
+	defer ordered.mu.Unlock()
+	for cookie, sequence := range ordered.sequence {
+		assert.IsIncreasing(t, sequence, "tags of cookie %s are processed in order", cookie)
+	}
+}
+
+func TestPipelineDrain(t *testing.T) {
+	ordered := &orderedProcessor{sequence: make(map[string][]int)}
+	RegisterProcessor("test_drained", func(Dependencies) (Processor, error) { return ordered, nil })
+	opts := testStageOptions(config.ErrorPolicyDrop)
+	opts.Concurrency = 4
+	p, err := newPipeline(Dependencies{
+		Cfg:    &config.Config{Stages: []string{"test_drained"}, StageOptions: map[string]config.StageOptions{"test_drained": opts}},
+		Logger: zap.NewNop(),
+	})
+	require.NoError(t, err)
+
+	tags := make(chan admittedTag, 20)
+	for i := 0; i < 20; i++ {
+		tags <- admittedTag{UserTag: types.UserTag{Cookie: "foo", ProductInfo: types.ProductInfo{ProductId: i}}}
+	}
+	close(tags)
+	require.NoError(t, p.Run(context.Background(), tags))
+	assert.Equal(t, uint64(20), p.Stats()[0].Processed, "queued tags are processed before the pipeline returns")
+}
+
+func TestPipelineBackpressure(t *testing.T) {
+	blocked := &orderedProcessor{sequence: make(map[string][]int), release: make(chan struct{})}
+	RegisterProcessor("test_blocked", func(Dependencies) (Processor, error) { return blocked, nil })
+	opts := testStageOptions(config.ErrorPolicyDrop)
+	opts.QueueSize = 1
+	p, err := newPipeline(Dependencies{
+		Cfg:    &config.Config{Stages: []string{"test_blocked"}, StageOptions: map[string]config.StageOptions{"test_blocked": opts}},
+		Logger: zap.NewNop(),
+	})
+	require.NoError(t, err)
+
+	tags := make(chan admittedTag, 10)
+	for i := 0; i < 10; i++ {
+		tags <- admittedTag{UserTag: types.UserTag{Cookie: "foo", ProductInfo: types.ProductInfo{ProductId: i}}}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = p.Run(ctx, tags) }()
+
+	// One tag is being processed, one waits in the queue of the shard and one is held by the pipeline.
+	require.Eventually(t, func() bool { return len(tags) == 7 }, 5*time.Second, time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	assert.Len(t, tags, 7, "consuming is blocked while the shard is full")
+
+	close(blocked.release)
+	require.Eventually(t, func() bool { return p.Stats()[0].Processed == 10 }, 5*time.Second, time.Millisecond)
+}
+
+// lateProcessor records cookies of tags processed as on time and late.
+type lateProcessor struct {
+	mu           sync.Mutex
+	onTime, late []string
+}
+
+func (l *lateProcessor) Process(_ context.Context, tag types.UserTag) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.onTime = append(l.onTime, tag.Cookie)
+	return nil
+}
+
+func (l *lateProcessor) ProcessLate(_ context.Context, tag types.UserTag) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.late = append(l.late, tag.Cookie)
+	return nil
+}
+
+func TestPipelineLateTags(t *testing.T) {
+	diverting := &lateProcessor{}
+	RegisterProcessor("test_diverting", func(Dependencies) (Processor, error) { return diverting, nil })
+	other := &flakyProcessor{attempts: make(map[string]int)}
+	RegisterProcessor("test_other", func(Dependencies) (Processor, error) { return other, nil })
+	opts := testStageOptions(config.ErrorPolicyDrop)
+	p, err := newPipeline(Dependencies{
+		Cfg: &config.Config{Stages: []string{"test_diverting", "test_other"}, StageOptions: map[string]config.StageOptions{
+			"test_diverting": opts,
+			"test_other":     opts,
+		}},
+		Logger: zap.NewNop(),
+	})
+	require.NoError(t, err)
+
+	tags := make(chan admittedTag, 2)
+	tags <- admittedTag{UserTag: types.UserTag{Cookie: "on-time"}}
+	tags <- admittedTag{UserTag: types.UserTag{Cookie: "late"}, late: true}
+	close(tags)
+	require.NoError(t, p.Run(context.Background(), tags))
+
+	assert.Equal(t, []string{"on-time"}, diverting.onTime)
+	assert.Equal(t, []string{"late"}, diverting.late)
+	assert.Equal(t, []string{"on-time", "late"}, other.Processed(), "stages without late handling get late tags like any other")
+}
+
+func TestNewPipelineUnknownProcessor(t *testing.T) {
+	conf := &config.Config{Stages: []string{"missing"}}
+	_, err := newPipeline(Dependencies{Cfg: conf, Logger: zap.NewNop()})
+	assert.Error(t, err)
+}
@@ -0,0 +1,327 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/TomaszDomagala/Allezon/src/cmd/worker/config"
+	"github.com/TomaszDomagala/Allezon/src/pkg/db"
+	"github.com/TomaszDomagala/Allezon/src/pkg/idGetter"
+	"github.com/TomaszDomagala/Allezon/src/pkg/messaging"
+)
+
+// Bound is a bound of the range of the user tags topic replayed by a rebuild, either the time tags were produced at or
+// offsets of partitions. Partitions without offsets are bounded like by the zero Bound, which is the oldest offsets
+// for the start of the range and the newest ones, at the start of the rebuild, for its end.
+type Bound struct {
+	Time    time.Time
+	Offsets map[int32]int64
+}
+
+// ParseBound parses an RFC3339 time or a comma separated list of partition:offset pairs. Empty string is the zero Bound.
+func ParseBound(s string) (Bound, error) {
+	if s == "" {
+		return Bound{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return Bound{Time: t}, nil
+	}
+	offsets := make(map[int32]int64)
+	for _, pair := range strings.Split(s, ",") {
+		partition, offset, ok := strings.Cut(pair, ":")
+		if !ok {
+			return Bound{}, fmt.Errorf("bound %s is neither a time nor a list of partition:offset pairs", s)
+		}
+		p, err := strconv.ParseInt(partition, 10, 32)
+		if err != nil {
+			return Bound{}, fmt.Errorf("invalid partition %s, %w", partition, err)
+		}
+		o, err := strconv.ParseInt(offset, 10, 64)
+		if err != nil {
+			return Bound{}, fmt.Errorf("invalid offset %s, %w", offset, err)
+		}
+		offsets[int32(p)] = o
+	}
+	return Bound{Offsets: offsets}, nil
+}
+
+// RebuildOptions select the range of the user tags topic replayed into the set of aggregates.
+type RebuildOptions struct {
+	Set  string
+	From Bound
+	To   Bound
+	// Switch makes the set active once the rebuild is done. Rebuilds of ranges ending at the newest offsets catch up
+	// with the worker first.
+	Switch bool
+	// ProgressInterval is the period of logging and storing the progress.
+	ProgressInterval time.Duration
+}
+
+// Replayer reads ranges of offsets of the user tags topic, see messaging.Replayer.
+type Replayer interface {
+	OffsetsAt(t time.Time) (map[int32]int64, error)
+	NewestOffsets() (map[int32]int64, error)
+	CommittedOffsets(group string) (map[int32]int64, error)
+	Replay(ctx context.Context, ranges map[int32]messaging.OffsetRange, messages chan<- messaging.Message) error
+}
+
+// RebuildDependencies are dependencies of Rebuild, Cfg provides options of the aggregates stage.
+type RebuildDependencies struct {
+	Cfg          *config.Config
+	Logger       *zap.Logger
+	Replayer     Replayer
+	AggregatesDB db.Client
+	IDGetter     idGetter.Client
+}
+
+// rebuild replays tags into a set of aggregates, tracking its progress.
+type rebuild struct {
+	logger   *zap.Logger
+	opts     RebuildOptions
+	replayer Replayer
+	sets     db.AggregatesSetClient
+	pipeline *pipeline
+
+	mu       sync.Mutex
+	progress db.RebuildProgress
+}
+
+// rebuildCatchUpPasses bounds replays of tags the worker consumed since the end of the range, done before switching.
+// Each pass replays the tags consumed during the previous one.
+const rebuildCatchUpPasses = 3
+
+// Rebuild clears the set of aggregates and replays the range of the user tags topic into it, with the aggregates
+// stage of the worker. The set must be an inactive shadow set. Late tags are not diverted, so the rebuilt set counts
+// tags the worker added to corrections in their buckets. Rebuilds with failed tags are not done and don't switch.
+//
+// The switch is not atomic: until replicas reload the active set, the worker adds tags to the previous set, and
+// those are missing from the rebuilt one.
+func Rebuild(ctx context.Context, deps RebuildDependencies, opts RebuildOptions) (db.RebuildProgress, error) {
+	if err := db.CheckShadowAggregatesSet(opts.Set); err != nil {
+		return db.RebuildProgress{}, err
+	}
+	// The aggregates stage may be missing from the configured ones, options of which are still overridden.
+	stages, err := config.ParseStageOptions(append([]string{"aggregates"}, deps.Cfg.Stages...), deps.Cfg.StageOptionsJSON, deps.Cfg.NumProcessors, deps.Cfg.ChanSize)
+	if err != nil {
+		return db.RebuildProgress{}, err
+	}
+	processor := &aggregatesProcessor{ids: deps.IDGetter, aggregates: deps.AggregatesDB.AggregatesIn(opts.Set)}
+	r := &rebuild{
+		logger:   deps.Logger,
+		opts:     opts,
+		replayer: deps.Replayer,
+		sets:     deps.AggregatesDB.AggregatesSets(),
+		pipeline: &pipeline{stages: []*stage{newStage("aggregates", processor, stages["aggregates"], deps.Logger)}},
+	}
+	return r.run(ctx, deps.Cfg.ChanSize)
+}
+
+func (r *rebuild) run(ctx context.Context, chanSize int) (db.RebuildProgress, error) {
+	ranges, err := r.ranges()
+	if err != nil {
+		return db.RebuildProgress{}, err
+	}
+	if err := r.sets.Clear(r.opts.Set); err != nil {
+		return db.RebuildProgress{}, err
+	}
+	now := time.Now().UTC()
+	r.progress = db.RebuildProgress{
+		Set:       r.opts.Set,
+		Offsets:   make(map[int32]int64, len(ranges)),
+		Ends:      make(map[int32]int64, len(ranges)),
+		StartedAt: now,
+		UpdatedAt: now,
+	}
+	for p, rng := range ranges {
+		r.progress.Offsets[p] = rng.Start
+		r.progress.Ends[p] = rng.End
+	}
+	r.report()
+	r.logger.Info("rebuild started", zap.String("set", r.opts.Set), zap.Any("ranges", ranges))
+
+	messages := make(chan messaging.Message, chanSize)
+	tags := make(chan admittedTag, chanSize)
+	g, gctx := errgroup.WithContext(ctx)
+	g.Go(func() error {
+		defer close(messages)
+		if err := r.replayer.Replay(gctx, ranges, messages); err != nil {
+			return err
+		}
+		return r.catchUp(gctx, messages)
+	})
+	g.Go(func() error {
+		defer close(tags)
+		for msg := range messages {
+			select {
+			case tags <- admittedTag{UserTag: msg.Tag}:
+			case <-gctx.Done():
+				return nil
+			}
+			r.mu.Lock()
+			r.progress.Offsets[msg.Partition] = msg.Offset + 1
+			r.progress.Tags++
+			r.mu.Unlock()
+		}
+		return nil
+	})
+	g.Go(func() error {
+		return r.pipeline.Run(gctx, tags)
+	})
+
+	done := make(chan error, 1)
+	go func() { done <- g.Wait() }()
+	ticker := time.NewTicker(r.opts.ProgressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.report()
+		case err := <-done:
+			if err == nil && ctx.Err() != nil {
+				err = ctx.Err()
+			}
+			if err != nil {
+				r.report()
+				return r.snapshot(), fmt.Errorf("error rebuilding aggregates set %s, %w", r.opts.Set, err)
+			}
+			return r.finish()
+		}
+	}
+}
+
+// ranges returns ranges of offsets of partitions selected by the bounds.
+func (r *rebuild) ranges() (map[int32]messaging.OffsetRange, error) {
+	starts, err := r.replayer.OffsetsAt(r.opts.From.Time)
+	if err != nil {
+		return nil, err
+	}
+	var ends map[int32]int64
+	if r.opts.To.Time.IsZero() {
+		ends, err = r.replayer.NewestOffsets()
+	} else {
+		ends, err = r.replayer.OffsetsAt(r.opts.To.Time)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ranges := make(map[int32]messaging.OffsetRange, len(starts))
+	for p, start := range starts {
+		if o, ok := r.opts.From.Offsets[p]; ok {
+			start = o
+		}
+		end, ok := r.opts.To.Offsets[p]
+		if !ok {
+			end = ends[p]
+		}
+		ranges[p] = messaging.OffsetRange{Start: start, End: end}
+	}
+	for _, bound := range []Bound{r.opts.From, r.opts.To} {
+		for p := range bound.Offsets {
+			if _, ok := ranges[p]; !ok {
+				return nil, fmt.Errorf("no partition %d in the user tags topic", p)
+			}
+		}
+	}
+	return ranges, nil
+}
+
+// catchUp replays tags the worker consumed since the end of the range, as committed by its consumer group, before
+// switching to the set. It's done only for ranges ending at the newest offsets, which follow the worker.
+func (r *rebuild) catchUp(ctx context.Context, messages chan<- messaging.Message) error {
+	if !r.opts.Switch || !r.opts.To.Time.IsZero() || len(r.opts.To.Offsets) > 0 {
+		return nil
+	}
+	for i := 0; i < rebuildCatchUpPasses && ctx.Err() == nil; i++ {
+		live, err := r.replayer.CommittedOffsets(messaging.UserTagsConsumerGroup)
+		if err != nil {
+			return err
+		}
+		ranges := make(map[int32]messaging.OffsetRange)
+		r.mu.Lock()
+		for p, end := range r.progress.Ends {
+			if o, ok := live[p]; ok && o > end {
+				ranges[p] = messaging.OffsetRange{Start: end, End: o}
+				r.progress.Ends[p] = o
+			}
+		}
+		r.mu.Unlock()
+		if len(ranges) == 0 {
+			return nil
+		}
+		r.logger.Info("rebuild catching up with the worker", zap.String("set", r.opts.Set), zap.Any("ranges", ranges))
+		if err := r.replayer.Replay(ctx, ranges, messages); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// finish marks the rebuild as done and switches to the set if requested. Rebuilds which failed to add tags to the set
+// are neither, as the set would miss them.
+func (r *rebuild) finish() (db.RebuildProgress, error) {
+	stats := r.pipeline.Stats()[0]
+	if stats.Failures > 0 {
+		r.report()
+		return r.snapshot(), fmt.Errorf("error rebuilding aggregates set %s, %d tags failed", r.opts.Set, stats.Failures)
+	}
+	r.mu.Lock()
+	r.progress.Done = true
+	r.mu.Unlock()
+	r.report()
+	r.logger.Info("rebuild done", zap.String("set", r.opts.Set), zap.Uint64("tags", stats.Processed), zap.Uint64("failures", stats.Failures))
+
+	if r.opts.Switch {
+		if err := r.sets.Switch(r.opts.Set); err != nil {
+			return r.snapshot(), err
+		}
+		r.mu.Lock()
+		r.progress.Switched = true
+		r.mu.Unlock()
+		r.report()
+		r.logger.Info("switched to rebuilt aggregates set", zap.String("set", r.opts.Set))
+	}
+	return r.snapshot(), nil
+}
+
+func (r *rebuild) snapshot() db.RebuildProgress {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	progress := r.progress
+	progress.Offsets = make(map[int32]int64, len(r.progress.Offsets))
+	for p, o := range r.progress.Offsets {
+		progress.Offsets[p] = o
+	}
+	progress.Ends = make(map[int32]int64, len(r.progress.Ends))
+	for p, o := range r.progress.Ends {
+		progress.Ends[p] = o
+	}
+	return progress
+}
+
+// report logs and stores the progress, failing to store it doesn't stop the rebuild.
+func (r *rebuild) report() {
+	r.mu.Lock()
+	r.progress.UpdatedAt = time.Now().UTC()
+	r.mu.Unlock()
+	progress := r.snapshot()
+
+	var remaining int64
+	for p, end := range progress.Ends {
+		if left := end - progress.Offsets[p]; left > 0 {
+			remaining += left
+		}
+	}
+	r.logger.Info("rebuild progress", zap.String("set", progress.Set), zap.Uint64("tags", progress.Tags), zap.Int64("remaining", remaining), zap.Bool("done", progress.Done))
+	if err := r.sets.PutProgress(progress); err != nil {
+		r.logger.Error("error storing rebuild progress", zap.String("set", progress.Set), zap.Error(err))
+	}
+}
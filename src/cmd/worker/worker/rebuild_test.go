@@ -0,0 +1,303 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/TomaszDomagala/Allezon/src/cmd/worker/config"
+	"github.com/TomaszDomagala/Allezon/src/pkg/db"
+	"github.com/TomaszDomagala/Allezon/src/pkg/idGetter"
+	"github.com/TomaszDomagala/Allezon/src/pkg/messaging"
+	"github.com/TomaszDomagala/Allezon/src/pkg/types"
+)
+
+// memoryReplayer replays tags of partitions, the offset of a tag is its index. Replays end at the last tag, or at
+// newest offsets if set. Committed offsets are those of the worker.
+type memoryReplayer struct {
+	partitions map[int32][]types.UserTag
+	newest     map[int32]int64
+	committed  map[int32]int64
+}
+
+func (m *memoryReplayer) OffsetsAt(t time.Time) (map[int32]int64, error) {
+	offsets := make(map[int32]int64)
+	for p, tags := range m.partitions {
+		offsets[p] = int64(len(tags))
+		for i, tag := range tags {
+			if !tag.Time.Before(t) {
+				offsets[p] = int64(i)
+				break
+			}
+		}
+	}
+	return offsets, nil
+}
+
+func (m *memoryReplayer) NewestOffsets() (map[int32]int64, error) {
+	if m.newest != nil {
+		return m.newest, nil
+	}
+	offsets := make(map[int32]int64)
+	for p, tags := range m.partitions {
+		offsets[p] = int64(len(tags))
+	}
+	return offsets, nil
+}
+
+func (m *memoryReplayer) CommittedOffsets(group string) (map[int32]int64, error) {
+	if group != messaging.UserTagsConsumerGroup {
+		return nil, fmt.Errorf("unexpected group %s", group)
+	}
+	return m.committed, nil
+}
+
+func (m *memoryReplayer) Replay(ctx context.Context, ranges map[int32]messaging.OffsetRange, messages chan<- messaging.Message) error {
+	for p, rng := range ranges {
+		for o := rng.Start; o < rng.End && o < int64(len(m.partitions[p])); o++ {
+			select {
+			case messages <- messaging.Message{Tag: m.partitions[p][o], Partition: p, Offset: o}:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// memoryAggregateSets counts tags added to sets of aggregates.
+type memoryAggregateSets struct {
+	db.Client
+
+	mu sync.Mutex
+	// fail is a cookie of tags which fail to be added.
+	fail     string
+	active   string
+	cleared  []string
+	tags     map[string][]string
+	progress map[string]db.RebuildProgress
+}
+
+func newMemoryAggregateSets() *memoryAggregateSets {
+	return &memoryAggregateSets{active: db.DefaultAggregatesSet, tags: make(map[string][]string), progress: make(map[string]db.RebuildProgress)}
+}
+
+func (m *memoryAggregateSets) AggregatesIn(set string) db.AggregatesClient {
+	return memorySetAggregates{sets: m, set: set}
+}
+
+func (m *memoryAggregateSets) AggregatesSets() db.AggregatesSetClient {
+	return m
+}
+
+func (m *memoryAggregateSets) Active() (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.active, nil
+}
+
+func (m *memoryAggregateSets) Switch(set string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.active = set
+	return nil
+}
+
+func (m *memoryAggregateSets) Follow(context.Context, time.Duration) error {
+	return nil
+}
+
+func (m *memoryAggregateSets) Clear(set string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if set == m.active {
+		return fmt.Errorf("refusing to clear the active aggregates set %s", set)
+	}
+	m.cleared = append(m.cleared, set)
+	delete(m.tags, set)
+	return nil
+}
+
+func (m *memoryAggregateSets) PutProgress(progress db.RebuildProgress) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.progress[progress.Set] = progress
+	return nil
+}
+
+func (m *memoryAggregateSets) Progress(set string) (db.RebuildProgress, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	progress, ok := m.progress[set]
+	if !ok {
+		return db.RebuildProgress{}, db.KeyNotFoundError
+	}
+	return progress, nil
+}
+
+type memorySetAggregates struct {
+	db.AggregatesClient
+	sets *memoryAggregateSets
+	set  string
+}
+
+func (m memorySetAggregates) Add(_ db.AggregateKey, tag types.UserTag) error {
+	m.sets.mu.Lock()
+	defer m.sets.mu.Unlock()
+
+	if tag.Cookie == m.sets.fail {
+		return fmt.Errorf("can't add tag of %s", tag.Cookie)
+	}
+	m.sets.tags[m.set] = append(m.sets.tags[m.set], tag.Cookie)
+	return nil
+}
+
+func testRebuildDependencies(sets *memoryAggregateSets, replayer Replayer) RebuildDependencies {
+	return RebuildDependencies{
+		Cfg:          &config.Config{NumProcessors: 2, ChanSize: 10},
+		Logger:       zap.NewNop(),
+		Replayer:     replayer,
+		AggregatesDB: sets,
+		IDGetter:     idGetter.NewNullClient(zap.NewNop()),
+	}
+}
+
+func TestRebuild(t *testing.T) {
+	t0 := time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC)
+	tag := func(cookie string, minutes int) types.UserTag {
+		return types.UserTag{Cookie: cookie, Time: t0.Add(time.Duration(minutes) * time.Minute)}
+	}
+	replayer := &memoryReplayer{partitions: map[int32][]types.UserTag{
+		0: {tag("a", 0), tag("b", 1), tag("c", 2)},
+		1: {tag("d", 0), tag("e", 3), tag("f", 4)},
+	}}
+	sets := newMemoryAggregateSets()
+
+	progress, err := Rebuild(context.Background(), testRebuildDependencies(sets, replayer), RebuildOptions{
+		Set:              "aggregates_v2",
+		From:             Bound{Time: t0.Add(time.Minute)},
+		To:               Bound{Offsets: map[int32]int64{1: 2}},
+		Switch:           true,
+		ProgressInterval: time.Hour,
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"aggregates_v2"}, sets.cleared, "the set is cleared before the rebuild")
+	assert.ElementsMatch(t, []string{"b", "c", "e"}, sets.tags["aggregates_v2"])
+	assert.Equal(t, "aggregates_v2", sets.active)
+	assert.Equal(t, map[int32]int64{0: 3, 1: 2}, progress.Offsets)
+	assert.Equal(t, map[int32]int64{0: 3, 1: 2}, progress.Ends)
+	assert.Equal(t, uint64(3), progress.Tags)
+	assert.True(t, progress.Done)
+	assert.True(t, progress.Switched)
+	stored, err := sets.Progress("aggregates_v2")
+	require.NoError(t, err)
+	assert.Equal(t, progress, stored)
+}
+
+func TestRebuildCatchesUpBeforeSwitch(t *testing.T) {
+	tag := func(cookie string) types.UserTag {
+		return types.UserTag{Cookie: cookie, Time: time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC)}
+	}
+	for _, doSwitch := range []bool{false, true} {
+		// The worker consumed tags past the newest offsets of the start of the rebuild.
+		replayer := &memoryReplayer{
+			partitions: map[int32][]types.UserTag{
+				0: {tag("a"), tag("b"), tag("c")},
+				1: {tag("d"), tag("e")},
+			},
+			newest:    map[int32]int64{0: 1, 1: 1},
+			committed: map[int32]int64{0: 3, 1: 2},
+		}
+		sets := newMemoryAggregateSets()
+
+		progress, err := Rebuild(context.Background(), testRebuildDependencies(sets, replayer), RebuildOptions{
+			Set:              "aggregates_v2",
+			Switch:           doSwitch,
+			ProgressInterval: time.Hour,
+		})
+		require.NoError(t, err)
+
+		if doSwitch {
+			assert.ElementsMatch(t, []string{"a", "b", "c", "d", "e"}, sets.tags["aggregates_v2"])
+			assert.Equal(t, map[int32]int64{0: 3, 1: 2}, progress.Ends)
+		} else {
+			assert.ElementsMatch(t, []string{"a", "d"}, sets.tags["aggregates_v2"])
+			assert.Equal(t, map[int32]int64{0: 1, 1: 1}, progress.Ends)
+		}
+	}
+}
+
+func TestRebuildWithFailuresIsNotDone(t *testing.T) {
+	replayer := &memoryReplayer{partitions: map[int32][]types.UserTag{
+		0: {{Cookie: "a"}, {Cookie: "b"}},
+	}}
+	sets := newMemoryAggregateSets()
+	sets.fail = "b"
+	deps := testRebuildDependencies(sets, replayer)
+	deps.Cfg.StageOptionsJSON = `{"aggregates": {"initial_interval": "1ms", "max_elapsed_time": "5ms"}}`
+
+	progress, err := Rebuild(context.Background(), deps, RebuildOptions{
+		Set:              "aggregates_v2",
+		Switch:           true,
+		ProgressInterval: time.Hour,
+	})
+	assert.Error(t, err)
+	assert.False(t, progress.Done)
+	assert.False(t, progress.Switched)
+	assert.Equal(t, db.DefaultAggregatesSet, sets.active)
+	stored, err := sets.Progress("aggregates_v2")
+	require.NoError(t, err)
+	assert.False(t, stored.Done, "failed rebuilds can't be switched to")
+}
+
+func TestRebuildRefusesActiveSet(t *testing.T) {
+	sets := newMemoryAggregateSets()
+	_, err := Rebuild(context.Background(), testRebuildDependencies(sets, &memoryReplayer{}), RebuildOptions{
+		Set:              db.DefaultAggregatesSet,
+		ProgressInterval: time.Hour,
+	})
+	assert.Error(t, err)
+	assert.Empty(t, sets.progress)
+}
+
+func TestRebuildRefusesSetsOtherThanShadowSets(t *testing.T) {
+	sets := newMemoryAggregateSets()
+	for _, set := range []string{"", "user_profiles", "aggregates_"} {
+		_, err := Rebuild(context.Background(), testRebuildDependencies(sets, &memoryReplayer{}), RebuildOptions{
+			Set:              set,
+			ProgressInterval: time.Hour,
+		})
+		assert.Error(t, err, set)
+	}
+	assert.Empty(t, sets.cleared, "sets are checked before clearing them")
+	assert.Empty(t, sets.progress)
+}
+
+func TestParseBound(t *testing.T) {
+	b, err := ParseBound("2022-03-01T00:00:00Z")
+	require.NoError(t, err)
+	assert.Equal(t, Bound{Time: time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC)}, b)
+
+	b, err = ParseBound("0:10,1:20")
+	require.NoError(t, err)
+	assert.Equal(t, Bound{Offsets: map[int32]int64{0: 10, 1: 20}}, b)
+
+	b, err = ParseBound("")
+	require.NoError(t, err)
+	assert.Equal(t, Bound{}, b)
+
+	_, err = ParseBound("yesterday")
+	assert.Error(t, err)
+}
@@ -0,0 +1,100 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/TomaszDomagala/Allezon/src/cmd/worker/config"
+	"github.com/TomaszDomagala/Allezon/src/cmd/worker/rules"
+	"github.com/TomaszDomagala/Allezon/src/pkg/db"
+	"github.com/TomaszDomagala/Allezon/src/pkg/messaging"
+	"github.com/TomaszDomagala/Allezon/src/pkg/types"
+)
+
+// rulesProcessor evaluates rules over sliding windows of tags of cookies and sends matches to the rule matches topic.
+// Rules are reloaded periodically, so changes made through the admin api take effect after the refresh interval.
+type rulesProcessor struct {
+	logger   *zap.Logger
+	conf     *config.Config
+	rules    db.RuleClient
+	producer messaging.MessageProducer
+
+	set atomic.Pointer[rules.Set]
+}
+
+func newRulesProcessor(logger *zap.Logger, conf *config.Config, rules db.RuleClient, producer messaging.MessageProducer) *rulesProcessor {
+	return &rulesProcessor{
+		logger:   logger,
+		conf:     conf,
+		rules:    rules,
+		producer: producer,
+	}
+}
+
+// Run refreshes rules until ctx is done.
+func (p *rulesProcessor) Run(ctx context.Context) {
+	p.refresh()
+
+	ticker := time.NewTicker(p.conf.RulesRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.refresh()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (p *rulesProcessor) refresh() {
+	definitions, err := p.rules.List()
+	if err != nil {
+		p.logger.Error("error refreshing rules", zap.Error(err))
+		return
+	}
+	var rs []rules.Rule
+	for id, definition := range definitions {
+		r, err := rules.Unmarshal(definition)
+		if err != nil {
+			p.logger.Error("skipping invalid rule", zap.String("rule", id), zap.Error(err))
+			continue
+		}
+		rs = append(rs, r)
+	}
+	p.set.Store(rules.NewSet(rs))
+}
+
+// Key keeps tags of a cookie in order, as matches depend on the order tags are added to its window.
+func (p *rulesProcessor) Key(tag types.UserTag) string {
+	return tag.Cookie
+}
+
+// Process adds the tag to the window of its cookie and sends matches of all rules. Tags are skipped while there are
+// no rules.
+func (p *rulesProcessor) Process(_ context.Context, tag types.UserTag) error {
+	set := p.set.Load()
+	if set == nil || len(set.Rules()) == 0 {
+		return nil
+	}
+	window, err := p.rules.AddToWindow(tag.Cookie, tag, set.Window())
+	if err != nil {
+		return err
+	}
+	for _, m := range set.Evaluate(tag, window) {
+		value, err := json.Marshal(rules.IntoMatchDTO(m))
+		if err != nil {
+			return fmt.Errorf("error marshalling match of rule %s, %w", m.RuleId, err)
+		}
+		if err := p.producer.SendMessage(messaging.RuleMatchesTopic, m.Cookie, value); err != nil {
+			return fmt.Errorf("error sending match of rule %s, %w", m.RuleId, err)
+		}
+		p.logger.Debug("rule matched", zap.String("rule", m.RuleId), zap.String("cookie", m.Cookie))
+	}
+	return nil
+}
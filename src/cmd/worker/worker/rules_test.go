@@ -0,0 +1,155 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/TomaszDomagala/Allezon/src/cmd/worker/config"
+	"github.com/TomaszDomagala/Allezon/src/pkg/db"
+	"github.com/TomaszDomagala/Allezon/src/pkg/dto"
+	"github.com/TomaszDomagala/Allezon/src/pkg/messaging"
+	"github.com/TomaszDomagala/Allezon/src/pkg/types"
+)
+
+// memoryRules is an in-memory db.RuleClient.
+type memoryRules struct {
+	mu          sync.Mutex
+	definitions map[string][]byte
+	windows     map[string][]types.UserTag
+}
+
+func newMemoryRules() *memoryRules {
+	return &memoryRules{definitions: make(map[string][]byte), windows: make(map[string][]types.UserTag)}
+}
+
+func (m *memoryRules) Put(id string, definition []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.definitions[id] = definition
+	return nil
+}
+
+func (m *memoryRules) Delete(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.definitions[id]; !ok {
+		return db.KeyNotFoundError
+	}
+	delete(m.definitions, id)
+	return nil
+}
+
+func (m *memoryRules) List() (map[string][]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	definitions := make(map[string][]byte, len(m.definitions))
+	for id, d := range m.definitions {
+		definitions[id] = d
+	}
+	return definitions, nil
+}
+
+func (m *memoryRules) AddToWindow(cookie string, tag types.UserTag, window time.Duration) ([]types.UserTag, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	start := tag.Time.Add(-window)
+	tags := []types.UserTag{tag}
+	for _, t := range m.windows[cookie] {
+		if !t.Time.Before(start) && !reflect.DeepEqual(t, tag) {
+			tags = append(tags, t)
+		}
+	}
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].Time.Before(tags[j].Time) })
+	m.windows[cookie] = tags
+	return append([]types.UserTag(nil), tags...), nil
+}
+
+type message struct {
+	topic string
+	key   string
+	value []byte
+}
+
+// memoryProducer is a messaging.MessageProducer collecting sent messages.
+type memoryProducer struct {
+	mu       sync.Mutex
+	messages []message
+}
+
+func (m *memoryProducer) SendMessage(topic string, key string, value []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.messages = append(m.messages, message{topic: topic, key: key, value: value})
+	return nil
+}
+
+func TestRulesProcessor(t *testing.T) {
+	store := newMemoryRules()
+	require.NoError(t, store.Put("views-without-buy", []byte(`{"id": "views-without-buy", "action": "VIEW", "group_by": "category_id", "count": 3, "window": "10m", "without": "BUY"}`)))
+	producer := &memoryProducer{}
+	conf := &config.Config{RulesRefreshInterval: time.Hour}
+	p := newRulesProcessor(zap.NewNop(), conf, store, producer)
+	p.refresh()
+
+	t0 := time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC)
+	tag := func(cookie string, minute int, action types.Action) types.UserTag {
+		return types.UserTag{
+			Time:        t0.Add(time.Duration(minute) * time.Minute),
+			Cookie:      cookie,
+			Action:      action,
+			ProductInfo: types.ProductInfo{ProductId: minute, CategoryId: "category"},
+		}
+	}
+	tags := []types.UserTag{
+		tag("foo", 0, types.View), tag("foo", 4, types.View), tag("foo", 8, types.View),
+		tag("bar", 0, types.View), tag("bar", 1, types.Buy), tag("bar", 4, types.View), tag("bar", 8, types.View),
+	}
+	for _, tag := range tags {
+		require.NoError(t, p.Process(context.Background(), tag))
+	}
+
+	require.Len(t, producer.messages, 1, "only views without a buy match")
+	msg := producer.messages[0]
+	assert.Equal(t, messaging.RuleMatchesTopic, msg.topic)
+	assert.Equal(t, "foo", msg.key)
+	var match dto.RuleMatchDTO
+	require.NoError(t, json.Unmarshal(msg.value, &match))
+	assert.Equal(t, dto.RuleMatchDTO{
+		RuleId: "views-without-buy",
+		Cookie: "foo",
+		Time:   "2022-03-01T00:08:00Z",
+		Group:  "category",
+		Tags:   []dto.UserTagDTO{dto.IntoUserTagDTO(tags[0]), dto.IntoUserTagDTO(tags[1]), dto.IntoUserTagDTO(tags[2])},
+	}, match)
+}
+
+func TestRulesProcessorRetriedTags(t *testing.T) {
+	store := newMemoryRules()
+	require.NoError(t, store.Put("views", []byte(`{"id": "views", "action": "VIEW", "group_by": "category_id", "count": 3, "window": "10m"}`)))
+	producer := &memoryProducer{}
+	p := newRulesProcessor(zap.NewNop(), &config.Config{RulesRefreshInterval: time.Hour}, store, producer)
+	p.refresh()
+
+	t0 := time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC)
+	first := types.UserTag{Time: t0, Cookie: "foo", Action: types.View, ProductInfo: types.ProductInfo{ProductId: 1, CategoryId: "category"}}
+	second := first
+	second.Time = t0.Add(time.Minute)
+	for _, tag := range []types.UserTag{first, first, second} {
+		require.NoError(t, p.Process(context.Background(), tag))
+	}
+	assert.Empty(t, producer.messages, "a retried tag is counted once")
+}
@@ -0,0 +1,80 @@
+package worker
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/TomaszDomagala/Allezon/src/pkg/db"
+)
+
+// watermarks track event time of partitions of the user tags topic. The watermark of a partition trails the latest
+// time of its tags by the allowed lateness, tags before it are late. It's used by a single goroutine.
+type watermarks struct {
+	logger   *zap.Logger
+	store    db.WatermarkClient
+	lateness time.Duration
+	now      func() time.Time
+
+	latest map[int32]time.Time
+	dirty  map[int32]bool
+}
+
+func newWatermarks(logger *zap.Logger, store db.WatermarkClient, lateness time.Duration) *watermarks {
+	return &watermarks{
+		logger:   logger,
+		store:    store,
+		lateness: lateness,
+		now:      time.Now,
+		latest:   make(map[int32]time.Time),
+		dirty:    make(map[int32]bool),
+	}
+}
+
+// observe reports whether the tag of the partition is late, advancing the watermark of the partition otherwise.
+func (w *watermarks) observe(partition int32, t time.Time) (late bool) {
+	latest, ok := w.latest[partition]
+	if !ok {
+		latest = w.load(partition)
+		w.latest[partition] = latest
+	}
+	if t.Before(latest.Add(-w.lateness)) {
+		return true
+	}
+	// Tags from the future don't advance the watermark, so they can't make the following ones late.
+	if now := w.now(); t.After(now) {
+		t = now
+	}
+	if t.After(latest) {
+		w.latest[partition] = t
+		w.dirty[partition] = true
+	}
+	return false
+}
+
+// load returns the latest time of the partition stored by its previous owner, as partitions move between workers
+// on rebalances. It's zero if there is none.
+func (w *watermarks) load(partition int32) time.Time {
+	stored, err := w.store.Get()
+	if err != nil {
+		w.logger.Error("error loading watermarks", zap.Error(err))
+		return time.Time{}
+	}
+	watermark, ok := stored[partition]
+	if !ok {
+		return time.Time{}
+	}
+	return watermark.Add(w.lateness)
+}
+
+// flush writes watermarks advanced since the previous flush.
+func (w *watermarks) flush() {
+	for partition := range w.dirty {
+		watermark := w.latest[partition].Add(-w.lateness)
+		if err := w.store.Put(partition, watermark); err != nil {
+			w.logger.Error("error writing watermark", zap.Int32("partition", partition), zap.Error(err))
+			continue
+		}
+		delete(w.dirty, partition)
+	}
+}
@@ -0,0 +1,104 @@
+package worker
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/TomaszDomagala/Allezon/src/cmd/worker/config"
+	"github.com/TomaszDomagala/Allezon/src/pkg/db"
+	"github.com/TomaszDomagala/Allezon/src/pkg/messaging"
+	"github.com/TomaszDomagala/Allezon/src/pkg/types"
+)
+
+// memoryWatermarks is an in-memory db.WatermarkClient.
+type memoryWatermarks struct {
+	mu         sync.Mutex
+	watermarks map[int32]time.Time
+}
+
+func (m *memoryWatermarks) Put(partition int32, watermark time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.watermarks[partition] = watermark
+	return nil
+}
+
+func (m *memoryWatermarks) Get() (map[int32]time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	watermarks := make(map[int32]time.Time, len(m.watermarks))
+	for p, w := range m.watermarks {
+		watermarks[p] = w
+	}
+	return watermarks, nil
+}
+
+func TestWatermarks(t *testing.T) {
+	t0 := time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC)
+	store := &memoryWatermarks{watermarks: map[int32]time.Time{1: t0}}
+	w := newWatermarks(zap.NewNop(), store, 5*time.Minute)
+	w.now = func() time.Time { return t0.Add(time.Hour) }
+
+	assert.False(t, w.observe(0, t0))
+	assert.False(t, w.observe(0, t0.Add(10*time.Minute)))
+	assert.False(t, w.observe(0, t0.Add(5*time.Minute)), "tags within the allowed lateness are on time")
+	assert.True(t, w.observe(0, t0.Add(4*time.Minute)))
+	assert.False(t, w.observe(0, t0.Add(2*time.Hour)), "tags from the future are on time")
+	assert.False(t, w.observe(0, t0.Add(56*time.Minute)), "tags from the future don't advance the watermark")
+
+	assert.True(t, w.observe(1, t0.Add(-time.Second)), "watermarks of partitions are loaded from the db")
+	assert.False(t, w.observe(1, t0))
+
+	w.flush()
+	watermarks, err := store.Get()
+	require.NoError(t, err)
+	assert.Equal(t, map[int32]time.Time{0: t0.Add(55 * time.Minute), 1: t0}, watermarks)
+}
+
+func TestAdmitMarksLateTags(t *testing.T) {
+	t0 := time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC)
+	w := worker{
+		logger:        zap.NewNop(),
+		watermarks:    newWatermarks(zap.NewNop(), &memoryWatermarks{watermarks: map[int32]time.Time{}}, time.Minute),
+		flushInterval: time.Hour,
+	}
+	messages := make(chan messaging.Message, 3)
+	tags := make(chan admittedTag, 3)
+	messages <- messaging.Message{Tag: types.UserTag{Cookie: "on-time", Time: t0.Add(5 * time.Minute)}}
+	messages <- messaging.Message{Tag: types.UserTag{Cookie: "late", Time: t0}}
+	messages <- messaging.Message{Tag: types.UserTag{Cookie: "other-partition", Time: t0}, Partition: 1}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.admit(ctx, messages, tags)
+
+	for _, want := range []admittedTag{
+		{UserTag: types.UserTag{Cookie: "on-time", Time: t0.Add(5 * time.Minute)}},
+		{UserTag: types.UserTag{Cookie: "late", Time: t0}, late: true},
+		{UserTag: types.UserTag{Cookie: "other-partition", Time: t0}},
+	} {
+		assert.Equal(t, want, <-tags, "late tags are passed to the pipeline too")
+	}
+}
+
+func TestAggregatesProcessorDivertsLateTags(t *testing.T) {
+	producer := &memoryProducer{}
+	p := &aggregatesProcessor{late: &lateTags{logger: zap.NewNop(), policy: config.LateTagsPolicyTopic, producer: producer}}
+
+	require.NoError(t, p.ProcessLate(context.Background(), types.UserTag{Cookie: "late"}))
+	require.Len(t, producer.messages, 1)
+	assert.Equal(t, messaging.LateUserTagsTopic, producer.messages[0].topic)
+	var tag types.UserTag
+	require.NoError(t, types.UnmarshalUserTag(producer.messages[0].value, &tag))
+	assert.Equal(t, "late", tag.Cookie)
+}
+
+var _ db.WatermarkClient = &memoryWatermarks{}
@@ -0,0 +1,342 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"go.uber.org/zap"
+
+	"github.com/TomaszDomagala/Allezon/src/cmd/worker/config"
+	"github.com/TomaszDomagala/Allezon/src/cmd/worker/egress"
+	"github.com/TomaszDomagala/Allezon/src/pkg/db"
+	"github.com/TomaszDomagala/Allezon/src/pkg/dto"
+	"github.com/TomaszDomagala/Allezon/src/pkg/types"
+)
+
+const (
+	// WebhookSignatureHeader holds the hex encoded HMAC-SHA256 of the timestamp, a dot and the body,
+	// keyed with the secret of the subscription.
+	WebhookSignatureHeader = "X-Allezon-Signature"
+	// WebhookTimestampHeader holds the unix time of the attempt, receivers should reject old ones to prevent replays.
+	WebhookTimestampHeader = "X-Allezon-Timestamp"
+	WebhookDeliveryHeader  = "X-Allezon-Delivery"
+)
+
+// WebhookSignature returns the signature of the webhook request body sent at timestamp.
+func WebhookSignature(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Outboxes are polled for deliveries queued by other replicas every webhookPollInterval, and sent in batches of
+// webhookBatchSize deliveries.
+const (
+	webhookPollInterval = time.Second
+	webhookBatchSize    = 100
+)
+
+// webhookDispatcher delivers tags to webhook subscriptions matching them. Matching tags are stored in outboxes of
+// subscriptions, retried by the stage, before their offsets are committed, and sent by a goroutine of each
+// subscription, so deliveries survive restarts and a slow endpoint holds back only its own subscription. Every outbox
+// is sent by the replica holding its lease, the oldest delivery first, and a delivery is removed once it succeeds or
+// fails permanently, so deliveries are at least once. Subscriptions are reloaded periodically, so changes made through the admin api
+// take effect after the refresh interval.
+type webhookDispatcher struct {
+	logger   *zap.Logger
+	conf     *config.Config
+	webhooks db.WebhookClient
+	client   *http.Client
+	// owner identifies the replica in leases of outboxes.
+	owner string
+
+	subs atomic.Pointer[[]db.WebhookSubscription]
+
+	mu      sync.Mutex
+	ctx     context.Context
+	senders map[string]*webhookSender
+	wg      sync.WaitGroup
+}
+
+// webhookSender sends the outbox of a single subscription.
+type webhookSender struct {
+	sub    atomic.Pointer[db.WebhookSubscription]
+	wake   chan struct{}
+	cancel context.CancelFunc
+}
+
+func newWebhookDispatcher(logger *zap.Logger, conf *config.Config, webhooks db.WebhookClient) (*webhookDispatcher, error) {
+	owner, err := newDeliveryID()
+	if err != nil {
+		return nil, err
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		owner = hostname + "-" + owner
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// Proxies would connect to addresses the dialer refuses.
+	transport.Proxy = nil
+	transport.DialContext = egress.Dialer(conf.WebhookTimeout, conf.WebhookAllowPrivateAddresses).DialContext
+	return &webhookDispatcher{
+		logger:   logger,
+		conf:     conf,
+		webhooks: webhooks,
+		client: &http.Client{
+			Timeout:   conf.WebhookTimeout,
+			Transport: transport,
+			// Redirects are not followed, so endpoints can't point deliveries elsewhere.
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		owner:   owner,
+		senders: make(map[string]*webhookSender),
+	}, nil
+}
+
+// Run refreshes subscriptions and sends their outboxes until ctx is done.
+func (d *webhookDispatcher) Run(ctx context.Context) {
+	d.mu.Lock()
+	d.ctx = ctx
+	d.mu.Unlock()
+	d.refresh()
+
+	ticker := time.NewTicker(d.conf.WebhookRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			d.refresh()
+		case <-ctx.Done():
+			d.wg.Wait()
+			return
+		}
+	}
+}
+
+// refresh reloads subscriptions, starting senders of new ones and stopping senders of deleted ones.
+func (d *webhookDispatcher) refresh() {
+	subs, err := d.webhooks.List()
+	if err != nil {
+		d.logger.Error("error refreshing webhook subscriptions", zap.Error(err))
+		return
+	}
+	d.subs.Store(&subs)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.ctx == nil {
+		return
+	}
+	current := make(map[string]bool, len(subs))
+	for _, sub := range subs {
+		sub := sub
+		current[sub.Id] = true
+		if s, ok := d.senders[sub.Id]; ok {
+			s.sub.Store(&sub)
+			continue
+		}
+		ctx, cancel := context.WithCancel(d.ctx)
+		s := &webhookSender{wake: make(chan struct{}, 1), cancel: cancel}
+		s.sub.Store(&sub)
+		d.senders[sub.Id] = s
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			d.send(ctx, s)
+		}()
+	}
+	for id, s := range d.senders {
+		if !current[id] {
+			s.cancel()
+			delete(d.senders, id)
+		}
+	}
+}
+
+// Process stores the tag in outboxes of all subscriptions matching it. Deliveries over the limit of an outbox are
+// dropped and logged as failed.
+func (d *webhookDispatcher) Process(_ context.Context, tag types.UserTag) error {
+	subs := d.subs.Load()
+	if subs == nil {
+		return nil
+	}
+	for _, sub := range *subs {
+		if !sub.Filter.Match(tag) {
+			continue
+		}
+		if err := d.enqueue(sub, tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *webhookDispatcher) enqueue(sub db.WebhookSubscription, tag types.UserTag) error {
+	id, err := newDeliveryID()
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(dto.WebhookPayloadDTO{DeliveryId: id, SubscriptionId: sub.Id, Tag: dto.IntoUserTagDTO(tag)})
+	if err != nil {
+		return fmt.Errorf("error marshalling payload, %w", err)
+	}
+	err = d.webhooks.Enqueue(sub.Id, db.PendingDelivery{Id: id, Cookie: tag.Cookie, Payload: body}, d.conf.WebhookOutboxLimit)
+	if errors.Is(err, db.OutboxFullError) {
+		d.logger.Warn("webhook delivery dropped", zap.String("subscription", sub.Id), zap.Error(err))
+		d.logDelivery(sub.Id, db.WebhookDelivery{Id: id, Time: time.Now(), Cookie: tag.Cookie, Error: err.Error()})
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if s, ok := d.senders[sub.Id]; ok {
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// send delivers the outbox of the subscription until ctx is done.
+func (d *webhookDispatcher) send(ctx context.Context, s *webhookSender) {
+	timer := time.NewTimer(webhookPollInterval)
+	defer timer.Stop()
+	for {
+		sent, err := d.sendPending(ctx, *s.sub.Load())
+		if err != nil {
+			d.logger.Error("error sending webhook outbox", zap.String("subscription", s.sub.Load().Id), zap.Error(err))
+		}
+		if sent && err == nil {
+			continue
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(webhookPollInterval)
+		select {
+		case <-s.wake:
+		case <-timer.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// sendPending delivers the oldest batch of deliveries of the outbox while the replica holds its lease,
+// and reports whether any was sent.
+func (d *webhookDispatcher) sendPending(ctx context.Context, sub db.WebhookSubscription) (bool, error) {
+	pending, err := d.webhooks.Pending(sub.Id, webhookBatchSize)
+	if err != nil {
+		return false, err
+	}
+	sent := false
+	for _, delivery := range pending {
+		// The lease outlives a delivery with all of its retries, it's extended before every one.
+		held, err := d.webhooks.AcquireLease(sub.Id, d.owner, d.conf.WebhookMaxElapsedTime+2*d.conf.WebhookTimeout)
+		if err != nil || !held {
+			return sent, err
+		}
+		if !d.deliver(ctx, sub, delivery) {
+			return sent, nil
+		}
+		if err := d.webhooks.Dequeue(sub.Id, delivery.Id); err != nil {
+			return sent, err
+		}
+		sent = true
+	}
+	return sent, nil
+}
+
+// deliver posts the delivery to the url of the subscription, retrying with backoff on network errors, 5xx, 408
+// and 429 responses, and logs the outcome. It reports false if it was interrupted by ctx, leaving the delivery
+// to be sent again.
+func (d *webhookDispatcher) deliver(ctx context.Context, sub db.WebhookSubscription, delivery db.PendingDelivery) bool {
+	record := db.WebhookDelivery{Id: delivery.Id, Cookie: delivery.Cookie}
+	bo := backoff.NewExponentialBackOff()
+	bo.MaxElapsedTime = d.conf.WebhookMaxElapsedTime
+	err := backoff.Retry(func() error {
+		var err error
+		record.Attempts++
+		record.StatusCode, err = d.post(ctx, sub, delivery.Id, delivery.Payload)
+		return err
+	}, backoff.WithContext(bo, ctx))
+	if ctx.Err() != nil {
+		return false
+	}
+	record.Time = time.Now()
+	if err != nil {
+		d.logger.Warn("error delivering webhook", zap.String("subscription", sub.Id), zap.String("url", sub.Url), zap.Error(err))
+		record.Error = err.Error()
+	}
+	d.logDelivery(sub.Id, record)
+	return true
+}
+
+func (d *webhookDispatcher) post(ctx context.Context, sub db.WebhookSubscription, deliveryID string, body []byte) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.Url, bytes.NewReader(body))
+	if err != nil {
+		return 0, backoff.Permanent(fmt.Errorf("error creating request, %w", err))
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookDeliveryHeader, deliveryID)
+	req.Header.Set(WebhookTimestampHeader, timestamp)
+	req.Header.Set(WebhookSignatureHeader, WebhookSignature(sub.Secret, timestamp, body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("error sending request, %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp.StatusCode, nil
+	}
+	err = fmt.Errorf("endpoint responded with status %d", resp.StatusCode)
+	if resp.StatusCode < 500 && resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+		return resp.StatusCode, backoff.Permanent(err)
+	}
+	return resp.StatusCode, err
+}
+
+func (d *webhookDispatcher) logDelivery(id string, delivery db.WebhookDelivery) {
+	if err := d.webhooks.AddDelivery(id, delivery, d.conf.WebhookDeliveryLogLimit); err != nil {
+		d.logger.Error("error logging webhook delivery", zap.String("subscription", id), zap.Error(err))
+	}
+}
+
+// newDeliveryID returns a random id prefixed with the current time, so ids are ordered by the time deliveries are queued.
+func newDeliveryID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("error generating delivery id, %w", err)
+	}
+	return fmt.Sprintf("%016x", time.Now().UnixNano()) + hex.EncodeToString(b), nil
+}
@@ -0,0 +1,388 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"golang.org/x/exp/slices"
+
+	"github.com/TomaszDomagala/Allezon/src/cmd/worker/config"
+	"github.com/TomaszDomagala/Allezon/src/pkg/db"
+	"github.com/TomaszDomagala/Allezon/src/pkg/dto"
+	"github.com/TomaszDomagala/Allezon/src/pkg/types"
+)
+
+// memoryWebhooks is an in-memory db.WebhookClient. Leases never expire.
+type memoryWebhooks struct {
+	mu         sync.Mutex
+	subs       map[string]db.WebhookSubscription
+	deliveries map[string][]db.WebhookDelivery
+	outboxes   map[string][]db.PendingDelivery
+	leases     map[string]string
+}
+
+func newMemoryWebhooks(subs ...db.WebhookSubscription) *memoryWebhooks {
+	m := &memoryWebhooks{
+		subs:       make(map[string]db.WebhookSubscription),
+		deliveries: make(map[string][]db.WebhookDelivery),
+		outboxes:   make(map[string][]db.PendingDelivery),
+		leases:     make(map[string]string),
+	}
+	for _, sub := range subs {
+		m.subs[sub.Id] = sub
+	}
+	return m
+}
+
+func (m *memoryWebhooks) Put(sub db.WebhookSubscription) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.subs[sub.Id] = sub
+	return nil
+}
+
+func (m *memoryWebhooks) Get(id string) (db.WebhookSubscription, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sub, ok := m.subs[id]
+	if !ok {
+		return db.WebhookSubscription{}, db.KeyNotFoundError
+	}
+	return sub, nil
+}
+
+func (m *memoryWebhooks) Delete(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.subs[id]; !ok {
+		return db.KeyNotFoundError
+	}
+	delete(m.subs, id)
+	delete(m.deliveries, id)
+	delete(m.outboxes, id)
+	return nil
+}
+
+func (m *memoryWebhooks) List() ([]db.WebhookSubscription, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var subs []db.WebhookSubscription
+	for _, sub := range m.subs {
+		subs = append(subs, sub)
+	}
+	return subs, nil
+}
+
+func (m *memoryWebhooks) AddDelivery(id string, delivery db.WebhookDelivery, limit int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	log := append(m.deliveries[id], delivery)
+	if len(log) > limit {
+		log = log[len(log)-limit:]
+	}
+	m.deliveries[id] = log
+	return nil
+}
+
+func (m *memoryWebhooks) Deliveries(id string) ([]db.WebhookDelivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]db.WebhookDelivery(nil), m.deliveries[id]...), nil
+}
+
+func (m *memoryWebhooks) Enqueue(id string, delivery db.PendingDelivery, limit int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.outboxes[id]) >= limit {
+		return db.OutboxFullError
+	}
+	m.outboxes[id] = append(m.outboxes[id], delivery)
+	return nil
+}
+
+func (m *memoryWebhooks) Pending(id string, n int) ([]db.PendingDelivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	pending := m.outboxes[id]
+	if len(pending) > n {
+		pending = pending[:n]
+	}
+	return append([]db.PendingDelivery(nil), pending...), nil
+}
+
+func (m *memoryWebhooks) Dequeue(id string, deliveryId string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.outboxes[id] = without(m.outboxes[id], func(d db.PendingDelivery) bool { return d.Id == deliveryId })
+	return nil
+}
+
+func (m *memoryWebhooks) AcquireLease(id string, owner string, _ time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if holder, ok := m.leases[id]; ok && holder != owner {
+		return false, nil
+	}
+	m.leases[id] = owner
+	return true, nil
+}
+
+func (m *memoryWebhooks) EraseCookies(cookies []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id := range m.outboxes {
+		m.outboxes[id] = without(m.outboxes[id], func(d db.PendingDelivery) bool { return slices.Contains(cookies, d.Cookie) })
+	}
+	for id := range m.deliveries {
+		m.deliveries[id] = without(m.deliveries[id], func(d db.WebhookDelivery) bool { return slices.Contains(cookies, d.Cookie) })
+	}
+	return nil
+}
+
+func without[T any](s []T, remove func(T) bool) []T {
+	var res []T
+	for _, v := range s {
+		if !remove(v) {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+func testWebhooksConfig() *config.Config {
+	return &config.Config{
+		WebhookRefreshInterval:  time.Hour,
+		WebhookTimeout:          time.Second,
+		WebhookMaxElapsedTime:   5 * time.Second,
+		WebhookDeliveryLogLimit: 10,
+		WebhookOutboxLimit:      10,
+		// Endpoints of tests listen on the loopback interface.
+		WebhookAllowPrivateAddresses: true,
+	}
+}
+
+func newTestWebhookDispatcher(t *testing.T, conf *config.Config, webhooks db.WebhookClient) *webhookDispatcher {
+	d, err := newWebhookDispatcher(zap.NewNop(), conf, webhooks)
+	require.NoError(t, err)
+	return d
+}
+
+func TestWebhookDispatcher(t *testing.T) {
+	var mu sync.Mutex
+	var requests int
+	var payload dto.WebhookPayloadDTO
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		requests++
+		if requests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		signature := WebhookSignature("secret", r.Header.Get(WebhookTimestampHeader), body)
+		if r.Header.Get(WebhookSignatureHeader) != signature {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_ = json.Unmarshal(body, &payload)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer endpoint.Close()
+
+	webhooks := newMemoryWebhooks(db.WebhookSubscription{
+		Id:     "sub",
+		Url:    endpoint.URL,
+		Secret: "secret",
+		Filter: db.WebhookFilter{Actions: []types.Action{types.Buy}, BrandIds: []string{"brand"}},
+	})
+	d := newTestWebhookDispatcher(t, testWebhooksConfig(), webhooks)
+	d.refresh()
+
+	tag := types.UserTag{
+		Time:        time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC),
+		Cookie:      "foo",
+		Action:      types.Buy,
+		ProductInfo: types.ProductInfo{ProductId: 1, BrandId: "brand", CategoryId: "category", Price: 100},
+	}
+	notMatching := tag
+	notMatching.Action = types.View
+	require.NoError(t, d.Process(context.Background(), notMatching))
+	require.NoError(t, d.Process(context.Background(), tag))
+	pending, err := webhooks.Pending("sub", 10)
+	require.NoError(t, err)
+	require.Len(t, pending, 1, "only the matching tag is queued")
+
+	sent, err := d.sendPending(context.Background(), webhooks.subs["sub"])
+	require.NoError(t, err)
+	assert.True(t, sent)
+	pending, err = webhooks.Pending("sub", 10)
+	require.NoError(t, err)
+	assert.Empty(t, pending, "delivered tags are removed from the outbox")
+
+	deliveries, err := webhooks.Deliveries("sub")
+	require.NoError(t, err)
+	require.Len(t, deliveries, 1)
+	assert.Empty(t, deliveries[0].Error)
+	assert.Equal(t, http.StatusNoContent, deliveries[0].StatusCode)
+	assert.Equal(t, 2, deliveries[0].Attempts, "delivery is retried after a 5xx response")
+	assert.Equal(t, "foo", deliveries[0].Cookie)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, dto.WebhookPayloadDTO{DeliveryId: deliveries[0].Id, SubscriptionId: "sub", Tag: dto.IntoUserTagDTO(tag)}, payload)
+}
+
+func TestWebhookDispatcherPermanentError(t *testing.T) {
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusGone)
+	}))
+	defer endpoint.Close()
+
+	sub := db.WebhookSubscription{Id: "sub", Url: endpoint.URL, Secret: "secret"}
+	webhooks := newMemoryWebhooks(sub)
+	d := newTestWebhookDispatcher(t, testWebhooksConfig(), webhooks)
+	assert.True(t, d.deliver(context.Background(), sub, db.PendingDelivery{Id: "delivery", Cookie: "foo"}))
+
+	deliveries, err := webhooks.Deliveries("sub")
+	require.NoError(t, err)
+	require.Len(t, deliveries, 1)
+	assert.Equal(t, http.StatusGone, deliveries[0].StatusCode)
+	assert.Equal(t, 1, deliveries[0].Attempts, "4xx responses are not retried")
+	assert.Equal(t, "endpoint responded with status 410", deliveries[0].Error)
+}
+
+func TestWebhookDispatcherOutbox(t *testing.T) {
+	var requests int32
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer endpoint.Close()
+
+	sub := db.WebhookSubscription{Id: "sub", Url: endpoint.URL, Secret: "secret"}
+	webhooks := newMemoryWebhooks(sub)
+	conf := testWebhooksConfig()
+	conf.WebhookOutboxLimit = 2
+	d := newTestWebhookDispatcher(t, conf, webhooks)
+	d.refresh()
+
+	for _, cookie := range []string{"foo", "bar", "baz"} {
+		require.NoError(t, d.Process(context.Background(), types.UserTag{Cookie: cookie}))
+	}
+	deliveries, err := webhooks.Deliveries("sub")
+	require.NoError(t, err)
+	require.Len(t, deliveries, 1, "dropped deliveries are logged")
+	assert.Equal(t, "baz", deliveries[0].Cookie)
+	assert.Contains(t, deliveries[0].Error, db.OutboxFullError.Error())
+
+	// Outboxes are sent only by the replica holding their leases.
+	webhooks.leases["sub"] = "other replica"
+	sent, err := d.sendPending(context.Background(), sub)
+	require.NoError(t, err)
+	assert.False(t, sent)
+	assert.Zero(t, atomic.LoadInt32(&requests))
+
+	delete(webhooks.leases, "sub")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		d.Run(ctx)
+	}()
+	assert.Eventually(t, func() bool {
+		pending, err := webhooks.Pending("sub", 10)
+		return err == nil && len(pending) == 0
+	}, 5*time.Second, 10*time.Millisecond, "senders should deliver pending tags of a previous run")
+	cancel()
+	<-done
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+}
+
+func TestWebhookDispatcherRefusesPrivateAddresses(t *testing.T) {
+	var requests int32
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+	}))
+	defer endpoint.Close()
+
+	sub := db.WebhookSubscription{Id: "sub", Url: endpoint.URL, Secret: "secret"}
+	webhooks := newMemoryWebhooks(sub)
+	conf := testWebhooksConfig()
+	conf.WebhookAllowPrivateAddresses = false
+	conf.WebhookMaxElapsedTime = time.Millisecond
+	d := newTestWebhookDispatcher(t, conf, webhooks)
+	d.deliver(context.Background(), sub, db.PendingDelivery{Id: "delivery", Cookie: "foo"})
+
+	deliveries, err := webhooks.Deliveries("sub")
+	require.NoError(t, err)
+	require.Len(t, deliveries, 1)
+	assert.Contains(t, deliveries[0].Error, "is not public")
+	assert.Zero(t, atomic.LoadInt32(&requests))
+}
+
+func TestWebhookDispatcherSlowEndpoint(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	defer close(release)
+	var fastRequests int32
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fastRequests, 1)
+	}))
+	defer fast.Close()
+
+	webhooks := newMemoryWebhooks(
+		db.WebhookSubscription{Id: "slow", Url: slow.URL, Secret: "secret"},
+		db.WebhookSubscription{Id: "fast", Url: fast.URL, Secret: "secret"},
+	)
+	conf := testWebhooksConfig()
+	conf.WebhookTimeout = time.Minute
+	d := newTestWebhookDispatcher(t, conf, webhooks)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		d.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	require.Eventually(t, func() bool { return d.subs.Load() != nil }, time.Second, time.Millisecond)
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		require.NoError(t, d.Process(context.Background(), types.UserTag{Cookie: "foo"}))
+	}
+	assert.Less(t, time.Since(start), time.Second, "processing doesn't wait for deliveries")
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&fastRequests) == 5 }, 5*time.Second, 10*time.Millisecond,
+		"a slow endpoint doesn't hold back other subscriptions")
+	pending, err := webhooks.Pending("slow", 10)
+	require.NoError(t, err)
+	assert.Len(t, pending, 5)
+}
@@ -3,14 +3,14 @@ package worker
 import (
 	"context"
 	"fmt"
-	"runtime"
+	"time"
 
 	"go.uber.org/zap"
 
+	"github.com/TomaszDomagala/Allezon/src/cmd/worker/config"
 	"github.com/TomaszDomagala/Allezon/src/pkg/db"
 	"github.com/TomaszDomagala/Allezon/src/pkg/idGetter"
 	"github.com/TomaszDomagala/Allezon/src/pkg/messaging"
-	"github.com/TomaszDomagala/Allezon/src/pkg/types"
 )
 
 type Worker interface {
@@ -18,42 +18,119 @@ type Worker interface {
 }
 
 type Dependencies struct {
+	Cfg          *config.Config
 	Consumer     *messaging.Consumer
+	Producer     messaging.MessageProducer
 	AggregatesDB db.Client
 	Logger       *zap.Logger
 	IDGetter     idGetter.Client
+	// ArchiveConsumer is required if Cfg.ArchiveDir is set, see messaging.UserTagsArchiveGroup.
+	ArchiveConsumer ArchiveConsumer
 }
 
-type worker struct {
-	consumer     *messaging.Consumer
-	aggregatesDB db.Client
-	logger       *zap.Logger
-	idGetter     idGetter.Client
+// tagsConsumer consumes the user tags topic, see messaging.Consumer.
+type tagsConsumer interface {
+	Consume(ctx context.Context, messages chan<- messaging.Message) error
 }
 
-const chanSize = 1024
+type worker struct {
+	logger   *zap.Logger
+	consumer tagsConsumer
+	pipeline *pipeline
+	chanSize int
+	// archiver is nil if archiving is disabled.
+	archiver *archiver
 
-var numProcessors = runtime.NumCPU()
+	// watermarks are nil if tracking them is disabled.
+	watermarks    *watermarks
+	flushInterval time.Duration
+}
 
 func (w worker) Run(ctx context.Context) error {
-	tagsChan := make(chan types.UserTag, chanSize)
-	defer close(tagsChan)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	messages := make(chan messaging.Message, w.chanSize)
+	tagsChan := make(chan admittedTag, w.chanSize)
+	go w.admit(ctx, messages, tagsChan)
 
-	for i := 0; i < numProcessors; i++ {
-		go runAggregatesProcessor(tagsChan, w.idGetter, w.aggregatesDB.Aggregates(), w.logger)
+	pipelineErr := make(chan error, 1)
+	go func() {
+		pipelineErr <- w.pipeline.Run(ctx, tagsChan)
+		cancel()
+	}()
+	archiveErr := make(chan error, 1)
+	if w.archiver != nil {
+		go func() {
+			err := w.archiver.run(ctx)
+			if err != nil {
+				cancel()
+			}
+			archiveErr <- err
+		}()
 	}
 
-	if err := w.consumer.Consume(ctx, tagsChan); err != nil {
+	if err := w.consumer.Consume(ctx, messages); err != nil {
 		return fmt.Errorf("error consuming messages, %w", err)
 	}
+	cancel()
+	if err := <-pipelineErr; err != nil {
+		return fmt.Errorf("error processing messages, %w", err)
+	}
+	if w.archiver != nil {
+		if err := <-archiveErr; err != nil {
+			return fmt.Errorf("error archiving tags, %w", err)
+		}
+	}
 	return nil
 }
 
-func New(deps Dependencies) Worker {
-	return worker{
-		consumer:     deps.Consumer,
-		aggregatesDB: deps.AggregatesDB,
-		logger:       deps.Logger,
-		idGetter:     deps.IDGetter,
+// admit passes consumed tags to the pipeline, marking late ones, and periodically writes watermarks.
+func (w worker) admit(ctx context.Context, messages <-chan messaging.Message, tags chan<- admittedTag) {
+	var flush <-chan time.Time
+	if w.watermarks != nil {
+		ticker := time.NewTicker(w.flushInterval)
+		defer ticker.Stop()
+		flush = ticker.C
+	}
+	for {
+		select {
+		case msg := <-messages:
+			late := w.watermarks != nil && w.watermarks.observe(msg.Partition, msg.Tag.Time)
+			select {
+			case tags <- admittedTag{UserTag: msg.Tag, late: late, ack: msg.Ack}:
+			case <-ctx.Done():
+				return
+			}
+		case <-flush:
+			w.watermarks.flush()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// New creates the worker with the pipeline of stages configured in deps.Cfg.
+func New(deps Dependencies) (Worker, error) {
+	p, err := newPipeline(deps)
+	if err != nil {
+		return nil, err
+	}
+	w := worker{
+		logger:        deps.Logger,
+		consumer:      deps.Consumer,
+		pipeline:      p,
+		chanSize:      deps.Cfg.ChanSize,
+		flushInterval: deps.Cfg.WatermarkFlushInterval,
+	}
+	if deps.Cfg.ArchiveDir != "" {
+		if deps.ArchiveConsumer == nil {
+			return nil, fmt.Errorf("archiving needs a consumer")
+		}
+		w.archiver = newArchiver(deps.Cfg, deps.Logger, deps.ArchiveConsumer)
+	}
+	if deps.Cfg.AllowedLateness > 0 {
+		w.watermarks = newWatermarks(deps.Logger, deps.AggregatesDB.Watermarks(), deps.Cfg.AllowedLateness)
 	}
+	return w, nil
 }
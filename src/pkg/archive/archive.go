@@ -0,0 +1,339 @@
+// Package archive stores raw user tags in a directory as gzip compressed NDJSON files, partitioned by the hour of
+// their event time. Files of a partition of the user tags topic are finalized exactly once for every range of its
+// offsets, so tags consumed again after a restart are neither lost nor duplicated. A partition must be archived by
+// a single process at a time, while processes may share the directory for different partitions.
+//
+// The directory may be a mount of an object store, as files are only created, renamed and removed.
+package archive
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/TomaszDomagala/Allezon/src/pkg/dto"
+	"github.com/TomaszDomagala/Allezon/src/pkg/types"
+)
+
+const (
+	// HourLayout formats hours in names of directories of the archive, like "hour=2022-03-01T10".
+	HourLayout = "2006-01-02T15"
+	hourPrefix = "hour="
+
+	fileSuffix = ".ndjson.gz"
+	tmpSuffix  = ".tmp"
+
+	// manifestsDir holds the manifest of the last batch of every partition. Renaming the manifest into place
+	// commits the batch, its temporary files are then renamed to their final names.
+	manifestsDir = "_manifests"
+)
+
+// manifest describes a committed batch of tags of a partition, with offsets in [Start, End).
+type manifest struct {
+	Partition int32          `json:"partition"`
+	Start     int64          `json:"start"`
+	End       int64          `json:"end"`
+	Files     []manifestFile `json:"files"`
+}
+
+type manifestFile struct {
+	Tmp   string `json:"tmp"`
+	Final string `json:"final"`
+}
+
+// Archive writes batches of tags of the partitions it was opened with. It's not safe for concurrent use.
+type Archive struct {
+	dir        string
+	partitions map[int32]bool
+	// maxOpenFiles is the limit of hours of a batch, reaching it commits the batch early.
+	maxOpenFiles int
+	// next are offsets of the next tags of partitions, older ones are already archived or in open batches.
+	next    map[int32]int64
+	batches map[int32]*batch
+}
+
+// batch holds the open files of tags of a partition, one for every hour.
+type batch struct {
+	start int64
+	count int
+	files map[string]*hourFile
+}
+
+type hourFile struct {
+	tmp  string
+	hour string
+	f    *os.File
+	gz   *gzip.Writer
+	enc  *json.Encoder
+}
+
+// Open opens the archive in dir for the partitions, creating it if needed. It finalizes files of batches of the
+// partitions committed before a crash and removes files of uncommitted ones, files of other partitions are left
+// alone. Batches have files of at most maxOpenFiles hours.
+func Open(dir string, partitions []int32, maxOpenFiles int) (*Archive, error) {
+	if maxOpenFiles <= 0 {
+		return nil, fmt.Errorf("archive needs at least one open file, got %d", maxOpenFiles)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, manifestsDir), 0o755); err != nil {
+		return nil, fmt.Errorf("error creating archive directory, %w", err)
+	}
+	a := &Archive{
+		dir:          dir,
+		partitions:   make(map[int32]bool, len(partitions)),
+		maxOpenFiles: maxOpenFiles,
+		next:         make(map[int32]int64),
+		batches:      make(map[int32]*batch),
+	}
+	for _, p := range partitions {
+		a.partitions[p] = true
+	}
+	if err := a.recover(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Offsets returns offsets of the next tags to archive of partitions with committed batches. Tags of other partitions
+// were never archived.
+func (a *Archive) Offsets() map[int32]int64 {
+	offsets := make(map[int32]int64, len(a.next))
+	for p, o := range a.next {
+		if b, ok := a.batches[p]; ok {
+			o = b.start
+		}
+		offsets[p] = o
+	}
+	return offsets
+}
+
+// Add writes the tag at the offset of the partition to its open batch. Tags at offsets which are already archived
+// are skipped. A tag of a new hour of a batch with maxOpenFiles hours commits the batch and starts the next one.
+func (a *Archive) Add(partition int32, offset int64, tag types.UserTag) error {
+	if !a.partitions[partition] {
+		return fmt.Errorf("partition %d is not archived by this archive", partition)
+	}
+	if next, ok := a.next[partition]; ok && offset < next {
+		return nil
+	}
+	hour := hourPrefix + tag.Time.UTC().Format(HourLayout)
+	if b, ok := a.batches[partition]; ok && b.files[hour] == nil && len(b.files) >= a.maxOpenFiles {
+		if err := a.Flush(partition); err != nil {
+			return err
+		}
+	}
+	b, ok := a.batches[partition]
+	if !ok {
+		b = &batch{start: offset, files: make(map[string]*hourFile)}
+		a.batches[partition] = b
+	}
+	f, ok := b.files[hour]
+	if !ok {
+		var err error
+		if f, err = a.create(hour, partition, b.start); err != nil {
+			return err
+		}
+		b.files[hour] = f
+	}
+	if err := f.enc.Encode(dto.IntoUserTagDTO(tag)); err != nil {
+		return fmt.Errorf("error writing tag to %s, %w", f.tmp, err)
+	}
+	b.count++
+	a.next[partition] = offset + 1
+	return nil
+}
+
+func (a *Archive) create(hour string, partition int32, start int64) (*hourFile, error) {
+	if err := os.MkdirAll(filepath.Join(a.dir, hour), 0o755); err != nil {
+		return nil, fmt.Errorf("error creating hour directory, %w", err)
+	}
+	tmp := filepath.Join(hour, fmt.Sprintf("part-%d-%020d%s%s", partition, start, fileSuffix, tmpSuffix))
+	f, err := os.Create(filepath.Join(a.dir, tmp))
+	if err != nil {
+		return nil, fmt.Errorf("error creating archive file, %w", err)
+	}
+	gz := gzip.NewWriter(f)
+	return &hourFile{tmp: tmp, hour: hour, f: f, gz: gz, enc: json.NewEncoder(gz)}, nil
+}
+
+// Pending returns the number of tags in the open batch of the partition.
+func (a *Archive) Pending(partition int32) int {
+	if b, ok := a.batches[partition]; ok {
+		return b.count
+	}
+	return 0
+}
+
+// Flush commits the open batch of the partition and finalizes its files, named after the range of its offsets.
+// After an error the archive must be opened again, which finalizes the batch if it was committed.
+func (a *Archive) Flush(partition int32) error {
+	b, ok := a.batches[partition]
+	if !ok {
+		return nil
+	}
+	end := a.next[partition]
+	m := manifest{Partition: partition, Start: b.start, End: end}
+	for _, f := range b.files {
+		if err := f.close(); err != nil {
+			return err
+		}
+		final := filepath.Join(f.hour, fmt.Sprintf("part-%d-%020d-%020d%s", partition, b.start, end-1, fileSuffix))
+		m.Files = append(m.Files, manifestFile{Tmp: f.tmp, Final: final})
+	}
+	if err := a.writeManifest(m); err != nil {
+		return err
+	}
+	delete(a.batches, partition)
+	return a.finalize(m)
+}
+
+// FlushAll flushes open batches of all partitions.
+func (a *Archive) FlushAll() error {
+	for p := range a.batches {
+		if err := a.Flush(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes files of open batches without committing them, they are removed when the archive is opened again.
+func (a *Archive) Close() error {
+	var firstErr error
+	for p, b := range a.batches {
+		for _, f := range b.files {
+			if err := f.close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		delete(a.batches, p)
+	}
+	return firstErr
+}
+
+func (f *hourFile) close() error {
+	if err := f.gz.Close(); err != nil {
+		_ = f.f.Close()
+		return fmt.Errorf("error compressing %s, %w", f.tmp, err)
+	}
+	if err := f.f.Sync(); err != nil {
+		_ = f.f.Close()
+		return fmt.Errorf("error syncing %s, %w", f.tmp, err)
+	}
+	if err := f.f.Close(); err != nil {
+		return fmt.Errorf("error closing %s, %w", f.tmp, err)
+	}
+	return nil
+}
+
+func (a *Archive) manifestPath(partition int32) string {
+	return filepath.Join(a.dir, manifestsDir, fmt.Sprintf("part-%d.json", partition))
+}
+
+// writeManifest atomically replaces the manifest of the partition, committing the batch.
+func (a *Archive) writeManifest(m manifest) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("error marshalling manifest, %w", err)
+	}
+	path := a.manifestPath(m.Partition)
+	f, err := os.Create(path + tmpSuffix)
+	if err != nil {
+		return fmt.Errorf("error creating manifest, %w", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("error writing manifest, %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("error syncing manifest, %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("error closing manifest, %w", err)
+	}
+	if err := os.Rename(path+tmpSuffix, path); err != nil {
+		return fmt.Errorf("error committing manifest, %w", err)
+	}
+	return nil
+}
+
+// finalize renames temporary files of the committed batch, files renamed before are skipped.
+func (a *Archive) finalize(m manifest) error {
+	for _, f := range m.Files {
+		if _, err := os.Stat(filepath.Join(a.dir, f.Final)); err == nil {
+			continue
+		}
+		if err := os.Rename(filepath.Join(a.dir, f.Tmp), filepath.Join(a.dir, f.Final)); err != nil {
+			return fmt.Errorf("error finalizing %s, %w", f.Final, err)
+		}
+	}
+	return nil
+}
+
+// filePartition returns the partition in the name of a manifest or a file of tags, like part-3-....
+func filePartition(name string) (int32, bool) {
+	if !strings.HasPrefix(name, "part-") {
+		return 0, false
+	}
+	digits := strings.TrimPrefix(name, "part-")
+	if i := strings.IndexAny(digits, "-."); i >= 0 {
+		digits = digits[:i]
+	}
+	p, err := strconv.ParseInt(digits, 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return int32(p), true
+}
+
+func (a *Archive) recover() error {
+	manifests, err := os.ReadDir(filepath.Join(a.dir, manifestsDir))
+	if err != nil {
+		return fmt.Errorf("error listing manifests, %w", err)
+	}
+	for _, e := range manifests {
+		if p, ok := filePartition(e.Name()); !ok || !a.partitions[p] {
+			continue
+		}
+		path := filepath.Join(a.dir, manifestsDir, e.Name())
+		if strings.HasSuffix(e.Name(), tmpSuffix) {
+			if err := os.Remove(path); err != nil {
+				return fmt.Errorf("error removing uncommitted manifest, %w", err)
+			}
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("error reading manifest, %w", err)
+		}
+		var m manifest
+		if err := json.Unmarshal(data, &m); err != nil {
+			return fmt.Errorf("error parsing manifest %s, %w", e.Name(), err)
+		}
+		if err := a.finalize(m); err != nil {
+			return err
+		}
+		a.next[m.Partition] = m.End
+	}
+
+	// Temporary files of the partitions left after finalizing committed batches belong to uncommitted ones.
+	return filepath.WalkDir(a.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(path, fileSuffix+tmpSuffix) {
+			return nil
+		}
+		if p, ok := filePartition(d.Name()); ok && a.partitions[p] {
+			if err := os.Remove(path); err != nil {
+				return fmt.Errorf("error removing uncommitted file, %w", err)
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,148 @@
+package archive
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/TomaszDomagala/Allezon/src/pkg/types"
+)
+
+var t0 = time.Date(2022, 3, 1, 10, 0, 0, 0, time.UTC)
+
+func testTag(cookie string, t time.Time) types.UserTag {
+	return types.UserTag{
+		Time:    t,
+		Cookie:  cookie,
+		Country: "PL",
+		Device:  types.Pc,
+		Action:  types.View,
+		Origin:  "origin",
+		ProductInfo: types.ProductInfo{
+			ProductId:  1,
+			BrandId:    "brand",
+			CategoryId: "category",
+			Price:      100,
+		},
+	}
+}
+
+func readAll(t *testing.T, dir string) []string {
+	var cookies []string
+	err := Read(dir, time.Time{}, t0.Add(24*time.Hour), func(tag types.UserTag) error {
+		cookies = append(cookies, tag.Cookie)
+		return nil
+	})
+	require.NoError(t, err)
+	return cookies
+}
+
+func TestArchive(t *testing.T) {
+	dir := t.TempDir()
+	a, err := Open(dir, []int32{0, 1}, 24)
+	require.NoError(t, err)
+
+	require.NoError(t, a.Add(0, 10, testTag("a", t0)))
+	require.NoError(t, a.Add(0, 11, testTag("b", t0.Add(time.Hour))))
+	require.NoError(t, a.Add(0, 12, testTag("c", t0.Add(time.Minute))))
+	require.NoError(t, a.Add(1, 5, testTag("d", t0)))
+	assert.Equal(t, 3, a.Pending(0))
+	assert.Empty(t, readAll(t, dir), "open batches are not readable")
+
+	require.NoError(t, a.FlushAll())
+	assert.Equal(t, map[int32]int64{0: 13, 1: 6}, a.Offsets())
+	assert.FileExists(t, filepath.Join(dir, "hour=2022-03-01T10", "part-0-00000000000000000010-00000000000000000012.ndjson.gz"))
+	assert.FileExists(t, filepath.Join(dir, "hour=2022-03-01T11", "part-0-00000000000000000010-00000000000000000012.ndjson.gz"))
+
+	hours, err := Hours(dir)
+	require.NoError(t, err)
+	assert.Equal(t, []time.Time{t0, t0.Add(time.Hour)}, hours)
+
+	var tags []types.UserTag
+	require.NoError(t, Read(dir, t0, t0.Add(time.Hour), func(tag types.UserTag) error {
+		tags = append(tags, tag)
+		return nil
+	}))
+	assert.ElementsMatch(t, []types.UserTag{testTag("a", t0), testTag("c", t0.Add(time.Minute)), testTag("d", t0)}, tags)
+
+	a, err = Open(dir, []int32{0, 1}, 24)
+	require.NoError(t, err)
+	assert.Equal(t, map[int32]int64{0: 13, 1: 6}, a.Offsets(), "offsets are recovered from manifests")
+	require.NoError(t, a.Add(0, 12, testTag("c", t0)))
+	assert.Equal(t, 0, a.Pending(0), "archived offsets are skipped")
+}
+
+func TestArchiveRecovery(t *testing.T) {
+	dir := t.TempDir()
+	a, err := Open(dir, []int32{0, 1}, 24)
+	require.NoError(t, err)
+	require.NoError(t, a.Add(0, 0, testTag("a", t0)))
+	require.NoError(t, a.Flush(0))
+
+	// A crash before committing the batch loses its files, its tags are archived again.
+	require.NoError(t, a.Add(0, 1, testTag("b", t0)))
+	require.NoError(t, a.Close())
+	a, err = Open(dir, []int32{0, 1}, 24)
+	require.NoError(t, err)
+	assert.Equal(t, map[int32]int64{0: 1}, a.Offsets())
+	assert.Equal(t, []string{"a"}, readAll(t, dir))
+	tmp, err := filepath.Glob(filepath.Join(dir, "*", "*"+tmpSuffix))
+	require.NoError(t, err)
+	assert.Empty(t, tmp, "files of uncommitted batches are removed")
+
+	// A crash after committing the batch finalizes its files on open.
+	require.NoError(t, a.Add(0, 1, testTag("b", t0)))
+	b := a.batches[0]
+	m := manifest{Partition: 0, Start: 1, End: 2}
+	for _, f := range b.files {
+		require.NoError(t, f.close())
+		m.Files = append(m.Files, manifestFile{Tmp: f.tmp, Final: filepath.Join(f.hour, "part-0-00000000000000000001-00000000000000000001.ndjson.gz")})
+	}
+	require.NoError(t, a.writeManifest(m))
+	a, err = Open(dir, []int32{0, 1}, 24)
+	require.NoError(t, err)
+	assert.Equal(t, map[int32]int64{0: 2}, a.Offsets())
+	assert.ElementsMatch(t, []string{"a", "b"}, readAll(t, dir))
+
+	entries, err := os.ReadDir(filepath.Join(dir, manifestsDir))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1, "only the last manifest of a partition is kept")
+}
+
+func TestArchiveMaxOpenFiles(t *testing.T) {
+	dir := t.TempDir()
+	a, err := Open(dir, []int32{0}, 2)
+	require.NoError(t, err)
+
+	require.NoError(t, a.Add(0, 0, testTag("a", t0)))
+	require.NoError(t, a.Add(0, 1, testTag("b", t0.Add(time.Hour))))
+	require.NoError(t, a.Add(0, 2, testTag("c", t0)))
+	assert.Empty(t, readAll(t, dir))
+
+	// The third hour commits the batch of the first two.
+	require.NoError(t, a.Add(0, 3, testTag("d", t0.Add(2*time.Hour))))
+	assert.ElementsMatch(t, []string{"a", "b", "c"}, readAll(t, dir))
+	assert.Equal(t, 1, a.Pending(0))
+	assert.Equal(t, map[int32]int64{0: 3}, a.Offsets())
+}
+
+func TestArchivePartitions(t *testing.T) {
+	dir := t.TempDir()
+	a, err := Open(dir, []int32{0}, 24)
+	require.NoError(t, err)
+	require.NoError(t, a.Add(0, 0, testTag("a", t0)))
+	assert.Error(t, a.Add(1, 0, testTag("b", t0)), "partitions of other archives are refused")
+
+	// Opening the archive of another partition leaves the open batch of partition 0 alone.
+	other, err := Open(dir, []int32{1}, 24)
+	require.NoError(t, err)
+	assert.Empty(t, other.Offsets())
+	require.NoError(t, other.Add(1, 0, testTag("b", t0)))
+	require.NoError(t, other.FlushAll())
+	require.NoError(t, a.FlushAll())
+	assert.ElementsMatch(t, []string{"a", "b"}, readAll(t, dir))
+}
@@ -0,0 +1,102 @@
+package archive
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/TomaszDomagala/Allezon/src/pkg/dto"
+	"github.com/TomaszDomagala/Allezon/src/pkg/types"
+)
+
+// Hours returns hours with archived tags, sorted in ascending order.
+func Hours(dir string) ([]time.Time, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error listing archive directory, %w", err)
+	}
+	var hours []time.Time
+	for _, e := range entries {
+		if !e.IsDir() || !strings.HasPrefix(e.Name(), hourPrefix) {
+			continue
+		}
+		hour, err := time.Parse(HourLayout, strings.TrimPrefix(e.Name(), hourPrefix))
+		if err != nil {
+			return nil, fmt.Errorf("invalid hour directory %s, %w", e.Name(), err)
+		}
+		hours = append(hours, hour)
+	}
+	sort.Slice(hours, func(i, j int) bool { return hours[i].Before(hours[j]) })
+	return hours, nil
+}
+
+// Read calls fn with archived tags with times in [from, to), hour by hour. Tags of a partition of the user tags topic
+// come in order of their offsets within an hour. It stops at the first error returned by fn.
+func Read(dir string, from, to time.Time, fn func(types.UserTag) error) error {
+	hours, err := Hours(dir)
+	if err != nil {
+		return err
+	}
+	for _, hour := range hours {
+		if !hour.Add(time.Hour).After(from) || !hour.Before(to) {
+			continue
+		}
+		files, err := filepath.Glob(filepath.Join(dir, hourPrefix+hour.Format(HourLayout), "*"+fileSuffix))
+		if err != nil {
+			return fmt.Errorf("error listing archive files, %w", err)
+		}
+		sort.Strings(files)
+		for _, file := range files {
+			err := ReadFile(file, func(tag types.UserTag) error {
+				if tag.Time.Before(from) || !tag.Time.Before(to) {
+					return nil
+				}
+				return fn(tag)
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ReadFile calls fn with tags of the archive file, in order. It stops at the first error returned by fn.
+func ReadFile(path string, fn func(types.UserTag) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error opening archive file, %w", err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("error decompressing %s, %w", path, err)
+	}
+	defer gz.Close()
+
+	scanner := bufio.NewScanner(gz)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var d dto.UserTagDTO
+		if err := json.Unmarshal(scanner.Bytes(), &d); err != nil {
+			return fmt.Errorf("error parsing tag in %s, %w", path, err)
+		}
+		tag, err := dto.FromUserTagDTO(d)
+		if err != nil {
+			return fmt.Errorf("error converting tag in %s, %w", path, err)
+		}
+		if err := fn(tag); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error reading %s, %w", path, err)
+	}
+	return nil
+}
@@ -30,7 +30,7 @@ var (
 				fmt.Sprintf("KAFKA_ADDRESSES=redpanda:%s", RedpandaPort),
 				fmt.Sprintf("DB_PROFILES_ADDRESSES=aerospike:%s", AerospikePort),
 				fmt.Sprintf("DB_AGGREGATES_ADDRESSES=aerospike:%s", AerospikePort),
-				fmt.Sprintf("ID_GETTER_ADDRESS=idgetter:%s", IDGetterPort),
+				fmt.Sprintf("ID_GETTER_ADDRESSES=idgetter:%s", IDGetterPort),
 				"LOG_LEVEL=DEBUG",
 			},
 		},
@@ -1,9 +1,12 @@
 package db
 
 import (
+	"expvar"
 	"fmt"
+	"math"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	as "github.com/aerospike/aerospike-client-go/v6"
@@ -17,16 +20,45 @@ import (
 const (
 	aggregatesNamespace = "allezon"
 
-	// aggregatesSet is the name of the set used for storing aggregates.
-	aggregatesSet = "aggregates"
-
+	// aggregatesIndex is the name of the index of the default set, indexes of other sets are prefixed with their names.
 	aggregatesIndex = "ts"
 	aggregatesTsBin = "ts"
 
 	aggregatesViewsBin = "views"
 	aggregatesBuysBin  = "buys"
+
+	// Suffixes of bins holding the optional state of an action.
+	// Min and max bins are key ordered maps trimmed to their single smallest or largest price.
+	aggregatesMinSuffix = "_min"
+	aggregatesMaxSuffix = "_max"
+	aggregatesHLLSuffix = "_hll"
+	// aggregatesHistogramSuffix is the suffix of the map of buckets of the PriceHistogram to counts of prices.
+	aggregatesHistogramSuffix = "_hist"
+
+	// aggregatesHLLIndexBits gives about 3% standard error of unique cookies, using 768 bytes per sketch.
+	aggregatesHLLIndexBits = 10
+
+	// Suffixes of bins holding Space-Saving sketches of products of an action, maps of at most
+	// TopSketchCapacity product ids to their count and sum of prices.
+	aggregatesProductCountSuffix = "_prod_cnt"
+	aggregatesProductSumSuffix   = "_prod_sum"
+
+	// aggregatesCorrectionSuffix is the suffix of the bin summing prices and counting tags that arrived after
+	// the bucket was finalized, encoded like the bin of the action. They are not included in aggregates.
+	aggregatesCorrectionSuffix = "_late"
+
+	// Bins holding the brand and category of the tags, as ids of the key can't be resolved back to names.
+	aggregatesBrandBin    = "brand"
+	aggregatesCategoryBin = "category"
 )
 
+// TopSketchCapacity is the number of products kept by each sketch, and so the largest number of top products
+// that can be reliably requested.
+const TopSketchCapacity = 100
+
+// topMaxAttempts bounds the attempts of adding a product to sketches modified concurrently.
+const topMaxAttempts = 10
+
 // For some peculiar reason client devs decided that even though it's int64 in the db they are going to use int.
 // Fortunately on Linux x86_64 it's 64bit.
 type aerospikeInt = int
@@ -34,6 +66,8 @@ type aerospikeInt = int
 type aggregatesClient struct {
 	cl *as.Client
 	l  *zap.Logger
+	// set holds the name of the set, shared with the client following the active set.
+	set *atomic.Pointer[string]
 }
 
 func toKey(ts int64, key AggregateKey) string {
@@ -50,10 +84,17 @@ func (a *AggregateKey) decode(key uint64) {
 	a.BrandId = uint16(key)
 	key >>= 16
 	a.CategoryId = uint16(key)
+	key >>= 16
+	a.CountryId = uint16(key) & MaxCountryId
+	key >>= 13
+	a.Device = uint8(key) & 0b11
 }
 
+// encode packs the key into 63 bits, so it stays a positive aerospikeInt. Bits of the country and device were
+// zero before they were tracked, so old records decode as an unknown country and device.
 func (a *AggregateKey) encode() aerospikeInt {
-	return aerospikeInt(a.CategoryId)<<32 | aerospikeInt(a.BrandId)<<16 | aerospikeInt(a.Origin)
+	return aerospikeInt(a.Device&0b11)<<61 | aerospikeInt(a.CountryId&MaxCountryId)<<48 |
+		aerospikeInt(a.CategoryId)<<32 | aerospikeInt(a.BrandId)<<16 | aerospikeInt(a.Origin)
 }
 
 func encodeSumAndCount(price uint32) uint64 {
@@ -66,14 +107,30 @@ func decodeSumAndCount(v uint64) (sum uint64, count uint16) {
 	return
 }
 
-func (a aggregatesClient) Get(t time.Time, action types.Action) (agg []ActionAggregates, err error) {
+func (a aggregatesClient) Get(t time.Time, action types.Action) ([]ActionAggregates, error) {
+	return a.get(t, action, false, false)
+}
+
+func (a aggregatesClient) GetWithCookies(t time.Time, action types.Action) ([]ActionAggregates, error) {
+	return a.get(t, action, true, false)
+}
+
+func (a aggregatesClient) GetWithTop(t time.Time, action types.Action) ([]ActionAggregates, error) {
+	return a.get(t, action, false, true)
+}
+
+func (a aggregatesClient) get(t time.Time, action types.Action, withCookies bool, withTop bool) (agg []ActionAggregates, err error) {
 	ts := toTs(t)
-	if err != nil {
-		return nil, err
-	}
 
 	binName := a.actionToBin(action)
-	stmt := as.NewStatement(aggregatesNamespace, aggregatesSet, binName)
+	binNames := []string{binName, binName + aggregatesMinSuffix, binName + aggregatesMaxSuffix, binName + aggregatesHistogramSuffix}
+	if withCookies {
+		binNames = append(binNames, binName+aggregatesHLLSuffix)
+	}
+	if withTop {
+		binNames = append(binNames, binName+aggregatesProductCountSuffix, binName+aggregatesProductSumSuffix, aggregatesBrandBin, aggregatesCategoryBin)
+	}
+	stmt := as.NewStatement(aggregatesNamespace, a.setName(), binNames...)
 	stmt.Filter = as.NewEqualFilter(aggregatesTsBin, ts)
 
 	qP := as.NewQueryPolicy()
@@ -110,12 +167,184 @@ func (a aggregatesClient) Get(t time.Time, action types.Action) (agg []ActionAgg
 		var a ActionAggregates
 		a.Sum, a.Count = decodeSumAndCount(uint64(sumCount))
 		a.Key.decode(key)
+		if err := decodePriceRange(&a, r.Record.Bins, binName); err != nil {
+			return nil, err
+		}
+		histogram, err := decodeIntMap(r.Record.Bins, binName+aggregatesHistogramSuffix)
+		if err != nil {
+			return nil, err
+		}
+		a.PriceHistogram = histogram
+		if raw, ok := r.Record.Bins[binName+aggregatesHLLSuffix]; ok && raw != nil {
+			hll, ok := raw.(as.HLLValue)
+			if !ok {
+				return nil, fmt.Errorf(`bin "%s" is not an %T but %T`, binName+aggregatesHLLSuffix, hll, raw)
+			}
+			a.Cookies = HLL(hll)
+		}
+		if withTop {
+			if err := decodeTop(&a, r.Record.Bins, binName); err != nil {
+				return nil, err
+			}
+		}
 
 		agg = append(agg, a)
 	}
 	return
 }
 
+// decodePriceRange sets the price range of the aggregate, if the record tracks it.
+func decodePriceRange(agg *ActionAggregates, bins as.BinMap, binName string) error {
+	minPrice, okMin, err := decodePrice(bins, binName+aggregatesMinSuffix)
+	if err != nil {
+		return err
+	}
+	maxPrice, okMax, err := decodePrice(bins, binName+aggregatesMaxSuffix)
+	if err != nil {
+		return err
+	}
+	if okMin && okMax {
+		agg.MinPrice, agg.MaxPrice, agg.HasPriceRange = minPrice, maxPrice, true
+	}
+	return nil
+}
+
+// decodePrice returns the single price kept in the min or max bin.
+func decodePrice(bins as.BinMap, binName string) (uint32, bool, error) {
+	raw, ok := bins[binName]
+	if !ok || raw == nil {
+		return 0, false, nil
+	}
+	var key interface{}
+	switch m := raw.(type) {
+	case []as.MapPair:
+		if len(m) == 0 {
+			return 0, false, nil
+		}
+		key = m[0].Key
+	case map[interface{}]interface{}:
+		for k := range m {
+			key = k
+		}
+		if key == nil {
+			return 0, false, nil
+		}
+	default:
+		return 0, false, fmt.Errorf(`bin "%s" has a wrong type: %T`, binName, raw)
+	}
+	price, ok := key.(aerospikeInt)
+	if !ok {
+		return 0, false, fmt.Errorf(`key of bin "%s" is not an %T but %T`, binName, price, key)
+	}
+	return uint32(price), true, nil
+}
+
+// decodeTop sets the product sketches and names of the brand and category of the aggregate.
+func decodeTop(agg *ActionAggregates, bins as.BinMap, binName string) (err error) {
+	agg.ProductCounts, err = decodeIntMap(bins, binName+aggregatesProductCountSuffix)
+	if err != nil {
+		return err
+	}
+	agg.ProductSums, err = decodeIntMap(bins, binName+aggregatesProductSumSuffix)
+	if err != nil {
+		return err
+	}
+	agg.BrandName, err = decodeName(bins, aggregatesBrandBin)
+	if err != nil {
+		return err
+	}
+	agg.CategoryName, err = decodeName(bins, aggregatesCategoryBin)
+	return err
+}
+
+// decodeIntMap decodes a map of integers, like sketches of products and price histograms.
+func decodeIntMap(bins as.BinMap, binName string) (map[int]uint64, error) {
+	raw, ok := bins[binName]
+	if !ok || raw == nil {
+		return nil, nil
+	}
+	res := make(map[int]uint64)
+	add := func(k, v interface{}) error {
+		key, ok := k.(aerospikeInt)
+		if !ok {
+			return fmt.Errorf(`key of bin "%s" is not an %T but %T`, binName, key, k)
+		}
+		value, ok := v.(aerospikeInt)
+		if !ok {
+			return fmt.Errorf(`value of bin "%s" is not an %T but %T`, binName, value, v)
+		}
+		res[key] = uint64(value)
+		return nil
+	}
+	switch m := raw.(type) {
+	case []as.MapPair:
+		for _, p := range m {
+			if err := add(p.Key, p.Value); err != nil {
+				return nil, err
+			}
+		}
+	case map[interface{}]interface{}:
+		for k, v := range m {
+			if err := add(k, v); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, fmt.Errorf(`bin "%s" has a wrong type: %T`, binName, raw)
+	}
+	return res, nil
+}
+
+func decodeName(bins as.BinMap, binName string) (string, error) {
+	raw, ok := bins[binName]
+	if !ok || raw == nil {
+		return "", nil
+	}
+	name, ok := raw.(string)
+	if !ok {
+		return "", fmt.Errorf(`bin "%s" is not a %T but %T`, binName, name, raw)
+	}
+	return name, nil
+}
+
+// CountUniqueCookies counts the union on the server, using the record of the first aggregate with a sketch.
+func (a aggregatesClient) CountUniqueCookies(t time.Time, action types.Action, aggs []ActionAggregates) (uint64, error) {
+	var anchor *ActionAggregates
+	var others []as.HLLValue
+	for i := range aggs {
+		if aggs[i].Cookies == nil {
+			continue
+		}
+		if anchor == nil {
+			anchor = &aggs[i]
+			continue
+		}
+		others = append(others, as.HLLValue(aggs[i].Cookies))
+	}
+	if anchor == nil {
+		return 0, nil
+	}
+
+	key, err := as.NewKey(aggregatesNamespace, a.setName(), toKey(toTs(t), anchor.Key))
+	if err != nil {
+		return 0, err
+	}
+	binName := a.actionToBin(action) + aggregatesHLLSuffix
+	op := as.HLLGetCountOp(binName)
+	if len(others) > 0 {
+		op = as.HLLGetUnionCountOp(binName, others)
+	}
+	r, aerr := a.cl.Operate(nil, key, op)
+	if aerr != nil {
+		return 0, fmt.Errorf("error counting unique cookies, %w", aerr)
+	}
+	count, ok := r.Bins[binName].(aerospikeInt)
+	if !ok {
+		return 0, fmt.Errorf(`count of bin "%s" is not an %T but %T`, binName, count, r.Bins[binName])
+	}
+	return uint64(count), nil
+}
+
 func (a aggregatesClient) actionToBin(action types.Action) string {
 	switch action {
 	case types.Buy:
@@ -129,45 +358,179 @@ func (a aggregatesClient) actionToBin(action types.Action) string {
 }
 
 func (a aggregatesClient) Add(aKey AggregateKey, tag types.UserTag) error {
+	binName := a.actionToBin(tag.Action)
+	encoded := encodeSumAndCount(tag.ProductInfo.Price)
+	bin := as.Bin{
+		Name:  binName,
+		Value: as.NewLongValue(int64(encoded)),
+	}
+	ops := []*as.Operation{as.AddOp(&bin)}
+	ops = append(ops, a.priceRangeOps(binName, tag.ProductInfo.Price)...)
+	ops = append(ops, as.HLLAddOp(as.DefaultHLLPolicy(), binName+aggregatesHLLSuffix, []as.Value{as.NewStringValue(tag.Cookie)}, aggregatesHLLIndexBits, -1))
+	ops = append(ops, topGetOps(binName)...)
+	key, r, err := a.operate(aKey, tag, ops)
+	if err != nil {
+		return err
+	}
+	// Other aggregates of the tag are already added, so retrying it would count it twice.
+	if err := a.addToTop(key, r, binName, tag); err != nil {
+		topSketchFailures.Add(1)
+		a.l.Warn("error adding tag to top products, it's missing from sketches", zap.Any("key", aKey), zap.Error(err))
+	}
+	return nil
+}
+
+func (a aggregatesClient) AddCorrection(aKey AggregateKey, tag types.UserTag) error {
+	encoded := encodeSumAndCount(tag.ProductInfo.Price)
+	bin := as.Bin{
+		Name:  a.actionToBin(tag.Action) + aggregatesCorrectionSuffix,
+		Value: as.NewLongValue(int64(encoded)),
+	}
+	_, _, err := a.operate(aKey, tag, []*as.Operation{as.AddOp(&bin)})
+	return err
+}
+
+// operate applies ops to the record of the bucket of the tag, creating it if it doesn't exist.
+// It returns the key of the record and the result of ops.
+func (a aggregatesClient) operate(aKey AggregateKey, tag types.UserTag, ops []*as.Operation) (*as.Key, *as.Record, error) {
 	ts := toTs(tag.Time)
 	name := toKey(ts, aKey)
-	key, ae := as.NewKey(aggregatesNamespace, aggregatesSet, name)
+	key, ae := as.NewKey(aggregatesNamespace, a.setName(), name)
 	if ae != nil {
-		return ae
+		return nil, nil, ae
 	}
 
 	updatePolicy := as.NewWritePolicy(0, as.TTLServerDefault)
 	updatePolicy.RecordExistsAction = as.UPDATE_ONLY
 
-	binName := a.actionToBin(tag.Action)
-	encoded := encodeSumAndCount(tag.ProductInfo.Price)
-	bin := as.Bin{
-		Name:  binName,
-		Value: as.NewLongValue(int64(encoded)),
-	}
-	increaseCountOp := as.AddOp(&bin)
-
-	if _, err := a.cl.Operate(updatePolicy, key, increaseCountOp); err != nil {
+	r, err := a.cl.Operate(updatePolicy, key, ops...)
+	if err != nil {
 		if err.Matches(asTypes.KEY_NOT_FOUND_ERROR) {
 			createPolicy := as.NewWritePolicy(0, as.TTLServerDefault)
 			createPolicy.RecordExistsAction = as.CREATE_ONLY
 			createPolicy.SendKey = true
-			if err := a.cl.Put(createPolicy, key, as.BinMap{
-				binName:         int64(encoded),
-				aggregatesTsBin: ts,
-			}); err != nil {
-				return fmt.Errorf("error while trying to add to aggregates, time: %s, aKey: %s, price: %d, action %s, %w", name, spew.Sprint(aKey), tag.ProductInfo.Price, tag.Action, err)
+			tsBin := as.NewBin(aggregatesTsBin, ts)
+			if r, err = a.cl.Operate(createPolicy, key, append(ops, as.PutOp(tsBin))...); err != nil {
+				return nil, nil, fmt.Errorf("error while trying to add to aggregates, time: %s, aKey: %s, price: %d, action %s, %w", name, spew.Sprint(aKey), tag.ProductInfo.Price, tag.Action, err)
 			}
 		} else {
-			return fmt.Errorf("error while trying to add to aggregates, time: %s, aKey: %s, price: %d, action %s, %w", name, spew.Sprint(aKey), tag.ProductInfo.Price, tag.Action, err)
+			return nil, nil, fmt.Errorf("error while trying to add to aggregates, time: %s, aKey: %s, price: %d, action %s, %w", name, spew.Sprint(aKey), tag.ProductInfo.Price, tag.Action, err)
 		}
 	}
 
-	return nil
+	return key, r, nil
+}
+
+// priceRangeOps put the price in the min and max maps and trim them back to their smallest and largest price.
+// They also count the price in its bucket of the histogram.
+// Maps are used instead of integers, as they can be updated conditionally in a single atomic operation.
+func (a aggregatesClient) priceRangeOps(binName string, price uint32) []*as.Operation {
+	mapPolicy := as.NewMapPolicy(as.MapOrder.KEY_ORDERED, as.MapWriteMode.UPDATE)
+	minBin, maxBin := binName+aggregatesMinSuffix, binName+aggregatesMaxSuffix
+	return []*as.Operation{
+		as.MapPutOp(mapPolicy, minBin, int64(price), 1),
+		as.MapRemoveByIndexRangeOp(minBin, 1, as.MapReturnType.NONE),
+		as.MapPutOp(mapPolicy, maxBin, int64(price), 1),
+		as.MapRemoveByIndexRangeCountOp(maxBin, -1, 1, as.MapReturnType.NONE|as.MapReturnType.INVERTED),
+		as.MapIncrementOp(mapPolicy, binName+aggregatesHistogramSuffix, priceHistogramBucket(price), 1),
+	}
+}
+
+// topGetOps read the sketches of products of the action and the names of the record, as needed by addToTop.
+func topGetOps(binName string) []*as.Operation {
+	return []*as.Operation{
+		as.GetBinOp(binName + aggregatesProductCountSuffix),
+		as.GetBinOp(binName + aggregatesProductSumSuffix),
+		as.GetBinOp(aggregatesBrandBin),
+		as.GetBinOp(aggregatesCategoryBin),
+	}
+}
+
+// topSketchFailures counts tags missing from sketches of top products, as adding them failed.
+var topSketchFailures = expvar.NewInt("aggregates_top_sketch_failures")
+
+// addToTop adds the product of the tag to the Space-Saving sketches of the record r, read by topGetOps. A product
+// missing from a full sketch replaces the one with the smallest value and inherits it, so sketches overestimate
+// products rather than losing heavy hitters that arrive late. Sketches are written only if the record wasn't
+// modified since r was read, otherwise they are read again, up to topMaxAttempts times.
+func (a aggregatesClient) addToTop(key *as.Key, r *as.Record, binName string, tag types.UserTag) error {
+	policy := as.NewWritePolicy(0, as.TTLServerDefault)
+	policy.RecordExistsAction = as.UPDATE_ONLY
+	policy.GenerationPolicy = as.EXPECT_GEN_EQUAL
+
+	countBin, sumBin := binName+aggregatesProductCountSuffix, binName+aggregatesProductSumSuffix
+	productId := tag.ProductInfo.ProductId
+	for attempt := 0; attempt < topMaxAttempts; attempt++ {
+		countOps, err := spaceSavingOps(r.Bins, countBin, productId, 1)
+		if err != nil {
+			return err
+		}
+		sumOps, err := spaceSavingOps(r.Bins, sumBin, productId, uint64(tag.ProductInfo.Price))
+		if err != nil {
+			return err
+		}
+		ops := append(countOps, sumOps...)
+		// Names are the same for all tags of the record, as its key holds ids of the brand and category.
+		if r.Bins[aggregatesBrandBin] == nil {
+			ops = append(ops, as.PutOp(as.NewBin(aggregatesBrandBin, tag.ProductInfo.BrandId)))
+		}
+		if r.Bins[aggregatesCategoryBin] == nil {
+			ops = append(ops, as.PutOp(as.NewBin(aggregatesCategoryBin, tag.ProductInfo.CategoryId)))
+		}
+
+		policy.Generation = r.Generation
+		_, aerr := a.cl.Operate(policy, key, ops...)
+		if aerr == nil {
+			return nil
+		}
+		if !aerr.Matches(asTypes.GENERATION_ERROR) {
+			return fmt.Errorf("error adding product %d to top products, %w", productId, aerr)
+		}
+		if r, aerr = a.cl.Get(nil, key, countBin, sumBin, aggregatesBrandBin, aggregatesCategoryBin); aerr != nil {
+			return fmt.Errorf("error reading top products, %w", aerr)
+		}
+	}
+	return fmt.Errorf("%w while adding product %d to top products %d times", GenerationMismatch, productId, topMaxAttempts)
+}
+
+// spaceSavingOps add value to the product in the sketch held in the bin.
+func spaceSavingOps(bins as.BinMap, binName string, productId int, value uint64) ([]*as.Operation, error) {
+	sketch, err := decodeIntMap(bins, binName)
+	if err != nil {
+		return nil, err
+	}
+	mapPolicy := as.NewMapPolicy(as.MapOrder.KEY_ORDERED, as.MapWriteMode.UPDATE)
+	if _, ok := sketch[productId]; ok || len(sketch) < TopSketchCapacity {
+		return []*as.Operation{as.MapIncrementOp(mapPolicy, binName, int64(productId), int64(value))}, nil
+	}
+
+	minId, minValue := 0, uint64(math.MaxUint64)
+	for id, v := range sketch {
+		if v < minValue || v == minValue && id < minId {
+			minId, minValue = id, v
+		}
+	}
+	return []*as.Operation{
+		as.MapRemoveByKeyOp(binName, int64(minId), as.MapReturnType.NONE),
+		as.MapPutOp(mapPolicy, binName, int64(productId), int64(minValue+value)),
+	}, nil
+}
+
+func (a aggregatesClient) setName() string {
+	return *a.set.Load()
+}
+
+// indexName returns the name of the index of the set, unique in the namespace.
+func indexName(set string) string {
+	if set == DefaultAggregatesSet {
+		return aggregatesIndex
+	}
+	return set + "_" + aggregatesIndex
 }
 
 func (a aggregatesClient) createIndex() {
-	task, err := a.cl.CreateIndex(nil, aggregatesNamespace, aggregatesSet, aggregatesIndex, aggregatesTsBin, as.NUMERIC)
+	set := a.setName()
+	task, err := a.cl.CreateIndex(nil, aggregatesNamespace, set, indexName(set), aggregatesTsBin, as.NUMERIC)
 	if err != nil {
 		if err.Matches(asTypes.INDEX_FOUND) {
 			return
@@ -200,7 +563,15 @@ func (a aggregatesClient) decodeKey(key *as.Key) (ts int64, aKey uint64, err err
 }
 
 func (c client) Aggregates() AggregatesClient {
-	cl := aggregatesClient(c)
+	cl := aggregatesClient{cl: c.cl, l: c.l, set: c.activeAggregates}
+	cl.createIndex()
+	return cl
+}
+
+func (c client) AggregatesIn(set string) AggregatesClient {
+	name := new(atomic.Pointer[string])
+	name.Store(&set)
+	cl := aggregatesClient{cl: c.cl, l: c.l, set: name}
 	cl.createIndex()
 	return cl
 }
@@ -0,0 +1,237 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	as "github.com/aerospike/aerospike-client-go/v6"
+	asTypes "github.com/aerospike/aerospike-client-go/v6/types"
+	"go.uber.org/zap"
+)
+
+const (
+	aggregatesSetsNamespace = "allezon"
+
+	aggregatesSetsSet = "aggregates_sets"
+
+	// aggregatesSetsActiveKey is the key of the record with the name of the active set of aggregates.
+	aggregatesSetsActiveKey = "active"
+	aggregatesSetsActiveBin = "set"
+
+	// aggregatesRebuildsSet holds a record with the progress of the rebuild of every set, keyed by its name.
+	aggregatesRebuildsSet = "aggregates_rebuilds"
+
+	// aggregatesRebuildsOffsetsBin and aggregatesRebuildsEndsBin are maps from partitions to offsets.
+	aggregatesRebuildsSetBin       = "set"
+	aggregatesRebuildsOffsetsBin   = "offsets"
+	aggregatesRebuildsEndsBin      = "ends"
+	aggregatesRebuildsTagsBin      = "tags"
+	aggregatesRebuildsStartedAtBin = "started_at"
+	aggregatesRebuildsUpdatedAtBin = "updated_at"
+	aggregatesRebuildsDoneBin      = "done"
+	aggregatesRebuildsSwitchedBin  = "switched"
+)
+
+// ShadowAggregatesSetPrefix prefixes names of shadow sets of aggregates, the only sets which can be rebuilt.
+const ShadowAggregatesSetPrefix = DefaultAggregatesSet + "_"
+
+// maxSetNameLength is the limit of length of names of aerospike sets.
+const maxSetNameLength = 63
+
+// CheckShadowAggregatesSet returns an error if the set is not a shadow set of aggregates, so that rebuilds never
+// clear other sets of the namespace.
+func CheckShadowAggregatesSet(set string) error {
+	if !strings.HasPrefix(set, ShadowAggregatesSetPrefix) || len(set) == len(ShadowAggregatesSetPrefix) {
+		return fmt.Errorf("set %q is not a shadow set of aggregates, its name must start with %s", set, ShadowAggregatesSetPrefix)
+	}
+	if len(set) > maxSetNameLength {
+		return fmt.Errorf("set %q is longer than %d characters", set, maxSetNameLength)
+	}
+	return nil
+}
+
+type aggregatesSetClient struct {
+	cl     *as.Client
+	l      *zap.Logger
+	active *atomic.Pointer[string]
+}
+
+func (c client) AggregatesSets() AggregatesSetClient {
+	return aggregatesSetClient{cl: c.cl, l: c.l, active: c.activeAggregates}
+}
+
+func (a aggregatesSetClient) Active() (string, error) {
+	key, err := as.NewKey(aggregatesSetsNamespace, aggregatesSetsSet, aggregatesSetsActiveKey)
+	if err != nil {
+		return "", fmt.Errorf("error creating active aggregates set key, %w", err)
+	}
+	r, aerr := a.cl.Get(nil, key, aggregatesSetsActiveBin)
+	if aerr != nil {
+		if aerr.Matches(asTypes.KEY_NOT_FOUND_ERROR) {
+			return DefaultAggregatesSet, nil
+		}
+		return "", fmt.Errorf("failed to get active aggregates set, %w", aerr)
+	}
+	set, ok := r.Bins[aggregatesSetsActiveBin].(string)
+	if !ok {
+		return "", fmt.Errorf("bin %s has a wrong type: %T", aggregatesSetsActiveBin, r.Bins[aggregatesSetsActiveBin])
+	}
+	return set, nil
+}
+
+func (a aggregatesSetClient) Switch(set string) error {
+	key, err := as.NewKey(aggregatesSetsNamespace, aggregatesSetsSet, aggregatesSetsActiveKey)
+	if err != nil {
+		return fmt.Errorf("error creating active aggregates set key, %w", err)
+	}
+	if err := a.cl.PutBins(nil, key, as.NewBin(aggregatesSetsActiveBin, set)); err != nil {
+		return fmt.Errorf("error switching aggregates to set %s, %w", set, err)
+	}
+	return nil
+}
+
+func (a aggregatesSetClient) Follow(ctx context.Context, interval time.Duration) error {
+	if err := a.reload(); err != nil {
+		return err
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := a.reload(); err != nil {
+					a.l.Error("error reloading active aggregates set", zap.Error(err))
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (a aggregatesSetClient) reload() error {
+	set, err := a.Active()
+	if err != nil {
+		return err
+	}
+	if previous := a.active.Swap(&set); previous == nil || *previous != set {
+		a.l.Info("active aggregates set loaded", zap.String("set", set))
+	}
+	return nil
+}
+
+func (a aggregatesSetClient) Clear(set string) error {
+	if err := CheckShadowAggregatesSet(set); err != nil {
+		return fmt.Errorf("refusing to clear aggregates, %w", err)
+	}
+	active, err := a.Active()
+	if err != nil {
+		return err
+	}
+	if set == active {
+		return fmt.Errorf("refusing to clear the active aggregates set %s", set)
+	}
+	if err := a.cl.Truncate(nil, aggregatesNamespace, set, nil); err != nil {
+		return fmt.Errorf("error clearing aggregates set %s, %w", set, err)
+	}
+	return nil
+}
+
+func (a aggregatesSetClient) PutProgress(progress RebuildProgress) error {
+	key, err := as.NewKey(aggregatesSetsNamespace, aggregatesRebuildsSet, progress.Set)
+	if err != nil {
+		return fmt.Errorf("error creating rebuild key %s, %w", progress.Set, err)
+	}
+	bins := as.BinMap{
+		aggregatesRebuildsSetBin:       progress.Set,
+		aggregatesRebuildsOffsetsBin:   fromOffsets(progress.Offsets),
+		aggregatesRebuildsEndsBin:      fromOffsets(progress.Ends),
+		aggregatesRebuildsTagsBin:      int(progress.Tags),
+		aggregatesRebuildsStartedAtBin: progress.StartedAt.UnixMilli(),
+		aggregatesRebuildsUpdatedAtBin: progress.UpdatedAt.UnixMilli(),
+		aggregatesRebuildsDoneBin:      boolToInt(progress.Done),
+		aggregatesRebuildsSwitchedBin:  boolToInt(progress.Switched),
+	}
+	if err := a.cl.Put(nil, key, bins); err != nil {
+		return fmt.Errorf("error writing progress of rebuild %s, %w", progress.Set, err)
+	}
+	return nil
+}
+
+func (a aggregatesSetClient) Progress(set string) (RebuildProgress, error) {
+	key, err := as.NewKey(aggregatesSetsNamespace, aggregatesRebuildsSet, set)
+	if err != nil {
+		return RebuildProgress{}, fmt.Errorf("error creating rebuild key %s, %w", set, err)
+	}
+	r, aerr := a.cl.Get(nil, key)
+	if aerr != nil {
+		if aerr.Matches(asTypes.KEY_NOT_FOUND_ERROR) {
+			return RebuildProgress{}, KeyNotFoundError
+		}
+		return RebuildProgress{}, fmt.Errorf("failed to get progress of rebuild %s, %w", set, aerr)
+	}
+
+	offsets, oerr := toOffsets(r.Bins, aggregatesRebuildsOffsetsBin)
+	if oerr != nil {
+		return RebuildProgress{}, oerr
+	}
+	ends, oerr := toOffsets(r.Bins, aggregatesRebuildsEndsBin)
+	if oerr != nil {
+		return RebuildProgress{}, oerr
+	}
+	progress := RebuildProgress{Set: set, Offsets: offsets, Ends: ends}
+	ints := make(map[string]int)
+	for _, bin := range []string{aggregatesRebuildsTagsBin, aggregatesRebuildsStartedAtBin, aggregatesRebuildsUpdatedAtBin, aggregatesRebuildsDoneBin, aggregatesRebuildsSwitchedBin} {
+		v, ok := r.Bins[bin].(int)
+		if !ok {
+			return RebuildProgress{}, fmt.Errorf("bin %s has a wrong type: %T", bin, r.Bins[bin])
+		}
+		ints[bin] = v
+	}
+	progress.Tags = uint64(ints[aggregatesRebuildsTagsBin])
+	progress.StartedAt = time.UnixMilli(int64(ints[aggregatesRebuildsStartedAtBin])).UTC()
+	progress.UpdatedAt = time.UnixMilli(int64(ints[aggregatesRebuildsUpdatedAtBin])).UTC()
+	progress.Done = ints[aggregatesRebuildsDoneBin] != 0
+	progress.Switched = ints[aggregatesRebuildsSwitchedBin] != 0
+	return progress, nil
+}
+
+func fromOffsets(offsets map[int32]int64) map[int]int {
+	m := make(map[int]int, len(offsets))
+	for p, o := range offsets {
+		m[int(p)] = int(o)
+	}
+	return m
+}
+
+func toOffsets(bins as.BinMap, bin string) (map[int32]int64, error) {
+	values, ok := bins[bin].(map[interface{}]interface{})
+	if !ok {
+		return nil, fmt.Errorf("bin %s has a wrong type: %T", bin, bins[bin])
+	}
+	offsets := make(map[int32]int64, len(values))
+	for k, v := range values {
+		partition, ok := k.(int)
+		if !ok {
+			return nil, fmt.Errorf("unexpected type %T of key in bin %s", k, bin)
+		}
+		offset, ok := v.(int)
+		if !ok {
+			return nil, fmt.Errorf("unexpected type %T of value in bin %s", v, bin)
+		}
+		offsets[int32(partition)] = int64(offset)
+	}
+	return offsets, nil
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
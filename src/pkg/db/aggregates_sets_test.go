@@ -0,0 +1,16 @@
+package db
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckShadowAggregatesSet(t *testing.T) {
+	assert.NoError(t, CheckShadowAggregatesSet("aggregates_v2"))
+
+	for _, set := range []string{DefaultAggregatesSet, ShadowAggregatesSetPrefix, "user_profiles", "v2", "aggregates_" + strings.Repeat("x", 60)} {
+		assert.Error(t, CheckShadowAggregatesSet(set), set)
+	}
+}
@@ -1,8 +1,10 @@
 package db
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"sync/atomic"
 	"time"
 
 	as "github.com/aerospike/aerospike-client-go/v6"
@@ -13,11 +15,67 @@ import (
 
 var KeyNotFoundError = errors.New("key not found")
 var GenerationMismatch = errors.New("generation mismatch")
+var OutboxFullError = errors.New("outbox is full")
 
 type UserProfileClient interface {
 	Get(cookie string) (UserProfile, error)
-	Add(tag *types.UserTag) (newLen int, err error)
+	// GetPages returns a page of the newest limit tags for every request, in the order of requests, reading them
+	// in one operation. Tags are keyed by their timestamps, so new tags never shift pages of older ones. Missing
+	// profiles have no tags. Requests must be of different actions.
+	GetPages(cookie string, reqs []PageRequest, limit int) ([]TagsPage, error)
+	// Add adds tag to the profile of cookie. The cookie differs from the one of the tag if it's an alias.
+	Add(cookie string, tag *types.UserTag) (newLen int, err error)
 	RemoveOverLimit(cookie string, action types.Action, limit int) error
+	// Erase removes the profile of cookie and leaves a tombstone for tombstoneTTL, marking the cookie as erased.
+	Erase(cookie string, receipt string, tombstoneTTL time.Duration) (Erasure, error)
+	// IsErased reports whether the cookie has a tombstone.
+	IsErased(cookie string) (bool, error)
+	// Resolve returns the cookie the given cookie is an alias of, following chains of aliases.
+	// Cookies that are not aliases resolve to themselves.
+	Resolve(cookie string) (string, error)
+	// Lookup resolves cookie like Resolve and reports whether any cookie on the way, the resolved one included, has a
+	// tombstone. Alias and tombstone of every cookie are read in one batch, so cookies that are not aliases take
+	// a single round trip.
+	Lookup(cookie string) (profileCookie string, erased bool, err error)
+	// Link makes alias an alias of canonical. Both cookies should already be resolved.
+	Link(alias string, canonical string) error
+	// Unlink removes the alias mapping of the cookie.
+	Unlink(alias string) error
+	// Aliases returns the cookies that resolve to the given cookie, aliases of its aliases included.
+	Aliases(cookie string) ([]string, error)
+	// Merge moves tags from the profile of cookie from into the profile of cookie into, keeping at most limit
+	// newest tags of each action. It returns GenerationMismatch if from was modified in the meantime.
+	Merge(from string, into string, limit int) (Merged, error)
+	// Scan calls fn with every stored profile, stopping at the first error returned by fn.
+	// It reads the whole set, so it's meant for occasional analytical queries only.
+	Scan(fn func(UserProfile) error) error
+}
+
+// PageRequest selects tags of the action with timestamps in [From, To).
+type PageRequest struct {
+	Action   types.Action
+	From, To time.Time
+}
+
+// TagsPage is a page of tags of a single action, sorted in ascending order relative to time.
+type TagsPage struct {
+	Tags []types.UserTag
+	// Next is the exclusive end of the time range of the next, older page. It's zero if there are no older tags.
+	Next time.Time
+}
+
+// Merged describes tags moved by UserProfileClient.Merge.
+type Merged struct {
+	Views int
+	Buys  int
+}
+
+// Erasure describes the profile removed by UserProfileClient.Erase.
+type Erasure struct {
+	// Found is false if there was no profile to remove.
+	Found bool
+	Views int
+	Buys  int
 }
 
 // UserProfile holds data about users views and buys.
@@ -31,22 +89,246 @@ type AggregateKey struct {
 	CategoryId uint16
 	BrandId    uint16
 	Origin     uint16
+	// CountryId is zero for records written before countries were tracked and for ids above MaxCountryId.
+	CountryId uint16
+	// Device is set by DeviceKey, it is zero for records written before devices were tracked.
+	Device uint8
+}
+
+// MaxCountryId is the largest country id that fits in the aggregate key, the id getter limits countries to it.
+const MaxCountryId = 1<<13 - 1
+
+// CountryKey returns the value of AggregateKey.CountryId of the country id, countries that don't fit in the key
+// are aggregated as unknown.
+func CountryKey(id uint16) uint16 {
+	if id > MaxCountryId {
+		return 0
+	}
+	return id
+}
+
+// DeviceKey returns the value of AggregateKey.Device of the device.
+func DeviceKey(d types.Device) uint8 {
+	return uint8(d) + 1
 }
 
 type ActionAggregates struct {
 	Key   AggregateKey
 	Sum   uint64
 	Count uint16
+	// MinPrice and MaxPrice are set only if HasPriceRange is, records created before they were tracked don't have them.
+	MinPrice      uint32
+	MaxPrice      uint32
+	HasPriceRange bool
+	// PriceHistogram is nil for records created before it was tracked.
+	PriceHistogram PriceHistogram
+	// Cookies is a HyperLogLog sketch of the cookies, fetched only by AggregatesClient.GetWithCookies.
+	Cookies HLL
+	// ProductCounts and ProductSums are heavy hitter sketches mapping product ids to their count and sum of prices.
+	// They, and the names of the brand and category of the key, are fetched only by AggregatesClient.GetWithTop.
+	// Records written before they were tracked don't have them.
+	ProductCounts map[int]uint64
+	ProductSums   map[int]uint64
+	BrandName     string
+	CategoryName  string
 }
 
+// HLL is a serialized HyperLogLog sketch.
+type HLL []byte
+
 type AggregatesClient interface {
 	Get(time time.Time, action types.Action) ([]ActionAggregates, error)
+	// GetWithCookies is like Get, but also fetches the sketches of cookies.
+	GetWithCookies(time time.Time, action types.Action) ([]ActionAggregates, error)
+	// CountUniqueCookies returns the estimated number of distinct cookies in the union of sketches of the aggregates.
+	// All aggregates must come from the same minute and action.
+	CountUniqueCookies(time time.Time, action types.Action, aggs []ActionAggregates) (uint64, error)
+	// GetWithTop is like Get, but also fetches the sketches of products and names of brands and categories.
+	GetWithTop(time time.Time, action types.Action) ([]ActionAggregates, error)
 	Add(key AggregateKey, tag types.UserTag) error
+	// AddCorrection records the tag, which arrived after its bucket was finalized, in the correction bin of the bucket.
+	AddCorrection(key AggregateKey, tag types.UserTag) error
+}
+
+// DefaultAggregatesSet is the set of aggregates active until AggregatesSetClient.Switch is called.
+const DefaultAggregatesSet = "aggregates"
+
+// AggregatesSetClient selects the set of aggregates used by Client.Aggregates, so aggregates can be rebuilt in a
+// shadow set and switched to once it's done.
+type AggregatesSetClient interface {
+	// Active returns the name of the active set.
+	Active() (string, error)
+	// Switch makes the set active. Clients following the active set pick it up when they reload it, so until then
+	// they still read and write the previous set.
+	Switch(set string) error
+	// Follow loads the active set and keeps reloading it every interval until ctx is done, so that aggregates clients
+	// of Client.Aggregates use it. It returns an error only if the first load fails.
+	Follow(ctx context.Context, interval time.Duration) error
+	// Clear removes all aggregates of the set. It refuses to clear the active set and sets which are not shadow sets,
+	// see CheckShadowAggregatesSet.
+	Clear(set string) error
+	// PutProgress creates or replaces the progress of the rebuild of the set.
+	PutProgress(progress RebuildProgress) error
+	// Progress returns KeyNotFoundError if there was no rebuild of the set.
+	Progress(set string) (RebuildProgress, error)
+}
+
+// RebuildProgress is the state of rebuilding aggregates of a set by replaying the user tags topic.
+type RebuildProgress struct {
+	Set string
+	// Offsets are the next offsets to replay of partitions, the replay of a partition is done at its offset in Ends.
+	Offsets map[int32]int64
+	Ends    map[int32]int64
+	// Tags is the number of replayed tags.
+	Tags      uint64
+	StartedAt time.Time
+	UpdatedAt time.Time
+	Done      bool
+	// Switched is set if the set was made active after the rebuild.
+	Switched bool
+}
+
+// WatermarkClient stores event time watermarks of partitions of the user tags topic, advanced by the worker.
+type WatermarkClient interface {
+	// Put sets the watermark of the partition.
+	Put(partition int32, watermark time.Time) error
+	// Get returns watermarks of all partitions.
+	Get() (map[int32]time.Time, error)
+}
+
+// MinWatermark returns the earliest of the watermarks of partitions of the topic with the given number of
+// partitions. Buckets ending before it are final, as later tags of them go to corrections. It's zero unless every
+// partition has a watermark, as partitions without one can still deliver on time tags of any bucket.
+func MinWatermark(watermarks map[int32]time.Time, partitions int32) time.Time {
+	var min time.Time
+	for p := int32(0); p < partitions; p++ {
+		w, ok := watermarks[p]
+		if !ok {
+			return time.Time{}
+		}
+		if min.IsZero() || w.Before(min) {
+			min = w
+		}
+	}
+	return min
+}
+
+// WebhookClient stores webhook subscriptions, their outboxes of deliveries waiting to be sent and logs of deliveries.
+type WebhookClient interface {
+	// Put creates or replaces the subscription.
+	Put(sub WebhookSubscription) error
+	// Get returns KeyNotFoundError if there is no subscription with the id.
+	Get(id string) (WebhookSubscription, error)
+	// Delete removes the subscription, its outbox and delivery log. It returns KeyNotFoundError if there is no subscription with the id.
+	Delete(id string) error
+	// List returns all subscriptions, it reads the whole set.
+	List() ([]WebhookSubscription, error)
+	// AddDelivery appends the delivery to the log of the subscription, keeping the newest limit deliveries.
+	AddDelivery(id string, delivery WebhookDelivery, limit int) error
+	// Deliveries returns the delivery log of the subscription, the oldest delivery first.
+	Deliveries(id string) ([]WebhookDelivery, error)
+	// Enqueue stores the delivery in the outbox of the subscription until it's removed by Dequeue. Ids of deliveries
+	// should be ordered by the time they are queued. It returns OutboxFullError, dropping the delivery, if the
+	// outbox already holds limit deliveries.
+	Enqueue(id string, delivery PendingDelivery, limit int) error
+	// Pending returns up to n oldest deliveries of the outbox of the subscription.
+	Pending(id string, n int) ([]PendingDelivery, error)
+	// Dequeue removes the delivery from the outbox of the subscription, it's a no-op if there is no such delivery.
+	Dequeue(id string, deliveryId string) error
+	// AcquireLease makes owner the only sender of the outbox of the subscription for ttl, or extends its lease.
+	// It reports false if another owner holds the lease.
+	AcquireLease(id string, owner string, ttl time.Duration) (bool, error)
+	// EraseCookies removes deliveries of the cookies from outboxes and delivery logs of all subscriptions.
+	EraseCookies(cookies []string) error
+}
+
+// WebhookSubscription notifies Url of tags matching Filter.
+type WebhookSubscription struct {
+	Id  string
+	Url string
+	// Secret is the key of HMAC signatures of payloads.
+	Secret    string
+	Filter    WebhookFilter
+	CreatedAt time.Time
+}
+
+// WebhookFilter matches tags with values in all of its non-empty lists and with the price in [MinPrice, MaxPrice].
+// Zero MaxPrice means no upper bound.
+type WebhookFilter struct {
+	Actions     []types.Action
+	ProductIds  []int
+	BrandIds    []string
+	CategoryIds []string
+	MinPrice    uint32
+	MaxPrice    uint32
+}
+
+func (f WebhookFilter) Match(tag types.UserTag) bool {
+	info := tag.ProductInfo
+	return matchAny(f.Actions, tag.Action) &&
+		matchAny(f.ProductIds, info.ProductId) &&
+		matchAny(f.BrandIds, info.BrandId) &&
+		matchAny(f.CategoryIds, info.CategoryId) &&
+		info.Price >= f.MinPrice &&
+		(f.MaxPrice == 0 || info.Price <= f.MaxPrice)
+}
+
+func matchAny[T comparable](values []T, v T) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookDelivery is the outcome of delivering a single tag to the url of a subscription.
+type WebhookDelivery struct {
+	Id     string
+	Time   time.Time
+	Cookie string
+	// StatusCode is the response status of the last attempt, zero if there was no response.
+	StatusCode int
+	Attempts   int
+	// Error is empty if the delivery succeeded.
+	Error string
+}
+
+// PendingDelivery is a delivery waiting in the outbox of a subscription until it's sent.
+type PendingDelivery struct {
+	Id     string
+	Cookie string
+	// Payload is the body of requests of the delivery.
+	Payload []byte
+}
+
+// RuleClient stores definitions of rules and sliding windows of tags of cookies evaluated by them.
+type RuleClient interface {
+	// Put creates or replaces the definition of the rule, which is opaque to the db.
+	Put(id string, definition []byte) error
+	// Delete returns KeyNotFoundError if there is no rule with the id.
+	Delete(id string) error
+	// List returns definitions of all rules keyed by their ids, it reads the whole set.
+	List() (map[string][]byte, error)
+	// AddToWindow adds tag to the window of cookie, drops tags older than window before the time of tag
+	// and returns the remaining tags, sorted in ascending order relative to time. Windows of idle cookies expire.
+	// Tags are told apart by their contents, adding a tag already in the window again leaves the window unchanged.
+	AddToWindow(cookie string, tag types.UserTag, window time.Duration) ([]types.UserTag, error)
 }
 
 type Client interface {
 	UserProfiles() UserProfileClient
+	// Aggregates returns the client of the active set of aggregates, see AggregatesSetClient.
 	Aggregates() AggregatesClient
+	// AggregatesIn returns the client of aggregates of the given set.
+	AggregatesIn(set string) AggregatesClient
+	AggregatesSets() AggregatesSetClient
+	Webhooks() WebhookClient
+	Rules() RuleClient
+	Watermarks() WatermarkClient
 }
 
 type Host = as.Host
@@ -55,6 +337,8 @@ type ClientPolicy = as.ClientPolicy
 type client struct {
 	cl *as.Client
 	l  *zap.Logger
+	// activeAggregates is the name of the active set of aggregates, updated by AggregatesSetClient.Follow.
+	activeAggregates *atomic.Pointer[string]
 }
 
 func NewClientFromAddresses(logger *zap.Logger, addresses ...string) (Client, error) {
@@ -67,5 +351,8 @@ func NewClientFromAddresses(logger *zap.Logger, addresses ...string) (Client, er
 
 func NewClient(clientPolicy *ClientPolicy, logger *zap.Logger, hosts ...*Host) (Client, error) {
 	cl, err := as.NewClientWithPolicyAndHost(clientPolicy, hosts...)
-	return client{cl: cl, l: logger}, err
+	active := new(atomic.Pointer[string])
+	set := DefaultAggregatesSet
+	active.Store(&set)
+	return client{cl: cl, l: logger, activeAggregates: active}, err
 }
@@ -1,11 +1,15 @@
 package db
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"runtime"
 	"sort"
 	"testing"
 	"time"
 
+	as "github.com/aerospike/aerospike-client-go/v6"
 	"github.com/google/go-cmp/cmp"
 	"github.com/stretchr/testify/suite"
 	"go.uber.org/zap"
@@ -82,12 +86,12 @@ func (s *DBSuite) Test_UserProfiles() {
 	// Insert
 	for _, profile := range profiles {
 		for i, view := range profile.Views {
-			newLen, err := up.Add(&view)
+			newLen, err := up.Add(view.Cookie, &view)
 			s.Require().NoErrorf(err, "failed to create record")
 			s.Require().Equal(i+1, newLen, "length mismatch")
 		}
 		for i, buy := range profile.Buys {
-			newLen, err := up.Add(&buy)
+			newLen, err := up.Add(buy.Cookie, &buy)
 			s.Require().NoErrorf(err, "failed to create record")
 			s.Require().Equal(i+1, newLen, "length mismatch")
 		}
@@ -113,12 +117,12 @@ func (s *DBSuite) Test_UserProfiles_RemoveOverLimit() {
 
 	// Insert
 	for i, view := range profile.Views {
-		newLen, err := up.Add(&view)
+		newLen, err := up.Add(view.Cookie, &view)
 		s.Require().NoErrorf(err, "failed to create record")
 		s.Require().Equal(i+1, newLen, "length mismatch")
 	}
 	for i, buy := range profile.Buys {
-		newLen, err := up.Add(&buy)
+		newLen, err := up.Add(buy.Cookie, &buy)
 		s.Require().NoErrorf(err, "failed to create record")
 		s.Require().Equal(i+1, newLen, "length mismatch")
 	}
@@ -151,7 +155,7 @@ func (s *DBSuite) Test_UserProfiles_RemoveOverLimit_Errors() {
 	err := up.RemoveOverLimit(cookieFoo, types.View, 10)
 	s.Require().NoErrorf(err, "error removing")
 
-	l, err := up.Add(&types.UserTag{Action: types.Buy, Cookie: cookieFoo, Time: time.Now()})
+	l, err := up.Add(cookieFoo, &types.UserTag{Action: types.Buy, Cookie: cookieFoo, Time: time.Now()})
 	s.Require().NoErrorf(err, "error adding key")
 	s.Require().Equal(1, l, "unexpected length")
 
@@ -169,6 +173,192 @@ func (s *DBSuite) Test_UserProfiles_ReturnsKeyNotFoundErrorOnKeyNotFound() {
 	s.Require().ErrorIs(err, KeyNotFoundError, "expected KeyNotFoundError")
 }
 
+func (s *DBSuite) Test_UserProfiles_Erase() {
+	m := s.newClient()
+
+	up := m.UserProfiles()
+	now := time.Now()
+
+	const cookieFoo = "foo"
+	for _, tag := range []types.UserTag{
+		{Time: now, Action: types.View, Cookie: cookieFoo},
+		{Time: now.Add(time.Second), Action: types.View, Cookie: cookieFoo},
+		{Time: now, Action: types.Buy, Cookie: cookieFoo},
+	} {
+		_, err := up.Add(tag.Cookie, &tag)
+		s.Require().NoErrorf(err, "failed to create record")
+	}
+
+	erased, err := up.IsErased(cookieFoo)
+	s.Require().NoErrorf(err, "failed to check tombstone")
+	s.Assert().False(erased)
+
+	erasure, err := up.Erase(cookieFoo, "receipt", time.Hour)
+	s.Require().NoErrorf(err, "failed to erase profile")
+	s.Assert().Equal(Erasure{Found: true, Views: 2, Buys: 1}, erasure)
+
+	_, err = up.Get(cookieFoo)
+	s.Require().ErrorIs(err, KeyNotFoundError, "profile should be removed")
+
+	erased, err = up.IsErased(cookieFoo)
+	s.Require().NoErrorf(err, "failed to check tombstone")
+	s.Assert().True(erased)
+
+	// Erasing again is a no-op.
+	erasure, err = up.Erase(cookieFoo, "receipt", time.Hour)
+	s.Require().NoErrorf(err, "failed to erase profile")
+	s.Assert().Equal(Erasure{}, erasure)
+}
+
+func (s *DBSuite) Test_UserProfiles_LinkAndMerge() {
+	m := s.newClient()
+
+	up := m.UserProfiles()
+	now := time.Now().Truncate(time.Millisecond)
+
+	const cookieOld = "old"
+	const cookieNew = "new"
+	tags := []types.UserTag{
+		{Time: now, Action: types.View, Cookie: cookieOld},
+		{Time: now.Add(time.Second), Action: types.View, Cookie: cookieNew},
+		{Time: now.Add(2 * time.Second), Action: types.View, Cookie: cookieOld},
+		{Time: now.Add(3 * time.Second), Action: types.Buy, Cookie: cookieOld},
+	}
+	for _, tag := range tags {
+		_, err := up.Add(tag.Cookie, &tag)
+		s.Require().NoErrorf(err, "failed to create record")
+	}
+
+	resolved, err := up.Resolve(cookieOld)
+	s.Require().NoErrorf(err, "failed to resolve cookie")
+	s.Assert().Equal(cookieOld, resolved)
+
+	s.Require().NoErrorf(up.Link(cookieOld, cookieNew), "failed to link cookies")
+	resolved, err = up.Resolve(cookieOld)
+	s.Require().NoErrorf(err, "failed to resolve cookie")
+	s.Assert().Equal(cookieNew, resolved)
+	s.Require().ErrorIs(up.Link(cookieNew, cookieNew), ErrAliasCycle)
+
+	// Only the newest 2 tags of each action are kept.
+	merged, err := up.Merge(cookieOld, cookieNew, 2)
+	s.Require().NoErrorf(err, "failed to merge profiles")
+	s.Assert().Equal(Merged{Views: 2, Buys: 1}, merged)
+
+	_, err = up.Get(cookieOld)
+	s.Require().ErrorIs(err, KeyNotFoundError, "merged profile should be removed")
+
+	res, err := up.Get(cookieNew)
+	s.Require().NoErrorf(err, "failed to get record")
+	s.Assert().Empty(cmp.Diff(UserProfile{Views: tags[1:3], Buys: tags[3:]}, res))
+
+	s.Require().NoErrorf(up.Unlink(cookieOld), "failed to unlink cookie")
+	resolved, err = up.Resolve(cookieOld)
+	s.Require().NoErrorf(err, "failed to resolve cookie")
+	s.Assert().Equal(cookieOld, resolved)
+}
+
+func (s *DBSuite) Test_UserProfiles_Lookup() {
+	m := s.newClient()
+
+	up := m.UserProfiles()
+	s.Require().NoErrorf(up.Link("alias", "canonical"), "failed to link cookies")
+
+	resolved, erased, err := up.Lookup("alias")
+	s.Require().NoErrorf(err, "failed to look up cookie")
+	s.Assert().Equal("canonical", resolved)
+	s.Assert().False(erased)
+
+	_, err = up.Erase("canonical", "receipt", time.Hour)
+	s.Require().NoErrorf(err, "failed to erase profile")
+	resolved, erased, err = up.Lookup("alias")
+	s.Require().NoErrorf(err, "failed to look up cookie")
+	s.Assert().Equal("canonical", resolved)
+	s.Assert().True(erased, "tombstone of the resolved cookie applies to its aliases")
+}
+
+func (s *DBSuite) Test_UserProfiles_Aliases() {
+	m := s.newClient()
+
+	up := m.UserProfiles()
+	s.Require().NoErrorf(up.Link("alias", "canonical"), "failed to link cookies")
+	s.Require().NoErrorf(up.Link("alias2", "alias"), "failed to link cookies")
+	s.Require().NoErrorf(up.Link("alias3", "canonical"), "failed to link cookies")
+
+	aliases, err := up.Aliases("canonical")
+	s.Require().NoErrorf(err, "failed to get aliases")
+	s.Assert().ElementsMatch([]string{"alias", "alias2", "alias3"}, aliases)
+
+	s.Require().NoErrorf(up.Unlink("alias3"), "failed to unlink cookie")
+	aliases, err = up.Aliases("canonical")
+	s.Require().NoErrorf(err, "failed to get aliases")
+	s.Assert().ElementsMatch([]string{"alias", "alias2"}, aliases)
+
+	aliases, err = up.Aliases("alias2")
+	s.Require().NoErrorf(err, "failed to get aliases")
+	s.Assert().Empty(aliases)
+}
+
+func (s *DBSuite) Test_UserProfiles_GetPages() {
+	m := s.newClient()
+
+	up := m.UserProfiles()
+	now := time.Now().Truncate(time.Millisecond)
+
+	var tags []types.UserTag
+	for i := 0; i < 3; i++ {
+		tag := types.UserTag{Time: now.Add(time.Duration(i) * time.Second), Action: types.View, Cookie: "foo"}
+		_, err := up.Add(tag.Cookie, &tag)
+		s.Require().NoErrorf(err, "failed to create record")
+		tags = append(tags, tag)
+	}
+
+	view := func(to time.Time) PageRequest { return PageRequest{Action: types.View, From: now, To: to} }
+	pages, err := up.GetPages("foo", []PageRequest{view(now.Add(time.Hour)), {Action: types.Buy, From: now, To: now.Add(time.Hour)}}, 2)
+	s.Require().NoErrorf(err, "failed to get pages")
+	s.Assert().Empty(cmp.Diff([]TagsPage{{Tags: tags[1:], Next: tags[1].Time}, {}}, pages))
+
+	pages, err = up.GetPages("foo", []PageRequest{view(pages[0].Next)}, 2)
+	s.Require().NoErrorf(err, "failed to get pages")
+	s.Assert().Empty(cmp.Diff([]TagsPage{{Tags: tags[:1]}}, pages))
+
+	pages, err = up.GetPages("foo", []PageRequest{view(now.Add(time.Hour))}, 0)
+	s.Require().NoErrorf(err, "failed to get pages")
+	s.Assert().Equal([]TagsPage{{}}, pages, "pages of zero tags have no next page")
+
+	pages, err = up.GetPages("bar", []PageRequest{view(now.Add(time.Hour))}, 2)
+	s.Require().NoErrorf(err, "failed to get pages of missing profile")
+	s.Assert().Equal([]TagsPage{{}}, pages)
+}
+
+func (s *DBSuite) Test_UserProfiles_Scan() {
+	m := s.newClient()
+
+	up := m.UserProfiles()
+	now := time.Now()
+
+	for _, tag := range []types.UserTag{
+		{Time: now, Action: types.View, Cookie: "foo"},
+		{Time: now, Action: types.Buy, Cookie: "foo"},
+		{Time: now, Action: types.View, Cookie: "bar"},
+	} {
+		_, err := up.Add(tag.Cookie, &tag)
+		s.Require().NoErrorf(err, "failed to create record")
+	}
+
+	var views, buys int
+	err := up.Scan(func(p UserProfile) error {
+		views += len(p.Views)
+		buys += len(p.Buys)
+		return nil
+	})
+	s.Require().NoErrorf(err, "failed to scan profiles")
+	s.Assert().Equal(2, views)
+	s.Assert().Equal(1, buys)
+
+	stop := errors.New("stop")
+	s.Require().ErrorIs(up.Scan(func(UserProfile) error { return stop }), stop)
+}
+
 func sortActionAggregates(agg []ActionAggregates) {
 	sort.Slice(agg, func(i, j int) bool {
 		return agg[i].Key.encode() < agg[j].Key.encode()
@@ -220,11 +410,21 @@ func (s *DBSuite) Test_Aggregates() {
 				Key:   k1,
 				Sum:   42,
 				Count: 2,
+
+				MinPrice:       21,
+				MaxPrice:       21,
+				HasPriceRange:  true,
+				PriceHistogram: PriceHistogram{priceHistogramBucket(21): 2},
 			},
 			{
 				Key:   k2,
 				Sum:   69,
 				Count: 3,
+
+				MinPrice:       23,
+				MaxPrice:       23,
+				HasPriceRange:  true,
+				PriceHistogram: PriceHistogram{priceHistogramBucket(23): 3},
 			},
 		},
 		buys: []ActionAggregates{
@@ -232,11 +432,21 @@ func (s *DBSuite) Test_Aggregates() {
 				Key:   k1,
 				Sum:   69,
 				Count: 3,
+
+				MinPrice:       23,
+				MaxPrice:       23,
+				HasPriceRange:  true,
+				PriceHistogram: PriceHistogram{priceHistogramBucket(23): 3},
 			},
 			{
 				Key:   k2,
 				Sum:   42,
 				Count: 2,
+
+				MinPrice:       21,
+				MaxPrice:       21,
+				HasPriceRange:  true,
+				PriceHistogram: PriceHistogram{priceHistogramBucket(21): 2},
 			},
 		},
 	}
@@ -305,6 +515,11 @@ func (s *DBSuite) Test_Aggregates_MinuteRounding() {
 				Key:   k1,
 				Sum:   6,
 				Count: 1,
+
+				MinPrice:       6,
+				MaxPrice:       6,
+				HasPriceRange:  true,
+				PriceHistogram: PriceHistogram{priceHistogramBucket(6): 1},
 			},
 		},
 		buys: []ActionAggregates{
@@ -312,6 +527,11 @@ func (s *DBSuite) Test_Aggregates_MinuteRounding() {
 				Key:   k2,
 				Sum:   9,
 				Count: 1,
+
+				MinPrice:       9,
+				MaxPrice:       9,
+				HasPriceRange:  true,
+				PriceHistogram: PriceHistogram{priceHistogramBucket(9): 1},
 			},
 		},
 	}
@@ -348,3 +568,313 @@ func (s *DBSuite) Test_Aggregates_MinuteRounding() {
 	s.Require().NoErrorf(err, "error getting from the database")
 	s.Require().Zero(agg, "expected no results")
 }
+
+func (s *DBSuite) Test_Aggregates_PriceRangeAndUniqueCookies() {
+	m := s.newClient()
+	a := m.Aggregates()
+
+	k1 := AggregateKey{CategoryId: 1, BrandId: 2, Origin: 3}
+	k2 := AggregateKey{CategoryId: 10, BrandId: 20, Origin: 30}
+	min := time.Now()
+
+	for i, price := range []uint32{30, 10, 20, 10} {
+		cookie := fmt.Sprintf("cookie_%d", i%3)
+		err := a.Add(k1, types.UserTag{Action: types.View, Time: min, Cookie: cookie, ProductInfo: types.ProductInfo{Price: price}})
+		s.Require().NoErrorf(err, "error inserting to the database")
+	}
+	err := a.Add(k2, types.UserTag{Action: types.View, Time: min, Cookie: "cookie_0", ProductInfo: types.ProductInfo{Price: 40}})
+	s.Require().NoErrorf(err, "error inserting to the database")
+	err = a.Add(k2, types.UserTag{Action: types.View, Time: min, Cookie: "cookie_3", ProductInfo: types.ProductInfo{Price: 5}})
+	s.Require().NoErrorf(err, "error inserting to the database")
+
+	agg, err := a.GetWithCookies(min, types.View)
+	s.Require().NoErrorf(err, "error getting from the database")
+	sortActionAggregates(agg)
+	s.Require().Len(agg, 2)
+	s.Assert().Equal(uint32(10), agg[0].MinPrice)
+	s.Assert().Equal(uint32(30), agg[0].MaxPrice)
+	s.Assert().Equal(uint32(5), agg[1].MinPrice)
+	s.Assert().Equal(uint32(40), agg[1].MaxPrice)
+
+	count, err := a.CountUniqueCookies(min, types.View, agg[:1])
+	s.Require().NoErrorf(err, "error counting unique cookies")
+	s.Assert().Equal(uint64(3), count)
+	count, err = a.CountUniqueCookies(min, types.View, agg)
+	s.Require().NoErrorf(err, "error counting unique cookies")
+	s.Assert().Equal(uint64(4), count)
+
+	plain, err := a.Get(min, types.View)
+	s.Require().NoErrorf(err, "error getting from the database")
+	for _, p := range plain {
+		s.Assert().Nil(p.Cookies, "cookies should be fetched only on demand")
+	}
+}
+
+func (s *DBSuite) Test_Aggregates_Top() {
+	m := s.newClient()
+	a := m.Aggregates()
+
+	k := AggregateKey{CategoryId: 1, BrandId: 2, Origin: 3}
+	min := time.Now()
+
+	for _, p := range []types.ProductInfo{{ProductId: 1, Price: 10}, {ProductId: 2, Price: 50}, {ProductId: 1, Price: 20}} {
+		p.BrandId, p.CategoryId = "Nike", "shoes"
+		err := a.Add(k, types.UserTag{Action: types.Buy, Time: min, Cookie: "foo", ProductInfo: p})
+		s.Require().NoErrorf(err, "error inserting to the database")
+	}
+	// Once the sketch is full, a new product replaces the one with the smallest value and inherits it.
+	for _, productId := range []int{100, 100} {
+		err := a.Add(k, types.UserTag{Action: types.View, Time: min, Cookie: "foo", ProductInfo: types.ProductInfo{ProductId: productId, Price: 1}})
+		s.Require().NoErrorf(err, "error inserting to the database")
+	}
+	for i := 1; i <= TopSketchCapacity; i++ {
+		err := a.Add(k, types.UserTag{Action: types.View, Time: min, Cookie: "foo", ProductInfo: types.ProductInfo{ProductId: 100 + i, Price: 1}})
+		s.Require().NoErrorf(err, "error inserting to the database")
+	}
+
+	agg, err := a.GetWithTop(min, types.Buy)
+	s.Require().NoErrorf(err, "error getting from the database")
+	s.Require().Len(agg, 1)
+	s.Assert().Equal(map[int]uint64{1: 2, 2: 1}, agg[0].ProductCounts)
+	s.Assert().Equal(map[int]uint64{1: 30, 2: 50}, agg[0].ProductSums)
+	s.Assert().Equal("Nike", agg[0].BrandName)
+	s.Assert().Equal("shoes", agg[0].CategoryName)
+
+	agg, err = a.GetWithTop(min, types.View)
+	s.Require().NoErrorf(err, "error getting from the database")
+	s.Require().Len(agg, 1)
+	s.Assert().Len(agg[0].ProductCounts, TopSketchCapacity)
+	s.Assert().Equal(uint64(2), agg[0].ProductCounts[100])
+	s.Assert().NotContains(agg[0].ProductCounts, 101)
+	s.Assert().Equal(uint64(2), agg[0].ProductCounts[100+TopSketchCapacity])
+
+	plain, err := a.Get(min, types.Buy)
+	s.Require().NoErrorf(err, "error getting from the database")
+	s.Assert().Nil(plain[0].ProductCounts, "sketches should be fetched only on demand")
+}
+
+func (s *DBSuite) Test_Aggregates_LegacyRecord() {
+	m := s.newClient()
+	a := m.Aggregates()
+
+	k := AggregateKey{CategoryId: 1, BrandId: 2, Origin: 3}
+	min := time.Now()
+
+	// Records written before the price range and cookies were tracked only have the sum and count.
+	key, kerr := as.NewKey(aggregatesNamespace, DefaultAggregatesSet, toKey(toTs(min), k))
+	s.Require().NoError(kerr)
+	policy := as.NewWritePolicy(0, as.TTLServerDefault)
+	policy.SendKey = true
+	perr := a.(aggregatesClient).cl.Put(policy, key, as.BinMap{
+		aggregatesViewsBin: int64(encodeSumAndCount(7)),
+		aggregatesTsBin:    toTs(min),
+	})
+	s.Require().NoErrorf(perr, "error inserting to the database")
+
+	agg, err := a.GetWithCookies(min, types.View)
+	s.Require().NoErrorf(err, "error getting from the database")
+	s.Require().Equal([]ActionAggregates{{Key: k, Sum: 7, Count: 1}}, agg)
+	count, err := a.CountUniqueCookies(min, types.View, agg)
+	s.Require().NoErrorf(err, "error counting unique cookies")
+	s.Assert().Zero(count)
+
+	// New tags extend the legacy record.
+	err = a.Add(k, types.UserTag{Action: types.View, Time: min, Cookie: "foo", ProductInfo: types.ProductInfo{Price: 3}})
+	s.Require().NoErrorf(err, "error inserting to the database")
+	agg, err = a.Get(min, types.View)
+	s.Require().NoErrorf(err, "error getting from the database")
+	s.Require().Equal([]ActionAggregates{{
+		Key: k, Sum: 10, Count: 2, MinPrice: 3, MaxPrice: 3, HasPriceRange: true,
+		PriceHistogram: PriceHistogram{priceHistogramBucket(3): 1},
+	}}, agg)
+}
+
+func (s *DBSuite) Test_Webhooks() {
+	m := s.newClient()
+
+	wh := m.Webhooks()
+	createdAt := time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC)
+	subs := []WebhookSubscription{
+		{
+			Id:        "foo",
+			Url:       "http://foo.test/hook",
+			Secret:    "secret",
+			Filter:    WebhookFilter{Actions: []types.Action{types.Buy}, ProductIds: []int{1, 2}, BrandIds: []string{"brand"}, MinPrice: 10, MaxPrice: 100},
+			CreatedAt: createdAt,
+		},
+		{Id: "bar", Url: "http://bar.test/hook", Secret: "secret", CreatedAt: createdAt},
+	}
+	for _, sub := range subs {
+		s.Require().NoErrorf(wh.Put(sub), "failed to put webhook")
+	}
+
+	res, err := wh.Get("foo")
+	s.Require().NoErrorf(err, "failed to get webhook")
+	s.Assert().Empty(cmp.Diff(subs[0], res))
+
+	list, err := wh.List()
+	s.Require().NoErrorf(err, "failed to list webhooks")
+	sort.Slice(list, func(i, j int) bool { return list[i].Id > list[j].Id })
+	s.Assert().Empty(cmp.Diff(subs, list))
+
+	for i := 0; i < 3; i++ {
+		err := wh.AddDelivery("foo", WebhookDelivery{Id: fmt.Sprint(i), Time: createdAt, Cookie: "cookie", StatusCode: 200, Attempts: 1}, 2)
+		s.Require().NoErrorf(err, "failed to add delivery")
+	}
+	deliveries, err := wh.Deliveries("foo")
+	s.Require().NoErrorf(err, "failed to get deliveries")
+	s.Assert().Equal([]WebhookDelivery{
+		{Id: "1", Time: createdAt, Cookie: "cookie", StatusCode: 200, Attempts: 1},
+		{Id: "2", Time: createdAt, Cookie: "cookie", StatusCode: 200, Attempts: 1},
+	}, deliveries, "only the newest deliveries are kept")
+
+	s.Require().NoErrorf(wh.Delete("foo"), "failed to delete webhook")
+	_, err = wh.Get("foo")
+	s.Assert().ErrorIs(err, KeyNotFoundError)
+	s.Assert().ErrorIs(wh.Delete("foo"), KeyNotFoundError)
+	deliveries, err = wh.Deliveries("foo")
+	s.Require().NoErrorf(err, "failed to get deliveries")
+	s.Assert().Empty(deliveries, "deliveries are deleted with the webhook")
+}
+
+func (s *DBSuite) Test_WebhookOutbox() {
+	m := s.newClient()
+
+	wh := m.Webhooks()
+	s.Require().NoErrorf(wh.Put(WebhookSubscription{Id: "foo", Url: "http://foo.test/hook"}), "failed to put webhook")
+
+	queued := []PendingDelivery{
+		{Id: "1", Cookie: "cookie", Payload: []byte(`{"n":1}`)},
+		{Id: "2", Cookie: "other", Payload: []byte(`{"n":2}`)},
+	}
+	for _, d := range queued {
+		s.Require().NoErrorf(wh.Enqueue("foo", d, 2), "failed to queue delivery")
+	}
+	s.Assert().ErrorIs(wh.Enqueue("foo", PendingDelivery{Id: "3", Cookie: "cookie"}, 2), OutboxFullError)
+
+	pending, err := wh.Pending("foo", 10)
+	s.Require().NoErrorf(err, "failed to get pending deliveries")
+	s.Assert().Equal(queued, pending, "deliveries over the limit are dropped")
+
+	s.Require().NoErrorf(wh.Dequeue("foo", "1"), "failed to remove delivery")
+	s.Require().NoErrorf(wh.Enqueue("foo", PendingDelivery{Id: "3", Cookie: "cookie"}, 2), "failed to queue delivery")
+	s.Require().NoErrorf(wh.AddDelivery("foo", WebhookDelivery{Id: "1", Cookie: "cookie"}, 10), "failed to add delivery")
+	s.Require().NoErrorf(wh.AddDelivery("foo", WebhookDelivery{Id: "4", Cookie: "other"}, 10), "failed to add delivery")
+
+	s.Require().NoErrorf(wh.EraseCookies([]string{"cookie"}), "failed to erase cookies")
+	pending, err = wh.Pending("foo", 10)
+	s.Require().NoErrorf(err, "failed to get pending deliveries")
+	s.Assert().Equal([]PendingDelivery{queued[1]}, pending)
+	deliveries, err := wh.Deliveries("foo")
+	s.Require().NoErrorf(err, "failed to get deliveries")
+	s.Require().Len(deliveries, 1)
+	s.Assert().Equal("4", deliveries[0].Id)
+
+	held, err := wh.AcquireLease("foo", "a", time.Minute)
+	s.Require().NoErrorf(err, "failed to acquire lease")
+	s.Assert().True(held)
+	held, err = wh.AcquireLease("foo", "b", time.Minute)
+	s.Require().NoErrorf(err, "failed to acquire lease")
+	s.Assert().False(held, "lease is held by another owner")
+	held, err = wh.AcquireLease("foo", "a", time.Minute)
+	s.Require().NoErrorf(err, "failed to extend lease")
+	s.Assert().True(held)
+}
+
+func (s *DBSuite) Test_Rules() {
+	m := s.newClient()
+
+	rules := m.Rules()
+	s.Require().NoErrorf(rules.Put("foo", []byte(`{"id":"foo"}`)), "failed to put rule")
+	s.Require().NoErrorf(rules.Put("bar", []byte(`{"id":"bar"}`)), "failed to put rule")
+
+	list, err := rules.List()
+	s.Require().NoErrorf(err, "failed to list rules")
+	s.Assert().Equal(map[string][]byte{"foo": []byte(`{"id":"foo"}`), "bar": []byte(`{"id":"bar"}`)}, list)
+
+	s.Require().NoErrorf(rules.Delete("foo"), "failed to delete rule")
+	s.Assert().ErrorIs(rules.Delete("foo"), KeyNotFoundError)
+
+	t0 := time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC)
+	tag := func(t time.Time) types.UserTag {
+		return types.UserTag{Time: t, Cookie: "cookie", Action: types.View, ProductInfo: types.ProductInfo{ProductId: 1, CategoryId: "category"}}
+	}
+	var window []types.UserTag
+	for _, t := range []time.Time{t0, t0.Add(5 * time.Minute), t0.Add(12 * time.Minute)} {
+		window, err = rules.AddToWindow("cookie", tag(t), 10*time.Minute)
+		s.Require().NoErrorf(err, "failed to add tag to window")
+	}
+	s.Assert().Empty(cmp.Diff([]types.UserTag{tag(t0.Add(5 * time.Minute)), tag(t0.Add(12 * time.Minute))}, window), "tags older than the window are dropped")
+
+	buy := tag(t0.Add(12 * time.Minute))
+	buy.Action = types.Buy
+	window, err = rules.AddToWindow("cookie", buy, 10*time.Minute)
+	s.Require().NoErrorf(err, "failed to add tag to window")
+	s.Assert().Empty(cmp.Diff([]types.UserTag{tag(t0.Add(5 * time.Minute)), tag(t0.Add(12 * time.Minute)), buy}, window), "tags of the same millisecond are kept")
+
+	window, err = rules.AddToWindow("cookie", buy, 10*time.Minute)
+	s.Require().NoErrorf(err, "failed to add tag to window again")
+	s.Assert().Empty(cmp.Diff([]types.UserTag{tag(t0.Add(5 * time.Minute)), tag(t0.Add(12 * time.Minute)), buy}, window), "retried tags are added once")
+}
+
+func (s *DBSuite) Test_Watermarks() {
+	m := s.newClient()
+
+	watermarks := m.Watermarks()
+	got, err := watermarks.Get()
+	s.Require().NoErrorf(err, "failed to get watermarks")
+	s.Assert().Empty(got)
+
+	t0 := time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC)
+	s.Require().NoErrorf(watermarks.Put(0, t0), "failed to put watermark")
+	s.Require().NoErrorf(watermarks.Put(1, t0.Add(time.Minute)), "failed to put watermark")
+	s.Require().NoErrorf(watermarks.Put(0, t0.Add(2*time.Minute)), "failed to put watermark")
+
+	got, err = watermarks.Get()
+	s.Require().NoErrorf(err, "failed to get watermarks")
+	s.Assert().Equal(map[int32]time.Time{0: t0.Add(2 * time.Minute), 1: t0.Add(time.Minute)}, got)
+	s.Assert().Equal(t0.Add(time.Minute), MinWatermark(got, 2))
+	s.Assert().Zero(MinWatermark(got, 3), "partition 2 has no watermark yet")
+}
+
+func (s *DBSuite) Test_AggregatesSets() {
+	m := s.newClient()
+	sets := m.AggregatesSets()
+
+	active, err := sets.Active()
+	s.Require().NoErrorf(err, "failed to get active set")
+	s.Assert().Equal(DefaultAggregatesSet, active)
+	s.Assert().Error(sets.Clear(DefaultAggregatesSet), "the active set can't be cleared")
+	s.Assert().Error(sets.Clear(userProfilesSet), "only shadow sets of aggregates can be cleared")
+
+	t0 := time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC)
+	tag := types.UserTag{Time: t0, Action: types.View, ProductInfo: types.ProductInfo{Price: 10}}
+	s.Require().NoErrorf(m.AggregatesIn("aggregates_v2").Add(AggregateKey{Origin: 1}, tag), "failed to add tag to shadow set")
+
+	aggs, err := m.Aggregates().Get(t0, types.View)
+	s.Require().NoErrorf(err, "failed to get aggregates")
+	s.Assert().Empty(aggs, "shadow sets don't affect the active one")
+
+	progress := RebuildProgress{
+		Set:       "aggregates_v2",
+		Offsets:   map[int32]int64{0: 10},
+		Ends:      map[int32]int64{0: 10},
+		Tags:      10,
+		StartedAt: t0,
+		UpdatedAt: t0.Add(time.Minute),
+		Done:      true,
+	}
+	s.Require().NoErrorf(sets.PutProgress(progress), "failed to put progress")
+	stored, err := sets.Progress("aggregates_v2")
+	s.Require().NoErrorf(err, "failed to get progress")
+	s.Assert().Equal(progress, stored)
+	_, err = sets.Progress("missing")
+	s.Assert().ErrorIs(err, KeyNotFoundError)
+
+	s.Require().NoErrorf(sets.Switch("aggregates_v2"), "failed to switch sets")
+	s.Require().NoErrorf(sets.Follow(context.Background(), time.Hour), "failed to follow active set")
+	aggs, err = m.Aggregates().Get(t0, types.View)
+	s.Require().NoErrorf(err, "failed to get aggregates")
+	s.Require().Len(aggs, 1, "aggregates are read from the active set")
+	s.Assert().Equal(uint64(10), aggs[0].Sum)
+}
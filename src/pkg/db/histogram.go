@@ -0,0 +1,71 @@
+package db
+
+import (
+	"math"
+	"sort"
+)
+
+// priceHistogramBucketsPerOctave is the number of buckets each power of two is split into.
+// Bucket bounds grow by about 19%, which bounds the relative error of percentiles.
+const priceHistogramBucketsPerOctave = 4
+
+// PriceHistogram maps buckets of the fixed log-scale price histogram to counts of prices in them.
+// Bucket 0 holds zero prices, bucket i > 0 holds prices in [2^((i-1)/4), 2^(i/4)).
+type PriceHistogram map[int]uint64
+
+// priceHistogramBucket returns the bucket of the price.
+func priceHistogramBucket(price uint32) int {
+	if price == 0 {
+		return 0
+	}
+	return 1 + int(math.Floor(priceHistogramBucketsPerOctave*math.Log2(float64(price))))
+}
+
+// priceHistogramLowerBound returns the smallest price in the bucket.
+func priceHistogramLowerBound(bucket int) uint32 {
+	if bucket <= 0 {
+		return 0
+	}
+	return uint32(math.Min(math.Ceil(math.Exp2(float64(bucket-1)/priceHistogramBucketsPerOctave)), math.MaxUint32))
+}
+
+// Add counts the price in its bucket.
+func (h PriceHistogram) Add(price uint32) {
+	h[priceHistogramBucket(price)]++
+}
+
+// Merge adds counts of the other histogram.
+func (h PriceHistogram) Merge(other PriceHistogram) {
+	for bucket, count := range other {
+		h[bucket] += count
+	}
+}
+
+// Percentile returns the lower bound of the bucket holding the p-th percentile of prices, with p in [0, 100].
+// It returns false if the histogram is empty.
+func (h PriceHistogram) Percentile(p float64) (uint32, bool) {
+	var total uint64
+	buckets := make([]int, 0, len(h))
+	for bucket, count := range h {
+		total += count
+		buckets = append(buckets, bucket)
+	}
+	if total == 0 {
+		return 0, false
+	}
+	sort.Ints(buckets)
+
+	// rank is the 1-based position of the percentile in the sorted prices, using the nearest rank method.
+	rank := uint64(math.Ceil(p / 100 * float64(total)))
+	if rank == 0 {
+		rank = 1
+	}
+	var seen uint64
+	for _, bucket := range buckets {
+		seen += h[bucket]
+		if seen >= rank {
+			return priceHistogramLowerBound(bucket), true
+		}
+	}
+	return priceHistogramLowerBound(buckets[len(buckets)-1]), true
+}
@@ -0,0 +1,36 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPriceHistogramBucket(t *testing.T) {
+	for _, price := range []uint32{0, 1, 2, 3, 7, 8, 100, 999, 1 << 20, 1 << 31} {
+		bucket := priceHistogramBucket(price)
+		assert.LessOrEqualf(t, priceHistogramLowerBound(bucket), price, "lower bound of the bucket of %d", price)
+		if bucket > 0 {
+			assert.Greaterf(t, uint64(priceHistogramLowerBound(bucket+1)), uint64(price), "lower bound of the next bucket of %d", price)
+		}
+	}
+	assert.Equal(t, priceHistogramBucket(8), priceHistogramBucket(9), "prices within 19%% share a bucket")
+}
+
+func TestPriceHistogramPercentile(t *testing.T) {
+	h := PriceHistogram{}
+	_, ok := h.Percentile(50)
+	assert.False(t, ok, "empty histogram has no percentiles")
+
+	for price := uint32(1); price <= 100; price++ {
+		h.Add(price)
+	}
+	for _, tt := range []struct {
+		p    float64
+		want uint32
+	}{{0, 1}, {50, 46}, {90, 77}, {99, 91}, {100, 91}} {
+		got, ok := h.Percentile(tt.p)
+		assert.True(t, ok)
+		assert.Equalf(t, tt.want, got, "percentile %v", tt.p)
+	}
+}
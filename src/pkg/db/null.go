@@ -1,6 +1,7 @@
 package db
 
 import (
+	"context"
 	"time"
 
 	"go.uber.org/zap"
@@ -26,11 +27,61 @@ func (n *nullUserProfileClient) Get(cookie string) (UserProfile, error) {
 	return UserProfile{}, nil
 }
 
-func (n *nullUserProfileClient) Add(tag *types.UserTag) (int, error) {
-	n.logger.Debug("null user profile client invoked", zap.String("method", "Add"), zap.Any("tag", tag))
+func (n *nullUserProfileClient) GetPages(cookie string, reqs []PageRequest, limit int) ([]TagsPage, error) {
+	n.logger.Debug("null user profile client invoked", zap.String("method", "GetPages"), zap.String("cookie", cookie), zap.Any("reqs", reqs), zap.Int("limit", limit))
+	return make([]TagsPage, len(reqs)), nil
+}
+
+func (n *nullUserProfileClient) Add(cookie string, tag *types.UserTag) (int, error) {
+	n.logger.Debug("null user profile client invoked", zap.String("method", "Add"), zap.String("cookie", cookie), zap.Any("tag", tag))
 	return 0, nil
 }
 
+func (n *nullUserProfileClient) Erase(cookie string, receipt string, tombstoneTTL time.Duration) (Erasure, error) {
+	n.logger.Debug("null user profile client invoked", zap.String("method", "Erase"), zap.String("cookie", cookie), zap.String("receipt", receipt), zap.Duration("tombstoneTTL", tombstoneTTL))
+	return Erasure{}, nil
+}
+
+func (n *nullUserProfileClient) IsErased(cookie string) (bool, error) {
+	n.logger.Debug("null user profile client invoked", zap.String("method", "IsErased"), zap.String("cookie", cookie))
+	return false, nil
+}
+
+func (n *nullUserProfileClient) Resolve(cookie string) (string, error) {
+	n.logger.Debug("null user profile client invoked", zap.String("method", "Resolve"), zap.String("cookie", cookie))
+	return cookie, nil
+}
+
+func (n *nullUserProfileClient) Lookup(cookie string) (string, bool, error) {
+	n.logger.Debug("null user profile client invoked", zap.String("method", "Lookup"), zap.String("cookie", cookie))
+	return cookie, false, nil
+}
+
+func (n *nullUserProfileClient) Link(alias string, canonical string) error {
+	n.logger.Debug("null user profile client invoked", zap.String("method", "Link"), zap.String("alias", alias), zap.String("canonical", canonical))
+	return nil
+}
+
+func (n *nullUserProfileClient) Unlink(alias string) error {
+	n.logger.Debug("null user profile client invoked", zap.String("method", "Unlink"), zap.String("alias", alias))
+	return nil
+}
+
+func (n *nullUserProfileClient) Aliases(cookie string) ([]string, error) {
+	n.logger.Debug("null user profile client invoked", zap.String("method", "Aliases"), zap.String("cookie", cookie))
+	return nil, nil
+}
+
+func (n *nullUserProfileClient) Merge(from string, into string, limit int) (Merged, error) {
+	n.logger.Debug("null user profile client invoked", zap.String("method", "Merge"), zap.String("from", from), zap.String("into", into), zap.Int("limit", limit))
+	return Merged{}, nil
+}
+
+func (n *nullUserProfileClient) Scan(func(UserProfile) error) error {
+	n.logger.Debug("null user profile client invoked", zap.String("method", "Scan"))
+	return nil
+}
+
 type nullAggregatesClient struct {
 	logger *zap.Logger
 }
@@ -40,11 +91,162 @@ func (n *nullAggregatesClient) Get(time time.Time, action types.Action) ([]Actio
 	return nil, nil
 }
 
+func (n *nullAggregatesClient) GetWithCookies(time time.Time, action types.Action) ([]ActionAggregates, error) {
+	n.logger.Debug("null aggregates client invoked", zap.String("method", "GetWithCookies"), zap.Time("time", time), zap.String("action", action.String()))
+	return nil, nil
+}
+
+func (n *nullAggregatesClient) CountUniqueCookies(time time.Time, action types.Action, aggs []ActionAggregates) (uint64, error) {
+	n.logger.Debug("null aggregates client invoked", zap.String("method", "CountUniqueCookies"), zap.Time("time", time), zap.String("action", action.String()), zap.Int("aggregates", len(aggs)))
+	return 0, nil
+}
+
+func (n *nullAggregatesClient) GetWithTop(time time.Time, action types.Action) ([]ActionAggregates, error) {
+	n.logger.Debug("null aggregates client invoked", zap.String("method", "GetWithTop"), zap.Time("time", time), zap.String("action", action.String()))
+	return nil, nil
+}
+
 func (n *nullAggregatesClient) Add(key AggregateKey, tag types.UserTag) error {
 	n.logger.Debug("null aggregates client invoked", zap.String("method", "Add"), zap.Any("key", key), zap.Any("tag", tag))
 	return nil
 }
 
+func (n *nullAggregatesClient) AddCorrection(key AggregateKey, tag types.UserTag) error {
+	n.logger.Debug("null aggregates client invoked", zap.String("method", "AddCorrection"), zap.Any("key", key), zap.Any("tag", tag))
+	return nil
+}
+
+type nullWebhookClient struct {
+	logger *zap.Logger
+}
+
+func (n *nullWebhookClient) Put(sub WebhookSubscription) error {
+	n.logger.Debug("null webhook client invoked", zap.String("method", "Put"), zap.String("id", sub.Id))
+	return nil
+}
+
+func (n *nullWebhookClient) Get(id string) (WebhookSubscription, error) {
+	n.logger.Debug("null webhook client invoked", zap.String("method", "Get"), zap.String("id", id))
+	return WebhookSubscription{}, KeyNotFoundError
+}
+
+func (n *nullWebhookClient) Delete(id string) error {
+	n.logger.Debug("null webhook client invoked", zap.String("method", "Delete"), zap.String("id", id))
+	return KeyNotFoundError
+}
+
+func (n *nullWebhookClient) List() ([]WebhookSubscription, error) {
+	n.logger.Debug("null webhook client invoked", zap.String("method", "List"))
+	return nil, nil
+}
+
+func (n *nullWebhookClient) AddDelivery(id string, delivery WebhookDelivery, limit int) error {
+	n.logger.Debug("null webhook client invoked", zap.String("method", "AddDelivery"), zap.String("id", id), zap.Any("delivery", delivery), zap.Int("limit", limit))
+	return nil
+}
+
+func (n *nullWebhookClient) Deliveries(id string) ([]WebhookDelivery, error) {
+	n.logger.Debug("null webhook client invoked", zap.String("method", "Deliveries"), zap.String("id", id))
+	return nil, nil
+}
+
+func (n *nullWebhookClient) Enqueue(id string, delivery PendingDelivery, limit int) error {
+	n.logger.Debug("null webhook client invoked", zap.String("method", "Enqueue"), zap.String("id", id), zap.String("delivery", delivery.Id), zap.Int("limit", limit))
+	return nil
+}
+
+func (n *nullWebhookClient) Pending(id string, count int) ([]PendingDelivery, error) {
+	n.logger.Debug("null webhook client invoked", zap.String("method", "Pending"), zap.String("id", id), zap.Int("count", count))
+	return nil, nil
+}
+
+func (n *nullWebhookClient) Dequeue(id string, deliveryId string) error {
+	n.logger.Debug("null webhook client invoked", zap.String("method", "Dequeue"), zap.String("id", id), zap.String("delivery", deliveryId))
+	return nil
+}
+
+func (n *nullWebhookClient) AcquireLease(id string, owner string, ttl time.Duration) (bool, error) {
+	n.logger.Debug("null webhook client invoked", zap.String("method", "AcquireLease"), zap.String("id", id), zap.String("owner", owner), zap.Duration("ttl", ttl))
+	return false, nil
+}
+
+func (n *nullWebhookClient) EraseCookies(cookies []string) error {
+	n.logger.Debug("null webhook client invoked", zap.String("method", "EraseCookies"), zap.Strings("cookies", cookies))
+	return nil
+}
+
+type nullRuleClient struct {
+	logger *zap.Logger
+}
+
+func (n *nullRuleClient) Put(id string, definition []byte) error {
+	n.logger.Debug("null rule client invoked", zap.String("method", "Put"), zap.String("id", id), zap.ByteString("definition", definition))
+	return nil
+}
+
+func (n *nullRuleClient) Delete(id string) error {
+	n.logger.Debug("null rule client invoked", zap.String("method", "Delete"), zap.String("id", id))
+	return KeyNotFoundError
+}
+
+func (n *nullRuleClient) List() (map[string][]byte, error) {
+	n.logger.Debug("null rule client invoked", zap.String("method", "List"))
+	return nil, nil
+}
+
+func (n *nullRuleClient) AddToWindow(cookie string, tag types.UserTag, window time.Duration) ([]types.UserTag, error) {
+	n.logger.Debug("null rule client invoked", zap.String("method", "AddToWindow"), zap.String("cookie", cookie), zap.Any("tag", tag), zap.Duration("window", window))
+	return []types.UserTag{tag}, nil
+}
+
+type nullWatermarkClient struct {
+	logger *zap.Logger
+}
+
+func (n *nullWatermarkClient) Put(partition int32, watermark time.Time) error {
+	n.logger.Debug("null watermark client invoked", zap.String("method", "Put"), zap.Int32("partition", partition), zap.Time("watermark", watermark))
+	return nil
+}
+
+func (n *nullWatermarkClient) Get() (map[int32]time.Time, error) {
+	n.logger.Debug("null watermark client invoked", zap.String("method", "Get"))
+	return nil, nil
+}
+
+type nullAggregatesSetClient struct {
+	logger *zap.Logger
+}
+
+func (n *nullAggregatesSetClient) Active() (string, error) {
+	n.logger.Debug("null aggregates set client invoked", zap.String("method", "Active"))
+	return DefaultAggregatesSet, nil
+}
+
+func (n *nullAggregatesSetClient) Switch(set string) error {
+	n.logger.Debug("null aggregates set client invoked", zap.String("method", "Switch"), zap.String("set", set))
+	return nil
+}
+
+func (n *nullAggregatesSetClient) Follow(_ context.Context, interval time.Duration) error {
+	n.logger.Debug("null aggregates set client invoked", zap.String("method", "Follow"), zap.Duration("interval", interval))
+	return nil
+}
+
+func (n *nullAggregatesSetClient) Clear(set string) error {
+	n.logger.Debug("null aggregates set client invoked", zap.String("method", "Clear"), zap.String("set", set))
+	return nil
+}
+
+func (n *nullAggregatesSetClient) PutProgress(progress RebuildProgress) error {
+	n.logger.Debug("null aggregates set client invoked", zap.String("method", "PutProgress"), zap.Any("progress", progress))
+	return nil
+}
+
+func (n *nullAggregatesSetClient) Progress(set string) (RebuildProgress, error) {
+	n.logger.Debug("null aggregates set client invoked", zap.String("method", "Progress"), zap.String("set", set))
+	return RebuildProgress{}, KeyNotFoundError
+}
+
 func (n *nullClient) UserProfiles() UserProfileClient {
 	return &nullUserProfileClient{logger: n.logger}
 }
@@ -53,6 +255,26 @@ func (n *nullClient) Aggregates() AggregatesClient {
 	return &nullAggregatesClient{logger: n.logger}
 }
 
+func (n *nullClient) AggregatesIn(_ string) AggregatesClient {
+	return &nullAggregatesClient{logger: n.logger}
+}
+
+func (n *nullClient) AggregatesSets() AggregatesSetClient {
+	return &nullAggregatesSetClient{logger: n.logger}
+}
+
+func (n *nullClient) Webhooks() WebhookClient {
+	return &nullWebhookClient{logger: n.logger}
+}
+
+func (n *nullClient) Rules() RuleClient {
+	return &nullRuleClient{logger: n.logger}
+}
+
+func (n *nullClient) Watermarks() WatermarkClient {
+	return &nullWatermarkClient{logger: n.logger}
+}
+
 func NewNullClient(logger *zap.Logger) Client {
 	return &nullClient{
 		logger: logger,
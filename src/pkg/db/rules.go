@@ -0,0 +1,186 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"time"
+
+	as "github.com/aerospike/aerospike-client-go/v6"
+	asTypes "github.com/aerospike/aerospike-client-go/v6/types"
+	"go.uber.org/zap"
+
+	"github.com/TomaszDomagala/Allezon/src/pkg/types"
+)
+
+const (
+	rulesNamespace = "allezon"
+
+	rulesSet = "rules"
+
+	// rulesIdBin duplicates the key, as scanned records have only digests of keys.
+	rulesIdBin         = "id"
+	rulesDefinitionBin = "definition"
+
+	// ruleWindowsSet holds a record with the sliding window of every cookie evaluated by rules, keyed by the cookie.
+	ruleWindowsSet = "rule_windows"
+
+	// ruleWindowsTagsBin is a map from window keys to marshalled tags, see windowKey.
+	ruleWindowsTagsBin = "tags"
+
+	// windowSeqBits is the number of low bits of window keys telling apart tags of the same millisecond.
+	windowSeqBits = 20
+	// windowMaxAttempts bounds the attempts of adding a tag with keys taken by other tags of the same millisecond.
+	windowMaxAttempts = 10
+)
+
+// windowKey orders tags of a window by their time in milliseconds, followed by a sequence number telling apart tags
+// of the same millisecond. Keys written before sequence numbers were added are older than any key of the window,
+// so they are dropped with the next tag.
+func windowKey(t time.Time, seq uint32) aerospikeInt {
+	return aerospikeInt(t.UnixMilli())<<windowSeqBits | aerospikeInt(seq&(1<<windowSeqBits-1))
+}
+
+// windowSeqOf derives the sequence number of the first key tried for the tag from its contents, so a tag added again
+// finds itself under one of the keys tried before instead of taking a new one.
+func windowSeqOf(marshalledTag []byte) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write(marshalledTag)
+	return h.Sum32()
+}
+
+type ruleClient struct {
+	cl *as.Client
+	l  *zap.Logger
+}
+
+func (c client) Rules() RuleClient {
+	return ruleClient{cl: c.cl, l: c.l}
+}
+
+func (r ruleClient) Put(id string, definition []byte) error {
+	key, err := as.NewKey(rulesNamespace, rulesSet, id)
+	if err != nil {
+		return fmt.Errorf("error creating rule key %s, %w", id, err)
+	}
+	policy := as.NewWritePolicy(0, as.TTLDontExpire)
+	policy.RecordExistsAction = as.REPLACE
+	if err := r.cl.Put(policy, key, as.BinMap{rulesIdBin: id, rulesDefinitionBin: definition}); err != nil {
+		return fmt.Errorf("error writing rule %s, %w", id, err)
+	}
+	return nil
+}
+
+func (r ruleClient) Delete(id string) error {
+	key, err := as.NewKey(rulesNamespace, rulesSet, id)
+	if err != nil {
+		return fmt.Errorf("error creating rule key %s, %w", id, err)
+	}
+	existed, err := r.cl.Delete(nil, key)
+	if err != nil {
+		return fmt.Errorf("error deleting rule %s, %w", id, err)
+	}
+	if !existed {
+		return fmt.Errorf("rule %s not found, %w", id, KeyNotFoundError)
+	}
+	return nil
+}
+
+func (r ruleClient) List() (map[string][]byte, error) {
+	rs, err := r.cl.ScanAll(nil, rulesNamespace, rulesSet)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan rules, %w", err)
+	}
+	defer func() {
+		if err := rs.Close(); err != nil {
+			r.l.Warn("error closing record set", zap.Error(err))
+		}
+	}()
+	definitions := make(map[string][]byte)
+	for res := range rs.Results() {
+		if res.Err != nil {
+			return nil, fmt.Errorf("error scanning rules, %w", res.Err)
+		}
+		id, ok := res.Record.Bins[rulesIdBin].(string)
+		if !ok {
+			return nil, fmt.Errorf("rule record without id: %v", res.Record.Key)
+		}
+		definition, ok := res.Record.Bins[rulesDefinitionBin].([]byte)
+		if !ok {
+			return nil, fmt.Errorf("bin %s of rule %s has a wrong type: %T", rulesDefinitionBin, id, res.Record.Bins[rulesDefinitionBin])
+		}
+		definitions[id] = definition
+	}
+	return definitions, nil
+}
+
+func (r ruleClient) AddToWindow(cookie string, tag types.UserTag, window time.Duration) ([]types.UserTag, error) {
+	key, err := as.NewKey(rulesNamespace, ruleWindowsSet, cookie)
+	if err != nil {
+		return nil, fmt.Errorf("error creating rule window key %s, %w", cookie, err)
+	}
+	marshalledTag, merr := types.MarshalUserTag(&tag)
+	if merr != nil {
+		return nil, fmt.Errorf("error marshalling tag %#v, %w", tag, merr)
+	}
+
+	ttl := uint32(window.Seconds())
+	if ttl == 0 {
+		ttl = 1
+	}
+	policy := as.NewWritePolicy(0, ttl)
+	policy.RecordExistsAction = as.UPDATE
+
+	start := windowKey(tag.Time.Add(-window), 0)
+	removeOld := as.MapRemoveByKeyRangeOp(ruleWindowsTagsBin, nil, start, as.MapReturnType.NONE)
+	getWindow := as.MapGetByKeyRangeOp(ruleWindowsTagsBin, start, nil, as.MapReturnType.VALUE)
+	// Tags are never overwritten, a key taken by another tag of the same millisecond is retried with the next number.
+	// A key taken by the same tag means it was added before, e.g. by an attempt retried after a failure, and only the
+	// window is read then, so the tag is counted once.
+	mapPolicy := as.NewMapPolicyWithFlags(as.MapOrder.KEY_ORDERED, as.MapWriteFlagsCreateOnly)
+	seq := windowSeqOf(marshalledTag)
+	var rec *as.Record
+	var aerr as.Error
+	for attempt := uint32(0); attempt < windowMaxAttempts; attempt++ {
+		k := windowKey(tag.Time, seq+attempt)
+		rec, aerr = r.cl.Operate(policy, key, as.MapPutOp(mapPolicy, ruleWindowsTagsBin, k, marshalledTag), removeOld, getWindow)
+		if aerr == nil || !aerr.Matches(asTypes.FAIL_ELEMENT_EXISTS) {
+			break
+		}
+		exists := aerr
+		var stored *as.Record
+		stored, aerr = r.cl.Operate(policy, key, as.MapGetByKeyOp(ruleWindowsTagsBin, k, as.MapReturnType.VALUE))
+		if aerr != nil {
+			break
+		}
+		if value, ok := stored.Bins[ruleWindowsTagsBin].([]byte); ok && bytes.Equal(value, marshalledTag) {
+			rec, aerr = r.cl.Operate(policy, key, removeOld, getWindow)
+			break
+		}
+		aerr = exists
+	}
+	if aerr != nil {
+		return nil, fmt.Errorf("error adding tag to the rule window of cookie %s, %w", cookie, aerr)
+	}
+
+	// Every operation on the bin has its own result, the window is returned by the last one.
+	raw := rec.Bins[ruleWindowsTagsBin]
+	if results, ok := raw.(as.OpResults); ok && len(results) > 0 {
+		raw = results[len(results)-1]
+	}
+	values, ok := raw.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("bin %s has a wrong type: %T", ruleWindowsTagsBin, raw)
+	}
+	tags := make([]types.UserTag, len(values))
+	for i, v := range values {
+		value, ok := v.([]byte)
+		if !ok {
+			return nil, fmt.Errorf("unexpected type %T of value in bin %s", v, ruleWindowsTagsBin)
+		}
+		if err := types.UnmarshalUserTag(value, &tags[i]); err != nil {
+			return nil, fmt.Errorf("cannot unmarshall tag %s, %w", string(value), err)
+		}
+	}
+	return tags, nil
+}
@@ -3,6 +3,7 @@ package db
 import (
 	"errors"
 	"fmt"
+	"time"
 
 	as "github.com/aerospike/aerospike-client-go/v6"
 	asTypes "github.com/aerospike/aerospike-client-go/v6/types"
@@ -18,8 +19,31 @@ const (
 
 	userProfilesViewsBin = "views"
 	userProfilesBuysBin  = "buys"
+
+	// userProfilesTombstonesSet holds cookies whose profiles were erased, records expire after the tombstone ttl.
+	userProfilesTombstonesSet = "user_profiles_tombstones"
+
+	userProfilesErasedAtBin = "erased_at"
+	userProfilesReceiptBin  = "receipt"
+
+	// userProfilesAliasesSet maps alias cookies to the cookie holding their profile.
+	userProfilesAliasesSet = "user_profiles_aliases"
+
+	userProfilesCanonicalBin = "canonical"
+
+	// userProfilesLinksSet maps cookies to the cookies that are their direct aliases, the reverse of
+	// userProfilesAliasesSet.
+	userProfilesLinksSet = "user_profiles_links"
+
+	userProfilesLinksBin = "aliases"
+
+	// maxAliasDepth bounds the chains of aliases followed by Resolve.
+	maxAliasDepth = 8
 )
 
+// ErrAliasCycle is returned when linking cookies would create a cycle of aliases.
+var ErrAliasCycle = errors.New("alias cycle")
+
 type userProfileClient struct {
 	cl *as.Client
 	l  *zap.Logger
@@ -70,8 +94,67 @@ func (u userProfileClient) Get(cookie string) (up UserProfile, err error) {
 	return
 }
 
-func (u userProfileClient) Add(tag *types.UserTag) (int, error) {
-	name := tag.Cookie
+func (u userProfileClient) GetPages(cookie string, reqs []PageRequest, limit int) ([]TagsPage, error) {
+	pages := make([]TagsPage, len(reqs))
+	if len(reqs) == 0 {
+		return pages, nil
+	}
+	key, err := as.NewKey(userProfilesNamespace, userProfilesSet, cookie)
+	if err != nil {
+		return nil, fmt.Errorf("error creating key %s, %w", cookie, err)
+	}
+	ops := make([]*as.Operation, len(reqs))
+	for i, req := range reqs {
+		ops[i] = as.MapGetByKeyRangeOp(u.actionToBin(req.Action), req.From.UnixMilli(), req.To.UnixMilli(), as.MapReturnType.VALUE)
+	}
+	r, aerr := u.cl.Operate(nil, key, ops...)
+	if aerr != nil {
+		if aerr.Matches(asTypes.KEY_NOT_FOUND_ERROR) {
+			return pages, nil
+		}
+		return nil, fmt.Errorf("error getting tags of cookie %s, %w", cookie, aerr)
+	}
+	for i, req := range reqs {
+		binName := u.actionToBin(req.Action)
+		raw := r.Bins[binName]
+		if raw == nil {
+			continue
+		}
+		values, ok := raw.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("bin %s has a wrong type: %T", binName, raw)
+		}
+		tags := make([]types.UserTag, len(values))
+		for j, v := range values {
+			value, ok := v.([]byte)
+			if !ok {
+				return nil, fmt.Errorf("unexpected type %T of value in bin %s", v, binName)
+			}
+			if err := types.UnmarshalUserTag(value, &tags[j]); err != nil {
+				return nil, fmt.Errorf("cannot unmarshall tag %s, %w", string(value), err)
+			}
+		}
+		pages[i] = NewTagsPage(tags, req.To, limit)
+	}
+	return pages, nil
+}
+
+// NewTagsPage returns the page of the newest limit tags, out of tags sorted in ascending order relative to time
+// and ending before to. There are no pages of non-positive limits, so they return no tags and no next page.
+func NewTagsPage(tags []types.UserTag, to time.Time, limit int) TagsPage {
+	if limit <= 0 {
+		return TagsPage{}
+	}
+	if len(tags) <= limit {
+		return TagsPage{Tags: tags}
+	}
+	page := TagsPage{Tags: tags[len(tags)-limit:]}
+	page.Next = page.Tags[0].Time
+	return page
+}
+
+func (u userProfileClient) Add(cookie string, tag *types.UserTag) (int, error) {
+	name := cookie
 	key, ae := as.NewKey(userProfilesNamespace, userProfilesSet, name)
 	if ae != nil {
 		return 0, fmt.Errorf("error creating key %s, %w", name, ae)
@@ -149,6 +232,265 @@ func (u userProfileClient) RemoveOverLimit(cookie string, action types.Action, l
 	return nil
 }
 
+func (u userProfileClient) Resolve(cookie string) (string, error) {
+	resolved := cookie
+	for i := 0; i < maxAliasDepth; i++ {
+		key, err := as.NewKey(userProfilesNamespace, userProfilesAliasesSet, resolved)
+		if err != nil {
+			return "", fmt.Errorf("error creating alias key %s, %w", resolved, err)
+		}
+		r, aerr := u.cl.Get(nil, key, userProfilesCanonicalBin)
+		if aerr != nil {
+			if aerr.Matches(asTypes.KEY_NOT_FOUND_ERROR) {
+				return resolved, nil
+			}
+			return "", fmt.Errorf("error resolving alias of cookie %s, %w", resolved, aerr)
+		}
+		canonical, ok := r.Bins[userProfilesCanonicalBin].(string)
+		if !ok {
+			return "", fmt.Errorf("canonical cookie of %s has unexpected type %T", resolved, r.Bins[userProfilesCanonicalBin])
+		}
+		if canonical == cookie {
+			return "", fmt.Errorf("%w starting at cookie %s", ErrAliasCycle, cookie)
+		}
+		resolved = canonical
+	}
+	return "", fmt.Errorf("%w: cookie %s has more than %d levels of aliases", ErrAliasCycle, cookie, maxAliasDepth)
+}
+
+func (u userProfileClient) Lookup(cookie string) (string, bool, error) {
+	resolved := cookie
+	for i := 0; i < maxAliasDepth; i++ {
+		aliasKey, err := as.NewKey(userProfilesNamespace, userProfilesAliasesSet, resolved)
+		if err != nil {
+			return "", false, fmt.Errorf("error creating alias key %s, %w", resolved, err)
+		}
+		tombstoneKey, err := as.NewKey(userProfilesNamespace, userProfilesTombstonesSet, resolved)
+		if err != nil {
+			return "", false, fmt.Errorf("error creating tombstone key %s, %w", resolved, err)
+		}
+		alias := as.NewBatchRead(aliasKey, []string{userProfilesCanonicalBin})
+		tombstone := as.NewBatchReadHeader(tombstoneKey)
+		if err := u.cl.BatchGetComplex(nil, []*as.BatchRead{alias, tombstone}); err != nil {
+			return "", false, fmt.Errorf("error looking up cookie %s, %w", resolved, err)
+		}
+		if tombstone.Record != nil {
+			return resolved, true, nil
+		}
+		if alias.Record == nil {
+			return resolved, false, nil
+		}
+		canonical, ok := alias.Record.Bins[userProfilesCanonicalBin].(string)
+		if !ok {
+			return "", false, fmt.Errorf("canonical cookie of %s has unexpected type %T", resolved, alias.Record.Bins[userProfilesCanonicalBin])
+		}
+		if canonical == cookie {
+			return "", false, fmt.Errorf("%w starting at cookie %s", ErrAliasCycle, cookie)
+		}
+		resolved = canonical
+	}
+	return "", false, fmt.Errorf("%w: cookie %s has more than %d levels of aliases", ErrAliasCycle, cookie, maxAliasDepth)
+}
+
+func (u userProfileClient) Link(alias string, canonical string) error {
+	if alias == canonical {
+		return fmt.Errorf("%w: cookie %s can't be an alias of itself", ErrAliasCycle, alias)
+	}
+	key, err := as.NewKey(userProfilesNamespace, userProfilesAliasesSet, alias)
+	if err != nil {
+		return fmt.Errorf("error creating alias key %s, %w", alias, err)
+	}
+	policy := as.NewWritePolicy(0, as.TTLDontExpire)
+	policy.RecordExistsAction = as.REPLACE
+	if err := u.cl.Put(policy, key, as.BinMap{userProfilesCanonicalBin: canonical}); err != nil {
+		return fmt.Errorf("error linking cookie %s to %s, %w", alias, canonical, err)
+	}
+
+	linksKey, err := as.NewKey(userProfilesNamespace, userProfilesLinksSet, canonical)
+	if err != nil {
+		return fmt.Errorf("error creating links key %s, %w", canonical, err)
+	}
+	listPolicy := as.NewListPolicy(as.ListOrderUnordered, as.ListWriteFlagsAddUnique|as.ListWriteFlagsNoFail)
+	if _, err := u.cl.Operate(nil, linksKey, as.ListAppendWithPolicyOp(listPolicy, userProfilesLinksBin, alias)); err != nil {
+		return fmt.Errorf("error adding alias %s to links of %s, %w", alias, canonical, err)
+	}
+	return nil
+}
+
+func (u userProfileClient) Unlink(alias string) error {
+	key, err := as.NewKey(userProfilesNamespace, userProfilesAliasesSet, alias)
+	if err != nil {
+		return fmt.Errorf("error creating alias key %s, %w", alias, err)
+	}
+	r, aerr := u.cl.Get(nil, key, userProfilesCanonicalBin)
+	if aerr != nil {
+		if aerr.Matches(asTypes.KEY_NOT_FOUND_ERROR) {
+			return nil
+		}
+		return fmt.Errorf("error reading alias of cookie %s, %w", alias, aerr)
+	}
+	if _, err := u.cl.Delete(nil, key); err != nil {
+		return fmt.Errorf("error unlinking cookie %s, %w", alias, err)
+	}
+
+	canonical, ok := r.Bins[userProfilesCanonicalBin].(string)
+	if !ok {
+		return fmt.Errorf("canonical cookie of %s has unexpected type %T", alias, r.Bins[userProfilesCanonicalBin])
+	}
+	linksKey, err := as.NewKey(userProfilesNamespace, userProfilesLinksSet, canonical)
+	if err != nil {
+		return fmt.Errorf("error creating links key %s, %w", canonical, err)
+	}
+	policy := as.NewWritePolicy(0, as.TTLDontExpire)
+	policy.RecordExistsAction = as.UPDATE_ONLY
+	if _, err := u.cl.Operate(policy, linksKey, as.ListRemoveByValueOp(userProfilesLinksBin, alias, as.ListReturnTypeNone)); err != nil && !err.Matches(asTypes.KEY_NOT_FOUND_ERROR) {
+		return fmt.Errorf("error removing alias %s from links of %s, %w", alias, canonical, err)
+	}
+	return nil
+}
+
+func (u userProfileClient) Aliases(cookie string) ([]string, error) {
+	var aliases []string
+	visited := map[string]bool{cookie: true}
+	level := []string{cookie}
+	for len(level) > 0 {
+		keys := make([]*as.Key, len(level))
+		for i, c := range level {
+			key, err := as.NewKey(userProfilesNamespace, userProfilesLinksSet, c)
+			if err != nil {
+				return nil, fmt.Errorf("error creating links key %s, %w", c, err)
+			}
+			keys[i] = key
+		}
+		records, err := u.cl.BatchGet(nil, keys, userProfilesLinksBin)
+		if err != nil {
+			return nil, fmt.Errorf("error reading aliases of cookie %s, %w", cookie, err)
+		}
+
+		var next []string
+		for i, r := range records {
+			if r == nil {
+				continue
+			}
+			links, ok := r.Bins[userProfilesLinksBin].([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("aliases of cookie %s have unexpected type %T", level[i], r.Bins[userProfilesLinksBin])
+			}
+			for _, l := range links {
+				alias, ok := l.(string)
+				if !ok {
+					return nil, fmt.Errorf("alias of cookie %s has unexpected type %T", level[i], l)
+				}
+				if visited[alias] {
+					continue
+				}
+				visited[alias] = true
+				aliases = append(aliases, alias)
+				next = append(next, alias)
+			}
+		}
+		level = next
+	}
+	return aliases, nil
+}
+
+// Merge puts the tags of from into the maps of into, so tags with the same timestamp are deduplicated, and trims
+// the maps to the newest limit tags in the same operation. The profile of from is removed only if it wasn't
+// modified since it was read, otherwise GenerationMismatch is returned and Merge can be retried.
+func (u userProfileClient) Merge(from string, into string, limit int) (Merged, error) {
+	fromKey, err := as.NewKey(userProfilesNamespace, userProfilesSet, from)
+	if err != nil {
+		return Merged{}, fmt.Errorf("error creating key %s, %w", from, err)
+	}
+	r, aerr := u.cl.Get(nil, fromKey, userProfilesViewsBin, userProfilesBuysBin)
+	if aerr != nil {
+		if aerr.Matches(asTypes.KEY_NOT_FOUND_ERROR) {
+			return Merged{}, nil
+		}
+		return Merged{}, fmt.Errorf("error getting profile of cookie %s, %w", from, aerr)
+	}
+
+	var merged Merged
+	var ops []*as.Operation
+	mapPolicy := as.NewMapPolicy(as.MapOrder.KEY_ORDERED, as.MapWriteMode.UPDATE)
+	for _, binName := range []string{userProfilesViewsBin, userProfilesBuysBin} {
+		raw, ok := r.Bins[binName]
+		if !ok || raw == nil {
+			continue
+		}
+		pairs, ok := raw.([]as.MapPair)
+		if !ok {
+			return Merged{}, fmt.Errorf("bin %s has a wrong type: %T", binName, raw)
+		}
+		if len(pairs) == 0 {
+			continue
+		}
+		items := make(map[interface{}]interface{}, len(pairs))
+		for _, kv := range pairs {
+			items[kv.Key] = kv.Value
+		}
+		ops = append(ops,
+			as.MapPutItemsOp(mapPolicy, binName, items),
+			as.MapRemoveByIndexRangeCountOp(binName, -limit, limit, as.MapReturnType.NONE|as.MapReturnType.INVERTED),
+		)
+		if binName == userProfilesViewsBin {
+			merged.Views = len(pairs)
+		} else {
+			merged.Buys = len(pairs)
+		}
+	}
+
+	if len(ops) > 0 {
+		intoKey, err := as.NewKey(userProfilesNamespace, userProfilesSet, into)
+		if err != nil {
+			return Merged{}, fmt.Errorf("error creating key %s, %w", into, err)
+		}
+		policy := as.NewWritePolicy(0, as.TTLDontExpire)
+		policy.RecordExistsAction = as.UPDATE
+		if _, err := u.cl.Operate(policy, intoKey, ops...); err != nil {
+			return Merged{}, fmt.Errorf("error merging profile of cookie %s into %s, %w", from, into, err)
+		}
+	}
+
+	deletePolicy := as.NewWritePolicy(r.Generation, as.TTLDontExpire)
+	deletePolicy.GenerationPolicy = as.EXPECT_GEN_EQUAL
+	if _, err := u.cl.Delete(deletePolicy, fromKey); err != nil {
+		if err.Matches(asTypes.GENERATION_ERROR) {
+			return Merged{}, fmt.Errorf("%w while removing merged profile %s, %s", GenerationMismatch, from, err)
+		}
+		return Merged{}, fmt.Errorf("error removing merged profile of cookie %s, %w", from, err)
+	}
+	return merged, nil
+}
+
+func (u userProfileClient) Scan(fn func(UserProfile) error) error {
+	rs, err := u.cl.ScanAll(nil, userProfilesNamespace, userProfilesSet, userProfilesViewsBin, userProfilesBuysBin)
+	if err != nil {
+		return fmt.Errorf("failed to scan user profiles, %w", err)
+	}
+	defer func() {
+		if err := rs.Close(); err != nil {
+			u.l.Warn("error closing record set", zap.Error(err))
+		}
+	}()
+	for r := range rs.Results() {
+		if r.Err != nil {
+			return fmt.Errorf("error scanning user profiles, %w", r.Err)
+		}
+		var up UserProfile
+		if err := u.decodeBin(&up.Views, types.View, r.Record.Bins); err != nil {
+			return fmt.Errorf("error parsing views, %w", err)
+		}
+		if err := u.decodeBin(&up.Buys, types.Buy, r.Record.Bins); err != nil {
+			return fmt.Errorf("error parsing buys, %w", err)
+		}
+		if err := fn(up); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (u userProfileClient) actionToBin(action types.Action) string {
 	switch action {
 	case types.Buy:
@@ -162,5 +504,67 @@ func (u userProfileClient) actionToBin(action types.Action) string {
 }
 
 func (c client) UserProfiles() UserProfileClient {
-	return userProfileClient(c)
+	return userProfileClient{cl: c.cl, l: c.l}
+}
+
+// Erase writes the tombstone first, so tags added concurrently with the removal are rejected by IsErased.
+// Non-positive tombstoneTTL skips the tombstone.
+func (u userProfileClient) Erase(cookie string, receipt string, tombstoneTTL time.Duration) (Erasure, error) {
+	if tombstoneTTL > 0 {
+		if err := u.putTombstone(cookie, receipt, tombstoneTTL); err != nil {
+			return Erasure{}, err
+		}
+	}
+
+	key, err := as.NewKey(userProfilesNamespace, userProfilesSet, cookie)
+	if err != nil {
+		return Erasure{}, fmt.Errorf("error creating key %s, %w", cookie, err)
+	}
+	policy := as.NewWritePolicy(0, as.TTLDontExpire)
+	policy.RecordExistsAction = as.UPDATE_ONLY
+
+	r, aerr := u.cl.Operate(policy, key, as.MapSizeOp(userProfilesViewsBin), as.MapSizeOp(userProfilesBuysBin), as.DeleteOp())
+	if aerr != nil {
+		if aerr.Matches(asTypes.KEY_NOT_FOUND_ERROR) {
+			return Erasure{}, nil
+		}
+		return Erasure{}, fmt.Errorf("error removing user profile of cookie %s, %w", cookie, aerr)
+	}
+	// Missing bins have nil size.
+	views, _ := r.Bins[userProfilesViewsBin].(int)
+	buys, _ := r.Bins[userProfilesBuysBin].(int)
+	return Erasure{Found: true, Views: views, Buys: buys}, nil
+}
+
+func (u userProfileClient) putTombstone(cookie string, receipt string, ttl time.Duration) error {
+	key, err := as.NewKey(userProfilesNamespace, userProfilesTombstonesSet, cookie)
+	if err != nil {
+		return fmt.Errorf("error creating tombstone key %s, %w", cookie, err)
+	}
+	seconds := uint32(ttl / time.Second)
+	if seconds == 0 {
+		seconds = 1
+	}
+	policy := as.NewWritePolicy(0, seconds)
+	policy.RecordExistsAction = as.REPLACE
+	bins := as.BinMap{
+		userProfilesErasedAtBin: time.Now().UnixMilli(),
+		userProfilesReceiptBin:  receipt,
+	}
+	if err := u.cl.Put(policy, key, bins); err != nil {
+		return fmt.Errorf("error writing tombstone for cookie %s, %w", cookie, err)
+	}
+	return nil
+}
+
+func (u userProfileClient) IsErased(cookie string) (bool, error) {
+	key, err := as.NewKey(userProfilesNamespace, userProfilesTombstonesSet, cookie)
+	if err != nil {
+		return false, fmt.Errorf("error creating tombstone key %s, %w", cookie, err)
+	}
+	exists, err := u.cl.Exists(nil, key)
+	if err != nil {
+		return false, fmt.Errorf("error checking tombstone of cookie %s, %w", cookie, err)
+	}
+	return exists, nil
 }
@@ -0,0 +1,75 @@
+package db
+
+import (
+	"fmt"
+	"time"
+
+	as "github.com/aerospike/aerospike-client-go/v6"
+	asTypes "github.com/aerospike/aerospike-client-go/v6/types"
+	"go.uber.org/zap"
+)
+
+const (
+	watermarksNamespace = "allezon"
+
+	watermarksSet = "watermarks"
+
+	// watermarksKey is the key of the record with watermarks of the user tags topic.
+	watermarksKey = "user-tags"
+
+	// watermarksPartitionsBin is a map from partitions to their watermarks in milliseconds.
+	watermarksPartitionsBin = "partitions"
+)
+
+type watermarkClient struct {
+	cl *as.Client
+	l  *zap.Logger
+}
+
+func (c client) Watermarks() WatermarkClient {
+	return watermarkClient{cl: c.cl, l: c.l}
+}
+
+func (w watermarkClient) Put(partition int32, watermark time.Time) error {
+	key, err := as.NewKey(watermarksNamespace, watermarksSet, watermarksKey)
+	if err != nil {
+		return fmt.Errorf("error creating watermarks key, %w", err)
+	}
+	mapPolicy := as.NewMapPolicy(as.MapOrder.KEY_ORDERED, as.MapWriteMode.UPDATE)
+	if _, err := w.cl.Operate(nil, key, as.MapPutOp(mapPolicy, watermarksPartitionsBin, int(partition), watermark.UnixMilli())); err != nil {
+		return fmt.Errorf("error writing watermark of partition %d, %w", partition, err)
+	}
+	return nil
+}
+
+func (w watermarkClient) Get() (map[int32]time.Time, error) {
+	key, err := as.NewKey(watermarksNamespace, watermarksSet, watermarksKey)
+	if err != nil {
+		return nil, fmt.Errorf("error creating watermarks key, %w", err)
+	}
+	r, aerr := w.cl.Get(nil, key, watermarksPartitionsBin)
+	if aerr != nil {
+		if aerr.Matches(asTypes.KEY_NOT_FOUND_ERROR) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get watermarks, %w", aerr)
+	}
+	raw := r.Bins[watermarksPartitionsBin]
+	values, ok := raw.(map[interface{}]interface{})
+	if !ok {
+		return nil, fmt.Errorf("bin %s has a wrong type: %T", watermarksPartitionsBin, raw)
+	}
+	watermarks := make(map[int32]time.Time, len(values))
+	for k, v := range values {
+		partition, ok := k.(int)
+		if !ok {
+			return nil, fmt.Errorf("unexpected type %T of key in bin %s", k, watermarksPartitionsBin)
+		}
+		ms, ok := v.(int)
+		if !ok {
+			return nil, fmt.Errorf("unexpected type %T of value in bin %s", v, watermarksPartitionsBin)
+		}
+		watermarks[int32(partition)] = time.UnixMilli(int64(ms)).UTC()
+	}
+	return watermarks, nil
+}
@@ -0,0 +1,507 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	as "github.com/aerospike/aerospike-client-go/v6"
+	asTypes "github.com/aerospike/aerospike-client-go/v6/types"
+	"go.uber.org/zap"
+
+	"github.com/TomaszDomagala/Allezon/src/pkg/types"
+)
+
+const (
+	webhooksNamespace = "allezon"
+
+	webhooksSet = "webhooks"
+
+	// webhooksIdBin duplicates the key, as scanned records have only digests of keys.
+	webhooksIdBin          = "id"
+	webhooksUrlBin         = "url"
+	webhooksSecretBin      = "secret"
+	webhooksCreatedAtBin   = "created_at"
+	webhooksActionsBin     = "actions"
+	webhooksProductIdsBin  = "product_ids"
+	webhooksBrandIdsBin    = "brand_ids"
+	webhooksCategoryIdsBin = "category_ids"
+	webhooksMinPriceBin    = "min_price"
+	webhooksMaxPriceBin    = "max_price"
+
+	// webhookDeliveriesSet holds a record with the delivery log of every subscription, keyed by its id.
+	webhookDeliveriesSet = "webhook_deliveries"
+
+	// webhookDeliveriesBin is a list of maps, each describing a single delivery.
+	webhookDeliveriesBin = "log"
+
+	webhookDeliveryIdKey         = "id"
+	webhookDeliveryTimeKey       = "time"
+	webhookDeliveryCookieKey     = "cookie"
+	webhookDeliveryStatusCodeKey = "status_code"
+	webhookDeliveryAttemptsKey   = "attempts"
+	webhookDeliveryErrorKey      = "error"
+
+	// webhookOutboxSet holds a record with deliveries of every subscription waiting to be sent, keyed by its id.
+	webhookOutboxSet = "webhook_outbox"
+
+	// webhookOutboxBin is a key ordered map of ids of deliveries to maps with their cookies and payloads.
+	webhookOutboxBin = "pending"
+
+	webhookOutboxCookieKey  = "cookie"
+	webhookOutboxPayloadKey = "payload"
+
+	// webhookLeasesSet holds a record for every subscription whose outbox is being sent, expiring with the lease.
+	webhookLeasesSet     = "webhook_leases"
+	webhookLeaseOwnerBin = "owner"
+
+	// webhookEraseMaxAttempts bounds the attempts of rewriting a delivery log modified concurrently.
+	webhookEraseMaxAttempts = 10
+)
+
+type webhookClient struct {
+	cl *as.Client
+	l  *zap.Logger
+}
+
+func (c client) Webhooks() WebhookClient {
+	return webhookClient{cl: c.cl, l: c.l}
+}
+
+func (w webhookClient) Put(sub WebhookSubscription) error {
+	key, err := as.NewKey(webhooksNamespace, webhooksSet, sub.Id)
+	if err != nil {
+		return fmt.Errorf("error creating webhook key %s, %w", sub.Id, err)
+	}
+	actions := make([]int, len(sub.Filter.Actions))
+	for i, a := range sub.Filter.Actions {
+		actions[i] = int(a)
+	}
+	policy := as.NewWritePolicy(0, as.TTLDontExpire)
+	policy.RecordExistsAction = as.REPLACE
+	bins := as.BinMap{
+		webhooksIdBin:          sub.Id,
+		webhooksUrlBin:         sub.Url,
+		webhooksSecretBin:      sub.Secret,
+		webhooksCreatedAtBin:   sub.CreatedAt.UnixMilli(),
+		webhooksActionsBin:     actions,
+		webhooksProductIdsBin:  sub.Filter.ProductIds,
+		webhooksBrandIdsBin:    sub.Filter.BrandIds,
+		webhooksCategoryIdsBin: sub.Filter.CategoryIds,
+		webhooksMinPriceBin:    int(sub.Filter.MinPrice),
+		webhooksMaxPriceBin:    int(sub.Filter.MaxPrice),
+	}
+	if err := w.cl.Put(policy, key, bins); err != nil {
+		return fmt.Errorf("error writing webhook %s, %w", sub.Id, err)
+	}
+	return nil
+}
+
+func (w webhookClient) Get(id string) (WebhookSubscription, error) {
+	key, err := as.NewKey(webhooksNamespace, webhooksSet, id)
+	if err != nil {
+		return WebhookSubscription{}, fmt.Errorf("error creating webhook key %s, %w", id, err)
+	}
+	r, err := w.cl.Get(nil, key)
+	if err != nil {
+		if errors.Is(err, as.ErrKeyNotFound) {
+			return WebhookSubscription{}, fmt.Errorf("webhook %s not found, %w", id, KeyNotFoundError)
+		}
+		return WebhookSubscription{}, fmt.Errorf("failed to get webhook %s, %w", id, err)
+	}
+	return decodeWebhook(id, r.Bins)
+}
+
+func (w webhookClient) Delete(id string) error {
+	key, err := as.NewKey(webhooksNamespace, webhooksSet, id)
+	if err != nil {
+		return fmt.Errorf("error creating webhook key %s, %w", id, err)
+	}
+	existed, err := w.cl.Delete(nil, key)
+	if err != nil {
+		return fmt.Errorf("error deleting webhook %s, %w", id, err)
+	}
+	if !existed {
+		return fmt.Errorf("webhook %s not found, %w", id, KeyNotFoundError)
+	}
+
+	deliveriesKey, err := as.NewKey(webhooksNamespace, webhookDeliveriesSet, id)
+	if err != nil {
+		return fmt.Errorf("error creating webhook deliveries key %s, %w", id, err)
+	}
+	if _, err := w.cl.Delete(nil, deliveriesKey); err != nil {
+		return fmt.Errorf("error deleting deliveries of webhook %s, %w", id, err)
+	}
+	outboxKey, err := as.NewKey(webhooksNamespace, webhookOutboxSet, id)
+	if err != nil {
+		return fmt.Errorf("error creating webhook outbox key %s, %w", id, err)
+	}
+	if _, err := w.cl.Delete(nil, outboxKey); err != nil {
+		return fmt.Errorf("error deleting outbox of webhook %s, %w", id, err)
+	}
+	return nil
+}
+
+func (w webhookClient) List() ([]WebhookSubscription, error) {
+	rs, err := w.cl.ScanAll(nil, webhooksNamespace, webhooksSet)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan webhooks, %w", err)
+	}
+	defer func() {
+		if err := rs.Close(); err != nil {
+			w.l.Warn("error closing record set", zap.Error(err))
+		}
+	}()
+	var subs []WebhookSubscription
+	for r := range rs.Results() {
+		if r.Err != nil {
+			return nil, fmt.Errorf("error scanning webhooks, %w", r.Err)
+		}
+		id, ok := r.Record.Bins[webhooksIdBin].(string)
+		if !ok {
+			return nil, fmt.Errorf("webhook record without id: %v", r.Record.Key)
+		}
+		sub, err := decodeWebhook(id, r.Record.Bins)
+		if err != nil {
+			return nil, err
+		}
+		subs = append(subs, sub)
+	}
+	return subs, nil
+}
+
+func decodeWebhook(id string, bins as.BinMap) (WebhookSubscription, error) {
+	sub := WebhookSubscription{Id: id}
+	sub.Url, _ = bins[webhooksUrlBin].(string)
+	sub.Secret, _ = bins[webhooksSecretBin].(string)
+	createdAt, _ := bins[webhooksCreatedAtBin].(int)
+	sub.CreatedAt = time.UnixMilli(int64(createdAt)).UTC()
+
+	actions, err := decodeList[int](bins, webhooksActionsBin)
+	if err != nil {
+		return WebhookSubscription{}, err
+	}
+	for _, a := range actions {
+		sub.Filter.Actions = append(sub.Filter.Actions, types.Action(a))
+	}
+	if sub.Filter.ProductIds, err = decodeList[int](bins, webhooksProductIdsBin); err != nil {
+		return WebhookSubscription{}, err
+	}
+	if sub.Filter.BrandIds, err = decodeList[string](bins, webhooksBrandIdsBin); err != nil {
+		return WebhookSubscription{}, err
+	}
+	if sub.Filter.CategoryIds, err = decodeList[string](bins, webhooksCategoryIdsBin); err != nil {
+		return WebhookSubscription{}, err
+	}
+	minPrice, _ := bins[webhooksMinPriceBin].(int)
+	maxPrice, _ := bins[webhooksMaxPriceBin].(int)
+	sub.Filter.MinPrice, sub.Filter.MaxPrice = uint32(minPrice), uint32(maxPrice)
+	return sub, nil
+}
+
+// decodeList decodes the list bin, which is missing if the list was empty.
+func decodeList[T any](bins as.BinMap, binName string) ([]T, error) {
+	raw, ok := bins[binName]
+	if !ok || raw == nil {
+		return nil, nil
+	}
+	values, ok := raw.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("bin %s has a wrong type: %T", binName, raw)
+	}
+	if len(values) == 0 {
+		return nil, nil
+	}
+	res := make([]T, len(values))
+	for i, v := range values {
+		if res[i], ok = v.(T); !ok {
+			return nil, fmt.Errorf("unexpected type %T of element of bin %s", v, binName)
+		}
+	}
+	return res, nil
+}
+
+func (w webhookClient) AddDelivery(id string, delivery WebhookDelivery, limit int) error {
+	key, err := as.NewKey(webhooksNamespace, webhookDeliveriesSet, id)
+	if err != nil {
+		return fmt.Errorf("error creating webhook deliveries key %s, %w", id, err)
+	}
+	entry := map[string]interface{}{
+		webhookDeliveryIdKey:         delivery.Id,
+		webhookDeliveryTimeKey:       delivery.Time.UnixMilli(),
+		webhookDeliveryCookieKey:     delivery.Cookie,
+		webhookDeliveryStatusCodeKey: delivery.StatusCode,
+		webhookDeliveryAttemptsKey:   delivery.Attempts,
+		webhookDeliveryErrorKey:      delivery.Error,
+	}
+	_, aerr := w.cl.Operate(nil, key,
+		as.ListAppendOp(webhookDeliveriesBin, entry),
+		as.ListRemoveByIndexRangeCountOp(webhookDeliveriesBin, -limit, limit, as.ListReturnTypeNone|as.ListReturnTypeInverted),
+	)
+	if aerr != nil {
+		return fmt.Errorf("error logging delivery of webhook %s, %w", id, aerr)
+	}
+	return nil
+}
+
+func (w webhookClient) Deliveries(id string) ([]WebhookDelivery, error) {
+	key, err := as.NewKey(webhooksNamespace, webhookDeliveriesSet, id)
+	if err != nil {
+		return nil, fmt.Errorf("error creating webhook deliveries key %s, %w", id, err)
+	}
+	r, aerr := w.cl.Get(nil, key, webhookDeliveriesBin)
+	if aerr != nil {
+		if aerr.Matches(asTypes.KEY_NOT_FOUND_ERROR) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get deliveries of webhook %s, %w", id, aerr)
+	}
+	entries, derr := decodeList[map[interface{}]interface{}](r.Bins, webhookDeliveriesBin)
+	if derr != nil {
+		return nil, derr
+	}
+	deliveries := make([]WebhookDelivery, len(entries))
+	for i, e := range entries {
+		d := &deliveries[i]
+		d.Id, _ = e[webhookDeliveryIdKey].(string)
+		t, _ := e[webhookDeliveryTimeKey].(int)
+		d.Time = time.UnixMilli(int64(t)).UTC()
+		d.Cookie, _ = e[webhookDeliveryCookieKey].(string)
+		d.StatusCode, _ = e[webhookDeliveryStatusCodeKey].(int)
+		d.Attempts, _ = e[webhookDeliveryAttemptsKey].(int)
+		d.Error, _ = e[webhookDeliveryErrorKey].(string)
+	}
+	return deliveries, nil
+}
+
+func (w webhookClient) Enqueue(id string, delivery PendingDelivery, limit int) error {
+	key, err := as.NewKey(webhooksNamespace, webhookOutboxSet, id)
+	if err != nil {
+		return fmt.Errorf("error creating webhook outbox key %s, %w", id, err)
+	}
+	value := map[string]interface{}{
+		webhookOutboxCookieKey:  delivery.Cookie,
+		webhookOutboxPayloadKey: delivery.Payload,
+	}
+	// The size of the outbox is checked by the server before the delivery is put, so deliveries queued concurrently
+	// by other replicas can't push the outbox over the limit.
+	policy := as.NewWritePolicy(0, as.TTLServerDefault)
+	policy.FilterExpression = as.ExpOr(
+		as.ExpNot(as.ExpBinExists(webhookOutboxBin)),
+		as.ExpLess(as.ExpMapSize(as.ExpMapBin(webhookOutboxBin)), as.ExpIntVal(int64(limit))),
+	)
+	mapPolicy := as.NewMapPolicy(as.MapOrder.KEY_ORDERED, as.MapWriteMode.UPDATE)
+	if _, aerr := w.cl.Operate(policy, key, as.MapPutOp(mapPolicy, webhookOutboxBin, delivery.Id, value)); aerr != nil {
+		if aerr.Matches(asTypes.FILTERED_OUT) {
+			return fmt.Errorf("%w, webhook %s has %d pending deliveries", OutboxFullError, id, limit)
+		}
+		return fmt.Errorf("error queueing delivery of webhook %s, %w", id, aerr)
+	}
+	return nil
+}
+
+func (w webhookClient) Pending(id string, n int) ([]PendingDelivery, error) {
+	key, err := as.NewKey(webhooksNamespace, webhookOutboxSet, id)
+	if err != nil {
+		return nil, fmt.Errorf("error creating webhook outbox key %s, %w", id, err)
+	}
+	r, aerr := w.cl.Operate(nil, key, as.MapGetByIndexRangeCountOp(webhookOutboxBin, 0, n, as.MapReturnType.KEY_VALUE))
+	if aerr != nil {
+		if aerr.Matches(asTypes.KEY_NOT_FOUND_ERROR) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get pending deliveries of webhook %s, %w", id, aerr)
+	}
+	return decodeOutbox(r.Bins[webhookOutboxBin])
+}
+
+// decodeOutbox decodes pending deliveries of the outbox, the oldest first.
+func decodeOutbox(raw interface{}) ([]PendingDelivery, error) {
+	var pairs []as.MapPair
+	switch m := raw.(type) {
+	case nil:
+		return nil, nil
+	case []as.MapPair:
+		pairs = m
+	case map[interface{}]interface{}:
+		for k, v := range m {
+			pairs = append(pairs, as.MapPair{Key: k, Value: v})
+		}
+		sort.Slice(pairs, func(i, j int) bool {
+			ki, _ := pairs[i].Key.(string)
+			kj, _ := pairs[j].Key.(string)
+			return ki < kj
+		})
+	default:
+		return nil, fmt.Errorf("bin %s has a wrong type: %T", webhookOutboxBin, raw)
+	}
+
+	deliveries := make([]PendingDelivery, len(pairs))
+	for i, p := range pairs {
+		d := &deliveries[i]
+		var ok bool
+		if d.Id, ok = p.Key.(string); !ok {
+			return nil, fmt.Errorf("unexpected type %T of key in bin %s", p.Key, webhookOutboxBin)
+		}
+		value, ok := p.Value.(map[interface{}]interface{})
+		if !ok {
+			return nil, fmt.Errorf("unexpected type %T of value in bin %s", p.Value, webhookOutboxBin)
+		}
+		d.Cookie, _ = value[webhookOutboxCookieKey].(string)
+		d.Payload, _ = value[webhookOutboxPayloadKey].([]byte)
+	}
+	return deliveries, nil
+}
+
+func (w webhookClient) Dequeue(id string, deliveryId string) error {
+	key, err := as.NewKey(webhooksNamespace, webhookOutboxSet, id)
+	if err != nil {
+		return fmt.Errorf("error creating webhook outbox key %s, %w", id, err)
+	}
+	_, aerr := w.cl.Operate(nil, key, as.MapRemoveByKeyOp(webhookOutboxBin, deliveryId, as.MapReturnType.NONE))
+	if aerr != nil && !aerr.Matches(asTypes.KEY_NOT_FOUND_ERROR) {
+		return fmt.Errorf("error removing delivery %s of webhook %s, %w", deliveryId, id, aerr)
+	}
+	return nil
+}
+
+func (w webhookClient) AcquireLease(id string, owner string, ttl time.Duration) (bool, error) {
+	key, err := as.NewKey(webhooksNamespace, webhookLeasesSet, id)
+	if err != nil {
+		return false, fmt.Errorf("error creating webhook lease key %s, %w", id, err)
+	}
+	expiration := uint32(ttl.Seconds())
+	if expiration == 0 {
+		expiration = 1
+	}
+
+	createPolicy := as.NewWritePolicy(0, expiration)
+	createPolicy.RecordExistsAction = as.CREATE_ONLY
+	aerr := w.cl.PutBins(createPolicy, key, as.NewBin(webhookLeaseOwnerBin, owner))
+	if aerr == nil {
+		return true, nil
+	}
+	if !aerr.Matches(asTypes.KEY_EXISTS_ERROR) {
+		return false, fmt.Errorf("error creating lease of webhook %s, %w", id, aerr)
+	}
+
+	r, aerr := w.cl.Get(nil, key, webhookLeaseOwnerBin)
+	if aerr != nil {
+		if aerr.Matches(asTypes.KEY_NOT_FOUND_ERROR) {
+			// The lease has just expired, it can be acquired by the next attempt.
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to get lease of webhook %s, %w", id, aerr)
+	}
+	if r.Bins[webhookLeaseOwnerBin] != owner {
+		return false, nil
+	}
+	// The lease is extended only if it didn't expire and wasn't taken over in the meantime.
+	renewPolicy := as.NewWritePolicy(r.Generation, expiration)
+	renewPolicy.RecordExistsAction = as.UPDATE_ONLY
+	renewPolicy.GenerationPolicy = as.EXPECT_GEN_EQUAL
+	aerr = w.cl.PutBins(renewPolicy, key, as.NewBin(webhookLeaseOwnerBin, owner))
+	if aerr != nil {
+		if aerr.Matches(asTypes.GENERATION_ERROR, asTypes.KEY_NOT_FOUND_ERROR) {
+			return false, nil
+		}
+		return false, fmt.Errorf("error extending lease of webhook %s, %w", id, aerr)
+	}
+	return true, nil
+}
+
+func (w webhookClient) EraseCookies(cookies []string) error {
+	subs, err := w.List()
+	if err != nil {
+		return err
+	}
+	erased := make(map[string]bool, len(cookies))
+	for _, cookie := range cookies {
+		erased[cookie] = true
+	}
+	for _, sub := range subs {
+		if err := w.eraseFromOutbox(sub.Id, erased); err != nil {
+			return err
+		}
+		if err := w.eraseFromLog(sub.Id, erased); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// eraseFromOutbox removes pending deliveries of erased cookies, by their ids, so deliveries queued in the meantime are kept.
+func (w webhookClient) eraseFromOutbox(id string, erased map[string]bool) error {
+	key, err := as.NewKey(webhooksNamespace, webhookOutboxSet, id)
+	if err != nil {
+		return fmt.Errorf("error creating webhook outbox key %s, %w", id, err)
+	}
+	r, aerr := w.cl.Get(nil, key, webhookOutboxBin)
+	if aerr != nil {
+		if aerr.Matches(asTypes.KEY_NOT_FOUND_ERROR) {
+			return nil
+		}
+		return fmt.Errorf("failed to get outbox of webhook %s, %w", id, aerr)
+	}
+	pending, derr := decodeOutbox(r.Bins[webhookOutboxBin])
+	if derr != nil {
+		return derr
+	}
+	var ids []interface{}
+	for _, p := range pending {
+		if erased[p.Cookie] {
+			ids = append(ids, p.Id)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	if _, aerr := w.cl.Operate(nil, key, as.MapRemoveByKeyListOp(webhookOutboxBin, ids, as.MapReturnType.NONE)); aerr != nil {
+		return fmt.Errorf("error erasing pending deliveries of webhook %s, %w", id, aerr)
+	}
+	return nil
+}
+
+// eraseFromLog rewrites the delivery log without deliveries of erased cookies, if it wasn't modified since it was
+// read, otherwise it's read again, up to webhookEraseMaxAttempts times.
+func (w webhookClient) eraseFromLog(id string, erased map[string]bool) error {
+	key, err := as.NewKey(webhooksNamespace, webhookDeliveriesSet, id)
+	if err != nil {
+		return fmt.Errorf("error creating webhook deliveries key %s, %w", id, err)
+	}
+	for attempt := 0; attempt < webhookEraseMaxAttempts; attempt++ {
+		r, aerr := w.cl.Get(nil, key, webhookDeliveriesBin)
+		if aerr != nil {
+			if aerr.Matches(asTypes.KEY_NOT_FOUND_ERROR) {
+				return nil
+			}
+			return fmt.Errorf("failed to get deliveries of webhook %s, %w", id, aerr)
+		}
+		entries, derr := decodeList[map[interface{}]interface{}](r.Bins, webhookDeliveriesBin)
+		if derr != nil {
+			return derr
+		}
+		kept := make([]interface{}, 0, len(entries))
+		for _, e := range entries {
+			if cookie, _ := e[webhookDeliveryCookieKey].(string); !erased[cookie] {
+				kept = append(kept, e)
+			}
+		}
+		if len(kept) == len(entries) {
+			return nil
+		}
+
+		policy := as.NewWritePolicy(r.Generation, as.TTLDontUpdate)
+		policy.RecordExistsAction = as.UPDATE_ONLY
+		policy.GenerationPolicy = as.EXPECT_GEN_EQUAL
+		aerr = w.cl.PutBins(policy, key, as.NewBin(webhookDeliveriesBin, kept))
+		if aerr == nil {
+			return nil
+		}
+		if !aerr.Matches(asTypes.GENERATION_ERROR) {
+			return fmt.Errorf("error erasing deliveries of webhook %s, %w", id, aerr)
+		}
+	}
+	return fmt.Errorf("%w while erasing deliveries of webhook %s %d times", GenerationMismatch, id, webhookEraseMaxAttempts)
+}
@@ -0,0 +1,34 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/TomaszDomagala/Allezon/src/pkg/types"
+)
+
+func TestWebhookFilterMatch(t *testing.T) {
+	tag := types.UserTag{
+		Action:      types.Buy,
+		ProductInfo: types.ProductInfo{ProductId: 1, BrandId: "brand", CategoryId: "category", Price: 100},
+	}
+	for _, tt := range []struct {
+		name   string
+		filter WebhookFilter
+		want   bool
+	}{
+		{name: "empty filter", filter: WebhookFilter{}, want: true},
+		{name: "any of values", filter: WebhookFilter{BrandIds: []string{"other", "brand"}, CategoryIds: []string{"category"}}, want: true},
+		{name: "action", filter: WebhookFilter{Actions: []types.Action{types.View}}, want: false},
+		{name: "product", filter: WebhookFilter{ProductIds: []int{2}}, want: false},
+		{name: "category", filter: WebhookFilter{BrandIds: []string{"brand"}, CategoryIds: []string{"other"}}, want: false},
+		{name: "price in range", filter: WebhookFilter{MinPrice: 100, MaxPrice: 100}, want: true},
+		{name: "price below range", filter: WebhookFilter{MinPrice: 101}, want: false},
+		{name: "price above range", filter: WebhookFilter{MaxPrice: 99}, want: false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.filter.Match(tag))
+		})
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/TomaszDomagala/Allezon/src/pkg/dto/pbdto"
 	"github.com/TomaszDomagala/Allezon/src/pkg/types"
+	"github.com/TomaszDomagala/Allezon/src/pkg/types/pbtypes"
 )
 
 const UserTagTimeLayout = "2006-01-02T15:04:05.999Z"
@@ -35,6 +37,8 @@ type UserProfileDTO struct {
 	Cookie string       `json:"cookie"`
 	Views  []UserTagDTO `json:"views"`
 	Buys   []UserTagDTO `json:"buys"`
+	// NextCursor is passed as the cursor to get the next, older page. It's empty on the last page.
+	NextCursor string `json:"next_cursor,omitempty"`
 }
 
 type AggregatesDTO struct {
@@ -42,13 +46,154 @@ type AggregatesDTO struct {
 	Rows    [][]string `json:"rows"`
 }
 
+// TopDTO lists items of the dimension with the largest aggregate, in descending order.
+type TopDTO struct {
+	Dimension string       `json:"dimension"`
+	Aggregate string       `json:"aggregate"`
+	Items     []TopItemDTO `json:"items"`
+}
+
+type TopItemDTO struct {
+	Id    string `json:"id"`
+	Value uint64 `json:"value"`
+}
+
+// ErasureReceiptDTO is an audit receipt of an erased user profile.
+type ErasureReceiptDTO struct {
+	ReceiptID string `json:"receipt_id"`
+	Cookie    string `json:"cookie"`
+	ErasedAt  string `json:"erased_at"`
+	// ProfileFound is false if there was no profile stored for the cookie.
+	ProfileFound bool `json:"profile_found"`
+	ViewsErased  int  `json:"views_erased"`
+	BuysErased   int  `json:"buys_erased"`
+	// AliasesErased lists the other cookies linked to the erased profile, they are erased and unlinked with it.
+	AliasesErased []string `json:"aliases_erased,omitempty"`
+	// TagsRejectedUntil is the end of the period in which new tags of the cookie are rejected.
+	// It's empty if tags are not rejected.
+	TagsRejectedUntil string `json:"tags_rejected_until,omitempty"`
+}
+
+// BulkErasureRequestDTO lists cookies whose profiles should be erased.
+type BulkErasureRequestDTO struct {
+	Cookies []string `json:"cookies" binding:"required,min=1,max=1000,dive,required"`
+}
+
+// BulkErasureDTO holds receipts of all erased profiles, in order of the request.
+type BulkErasureDTO struct {
+	Receipts []ErasureReceiptDTO `json:"receipts"`
+}
+
+// CookieLinkRequestDTO links the cookie from the path to the target cookie, which becomes its canonical cookie.
+type CookieLinkRequestDTO struct {
+	Target string `json:"target" binding:"required"`
+}
+
+// CookieLinkDTO describes the result of linking cookies.
+type CookieLinkDTO struct {
+	Cookie string `json:"cookie"`
+	// Canonical is the cookie holding the merged profile.
+	Canonical   string `json:"canonical"`
+	ViewsMerged int    `json:"views_merged"`
+	BuysMerged  int    `json:"buys_merged"`
+}
+
+// WebhookSubscriptionRequestDTO creates a webhook subscription.
+type WebhookSubscriptionRequestDTO struct {
+	Url string `json:"url" binding:"required,url"`
+	// Secret signs payloads, it's generated if it's empty.
+	Secret string           `json:"secret"`
+	Filter WebhookFilterDTO `json:"filter"`
+}
+
+// WebhookFilterDTO matches tags with values in all of its non-empty lists and with the price in [min_price, max_price].
+// Zero max_price means no upper bound.
+type WebhookFilterDTO struct {
+	Actions     []string `json:"actions,omitempty" binding:"dive,oneof=VIEW BUY"`
+	ProductIds  []int    `json:"product_ids,omitempty"`
+	BrandIds    []string `json:"brand_ids,omitempty"`
+	CategoryIds []string `json:"category_ids,omitempty"`
+	MinPrice    uint32   `json:"min_price,omitempty"`
+	MaxPrice    uint32   `json:"max_price,omitempty" binding:"omitempty,gtefield=MinPrice"`
+}
+
+// WebhookSubscriptionDTO describes a webhook subscription.
+type WebhookSubscriptionDTO struct {
+	Id  string `json:"id"`
+	Url string `json:"url"`
+	// Secret is returned only when the subscription is created.
+	Secret    string           `json:"secret,omitempty"`
+	Filter    WebhookFilterDTO `json:"filter"`
+	CreatedAt string           `json:"created_at"`
+}
+
+// WebhookDeliveryDTO is an entry of the delivery log of a webhook subscription.
+type WebhookDeliveryDTO struct {
+	Id     string `json:"id"`
+	Time   string `json:"time"`
+	Cookie string `json:"cookie"`
+	// StatusCode is the response status of the last attempt, zero if there was no response.
+	StatusCode int `json:"status_code"`
+	Attempts   int `json:"attempts"`
+	// Error is empty if the delivery succeeded.
+	Error string `json:"error,omitempty"`
+}
+
+// WebhookPayloadDTO is the body of a webhook request.
+type WebhookPayloadDTO struct {
+	DeliveryId     string     `json:"delivery_id"`
+	SubscriptionId string     `json:"subscription_id"`
+	Tag            UserTagDTO `json:"tag"`
+}
+
+// RuleDTO matches a tag of action that makes the number of such tags of the cookie in the window ending at it
+// reach count. With group_by only tags with the same product field as the tag are counted. The match is suppressed
+// if the window holds a tag of the without action, of the same group if group_by is set.
+type RuleDTO struct {
+	Id      string `json:"id" binding:"required,max=100"`
+	Action  string `json:"action" binding:"required,oneof=VIEW BUY"`
+	GroupBy string `json:"group_by,omitempty" binding:"omitempty,oneof=product_id brand_id category_id"`
+	Count   int    `json:"count" binding:"required,min=1"`
+	// Window is a duration, like "10m".
+	Window  string `json:"window" binding:"required"`
+	Without string `json:"without,omitempty" binding:"omitempty,oneof=VIEW BUY"`
+}
+
+// RuleMatchDTO is a message of the rule matches topic.
+type RuleMatchDTO struct {
+	RuleId string `json:"rule_id"`
+	Cookie string `json:"cookie"`
+	// Time is the time of the tag which triggered the match.
+	Time string `json:"time"`
+	// Group is the value of the group_by field of counted tags, empty if the rule doesn't group tags.
+	Group string       `json:"group,omitempty"`
+	Tags  []UserTagDTO `json:"tags"`
+}
+
+// AggregatesSetDTO names a set of aggregates.
+type AggregatesSetDTO struct {
+	Set string `json:"set" binding:"required"`
+}
+
+// AggregatesRebuildDTO is the progress of rebuilding a set of aggregates. Offsets and ends are keyed by partitions.
+type AggregatesRebuildDTO struct {
+	Set       string          `json:"set"`
+	Offsets   map[int32]int64 `json:"offsets"`
+	Ends      map[int32]int64 `json:"ends"`
+	Tags      uint64          `json:"tags"`
+	StartedAt string          `json:"started_at"`
+	UpdatedAt string          `json:"updated_at"`
+	Done      bool            `json:"done"`
+	Switched  bool            `json:"switched"`
+}
+
 // FromUserTagDTO converts UserTagDTO to types.UserTag.
 func FromUserTagDTO(dto UserTagDTO) (types.UserTag, error) {
 	t, err := time.Parse(UserTagTimeLayout, dto.Time)
 	if err != nil {
 		return types.UserTag{}, err
 	}
-	device, err := toDevice(dto.Device)
+	device, err := ToDevice(dto.Device)
 	if err != nil {
 		return types.UserTag{}, err
 	}
@@ -91,7 +236,7 @@ func IntoUserTagDTO(tag types.UserTag) UserTagDTO {
 	}
 }
 
-func toDevice(s string) (types.Device, error) {
+func ToDevice(s string) (types.Device, error) {
 	switch s {
 	case "PC":
 		return types.Pc, nil
@@ -121,7 +266,66 @@ func ToAggregate(s string) (types.Aggregate, error) {
 		return types.Count, nil
 	case "SUM_PRICE":
 		return types.Sum, nil
+	case "AVG_PRICE":
+		return types.AvgPrice, nil
+	case "MIN_PRICE":
+		return types.MinPrice, nil
+	case "MAX_PRICE":
+		return types.MaxPrice, nil
+	case "UNIQUE_COOKIES":
+		return types.UniqueCookies, nil
+	case "PRICE_P50":
+		return types.PriceP50, nil
+	case "PRICE_P90":
+		return types.PriceP90, nil
+	case "PRICE_P99":
+		return types.PriceP99, nil
 	default:
 		return 0, fmt.Errorf("can't convert to aggregate: %s", s)
 	}
 }
+
+// IntoUserProfileProto converts the profile into its protobuf representation.
+func IntoUserProfileProto(profile UserProfileDTO) (*pbdto.UserProfile, error) {
+	views, err := intoUserTagsProto(profile.Views)
+	if err != nil {
+		return nil, fmt.Errorf("error converting views, %w", err)
+	}
+	buys, err := intoUserTagsProto(profile.Buys)
+	if err != nil {
+		return nil, fmt.Errorf("error converting buys, %w", err)
+	}
+	return &pbdto.UserProfile{
+		Cookie:     profile.Cookie,
+		Views:      views,
+		Buys:       buys,
+		NextCursor: profile.NextCursor,
+	}, nil
+}
+
+func intoUserTagsProto(tags []UserTagDTO) ([]*pbtypes.UserTag, error) {
+	res := make([]*pbtypes.UserTag, len(tags))
+	for i, t := range tags {
+		tag, err := FromUserTagDTO(t)
+		if err != nil {
+			return nil, err
+		}
+		res[i], err = types.UserTagIntoProto(&tag)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// IntoAggregatesProto converts the aggregates into their protobuf representation.
+func IntoAggregatesProto(aggregates AggregatesDTO) *pbdto.Aggregates {
+	rows := make([]*pbdto.Aggregates_Row, len(aggregates.Rows))
+	for i, row := range aggregates.Rows {
+		rows[i] = &pbdto.Aggregates_Row{Values: row}
+	}
+	return &pbdto.Aggregates{
+		Columns: aggregates.Columns,
+		Rows:    rows,
+	}
+}
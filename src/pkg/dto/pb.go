@@ -0,0 +1,3 @@
+package dto
+
+//go:generate protoc -I . -I ../types --go_out=. --go_opt=Musertag.proto=github.com/TomaszDomagala/Allezon/src/pkg/types/pbtypes ./dto.proto
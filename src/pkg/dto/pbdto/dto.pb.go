@@ -0,0 +1,316 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.28.1
+// 	protoc        v3.12.4
+// source: dto.proto
+
+package pbdto
+
+import (
+	pbtypes "github.com/TomaszDomagala/Allezon/src/pkg/types/pbtypes"
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// UserProfile is the protobuf representation of UserProfileDTO.
+type UserProfile struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Cookie string             `protobuf:"bytes,1,opt,name=cookie,proto3" json:"cookie,omitempty"`
+	Views  []*pbtypes.UserTag `protobuf:"bytes,2,rep,name=views,proto3" json:"views,omitempty"`
+	Buys   []*pbtypes.UserTag `protobuf:"bytes,3,rep,name=buys,proto3" json:"buys,omitempty"`
+	// next_cursor is empty on the last page.
+	NextCursor string `protobuf:"bytes,4,opt,name=next_cursor,json=nextCursor,proto3" json:"next_cursor,omitempty"`
+}
+
+func (x *UserProfile) Reset() {
+	*x = UserProfile{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_dto_proto_msgTypes[0]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *UserProfile) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*UserProfile) ProtoMessage() {}
+
+func (x *UserProfile) ProtoReflect() protoreflect.Message {
+	mi := &file_dto_proto_msgTypes[0]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use UserProfile.ProtoReflect.Descriptor instead.
+func (*UserProfile) Descriptor() ([]byte, []int) {
+	return file_dto_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *UserProfile) GetCookie() string {
+	if x != nil {
+		return x.Cookie
+	}
+	return ""
+}
+
+func (x *UserProfile) GetViews() []*pbtypes.UserTag {
+	if x != nil {
+		return x.Views
+	}
+	return nil
+}
+
+func (x *UserProfile) GetBuys() []*pbtypes.UserTag {
+	if x != nil {
+		return x.Buys
+	}
+	return nil
+}
+
+func (x *UserProfile) GetNextCursor() string {
+	if x != nil {
+		return x.NextCursor
+	}
+	return ""
+}
+
+// Aggregates is the protobuf representation of AggregatesDTO.
+type Aggregates struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Columns []string          `protobuf:"bytes,1,rep,name=columns,proto3" json:"columns,omitempty"`
+	Rows    []*Aggregates_Row `protobuf:"bytes,2,rep,name=rows,proto3" json:"rows,omitempty"`
+}
+
+func (x *Aggregates) Reset() {
+	*x = Aggregates{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_dto_proto_msgTypes[1]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *Aggregates) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Aggregates) ProtoMessage() {}
+
+func (x *Aggregates) ProtoReflect() protoreflect.Message {
+	mi := &file_dto_proto_msgTypes[1]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Aggregates.ProtoReflect.Descriptor instead.
+func (*Aggregates) Descriptor() ([]byte, []int) {
+	return file_dto_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *Aggregates) GetColumns() []string {
+	if x != nil {
+		return x.Columns
+	}
+	return nil
+}
+
+func (x *Aggregates) GetRows() []*Aggregates_Row {
+	if x != nil {
+		return x.Rows
+	}
+	return nil
+}
+
+type Aggregates_Row struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Values []string `protobuf:"bytes,1,rep,name=values,proto3" json:"values,omitempty"`
+}
+
+func (x *Aggregates_Row) Reset() {
+	*x = Aggregates_Row{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_dto_proto_msgTypes[2]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *Aggregates_Row) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Aggregates_Row) ProtoMessage() {}
+
+func (x *Aggregates_Row) ProtoReflect() protoreflect.Message {
+	mi := &file_dto_proto_msgTypes[2]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Aggregates_Row.ProtoReflect.Descriptor instead.
+func (*Aggregates_Row) Descriptor() ([]byte, []int) {
+	return file_dto_proto_rawDescGZIP(), []int{1, 0}
+}
+
+func (x *Aggregates_Row) GetValues() []string {
+	if x != nil {
+		return x.Values
+	}
+	return nil
+}
+
+var File_dto_proto protoreflect.FileDescriptor
+
+var file_dto_proto_rawDesc = []byte{
+	0x0a, 0x09, 0x64, 0x74, 0x6f, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x03, 0x64, 0x74, 0x6f,
+	0x1a, 0x0d, 0x75, 0x73, 0x65, 0x72, 0x74, 0x61, 0x67, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x22,
+	0x90, 0x01, 0x0a, 0x0b, 0x55, 0x73, 0x65, 0x72, 0x50, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x12,
+	0x16, 0x0a, 0x06, 0x63, 0x6f, 0x6f, 0x6b, 0x69, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52,
+	0x06, 0x63, 0x6f, 0x6f, 0x6b, 0x69, 0x65, 0x12, 0x24, 0x0a, 0x05, 0x76, 0x69, 0x65, 0x77, 0x73,
+	0x18, 0x02, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x0e, 0x2e, 0x74, 0x79, 0x70, 0x65, 0x73, 0x2e, 0x55,
+	0x73, 0x65, 0x72, 0x54, 0x61, 0x67, 0x52, 0x05, 0x76, 0x69, 0x65, 0x77, 0x73, 0x12, 0x22, 0x0a,
+	0x04, 0x62, 0x75, 0x79, 0x73, 0x18, 0x03, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x0e, 0x2e, 0x74, 0x79,
+	0x70, 0x65, 0x73, 0x2e, 0x55, 0x73, 0x65, 0x72, 0x54, 0x61, 0x67, 0x52, 0x04, 0x62, 0x75, 0x79,
+	0x73, 0x12, 0x1f, 0x0a, 0x0b, 0x6e, 0x65, 0x78, 0x74, 0x5f, 0x63, 0x75, 0x72, 0x73, 0x6f, 0x72,
+	0x18, 0x04, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0a, 0x6e, 0x65, 0x78, 0x74, 0x43, 0x75, 0x72, 0x73,
+	0x6f, 0x72, 0x22, 0x6e, 0x0a, 0x0a, 0x41, 0x67, 0x67, 0x72, 0x65, 0x67, 0x61, 0x74, 0x65, 0x73,
+	0x12, 0x18, 0x0a, 0x07, 0x63, 0x6f, 0x6c, 0x75, 0x6d, 0x6e, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28,
+	0x09, 0x52, 0x07, 0x63, 0x6f, 0x6c, 0x75, 0x6d, 0x6e, 0x73, 0x12, 0x27, 0x0a, 0x04, 0x72, 0x6f,
+	0x77, 0x73, 0x18, 0x02, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x13, 0x2e, 0x64, 0x74, 0x6f, 0x2e, 0x41,
+	0x67, 0x67, 0x72, 0x65, 0x67, 0x61, 0x74, 0x65, 0x73, 0x2e, 0x52, 0x6f, 0x77, 0x52, 0x04, 0x72,
+	0x6f, 0x77, 0x73, 0x1a, 0x1d, 0x0a, 0x03, 0x52, 0x6f, 0x77, 0x12, 0x16, 0x0a, 0x06, 0x76, 0x61,
+	0x6c, 0x75, 0x65, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x09, 0x52, 0x06, 0x76, 0x61, 0x6c, 0x75,
+	0x65, 0x73, 0x42, 0x08, 0x5a, 0x06, 0x70, 0x62, 0x64, 0x74, 0x6f, 0x2f, 0x62, 0x06, 0x70, 0x72,
+	0x6f, 0x74, 0x6f, 0x33,
+}
+
+var (
+	file_dto_proto_rawDescOnce sync.Once
+	file_dto_proto_rawDescData = file_dto_proto_rawDesc
+)
+
+func file_dto_proto_rawDescGZIP() []byte {
+	file_dto_proto_rawDescOnce.Do(func() {
+		file_dto_proto_rawDescData = protoimpl.X.CompressGZIP(file_dto_proto_rawDescData)
+	})
+	return file_dto_proto_rawDescData
+}
+
+var file_dto_proto_msgTypes = make([]protoimpl.MessageInfo, 3)
+var file_dto_proto_goTypes = []interface{}{
+	(*UserProfile)(nil),     // 0: dto.UserProfile
+	(*Aggregates)(nil),      // 1: dto.Aggregates
+	(*Aggregates_Row)(nil),  // 2: dto.Aggregates.Row
+	(*pbtypes.UserTag)(nil), // 3: types.UserTag
+}
+var file_dto_proto_depIdxs = []int32{
+	3, // 0: dto.UserProfile.views:type_name -> types.UserTag
+	3, // 1: dto.UserProfile.buys:type_name -> types.UserTag
+	2, // 2: dto.Aggregates.rows:type_name -> dto.Aggregates.Row
+	3, // [3:3] is the sub-list for method output_type
+	3, // [3:3] is the sub-list for method input_type
+	3, // [3:3] is the sub-list for extension type_name
+	3, // [3:3] is the sub-list for extension extendee
+	0, // [0:3] is the sub-list for field type_name
+}
+
+func init() { file_dto_proto_init() }
+func file_dto_proto_init() {
+	if File_dto_proto != nil {
+		return
+	}
+	if !protoimpl.UnsafeEnabled {
+		file_dto_proto_msgTypes[0].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*UserProfile); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_dto_proto_msgTypes[1].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*Aggregates); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_dto_proto_msgTypes[2].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*Aggregates_Row); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: file_dto_proto_rawDesc,
+			NumEnums:      0,
+			NumMessages:   3,
+			NumExtensions: 0,
+			NumServices:   0,
+		},
+		GoTypes:           file_dto_proto_goTypes,
+		DependencyIndexes: file_dto_proto_depIdxs,
+		MessageInfos:      file_dto_proto_msgTypes,
+	}.Build()
+	File_dto_proto = out.File
+	file_dto_proto_rawDesc = nil
+	file_dto_proto_goTypes = nil
+	file_dto_proto_depIdxs = nil
+}
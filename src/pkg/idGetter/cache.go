@@ -0,0 +1,109 @@
+package idGetter
+
+import (
+	"sync"
+
+	"github.com/TomaszDomagala/Allezon/src/cmd/id_getter/api"
+)
+
+// idCache holds ids of elements shared by client implementations.
+// A disabled cache never returns any id and ignores all saves.
+type idCache struct {
+	enabled bool
+	rwLock  sync.RWMutex
+	ids     map[string]map[string]int32
+	// versions holds the highest id of each collection received in a snapshot or delta.
+	versions map[string]int32
+	// configVersion is the version of the dictionary config of the id getter the ids were received from.
+	configVersion string
+}
+
+func newIDCache(enabled bool) *idCache {
+	return &idCache{
+		enabled:  enabled,
+		ids:      make(map[string]map[string]int32),
+		versions: make(map[string]int32),
+	}
+}
+
+func (c *idCache) get(name string, element string) (int32, bool) {
+	if !c.enabled {
+		return 0, false
+	}
+
+	c.rwLock.RLock()
+	defer c.rwLock.RUnlock()
+
+	if cache, ok := c.ids[name]; ok {
+		idx, ok := cache[element]
+		return idx, ok
+	}
+	return 0, false
+}
+
+func (c *idCache) save(name string, element string, id int32) {
+	if !c.enabled {
+		return
+	}
+
+	c.rwLock.Lock()
+	defer c.rwLock.Unlock()
+
+	c.saveLocked(name, element, id)
+}
+
+func (c *idCache) saveLocked(name string, element string, id int32) {
+	if cache, ok := c.ids[name]; ok {
+		cache[element] = id
+	} else {
+		c.ids[name] = map[string]int32{element: id}
+	}
+}
+
+// apply saves entries in cache and bumps versions of their collections.
+func (c *idCache) apply(entries []api.SnapshotEntry) {
+	if !c.enabled {
+		return
+	}
+
+	c.rwLock.Lock()
+	defer c.rwLock.Unlock()
+
+	for _, e := range entries {
+		c.saveLocked(e.CollectionName, e.Element, e.ID)
+		if e.ID > c.versions[e.CollectionName] {
+			c.versions[e.CollectionName] = e.ID
+		}
+	}
+}
+
+// switchConfig clears the cache if the dictionary config version of the id getter differs from the one of cached ids,
+// as elements may be mapped to other ids now. It reports whether the cache was cleared.
+func (c *idCache) switchConfig(version string) bool {
+	if !c.enabled {
+		return false
+	}
+
+	c.rwLock.Lock()
+	defer c.rwLock.Unlock()
+
+	if version == c.configVersion {
+		return false
+	}
+	c.configVersion = version
+	c.ids = make(map[string]map[string]int32)
+	c.versions = make(map[string]int32)
+	return true
+}
+
+// currentVersions returns a copy of collection versions.
+func (c *idCache) currentVersions() map[string]int32 {
+	c.rwLock.RLock()
+	defer c.rwLock.RUnlock()
+
+	versions := make(map[string]int32, len(c.versions))
+	for collection, version := range c.versions {
+		versions[collection] = version
+	}
+	return versions
+}
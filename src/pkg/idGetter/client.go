@@ -3,9 +3,14 @@ package idGetter
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
+	"math/rand"
+	"net"
 	"net/http"
-	"sync"
+	"sync/atomic"
+	"time"
 
 	"go.uber.org/zap"
 
@@ -16,8 +21,15 @@ const (
 	OriginCollection   = "origin"
 	BrandCollection    = "brand"
 	CategoryCollection = "category"
+	CountryCollection  = "country"
 )
 
+// ErrNotFound is returned when the element does not exist in the collection and createMissing is disabled.
+var ErrNotFound = errors.New("element not found")
+
+// ErrCircuitOpen is returned when circuit breakers of all addresses are open and the request was not sent.
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
 func GetU16ID(cl Client, collection string, element string, createMissing bool) (uint16, error) {
 	id, err := cl.GetID(collection, element, createMissing)
 	if err != nil {
@@ -30,35 +42,145 @@ func GetU16ID(cl Client, collection string, element string, createMissing bool)
 	return idRes, nil
 }
 
+// GetU16IDs is GetIDs of ids in the range of uint16.
+func GetU16IDs(cl Client, reqs []api.GetIDRequest) ([]uint16, error) {
+	ids, err := GetIDs(cl, reqs)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]uint16, len(ids))
+	for i, id := range ids {
+		res[i] = uint16(id)
+		if int32(res[i]) != id {
+			return nil, fmt.Errorf("if of element %s in collection %s not in range %d", reqs[i].Element, reqs[i].CollectionName, id)
+		}
+	}
+	return res, nil
+}
+
 type Client interface {
 	GetID(collection string, element string, createMissing bool) (id int32, err error)
 }
 
+// BatchClient is implemented by clients looking up ids of many elements in one call.
+type BatchClient interface {
+	// GetIDs returns ids in the order of requests. It fails if any of the lookups fails.
+	GetIDs(reqs []api.GetIDRequest) ([]int32, error)
+}
+
+// GetIDs returns ids of elements in the order of requests, in one call if the client is a BatchClient.
+func GetIDs(cl Client, reqs []api.GetIDRequest) ([]int32, error) {
+	if b, ok := cl.(BatchClient); ok {
+		return b.GetIDs(reqs)
+	}
+	ids := make([]int32, len(reqs))
+	for i, r := range reqs {
+		id, err := cl.GetID(r.CollectionName, r.Element, r.CreateMissing)
+		if err != nil {
+			return nil, err
+		}
+		ids[i] = id
+	}
+	return ids, nil
+}
+
+// Policy controls failover, retries and circuit breaking of the client.
+type Policy struct {
+	// MaxRetries is the number of additional attempts made for lookups with createMissing disabled.
+	MaxRetries int
+	// RetryInitialInterval is the upper bound of the first retry delay. It doubles with every attempt.
+	RetryInitialInterval time.Duration
+	// RetryMaxInterval caps the retry delay.
+	RetryMaxInterval time.Duration
+	// BreakerThreshold is the number of consecutive failures after which the address is considered down.
+	BreakerThreshold int
+	// BreakerCooldown is the time after which a down address is probed again.
+	BreakerCooldown time.Duration
+}
+
+// DefaultPolicy returns a policy suitable for most deployments.
+func DefaultPolicy() Policy {
+	return Policy{
+		MaxRetries:           2,
+		RetryInitialInterval: 50 * time.Millisecond,
+		RetryMaxInterval:     time.Second,
+		BreakerThreshold:     5,
+		BreakerCooldown:      5 * time.Second,
+	}
+}
+
+// Stats is a snapshot of the client state, exposed for metrics.
+type Stats struct {
+	Requests  uint64          `json:"requests"`
+	Retries   uint64          `json:"retries"`
+	Failures  uint64          `json:"failures"`
+	Rejected  uint64          `json:"rejected"`
+	CacheHits uint64          `json:"cache_hits"`
+	Endpoints []EndpointStats `json:"endpoints"`
+}
+
+// EndpointStats describes the circuit breaker of a single address.
+type EndpointStats struct {
+	Address             string `json:"address"`
+	State               string `json:"state"`
+	ConsecutiveFailures int    `json:"consecutive_failures"`
+}
+
+// StatsProvider is implemented by clients that expose their state for metrics.
+type StatsProvider interface {
+	Stats() Stats
+}
+
+type endpoint struct {
+	addr    string
+	breaker *breaker
+}
+
 type client struct {
 	httpClient http.Client
-	addr       string
+	endpoints  []*endpoint
+	policy     Policy
 	logger     *zap.Logger
 
-	cacheEnabled bool
-	rwLock       sync.RWMutex
-	cache        map[string]map[string]int32
+	requests  uint64
+	retries   uint64
+	failures  uint64
+	rejected  uint64
+	cacheHits uint64
+
+	cache *idCache
+}
+
+// statusError is returned when id_getter responds with non-OK status code.
+type statusError struct {
+	code   int
+	status string
+}
+
+func (e statusError) Error() string {
+	return fmt.Sprintf("ip_getter%s return not OK code %d with status %s", api.GetIDUrl, e.code, e.status)
 }
 
 func (c *client) GetID(collectionName string, element string, createMissing bool) (int32, error) {
-	id, ok := c.getFromCache(collectionName, element)
+	id, ok := c.cache.get(collectionName, element)
 	if ok {
+		atomic.AddUint64(&c.cacheHits, 1)
 		return id, nil
 	}
 	id, err := c.getIDFromServer(collectionName, element, createMissing)
 	if err != nil {
 		return id, fmt.Errorf("error getting id from the server, %w", err)
 	}
-	c.saveInCache(collectionName, element, id)
+	c.cache.save(collectionName, element, id)
 
 	return id, nil
 }
 
+// getIDFromServer asks id_getter for the id. Lookups with createMissing disabled are idempotent and are retried
+// with jittered exponential delay. Lookups creating elements are only failed over when the request was not sent.
 func (c *client) getIDFromServer(collectionName string, element string, createMissing bool) (int32, error) {
+	atomic.AddUint64(&c.requests, 1)
+
 	body, err := json.Marshal(api.GetIDRequest{
 		CollectionName: collectionName,
 		Element:        element,
@@ -68,17 +190,66 @@ func (c *client) getIDFromServer(collectionName string, element string, createMi
 		return 0, fmt.Errorf("failed to marshall body, %w", err)
 	}
 
-	resp, err := c.httpClient.Post(fmt.Sprintf("http://%s%s", c.addr, api.GetIDUrl), "application/json", bytes.NewReader(body))
+	attempts := 1
+	if !createMissing {
+		attempts += c.policy.MaxRetries
+	}
+
+	for attempt := 0; ; attempt++ {
+		id, err := c.tryEndpoints(body, createMissing)
+		if err == nil {
+			return id, nil
+		}
+		if attempt+1 >= attempts || !isRetryable(err) {
+			atomic.AddUint64(&c.failures, 1)
+			return 0, err
+		}
+		atomic.AddUint64(&c.retries, 1)
+		delay := retryDelay(c.policy, attempt)
+		c.logger.Debug("retrying id_getter request", zap.Int("attempt", attempt+1), zap.Duration("delay", delay), zap.Error(err))
+		time.Sleep(delay)
+	}
+}
+
+// tryEndpoints sends the request to the first address with a closed circuit, failing over to the next ones.
+func (c *client) tryEndpoints(body []byte, createMissing bool) (int32, error) {
+	var lastErr error
+	for _, e := range c.endpoints {
+		if !e.breaker.allow() {
+			continue
+		}
+		id, err := c.post(e.addr, body)
+		if err == nil || errors.Is(err, ErrNotFound) {
+			e.breaker.success()
+			return id, err
+		}
+		e.breaker.failure()
+		c.logger.Warn("id_getter request failed", zap.String("address", e.addr), zap.Error(err))
+
+		if createMissing && !isDialError(err) {
+			// The request might have reached the server, don't send it again.
+			return 0, err
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		atomic.AddUint64(&c.rejected, 1)
+		return 0, ErrCircuitOpen
+	}
+	return 0, lastErr
+}
+
+func (c *client) post(addr string, body []byte) (int32, error) {
+	resp, err := c.httpClient.Post(fmt.Sprintf("http://%s%s", addr, api.GetIDUrl), "application/json", bytes.NewReader(body))
 	if err != nil {
 		return 0, fmt.Errorf("failed to make request to ip_getter, %w", err)
 	}
-	defer func() {
-		if err := resp.Body.Close(); err != nil {
-			c.logger.Warn("error closing response body", zap.Error(err))
-		}
-	}()
+	defer c.closeBody(resp)
+	if resp.StatusCode == http.StatusNotFound {
+		return 0, ErrNotFound
+	}
 	if resp.StatusCode != http.StatusOK {
-		return 0, fmt.Errorf("ip_getter%s return not OK code %d with status %s", api.GetIDUrl, resp.StatusCode, resp.Status)
+		return 0, statusError{code: resp.StatusCode, status: resp.Status}
 	}
 
 	var res api.GetIdResponse
@@ -88,53 +259,86 @@ func (c *client) getIDFromServer(collectionName string, element string, createMi
 	return res.ID, nil
 }
 
-func (c *client) getFromCache(name string, element string) (int32, bool) {
-	if !c.cacheEnabled {
-		return 0, false
+// retryDelay returns a random delay between zero and exponentially growing upper bound (full jitter).
+func retryDelay(policy Policy, attempt int) time.Duration {
+	upper := policy.RetryInitialInterval << attempt
+	if upper <= 0 || upper > policy.RetryMaxInterval {
+		upper = policy.RetryMaxInterval
 	}
-
-	c.rwLock.RLock()
-	defer c.rwLock.RUnlock()
-
-	if cache, ok := c.cache[name]; ok {
-		idx, ok := cache[element]
-		return idx, ok
+	if upper <= 0 {
+		return 0
 	}
-	return 0, false
+	return time.Duration(rand.Int63n(int64(upper)))
 }
 
-func (c *client) saveInCache(name string, element string, id int32) {
-	if !c.cacheEnabled {
-		return
+func isRetryable(err error) bool {
+	if errors.Is(err, ErrNotFound) || errors.Is(err, ErrCircuitOpen) {
+		return false
 	}
+	var se statusError
+	if errors.As(err, &se) {
+		return se.code >= http.StatusInternalServerError
+	}
+	return true
+}
 
-	c.rwLock.Lock()
-	defer c.rwLock.Unlock()
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
 
-	if cache, ok := c.cache[name]; ok {
-		cache[element] = id
-	} else {
-		c.cache[name] = map[string]int32{element: id}
+// Stats returns the current state of the client.
+func (c *client) Stats() Stats {
+	s := Stats{
+		Requests:  atomic.LoadUint64(&c.requests),
+		Retries:   atomic.LoadUint64(&c.retries),
+		Failures:  atomic.LoadUint64(&c.failures),
+		Rejected:  atomic.LoadUint64(&c.rejected),
+		CacheHits: atomic.LoadUint64(&c.cacheHits),
+		Endpoints: make([]EndpointStats, len(c.endpoints)),
+	}
+	for i, e := range c.endpoints {
+		state, failures := e.breaker.snapshot()
+		s.Endpoints[i] = EndpointStats{
+			Address:             e.addr,
+			State:               state.String(),
+			ConsecutiveFailures: failures,
+		}
 	}
+	return s
 }
 
-// NewClient returns a client with enabled cache.
-func NewClient(cl http.Client, addr string, logger *zap.Logger) Client {
+func newClient(cl http.Client, addrs []string, policy Policy, cacheEnabled bool, logger *zap.Logger) *client {
+	endpoints := make([]*endpoint, len(addrs))
+	for i, addr := range addrs {
+		endpoints[i] = &endpoint{
+			addr:    addr,
+			breaker: newBreaker(policy.BreakerThreshold, policy.BreakerCooldown),
+		}
+	}
 	return &client{
-		httpClient:   cl,
-		addr:         addr,
-		cache:        make(map[string]map[string]int32),
-		cacheEnabled: true,
-		logger:       logger,
+		httpClient: cl,
+		endpoints:  endpoints,
+		policy:     policy,
+		logger:     logger,
+		cache:      newIDCache(cacheEnabled),
 	}
 }
 
+// NewClient returns a client with enabled cache. Addresses are tried in order, skipping the ones that are down.
+func NewClient(cl http.Client, addrs []string, policy Policy, logger *zap.Logger) Client {
+	return newClient(cl, addrs, policy, true, logger)
+}
+
 // NewPureClient returns a client with disabled cache.
-func NewPureClient(cl http.Client, addr string, logger *zap.Logger) Client {
-	return &client{
-		httpClient:   cl,
-		addr:         addr,
-		cacheEnabled: false,
-		logger:       logger,
+func NewPureClient(cl http.Client, addrs []string, policy Policy, logger *zap.Logger) Client {
+	return newClient(cl, addrs, policy, false, logger)
+}
+
+// PublishStats publishes stats of the client as an expvar variable with the given name,
+// if the client exposes them.
+func PublishStats(name string, cl Client) {
+	if p, ok := cl.(StatsProvider); ok {
+		expvar.Publish(name, expvar.Func(func() any { return p.Stats() }))
 	}
 }
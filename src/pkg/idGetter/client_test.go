@@ -0,0 +1,223 @@
+package idGetter
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/TomaszDomagala/Allezon/src/cmd/id_getter/api"
+	"github.com/TomaszDomagala/Allezon/src/pkg/idGetter/db"
+	"github.com/TomaszDomagala/Allezon/src/pkg/idGetter/dictionary"
+)
+
+func newTestServer(t *testing.T, status *int32, calls *int32) string {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(calls, 1)
+		if code := int(atomic.LoadInt32(status)); code != http.StatusOK {
+			w.WriteHeader(code)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(api.GetIdResponse{ID: 7})
+	}))
+	t.Cleanup(srv.Close)
+	return strings.TrimPrefix(srv.URL, "http://")
+}
+
+func testPolicy() Policy {
+	return Policy{
+		MaxRetries:           2,
+		RetryInitialInterval: time.Millisecond,
+		RetryMaxInterval:     time.Millisecond,
+		BreakerThreshold:     2,
+		BreakerCooldown:      time.Hour,
+	}
+}
+
+func TestClient_FailsOverToHealthyAddress(t *testing.T) {
+	var badStatus, badCalls, goodStatus, goodCalls int32 = http.StatusInternalServerError, 0, http.StatusOK, 0
+	bad := newTestServer(t, &badStatus, &badCalls)
+	good := newTestServer(t, &goodStatus, &goodCalls)
+
+	cl := NewPureClient(http.Client{}, []string{bad, good}, testPolicy(), zap.NewNop())
+
+	for i := 0; i < 3; i++ {
+		id, err := cl.GetID("brand", "foo", false)
+		require.NoError(t, err)
+		assert.Equal(t, int32(7), id)
+	}
+	// The bad address is skipped once its circuit opens.
+	assert.Equal(t, int32(2), badCalls)
+	assert.Equal(t, int32(3), goodCalls)
+
+	stats := cl.(StatsProvider).Stats()
+	assert.Equal(t, breakerOpen.String(), stats.Endpoints[0].State)
+	assert.Equal(t, breakerClosed.String(), stats.Endpoints[1].State)
+}
+
+func TestClient_RetriesOnlyIdempotentLookups(t *testing.T) {
+	var status, calls int32 = http.StatusInternalServerError, 0
+	addr := newTestServer(t, &status, &calls)
+
+	policy := testPolicy()
+	policy.BreakerThreshold = 100
+	cl := NewPureClient(http.Client{}, []string{addr}, policy, zap.NewNop())
+
+	_, err := cl.GetID("brand", "foo", false)
+	require.Error(t, err)
+	assert.Equal(t, int32(3), calls)
+
+	_, err = cl.GetID("brand", "foo", true)
+	require.Error(t, err)
+	assert.Equal(t, int32(4), calls)
+}
+
+func TestClient_NotFoundIsNotRetried(t *testing.T) {
+	var status, calls int32 = http.StatusNotFound, 0
+	addr := newTestServer(t, &status, &calls)
+
+	cl := NewPureClient(http.Client{}, []string{addr}, testPolicy(), zap.NewNop())
+
+	_, err := cl.GetID("brand", "foo", false)
+	require.ErrorIs(t, err, ErrNotFound)
+	assert.Equal(t, int32(1), calls)
+	assert.Equal(t, breakerClosed.String(), cl.(StatsProvider).Stats().Endpoints[0].State)
+}
+
+func TestClient_FailsFastWhenCircuitOpen(t *testing.T) {
+	var status, calls int32 = http.StatusInternalServerError, 0
+	addr := newTestServer(t, &status, &calls)
+
+	cl := NewPureClient(http.Client{}, []string{addr}, testPolicy(), zap.NewNop())
+
+	_, err := cl.GetID("brand", "foo", false)
+	require.ErrorIs(t, err, ErrCircuitOpen)
+	assert.Equal(t, int32(2), calls)
+
+	_, err = cl.GetID("brand", "foo", false)
+	require.ErrorIs(t, err, ErrCircuitOpen)
+	assert.Equal(t, int32(2), calls)
+	assert.Equal(t, uint64(2), cl.(StatsProvider).Stats().Rejected)
+}
+
+func TestBreaker_HalfOpenAfterCooldown(t *testing.T) {
+	now := time.Now()
+	b := newBreaker(1, time.Minute)
+	b.now = func() time.Time { return now }
+
+	b.failure()
+	assert.False(t, b.allow())
+
+	now = now.Add(time.Minute)
+	assert.True(t, b.allow(), "probe should be allowed after cooldown")
+	assert.False(t, b.allow(), "only a single probe should be allowed")
+
+	b.success()
+	assert.True(t, b.allow())
+}
+
+func TestClient_WarmUpAndDeltas(t *testing.T) {
+	var getIDCalls int32
+	var deltaReq api.DeltaRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case api.SnapshotUrl:
+			enc := json.NewEncoder(w)
+			_ = enc.Encode(api.SnapshotEntry{CollectionName: BrandCollection, Element: "nike", ID: 1})
+			_ = enc.Encode(api.SnapshotEntry{CollectionName: BrandCollection, Element: "adidas", ID: 2})
+		case api.DeltaUrl:
+			_ = json.NewDecoder(r.Body).Decode(&deltaReq)
+			_ = json.NewEncoder(w).Encode(api.DeltaResponse{Entries: []api.SnapshotEntry{{CollectionName: BrandCollection, Element: "puma", ID: 3}}})
+		default:
+			atomic.AddInt32(&getIDCalls, 1)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	cl := NewClient(http.Client{}, []string{strings.TrimPrefix(srv.URL, "http://")}, testPolicy(), zap.NewNop())
+	w := cl.(Warmer)
+
+	require.NoError(t, w.WarmUp())
+	id, err := cl.GetID(BrandCollection, "adidas", false)
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), id)
+
+	require.NoError(t, cl.(*client).fetchDelta())
+	assert.Equal(t, map[string]int32{BrandCollection: 2}, deltaReq.Versions)
+
+	id, err = cl.GetID(BrandCollection, "puma", false)
+	require.NoError(t, err)
+	assert.Equal(t, int32(3), id)
+	assert.Zero(t, getIDCalls, "all lookups should be served from cache")
+}
+
+func TestClient_DeltaClearsCacheWhenConfigChanges(t *testing.T) {
+	var getIDCalls int32
+	var deltaVersions []map[string]int32
+	version := "before"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(api.ConfigVersionHeader, version)
+		switch r.URL.Path {
+		case api.SnapshotUrl:
+			enc := json.NewEncoder(w)
+			_ = enc.Encode(api.SnapshotEntry{CollectionName: BrandCollection, Element: "nike", ID: 1})
+			_ = enc.Encode(api.SnapshotEntry{CollectionName: BrandCollection, Element: "Nike", ID: 2})
+		case api.DeltaUrl:
+			var req api.DeltaRequest
+			_ = json.NewDecoder(r.Body).Decode(&req)
+			deltaVersions = append(deltaVersions, req.Versions)
+			// Nike became an alias of nike.
+			_ = json.NewEncoder(w).Encode(api.DeltaResponse{Entries: []api.SnapshotEntry{{CollectionName: BrandCollection, Element: "nike", ID: 1}}})
+		default:
+			atomic.AddInt32(&getIDCalls, 1)
+			_ = json.NewEncoder(w).Encode(api.GetIdResponse{ID: 1})
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	cl := NewClient(http.Client{}, []string{strings.TrimPrefix(srv.URL, "http://")}, testPolicy(), zap.NewNop())
+	require.NoError(t, cl.(Warmer).WarmUp())
+	id, err := cl.GetID(BrandCollection, "Nike", false)
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), id)
+
+	version = "after"
+	require.NoError(t, cl.(*client).fetchDelta())
+	assert.Equal(t, []map[string]int32{{BrandCollection: 2}, {}}, deltaVersions, "all elements are fetched again")
+
+	id, err = cl.GetID(BrandCollection, "Nike", false)
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), id)
+	assert.Equal(t, int32(1), getIDCalls, "elements missing from the delta are looked up again")
+}
+
+func TestEmbeddedClient(t *testing.T) {
+	dict := dictionary.New(dictionary.Config{
+		CollectionNormalization: map[string]dictionary.NormalizationRules{BrandCollection: {CaseFold: true}},
+	}, db.NewMemoryClient(), zap.NewNop())
+	cl := NewEmbeddedClient(dict, zap.NewNop())
+
+	id, err := cl.GetID(BrandCollection, "Nike", true)
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), id)
+
+	id, err = cl.GetID(BrandCollection, "nike", false)
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), id)
+
+	_, err = cl.GetID(BrandCollection, "adidas", false)
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestEmbeddedClient_RequiresDBAddresses(t *testing.T) {
+	_, err := NewEmbeddedClientFromAddresses(dictionary.Config{}, zap.NewNop())
+	assert.Error(t, err, "ids kept in memory would differ between processes")
+}
@@ -16,11 +16,20 @@ type ClientPolicy = as.ClientPolicy
 
 const namespace = "allezon"
 
+// Client stores collections as append only lists of elements. The id of an element is its position in the list
+// counted from 1, which is the new length returned by AppendElement, so ids never change once assigned.
 type Client interface {
 	GetElements(name string) ([]string, error)
+	// GetElementsFrom returns elements at positions starting from start, that is with ids greater than start.
+	GetElementsFrom(name string, start int) ([]string, error)
 	AppendElement(name string, el string) (newLen int, err error)
 }
 
+// IDOfIndex returns the id of the element at idx of the list returned by GetElements.
+func IDOfIndex(idx int) int {
+	return idx + 1
+}
+
 func NewClientFromAddresses(addresses ...string) (Client, error) {
 	hosts, err := as.NewHosts(addresses...)
 	if err != nil {
@@ -81,7 +90,27 @@ func (c client) GetElements(category string) (elements []string, err error) {
 		return elements, fmt.Errorf("failed to get elements for category %s, %w", category, err)
 	}
 
-	if els, ok := r.Bins[bin].([]interface{}); ok {
+	return toElements(r.Bins[bin])
+}
+
+// GetElementsFrom returns elements for given category at positions starting from start.
+func (c client) GetElementsFrom(category string, start int) ([]string, error) {
+	key, err := as.NewKey(namespace, set, category)
+	if err != nil {
+		return nil, err
+	}
+	r, getError := c.cl.Operate(nil, key, as.ListGetByIndexRangeOp(bin, start, as.ListReturnTypeValue))
+	if getError != nil {
+		if getError.Matches(types.KEY_NOT_FOUND_ERROR) {
+			return nil, fmt.Errorf("ids for category %s not found, %w", category, KeyNotFoundError)
+		}
+		return nil, fmt.Errorf("failed to get elements for category %s, %w", category, getError)
+	}
+	return toElements(r.Bins[bin])
+}
+
+func toElements(bin interface{}) (elements []string, err error) {
+	if els, ok := bin.([]interface{}); ok {
 		elements = make([]string, len(els))
 		for i, e := range els {
 			if s, ok := e.(string); ok {
@@ -91,7 +120,7 @@ func (c client) GetElements(category string) (elements []string, err error) {
 			}
 		}
 	} else {
-		return elements, fmt.Errorf("els have wrong type: %T", r.Bins[bin])
+		return elements, fmt.Errorf("els have wrong type: %T", bin)
 	}
 
 	return
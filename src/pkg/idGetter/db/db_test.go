@@ -79,6 +79,14 @@ func (s *DBSuite) Test_Ids() {
 	updated, err := c.GetElements(name)
 	s.Require().NoErrorf(err, "failed to get record")
 	s.Require().Equal([]string{t, t2}, updated)
+
+	tail, err := c.GetElementsFrom(name, 1)
+	s.Require().NoErrorf(err, "failed to get record")
+	s.Require().Equal([]string{t2}, tail)
+
+	tail, err = c.GetElementsFrom(name, 2)
+	s.Require().NoErrorf(err, "failed to get record")
+	s.Require().Empty(tail)
 }
 
 func (s *DBSuite) Test_Ids_ErrorOnDuplicate() {
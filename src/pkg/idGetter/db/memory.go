@@ -0,0 +1,54 @@
+package db
+
+import (
+	"sync"
+
+	"golang.org/x/exp/slices"
+)
+
+type memoryClient struct {
+	mu    sync.Mutex
+	lists map[string][]string
+}
+
+// NewMemoryClient returns a client keeping the ids in memory. It's meant for tests and single process deployments,
+// as the ids are lost on restart.
+func NewMemoryClient() Client {
+	return &memoryClient{lists: make(map[string][]string)}
+}
+
+func (m *memoryClient) GetElements(category string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	list, ok := m.lists[category]
+	if !ok {
+		return nil, KeyNotFoundError
+	}
+	return slices.Clone(list), nil
+}
+
+func (m *memoryClient) GetElementsFrom(category string, start int) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	list, ok := m.lists[category]
+	if !ok {
+		return nil, KeyNotFoundError
+	}
+	if start >= len(list) {
+		return []string{}, nil
+	}
+	return slices.Clone(list[start:]), nil
+}
+
+func (m *memoryClient) AppendElement(category string, element string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if slices.Contains(m.lists[category], element) {
+		return 0, ElementExists
+	}
+	m.lists[category] = append(m.lists[category], element)
+	return len(m.lists[category]), nil
+}
@@ -0,0 +1,154 @@
+package dictionary
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"regexp"
+	"strconv"
+
+	aggdb "github.com/TomaszDomagala/Allezon/src/pkg/db"
+)
+
+const (
+	// DefaultMaxCardinality leaves one id for the overflow element, as ids are stored as uint16 in aggregates.
+	DefaultMaxCardinality = math.MaxUint16 - 1
+	// DefaultOverflowElement gets the id of elements rejected by the collection limits.
+	DefaultOverflowElement = "__other__"
+	// MaxCountryCardinality leaves one id for the overflow element, as country ids above aggdb.MaxCountryId don't fit
+	// in aggregate keys.
+	MaxCountryCardinality = aggdb.MaxCountryId - 1
+
+	// countryCollection is the name of the collection of countries used by clients of the id getter.
+	countryCollection = "country"
+)
+
+// Config configures limits and normalization of the collections.
+type Config struct {
+	// Collections are preloaded into the cache and served in snapshots.
+	Collections []string
+	// DefaultMaxCardinality applies to collections without their own limits.
+	DefaultMaxCardinality int
+	// DefaultOverflowElement applies to collections without their own limits.
+	DefaultOverflowElement string
+	// CollectionLimits maps collection names to their limits.
+	CollectionLimits map[string]CollectionLimits
+	// CollectionNormalization maps collection names to their normalization rules.
+	CollectionNormalization map[string]NormalizationRules
+}
+
+// CollectionLimits restricts elements that get an id in a collection.
+type CollectionLimits struct {
+	// MaxCardinality is the maximum number of elements in the collection, not counting the overflow element.
+	// Zero means no limit.
+	MaxCardinality int `json:"max_cardinality"`
+	// Pattern is a regular expression new elements must match. Empty pattern matches everything.
+	Pattern string `json:"pattern"`
+	// AllowList restricts new elements to the listed ones. Empty list allows everything.
+	AllowList []string `json:"allow_list"`
+	// OverflowElement gets the id instead of new elements that are rejected or don't fit in the collection.
+	OverflowElement string `json:"overflow_element"`
+}
+
+// NormalizationRules describe how elements of a collection are normalized before they get an id.
+// Rules are applied in order: NFC, trimming, case folding and finally the alias table.
+type NormalizationRules struct {
+	// NFC converts elements to the Unicode normalization form C.
+	NFC bool `json:"nfc"`
+	// Trim removes leading and trailing white space.
+	Trim bool `json:"trim"`
+	// CaseFold folds elements to a case-insensitive form.
+	CaseFold bool `json:"case_fold"`
+	// Aliases map normalized elements to the element they are an alias of.
+	Aliases map[string]string `json:"aliases"`
+}
+
+// Limits returns limits of the collection, falling back to the defaults.
+func (c Config) Limits(collection string) CollectionLimits {
+	if l, ok := c.CollectionLimits[collection]; ok {
+		return l
+	}
+	return CollectionLimits{
+		MaxCardinality:  c.DefaultMaxCardinality,
+		OverflowElement: c.DefaultOverflowElement,
+	}
+}
+
+// Version identifies the limits and normalization of collections. Clients caching ids compare versions to notice
+// that elements may be mapped to other ids.
+func (c Config) Version() string {
+	// Maps are marshalled with sorted keys, so equal configs have equal versions.
+	b, err := json.Marshal(struct {
+		DefaultMaxCardinality   int
+		DefaultOverflowElement  string
+		CollectionLimits        map[string]CollectionLimits
+		CollectionNormalization map[string]NormalizationRules
+	}{c.DefaultMaxCardinality, c.DefaultOverflowElement, c.CollectionLimits, c.CollectionNormalization})
+	if err != nil {
+		// The config holds only marshallable types.
+		panic(err)
+	}
+	h := fnv.New64a()
+	_, _ = h.Write(b)
+	return strconv.FormatUint(h.Sum64(), 16)
+}
+
+// ParseConfig returns the config of collections with limits and normalization parsed from json, see
+// ParseCollectionLimits and ParseCollectionNormalization.
+func ParseConfig(collections []string, defaultMaxCardinality int, defaultOverflow string, limitsJSON string, normalizationJSON string) (Config, error) {
+	limits, err := ParseCollectionLimits(limitsJSON, defaultOverflow)
+	if err != nil {
+		return Config{}, err
+	}
+	normalization, err := ParseCollectionNormalization(normalizationJSON)
+	if err != nil {
+		return Config{}, err
+	}
+	return Config{
+		Collections:             collections,
+		DefaultMaxCardinality:   defaultMaxCardinality,
+		DefaultOverflowElement:  defaultOverflow,
+		CollectionLimits:        limits,
+		CollectionNormalization: normalization,
+	}, nil
+}
+
+// ParseCollectionLimits parses a json object mapping collection names to CollectionLimits.
+// Limits without overflow element get defaultOverflow. Countries are limited to MaxCountryCardinality elements unless
+// they have lower limits configured.
+func ParseCollectionLimits(limitsJSON string, defaultOverflow string) (map[string]CollectionLimits, error) {
+	limits := make(map[string]CollectionLimits)
+	if limitsJSON != "" {
+		if err := json.Unmarshal([]byte(limitsJSON), &limits); err != nil {
+			return nil, fmt.Errorf("failed to parse collection limits: %w", err)
+		}
+	}
+	if l, ok := limits[countryCollection]; !ok {
+		limits[countryCollection] = CollectionLimits{MaxCardinality: MaxCountryCardinality}
+	} else if l.MaxCardinality <= 0 || l.MaxCardinality > MaxCountryCardinality {
+		return nil, fmt.Errorf("max cardinality of collection %s must be between 1 and %d", countryCollection, MaxCountryCardinality)
+	}
+	for name, l := range limits {
+		if _, err := regexp.Compile(l.Pattern); err != nil {
+			return nil, fmt.Errorf("invalid pattern of collection %s: %w", name, err)
+		}
+		if l.OverflowElement == "" {
+			l.OverflowElement = defaultOverflow
+			limits[name] = l
+		}
+	}
+	return limits, nil
+}
+
+// ParseCollectionNormalization parses a json object mapping collection names to NormalizationRules.
+func ParseCollectionNormalization(normalizationJSON string) (map[string]NormalizationRules, error) {
+	rules := make(map[string]NormalizationRules)
+	if normalizationJSON == "" {
+		return rules, nil
+	}
+	if err := json.Unmarshal([]byte(normalizationJSON), &rules); err != nil {
+		return nil, fmt.Errorf("failed to parse collection normalization: %w", err)
+	}
+	return rules, nil
+}
@@ -0,0 +1,283 @@
+// Package dictionary assigns ids to elements of collections. It's used by the id_getter service and by the
+// embedded id getter client, so both allocate ids in the same way.
+package dictionary
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/TomaszDomagala/Allezon/src/cmd/id_getter/api"
+	"github.com/TomaszDomagala/Allezon/src/pkg/idGetter/db"
+)
+
+var ErrorNotFound = errors.New("not found")
+
+// Dictionary caches ids stored in the db and allocates new ones, applying limits and normalization of collections.
+type Dictionary struct {
+	conf        Config
+	logger      *zap.Logger
+	db          db.Client
+	limiters    limiters
+	normalizers normalizers
+	watchers    *watchers
+	idsCache    map[string]map[string]int
+	// loaded are elements of collections read from the db, ordered by id. Elements created by this dictionary
+	// are only in idsCache until the next load.
+	loaded        map[string][]string
+	idsCacheMutex *sync.RWMutex
+	configVersion string
+}
+
+func New(conf Config, client db.Client, logger *zap.Logger) *Dictionary {
+	return &Dictionary{
+		conf:          conf,
+		logger:        logger,
+		db:            client,
+		limiters:      newLimiters(conf),
+		normalizers:   newNormalizers(conf),
+		watchers:      newWatchers(),
+		idsCache:      make(map[string]map[string]int),
+		loaded:        make(map[string][]string),
+		idsCacheMutex: &sync.RWMutex{},
+		configVersion: conf.Version(),
+	}
+}
+
+// ConfigVersion returns the version of the config of limits and normalization, see Config.Version.
+func (d *Dictionary) ConfigVersion() string {
+	return d.configVersion
+}
+
+// Cacheable reports whether clients may cache the id of element read from the collection, that is the element is
+// mapped to its own id. Elements that are rejected by the collection limits or normalized to other elements are
+// mapped to ids of other elements by GetID.
+func (d *Dictionary) Cacheable(collection string, element string) bool {
+	return d.limiters.get(collection).allows(element) && d.normalizers.normalize(collection, element) == element
+}
+
+// Collections returns the configured collections.
+func (d *Dictionary) Collections() []string {
+	return d.conf.Collections
+}
+
+// GetID returns id of element in collection. It tries to find it in cache first, then in database.
+// If it's not found in db, it generates new id and caches it. Elements that are not allowed by the
+// collection limits get the id of the overflow element, both when they are read and created, even if
+// they got their own ids before the limits were configured.
+// Elements are normalized first, so all their spellings share one id.
+func (d *Dictionary) GetID(collection string, element string, createMissing bool) (int, error) {
+	element = d.normalizers.normalize(collection, element)
+	lim := d.limiters.get(collection)
+	if !lim.allows(element) {
+		rejectedElements.Add(fmt.Sprintf("%s.%s", collection, rejectedInvalid), 1)
+		d.logger.Debug("element rejected", zap.String("collection", collection), zap.String("element", element))
+		return d.GetID(collection, lim.overflow, createMissing)
+	}
+
+	if id, inCache := d.checkInCache(collection, element); inCache {
+		return id, nil
+	}
+
+	id, err := d.getIDFromDB(collection, element)
+	if err != nil {
+		if errors.Is(err, ErrorNotFound) {
+			if createMissing {
+				// element not found in db, save it and return new id.
+				var overflowed bool
+				id, overflowed, err = d.createID(collection, element, lim)
+				if err != nil {
+					return 0, fmt.Errorf("error while saving id in db: %w", err)
+				}
+				if overflowed {
+					d.logger.Debug("collection full, element overflowed", zap.String("collection", collection), zap.String("element", element))
+					return id, nil
+				}
+			} else {
+				return 0, fmt.Errorf("id in collection %s for element %s not found(createMissing=disable) : %w", collection, element, err)
+			}
+		} else {
+			return 0, fmt.Errorf("error while getting id from db: %w", err)
+		}
+	}
+
+	d.saveInCache(collection, element, id)
+	return id, nil
+}
+
+// getIDFromDB returns id of element in collection.
+// It loads elements created since the last load from db and then searches for element in the cache.
+func (d *Dictionary) getIDFromDB(collection string, element string) (int, error) {
+	elements, err := d.LoadCollection(collection)
+	if err != nil {
+		return 0, err
+	}
+	if elements == nil {
+		return 0, fmt.Errorf("collection %s not found, %w", collection, ErrorNotFound)
+	}
+	id, ok := d.checkInCache(collection, element)
+	if !ok {
+		return 0, fmt.Errorf("element not found in list, %w: (%v, %v)", ErrorNotFound, collection, element)
+	}
+	d.logger.Debug("found id in db", zap.String("collection", collection), zap.String("element", element), zap.Int("id", id))
+	return id, nil
+}
+
+// saveIDInDB saves element in category and returns its id.
+func (d *Dictionary) saveIDInDB(category string, element string) (int, error) {
+	id, err := d.db.AppendElement(category, element)
+	if err != nil {
+		return 0, fmt.Errorf("error while appending record, %w", err)
+	}
+	d.logger.Debug("saved id in db", zap.String("category", category), zap.String("element", element), zap.Int("id", id))
+	// Watchers get new elements in the order of ids, along with ones created by other processes before.
+	if _, err := d.LoadCollection(category); err != nil {
+		d.logger.Warn("can't load collection after saving id", zap.String("category", category), zap.Error(err))
+	}
+	return id, nil
+
+}
+
+func (d *Dictionary) checkInCache(category string, element string) (int, bool) {
+	d.idsCacheMutex.RLock()
+	defer d.idsCacheMutex.RUnlock()
+
+	if cache, ok := d.idsCache[category]; ok {
+		if id, ok := cache[element]; ok {
+			d.logger.Debug("found id in cache", zap.String("category", category), zap.String("element", element), zap.Int("id", id))
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+func (d *Dictionary) saveInCache(category string, element string, colLen int) {
+	d.idsCacheMutex.Lock()
+	defer d.idsCacheMutex.Unlock()
+
+	if _, ok := d.idsCache[category]; !ok {
+		d.idsCache[category] = make(map[string]int)
+	}
+	d.idsCache[category][element] = colLen
+}
+
+// Preload loads all configured collections into the cache, so the first lookups after restart don't hit the db.
+func (d *Dictionary) Preload() {
+	for _, collection := range d.conf.Collections {
+		elements, err := d.LoadCollection(collection)
+		if err != nil {
+			d.logger.Warn("can't preload collection", zap.String("collection", collection), zap.Error(err))
+			continue
+		}
+		d.logger.Info("collection preloaded", zap.String("collection", collection), zap.Int("elements", len(elements)))
+	}
+}
+
+// LoadCollection returns all elements of the collection ordered by id and saves them in cache. Only elements created
+// since the last load are read from the db, Cacheable ones are published to watchers in the order of ids, whichever
+// process created them. It returns nil if the collection doesn't exist.
+func (d *Dictionary) LoadCollection(collection string) ([]string, error) {
+	d.idsCacheMutex.RLock()
+	start := len(d.loaded[collection])
+	d.idsCacheMutex.RUnlock()
+
+	created, err := d.db.GetElementsFrom(collection, start)
+	if err != nil {
+		if errors.Is(err, db.KeyNotFoundError) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error while getting elements from db: %w", err)
+	}
+
+	d.idsCacheMutex.Lock()
+	defer d.idsCacheMutex.Unlock()
+
+	elements := d.loaded[collection]
+	// Concurrent loads may have appended some of the elements already.
+	if skip := len(elements) - start; skip > 0 {
+		if skip > len(created) {
+			skip = len(created)
+		}
+		created = created[skip:]
+	}
+	cache, ok := d.idsCache[collection]
+	if !ok {
+		cache = make(map[string]int, len(created))
+		d.idsCache[collection] = cache
+	}
+	for i, element := range created {
+		id := db.IDOfIndex(len(elements) + i)
+		cache[element] = id
+		if d.Cacheable(collection, element) {
+			d.watchers.publish(api.SnapshotEntry{CollectionName: collection, Element: element, ID: int32(id)})
+		}
+	}
+	elements = append(elements, created...)
+	d.loaded[collection] = elements
+	return elements[:len(elements):len(elements)], nil
+}
+
+// Poll loads all configured collections every interval, so watchers get elements created by other processes
+// sharing the db. It returns when ctx is done, zero interval disables polling.
+func (d *Dictionary) Poll(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, collection := range d.conf.Collections {
+				if _, err := d.LoadCollection(collection); err != nil {
+					d.logger.Warn("error reloading id collection", zap.String("collection", collection), zap.Error(err))
+				}
+			}
+		}
+	}
+}
+
+// EntriesSince returns elements of all collections with ids greater than the given versions, skipping elements
+// that aren't Cacheable. Collections missing from versions are returned in full.
+func (d *Dictionary) EntriesSince(versions map[string]int32) ([]api.SnapshotEntry, error) {
+	entries := []api.SnapshotEntry{}
+	for _, collection := range d.conf.Collections {
+		elements, err := d.LoadCollection(collection)
+		if err != nil {
+			return nil, fmt.Errorf("can't load collection %s, %w", collection, err)
+		}
+		start := int(versions[collection])
+		if start < 0 {
+			start = 0
+		}
+		for idx := start; idx < len(elements); idx++ {
+			if d.Cacheable(collection, elements[idx]) {
+				entries = append(entries, Entry(collection, elements, idx))
+			}
+		}
+	}
+	return entries, nil
+}
+
+// Entry returns the snapshot entry of the element at idx of the collection elements returned by LoadCollection.
+func Entry(collection string, elements []string, idx int) api.SnapshotEntry {
+	return api.SnapshotEntry{CollectionName: collection, Element: elements[idx], ID: int32(db.IDOfIndex(idx))}
+}
+
+// Subscribe returns a channel receiving elements created from now on. The channel is closed when the subscriber
+// can't keep up, it should resubscribe from its last version then.
+func (d *Dictionary) Subscribe() chan api.SnapshotEntry {
+	return d.watchers.subscribe()
+}
+
+// Unsubscribe stops sending new elements to the channel returned by Subscribe.
+func (d *Dictionary) Unsubscribe(ch chan api.SnapshotEntry) {
+	d.watchers.unsubscribe(ch)
+}
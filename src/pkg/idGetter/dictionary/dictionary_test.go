@@ -0,0 +1,85 @@
+package dictionary
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/TomaszDomagala/Allezon/src/cmd/id_getter/api"
+	"github.com/TomaszDomagala/Allezon/src/pkg/idGetter/db"
+)
+
+// countingClient records starts of reads of collections.
+type countingClient struct {
+	db.Client
+	starts []int
+}
+
+func (c *countingClient) GetElements(name string) ([]string, error) {
+	c.starts = append(c.starts, 0)
+	return c.Client.GetElements(name)
+}
+
+func (c *countingClient) GetElementsFrom(name string, start int) ([]string, error) {
+	c.starts = append(c.starts, start)
+	return c.Client.GetElementsFrom(name, start)
+}
+
+func TestGetID_StableAcrossProcesses(t *testing.T) {
+	client := db.NewMemoryClient()
+	created := make(map[string]int)
+	d := New(Config{}, client, zap.NewNop())
+	for _, el := range []string{"a", "b", "c"} {
+		id, err := d.GetID("brand", el, true)
+		require.NoError(t, err)
+		created[el] = id
+	}
+
+	other := New(Config{}, client, zap.NewNop())
+	for el, id := range created {
+		got, err := other.GetID("brand", el, false)
+		require.NoError(t, err)
+		assert.Equal(t, id, got, "id of %s read by another dictionary", el)
+	}
+}
+
+func TestEntriesSince_ReadsOnlyNewElements(t *testing.T) {
+	client := &countingClient{Client: db.NewMemoryClient()}
+	d := New(Config{Collections: []string{"brand"}}, client, zap.NewNop())
+	for _, el := range []string{"a", "b"} {
+		_, err := client.AppendElement("brand", el)
+		require.NoError(t, err)
+	}
+
+	entries, err := d.EntriesSince(map[string]int32{"brand": 1})
+	require.NoError(t, err)
+	assert.Equal(t, []api.SnapshotEntry{{CollectionName: "brand", Element: "b", ID: 2}}, entries)
+
+	_, err = client.AppendElement("brand", "c")
+	require.NoError(t, err)
+	client.starts = nil
+	entries, err = d.EntriesSince(map[string]int32{"brand": 2})
+	require.NoError(t, err)
+	assert.Equal(t, []api.SnapshotEntry{{CollectionName: "brand", Element: "c", ID: 3}}, entries)
+	assert.Equal(t, []int{2}, client.starts, "only elements after the loaded ones are read")
+}
+
+func TestEntriesSince_SkipsRemappedElements(t *testing.T) {
+	client := db.NewMemoryClient()
+	before := New(Config{Collections: []string{"brand"}}, client, zap.NewNop())
+	for _, el := range []string{"Nike", "nike"} {
+		_, err := before.GetID("brand", el, true)
+		require.NoError(t, err)
+	}
+
+	d := New(Config{
+		Collections:             []string{"brand"},
+		CollectionNormalization: map[string]NormalizationRules{"brand": {CaseFold: true}},
+	}, client, zap.NewNop())
+	assert.NotEqual(t, before.ConfigVersion(), d.ConfigVersion())
+	entries, err := d.EntriesSince(nil)
+	require.NoError(t, err)
+	assert.Equal(t, []api.SnapshotEntry{{CollectionName: "brand", Element: "nike", ID: 2}}, entries, "elements normalized to others aren't cacheable")
+}
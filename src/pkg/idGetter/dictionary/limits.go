@@ -0,0 +1,108 @@
+package dictionary
+
+import (
+	"expvar"
+	"fmt"
+	"regexp"
+)
+
+// rejectedElements counts elements replaced with the overflow element, keyed by "<collection>.<reason>".
+var rejectedElements = expvar.NewMap("id_getter_rejected_elements")
+
+const (
+	rejectedInvalid  = "invalid"
+	rejectedOverflow = "overflow"
+)
+
+// limiter enforces CollectionLimits of a single collection.
+type limiter struct {
+	maxCardinality int
+	pattern        *regexp.Regexp
+	allowed        map[string]struct{}
+	overflow       string
+}
+
+func newLimiter(l CollectionLimits) limiter {
+	lim := limiter{
+		maxCardinality: l.MaxCardinality,
+		overflow:       l.OverflowElement,
+	}
+	if l.Pattern != "" {
+		// Patterns are validated when the config is loaded.
+		lim.pattern = regexp.MustCompile(l.Pattern)
+	}
+	if len(l.AllowList) > 0 {
+		lim.allowed = make(map[string]struct{}, len(l.AllowList))
+		for _, el := range l.AllowList {
+			lim.allowed[el] = struct{}{}
+		}
+	}
+	return lim
+}
+
+// allows reports whether the element may get its own id. The overflow element is always allowed.
+func (l limiter) allows(element string) bool {
+	if element == l.overflow {
+		return true
+	}
+	if l.allowed != nil {
+		if _, ok := l.allowed[element]; !ok {
+			return false
+		}
+	}
+	return l.pattern == nil || l.pattern.MatchString(element)
+}
+
+// full reports whether the collection of given size, not counting the overflow element, reached its limit.
+func (l limiter) full(size int) bool {
+	return l.maxCardinality > 0 && size >= l.maxCardinality
+}
+
+type limiters struct {
+	byName     map[string]limiter
+	defaultLim limiter
+}
+
+func newLimiters(conf Config) limiters {
+	l := limiters{
+		byName:     make(map[string]limiter, len(conf.CollectionLimits)),
+		defaultLim: newLimiter(conf.Limits("")),
+	}
+	for name, cl := range conf.CollectionLimits {
+		l.byName[name] = newLimiter(cl)
+	}
+	return l
+}
+
+func (l limiters) get(collection string) limiter {
+	if lim, ok := l.byName[collection]; ok {
+		return lim
+	}
+	return l.defaultLim
+}
+
+// createID saves element in collection and returns its id. If the collection is full, id of the overflow
+// element is returned instead and overflowed is set.
+func (d *Dictionary) createID(collection string, element string, lim limiter) (id int, overflowed bool, err error) {
+	if element != lim.overflow && lim.full(d.collectionSize(collection, lim)) {
+		rejectedElements.Add(fmt.Sprintf("%s.%s", collection, rejectedOverflow), 1)
+		id, err := d.GetID(collection, lim.overflow, true)
+		return id, true, err
+	}
+	id, err = d.saveIDInDB(collection, element)
+	return id, false, err
+}
+
+// collectionSize returns the number of elements in collection, not counting the overflow element. It counts elements
+// loaded from the db, which is done right before creating an element. Concurrent creations may make the collection
+// exceed its limit by a few elements.
+func (d *Dictionary) collectionSize(collection string, lim limiter) int {
+	d.idsCacheMutex.RLock()
+	defer d.idsCacheMutex.RUnlock()
+
+	size := len(d.loaded[collection])
+	if _, ok := d.idsCache[collection][lim.overflow]; ok {
+		size--
+	}
+	return size
+}
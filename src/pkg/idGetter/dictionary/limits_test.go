@@ -0,0 +1,113 @@
+package dictionary
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/TomaszDomagala/Allezon/src/pkg/idGetter/db"
+)
+
+func newTestDictionary(conf Config) *Dictionary {
+	return New(conf, db.NewMemoryClient(), zap.NewNop())
+}
+
+func TestGetID_MaxCardinality(t *testing.T) {
+	d := newTestDictionary(Config{
+		DefaultMaxCardinality:  2,
+		DefaultOverflowElement: "__other__",
+	})
+
+	ids := make([]int, 0, 4)
+	for _, el := range []string{"a", "b", "c", "d"} {
+		id, err := d.GetID("brand", el, true)
+		require.NoError(t, err)
+		ids = append(ids, id)
+	}
+	assert.Equal(t, []int{1, 2, 3, 3}, ids)
+
+	overflow, err := d.GetID("brand", "__other__", false)
+	require.NoError(t, err)
+	assert.Equal(t, 3, overflow)
+
+	_, err = d.GetID("brand", "c", false)
+	assert.ErrorIs(t, err, ErrorNotFound, "overflowed element must not get an id")
+}
+
+func TestGetID_MaxCardinalityReadsOnlyNewElements(t *testing.T) {
+	client := &countingClient{Client: db.NewMemoryClient()}
+	d := New(Config{DefaultMaxCardinality: 10, DefaultOverflowElement: "__other__"}, client, zap.NewNop())
+	for _, el := range []string{"a", "b", "c"} {
+		_, err := d.GetID("brand", el, true)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, []int{0, 0, 1, 1, 2, 2}, client.starts, "sizes of limited collections are counted from loaded elements")
+}
+
+func TestGetID_AllowListAndPattern(t *testing.T) {
+	d := newTestDictionary(Config{
+		CollectionLimits: map[string]CollectionLimits{
+			"origin":   {AllowList: []string{"internal", "external"}, OverflowElement: "__other__"},
+			"category": {Pattern: "^[a-z]+$", OverflowElement: "__other__"},
+		},
+	})
+
+	id, err := d.GetID("origin", "internal", true)
+	require.NoError(t, err)
+	assert.Equal(t, 1, id)
+	id, err = d.GetID("origin", "spam", true)
+	require.NoError(t, err)
+	assert.Equal(t, 2, id, "rejected element should get the overflow id")
+
+	id, err = d.GetID("category", "shoes", true)
+	require.NoError(t, err)
+	assert.Equal(t, 1, id)
+	id, err = d.GetID("category", "Shoes!", true)
+	require.NoError(t, err)
+	assert.Equal(t, 2, id, "rejected element should get the overflow id")
+
+	// Collections without limits accept anything.
+	id, err = d.GetID("brand", "Shoes!", true)
+	require.NoError(t, err)
+	assert.Equal(t, 1, id)
+}
+
+func TestGetID_AllowListAppliesToReads(t *testing.T) {
+	client := db.NewMemoryClient()
+	before := New(Config{}, client, zap.NewNop())
+	_, err := before.GetID("origin", "spam", true)
+	require.NoError(t, err)
+
+	d := New(Config{
+		CollectionLimits: map[string]CollectionLimits{
+			"origin": {AllowList: []string{"internal"}, OverflowElement: "__other__"},
+		},
+	}, client, zap.NewNop())
+	_, err = d.GetID("origin", "spam", false)
+	assert.ErrorIs(t, err, ErrorNotFound, "rejected element is read as the missing overflow element")
+
+	created, err := d.GetID("origin", "spam", true)
+	require.NoError(t, err)
+	read, err := d.GetID("origin", "spam", false)
+	require.NoError(t, err)
+	assert.Equal(t, created, read, "reads and writes of a rejected element get the same id")
+	assert.Equal(t, 2, read, "the id assigned before the allow-list is not used")
+}
+
+func TestParseCollectionLimits_Country(t *testing.T) {
+	limits, err := ParseCollectionLimits("", "__other__")
+	require.NoError(t, err)
+	assert.Equal(t, CollectionLimits{MaxCardinality: MaxCountryCardinality, OverflowElement: "__other__"}, limits["country"],
+		"countries are limited to ids that fit in aggregate keys")
+
+	limits, err = ParseCollectionLimits(`{"country": {"max_cardinality": 200}}`, "__other__")
+	require.NoError(t, err)
+	assert.Equal(t, 200, limits["country"].MaxCardinality)
+
+	_, err = ParseCollectionLimits(`{"country": {"max_cardinality": 10000}}`, "__other__")
+	assert.Error(t, err)
+	_, err = ParseCollectionLimits(`{"country": {"allow_list": ["PL"]}}`, "__other__")
+	assert.Error(t, err, "countries can't be unlimited")
+}
@@ -0,0 +1,68 @@
+package dictionary
+
+import (
+	"strings"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// normalizer applies NormalizationRules of a single collection.
+type normalizer struct {
+	rules   NormalizationRules
+	aliases map[string]string
+}
+
+func newNormalizer(rules NormalizationRules) normalizer {
+	n := normalizer{rules: rules}
+	if len(rules.Aliases) > 0 {
+		// Aliases are matched and resolved in their normalized form, so they work regardless of casing.
+		n.aliases = make(map[string]string, len(rules.Aliases))
+		for alias, target := range rules.Aliases {
+			n.aliases[n.clean(alias)] = n.clean(target)
+		}
+	}
+	return n
+}
+
+func (n normalizer) clean(element string) string {
+	if n.rules.NFC {
+		element = norm.NFC.String(element)
+	}
+	if n.rules.Trim {
+		element = strings.TrimSpace(element)
+	}
+	if n.rules.CaseFold {
+		// Caser is not safe for concurrent use, hence a new one for every call.
+		element = cases.Fold().String(element)
+	}
+	return element
+}
+
+func (n normalizer) normalize(element string) string {
+	element = n.clean(element)
+	if target, ok := n.aliases[element]; ok {
+		return target
+	}
+	return element
+}
+
+type normalizers struct {
+	byName map[string]normalizer
+}
+
+func newNormalizers(conf Config) normalizers {
+	n := normalizers{byName: make(map[string]normalizer, len(conf.CollectionNormalization))}
+	for name, rules := range conf.CollectionNormalization {
+		n.byName[name] = newNormalizer(rules)
+	}
+	return n
+}
+
+// normalize returns the normalized form of element. Collections without rules are returned unchanged.
+func (n normalizers) normalize(collection string, element string) string {
+	if nr, ok := n.byName[collection]; ok {
+		return nr.normalize(element)
+	}
+	return element
+}
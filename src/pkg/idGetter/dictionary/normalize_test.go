@@ -0,0 +1,42 @@
+package dictionary
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetID_Normalization(t *testing.T) {
+	d := newTestDictionary(Config{
+		CollectionNormalization: map[string]NormalizationRules{
+			"brand": {
+				NFC:      true,
+				Trim:     true,
+				CaseFold: true,
+				Aliases:  map[string]string{"Nike Inc.": "nike"},
+			},
+		},
+	})
+
+	for _, el := range []string{"Nike", "nike ", "NIKE", " nike inc. "} {
+		id, err := d.GetID("brand", el, true)
+		require.NoError(t, err)
+		assert.Equalf(t, 1, id, "unexpected id of %q", el)
+	}
+
+	// "e" with combining acute accent and precomposed "é" are the same element.
+	id, err := d.GetID("brand", "Cafe\u0301", true)
+	require.NoError(t, err)
+	assert.Equal(t, 2, id)
+	id, err = d.GetID("brand", "caf\u00e9", false)
+	require.NoError(t, err)
+	assert.Equal(t, 2, id)
+
+	// Collections without rules are not normalized.
+	id, err = d.GetID("category", "Shoes", true)
+	require.NoError(t, err)
+	assert.Equal(t, 1, id)
+	_, err = d.GetID("category", "shoes", false)
+	assert.ErrorIs(t, err, ErrorNotFound)
+}
@@ -0,0 +1,54 @@
+package dictionary
+
+import (
+	"sync"
+
+	"github.com/TomaszDomagala/Allezon/src/cmd/id_getter/api"
+)
+
+const watcherBufferSize = 1024
+
+// watchers broadcasts newly created elements to subscribed streams.
+type watchers struct {
+	mu   sync.Mutex
+	subs map[chan api.SnapshotEntry]struct{}
+}
+
+func newWatchers() *watchers {
+	return &watchers{subs: make(map[chan api.SnapshotEntry]struct{})}
+}
+
+func (w *watchers) subscribe() chan api.SnapshotEntry {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	ch := make(chan api.SnapshotEntry, watcherBufferSize)
+	w.subs[ch] = struct{}{}
+	return ch
+}
+
+func (w *watchers) unsubscribe(ch chan api.SnapshotEntry) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, ok := w.subs[ch]; ok {
+		delete(w.subs, ch)
+		close(ch)
+	}
+}
+
+// publish sends the entry to all subscribers. Subscribers that can't keep up are dropped and their channel is
+// closed, so they can resubscribe from their last version.
+func (w *watchers) publish(entry api.SnapshotEntry) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for ch := range w.subs {
+		select {
+		case ch <- entry:
+		default:
+			delete(w.subs, ch)
+			close(ch)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package idGetter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/TomaszDomagala/Allezon/src/pkg/idGetter/db"
+	"github.com/TomaszDomagala/Allezon/src/pkg/idGetter/dictionary"
+)
+
+type embeddedClient struct {
+	dict   *dictionary.Dictionary
+	logger *zap.Logger
+}
+
+// NewEmbeddedClient returns a client assigning ids in process, without the id_getter service.
+// Ids are allocated the same way as by id_getter, so both can share the ids db.
+func NewEmbeddedClient(dict *dictionary.Dictionary, logger *zap.Logger) Client {
+	return &embeddedClient{dict: dict, logger: logger}
+}
+
+// NewEmbeddedClientFromAddresses returns an embedded client using the ids db at given addresses. Addresses are
+// required, as ids kept in memory would differ between the api and the worker.
+func NewEmbeddedClientFromAddresses(conf dictionary.Config, logger *zap.Logger, addresses ...string) (Client, error) {
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("no addresses of the ids db for the embedded id getter client")
+	}
+	client, err := db.NewClientFromAddresses(addresses...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create ids db client, %w", err)
+	}
+	return NewEmbeddedClient(dictionary.New(conf, client, logger), logger), nil
+}
+
+func (e *embeddedClient) GetID(collectionName string, element string, createMissing bool) (int32, error) {
+	id, err := e.dict.GetID(collectionName, element, createMissing)
+	if err != nil {
+		if errors.Is(err, dictionary.ErrorNotFound) {
+			return 0, fmt.Errorf("error getting id from the dictionary, %w", ErrNotFound)
+		}
+		return 0, fmt.Errorf("error getting id from the dictionary, %w", err)
+	}
+	return int32(id), nil
+}
+
+// WarmUp loads all configured collections into the dictionary cache.
+func (e *embeddedClient) WarmUp() error {
+	e.dict.Preload()
+	return nil
+}
+
+// PollDeltas periodically reloads the collections, caching elements created by other processes.
+func (e *embeddedClient) PollDeltas(ctx context.Context, interval time.Duration) {
+	e.dict.Poll(ctx, interval)
+}
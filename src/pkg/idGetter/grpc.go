@@ -0,0 +1,226 @@
+package idGetter
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/resolver/manual"
+	"google.golang.org/grpc/status"
+
+	"github.com/TomaszDomagala/Allezon/src/cmd/id_getter/api"
+	"github.com/TomaszDomagala/Allezon/src/cmd/id_getter/api/pb"
+)
+
+// grpcServiceConfig spreads requests over all addresses, skipping the ones without a ready connection.
+const grpcServiceConfig = `{"loadBalancingConfig": [{"round_robin": {}}]}`
+
+type grpcClient struct {
+	conn    *grpc.ClientConn
+	cl      pb.IDGetterClient
+	timeout time.Duration
+	policy  Policy
+	logger  *zap.Logger
+	cache   *idCache
+}
+
+// NewGRPCClient returns a client with enabled cache talking to the id_getter grpc service.
+// Requests are balanced over all addresses with a ready connection, which takes the place of circuit breakers,
+// so only retries of the policy apply.
+func NewGRPCClient(addrs []string, timeout time.Duration, policy Policy, logger *zap.Logger) (Client, error) {
+	return newGRPCClient(addrs, timeout, policy, logger)
+}
+
+func newGRPCClient(addrs []string, timeout time.Duration, policy Policy, logger *zap.Logger, opts ...grpc.DialOption) (*grpcClient, error) {
+	r := manual.NewBuilderWithScheme("idgetter")
+	state := resolver.State{Addresses: make([]resolver.Address, len(addrs))}
+	for i, addr := range addrs {
+		state.Addresses[i] = resolver.Address{Addr: addr}
+	}
+	r.InitialState(state)
+
+	opts = append([]grpc.DialOption{
+		grpc.WithResolvers(r),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultServiceConfig(grpcServiceConfig),
+	}, opts...)
+	conn, err := grpc.Dial(r.Scheme()+":///id_getter", opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial id_getter grpc service, %w", err)
+	}
+	return &grpcClient{
+		conn:    conn,
+		cl:      pb.NewIDGetterClient(conn),
+		timeout: timeout,
+		policy:  policy,
+		logger:  logger,
+		cache:   newIDCache(true),
+	}, nil
+}
+
+func (g *grpcClient) GetID(collectionName string, element string, createMissing bool) (int32, error) {
+	ids, err := g.GetIDs([]api.GetIDRequest{{CollectionName: collectionName, Element: element, CreateMissing: createMissing}})
+	if err != nil {
+		return 0, err
+	}
+	return ids[0], nil
+}
+
+// GetIDs returns ids of elements in the order of requests, looking up the ones missing from the cache in one call.
+// Lookups without createMissing are retried with the policy, like by the http client.
+func (g *grpcClient) GetIDs(reqs []api.GetIDRequest) ([]int32, error) {
+	ids := make([]int32, len(reqs))
+	var missing []int
+	batch := &pb.GetIDsRequest{}
+	createMissing := false
+	for i, r := range reqs {
+		if id, ok := g.cache.get(r.CollectionName, r.Element); ok {
+			ids[i] = id
+			continue
+		}
+		missing = append(missing, i)
+		batch.Requests = append(batch.Requests, &pb.GetIDRequest{
+			CollectionName: r.CollectionName,
+			Element:        r.Element,
+			CreateMissing:  r.CreateMissing,
+		})
+		createMissing = createMissing || r.CreateMissing
+	}
+	if len(missing) == 0 {
+		return ids, nil
+	}
+
+	resp, err := g.getIDs(batch, createMissing)
+	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			return nil, fmt.Errorf("error getting id from the server, %w", ErrNotFound)
+		}
+		return nil, fmt.Errorf("error getting id from the server, %w", err)
+	}
+	if len(resp.Ids) != len(missing) {
+		return nil, fmt.Errorf("server returned %d ids for %d elements", len(resp.Ids), len(missing))
+	}
+	for j, i := range missing {
+		ids[i] = resp.Ids[j]
+		g.cache.save(reqs[i].CollectionName, reqs[i].Element, resp.Ids[j])
+	}
+	return ids, nil
+}
+
+// getIDs sends the batch, retrying lookups without createMissing while the service is unavailable.
+// Lookups creating elements are only retried by grpc when the request was not sent.
+func (g *grpcClient) getIDs(batch *pb.GetIDsRequest, createMissing bool) (*pb.GetIDsResponse, error) {
+	attempts := 1
+	if !createMissing {
+		attempts += g.policy.MaxRetries
+	}
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), g.timeout)
+		resp, err := g.cl.GetIDs(ctx, batch)
+		cancel()
+		if err == nil {
+			return resp, nil
+		}
+		if code := status.Code(err); attempt+1 >= attempts || (code != codes.Unavailable && code != codes.DeadlineExceeded) {
+			return nil, err
+		}
+		delay := retryDelay(g.policy, attempt)
+		g.logger.Debug("retrying id_getter request", zap.Int("attempt", attempt+1), zap.Duration("delay", delay), zap.Error(err))
+		time.Sleep(delay)
+	}
+}
+
+// WarmUp fills the cache with the first response of the watch stream, which holds all existing elements.
+func (g *grpcClient) WarmUp() error {
+	stream, cancelStream, err := g.openWatch(context.Background())
+	if err != nil {
+		return err
+	}
+	defer cancelStream()
+	resp, err := stream.Recv()
+	if err != nil {
+		return fmt.Errorf("failed to receive snapshot, %w", err)
+	}
+	g.apply(resp)
+	g.logger.Info("id cache warmed up from watch stream", zap.Int("entries", len(resp.Entries)))
+	return nil
+}
+
+// PollDeltas keeps a watch stream open and applies new elements as they are created.
+// Broken streams are reopened from the last known versions after interval, zero interval disables watching.
+func (g *grpcClient) PollDeltas(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	for {
+		if err := g.watch(ctx); err != nil {
+			g.logger.Warn("id_getter watch stream broken", zap.Error(err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (g *grpcClient) watch(ctx context.Context) error {
+	stream, cancelStream, err := g.openWatch(ctx)
+	if err != nil {
+		return err
+	}
+	defer cancelStream()
+	for {
+		resp, err := stream.Recv()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("failed to receive entries, %w", err)
+		}
+		g.apply(resp)
+	}
+}
+
+// openWatch opens a watch stream from the known versions. If the dictionary config changed, the cache is cleared and
+// the stream is opened again, so it starts with all elements. The returned function closes the stream.
+func (g *grpcClient) openWatch(ctx context.Context) (pb.IDGetter_WatchClient, context.CancelFunc, error) {
+	versions := g.cache.currentVersions()
+	streamCtx, cancel := context.WithCancel(ctx)
+	stream, err := g.cl.Watch(streamCtx, &pb.WatchRequest{Versions: versions})
+	if err != nil {
+		cancel()
+		return nil, nil, fmt.Errorf("failed to watch id_getter, %w", err)
+	}
+	header, err := stream.Header()
+	if err != nil {
+		cancel()
+		return nil, nil, fmt.Errorf("failed to receive watch header, %w", err)
+	}
+	var version string
+	if v := header.Get(api.ConfigVersionHeader); len(v) > 0 {
+		version = v[0]
+	}
+	if g.cache.switchConfig(version) {
+		g.logger.Info("id_getter dictionary config changed, id cache cleared")
+		if len(versions) > 0 {
+			cancel()
+			// Entries after the known versions don't fill the cleared cache.
+			return g.openWatch(ctx)
+		}
+	}
+	return stream, cancel, nil
+}
+
+func (g *grpcClient) apply(resp *pb.WatchResponse) {
+	entries := make([]api.SnapshotEntry, len(resp.Entries))
+	for i, e := range resp.Entries {
+		entries[i] = api.SnapshotEntry{CollectionName: e.CollectionName, Element: e.Element, ID: e.Id}
+	}
+	g.cache.apply(entries)
+}
@@ -0,0 +1,92 @@
+package idGetter
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/TomaszDomagala/Allezon/src/cmd/id_getter/api"
+	"github.com/TomaszDomagala/Allezon/src/cmd/id_getter/api/pb"
+)
+
+// fakeIDGetter assigns ids by the length of elements, failing the first unavailable calls.
+type fakeIDGetter struct {
+	pb.UnimplementedIDGetterServer
+	unavailable int32
+	calls       int32
+}
+
+func (f *fakeIDGetter) GetIDs(_ context.Context, req *pb.GetIDsRequest) (*pb.GetIDsResponse, error) {
+	atomic.AddInt32(&f.calls, 1)
+	if atomic.AddInt32(&f.unavailable, -1) >= 0 {
+		return nil, status.Error(codes.Unavailable, "unavailable")
+	}
+	resp := &pb.GetIDsResponse{}
+	for _, r := range req.Requests {
+		if r.Element == "missing" {
+			return nil, status.Error(codes.NotFound, "not found")
+		}
+		resp.Ids = append(resp.Ids, int32(len(r.Element)))
+	}
+	return resp, nil
+}
+
+func newTestGRPCClient(t *testing.T, srv pb.IDGetterServer) *grpcClient {
+	lis := bufconn.Listen(1 << 20)
+	s := grpc.NewServer()
+	pb.RegisterIDGetterServer(s, srv)
+	go func() { _ = s.Serve(lis) }()
+	t.Cleanup(s.Stop)
+
+	cl, err := newGRPCClient([]string{"bufnet"}, time.Second, testPolicy(), zap.NewNop(),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = cl.conn.Close() })
+	return cl
+}
+
+func TestGRPCClient_GetIDs(t *testing.T) {
+	srv := &fakeIDGetter{}
+	cl := newTestGRPCClient(t, srv)
+
+	ids, err := GetIDs(cl, []api.GetIDRequest{
+		{CollectionName: "brand", Element: "nike"},
+		{CollectionName: "origin", Element: "internal"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []int32{4, 8}, ids)
+
+	id, err := cl.GetID("brand", "nike", false)
+	require.NoError(t, err)
+	assert.Equal(t, int32(4), id)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&srv.calls), "cached ids are not requested again")
+
+	_, err = cl.GetID("brand", "missing", false)
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestGRPCClient_Retries(t *testing.T) {
+	srv := &fakeIDGetter{unavailable: 2}
+	cl := newTestGRPCClient(t, srv)
+
+	id, err := cl.GetID("brand", "nike", false)
+	require.NoError(t, err)
+	assert.Equal(t, int32(4), id)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&srv.calls))
+
+	atomic.StoreInt32(&srv.unavailable, 1)
+	_, err = cl.GetID("brand", "adidas", true)
+	assert.Equal(t, codes.Unavailable, status.Code(errors.Unwrap(err)), "lookups creating elements are not retried")
+}
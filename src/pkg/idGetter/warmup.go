@@ -0,0 +1,151 @@
+package idGetter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/TomaszDomagala/Allezon/src/cmd/id_getter/api"
+)
+
+// Warmer is implemented by clients that can bootstrap their cache from the id_getter snapshot.
+type Warmer interface {
+	// WarmUp fills the cache with the snapshot of all collections.
+	WarmUp() error
+	// PollDeltas periodically fetches elements added since the last snapshot or delta. It blocks until ctx is done.
+	// The cache is cleared and filled again whenever the dictionary config of the id_getter changes.
+	PollDeltas(ctx context.Context, interval time.Duration)
+}
+
+func (c *client) WarmUp() error {
+	if !c.cache.enabled {
+		return nil
+	}
+	return c.firstAvailable(func(addr string) error {
+		resp, err := c.httpClient.Get(fmt.Sprintf("http://%s%s", addr, api.SnapshotUrl))
+		if err != nil {
+			return fmt.Errorf("failed to make snapshot request to ip_getter, %w", err)
+		}
+		defer c.closeBody(resp)
+		if resp.StatusCode != http.StatusOK {
+			return statusError{code: resp.StatusCode, status: resp.Status}
+		}
+
+		var entries []api.SnapshotEntry
+		dec := json.NewDecoder(resp.Body)
+		for {
+			var entry api.SnapshotEntry
+			if err := dec.Decode(&entry); err != nil {
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				return fmt.Errorf("failed to decode snapshot entry, %w", err)
+			}
+			entries = append(entries, entry)
+		}
+		c.cache.switchConfig(resp.Header.Get(api.ConfigVersionHeader))
+		c.cache.apply(entries)
+		c.logger.Info("id cache warmed up from snapshot", zap.String("address", addr), zap.Int("entries", len(entries)))
+		return nil
+	})
+}
+
+func (c *client) PollDeltas(ctx context.Context, interval time.Duration) {
+	if !c.cache.enabled || interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.fetchDelta(); err != nil {
+				c.logger.Warn("error fetching id cache delta", zap.Error(err))
+			}
+		}
+	}
+}
+
+// fetchDelta applies elements added since the known versions. If the dictionary config changed, the cache is cleared
+// and all elements are fetched again.
+func (c *client) fetchDelta() error {
+	versions := c.cache.currentVersions()
+	body, err := json.Marshal(api.DeltaRequest{Versions: versions})
+	if err != nil {
+		return fmt.Errorf("failed to marshall body, %w", err)
+	}
+
+	var refetch bool
+	err = c.firstAvailable(func(addr string) error {
+		resp, err := c.httpClient.Post(fmt.Sprintf("http://%s%s", addr, api.DeltaUrl), "application/json", bytes.NewReader(body))
+		if err != nil {
+			return fmt.Errorf("failed to make delta request to ip_getter, %w", err)
+		}
+		defer c.closeBody(resp)
+		if resp.StatusCode != http.StatusOK {
+			return statusError{code: resp.StatusCode, status: resp.Status}
+		}
+
+		var res api.DeltaResponse
+		if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+			return fmt.Errorf("failed to unmarshall body, %w", err)
+		}
+		if c.cache.switchConfig(resp.Header.Get(api.ConfigVersionHeader)) {
+			c.logger.Info("id_getter dictionary config changed, id cache cleared", zap.String("address", addr))
+			// Entries after the known versions don't fill the cleared cache.
+			refetch = len(versions) > 0
+			if refetch {
+				return nil
+			}
+		}
+		c.cache.apply(res.Entries)
+		if len(res.Entries) > 0 {
+			c.logger.Debug("id cache delta applied", zap.Int("entries", len(res.Entries)))
+		}
+		return nil
+	})
+	if err == nil && refetch {
+		return c.fetchDelta()
+	}
+	return err
+}
+
+// firstAvailable calls fn with the first address whose circuit is not open, failing over to the next ones.
+func (c *client) firstAvailable(fn func(addr string) error) error {
+	var lastErr error
+	for _, e := range c.endpoints {
+		if !e.breaker.allow() {
+			continue
+		}
+		if err := fn(e.addr); err != nil {
+			e.breaker.failure()
+			c.logger.Warn("id_getter request failed", zap.String("address", e.addr), zap.Error(err))
+			lastErr = err
+			continue
+		}
+		e.breaker.success()
+		return nil
+	}
+	if lastErr == nil {
+		atomic.AddUint64(&c.rejected, 1)
+		return ErrCircuitOpen
+	}
+	return lastErr
+}
+
+func (c *client) closeBody(resp *http.Response) {
+	if err := resp.Body.Close(); err != nil {
+		c.logger.Warn("error closing response body", zap.Error(err))
+	}
+}
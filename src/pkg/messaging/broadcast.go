@@ -0,0 +1,159 @@
+package messaging
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/TomaszDomagala/Allezon/src/pkg/pubsub"
+	"github.com/TomaszDomagala/Allezon/src/pkg/types"
+)
+
+// UserTagsBroadcast delivers tags accepted by any api replica to all replicas.
+type UserTagsBroadcast interface {
+	// Publish broadcasts the tag accepted by this replica.
+	Publish(tag types.UserTag) error
+	// Receive passes tags broadcast by all replicas to fn until ctx is done. fn may be called concurrently.
+	Receive(ctx context.Context, fn func(types.UserTag)) error
+}
+
+// localBroadcastBuffer is the number of tags buffered for every receiver of the local broadcast.
+const localBroadcastBuffer = 1024
+
+type localBroadcast struct {
+	hub *pubsub.Hub[types.UserTag]
+}
+
+// NewLocalBroadcast returns a broadcast delivering tags only within the process, it suits a single replica.
+// Tags published while a receiver is busy with a full buffer are dropped for it.
+func NewLocalBroadcast() UserTagsBroadcast {
+	return localBroadcast{hub: pubsub.NewHub[types.UserTag](localBroadcastBuffer)}
+}
+
+func (b localBroadcast) Publish(tag types.UserTag) error {
+	b.hub.Publish(tag)
+	return nil
+}
+
+func (b localBroadcast) Receive(ctx context.Context, fn func(types.UserTag)) error {
+	tags, cancel := b.hub.Subscribe()
+	defer cancel()
+
+	for {
+		select {
+		case tag := <-tags:
+			fn(tag)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// broadcastPartitionsRefreshInterval is the period of looking for partitions added to the user tags topic.
+const broadcastPartitionsRefreshInterval = 30 * time.Second
+
+// KafkaBroadcast receives tags from the user tags topic, to which the producer of every replica already sends
+// accepted tags. Every replica reads all partitions from the newest offset, outside the consumer group of workers.
+// Partitions are consumed only while Receive runs.
+type KafkaBroadcast struct {
+	logger   *zap.Logger
+	client   sarama.Client
+	consumer sarama.Consumer
+}
+
+func NewKafkaBroadcast(logger *zap.Logger, addresses []string) (*KafkaBroadcast, error) {
+	client, err := sarama.NewClient(addresses, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create broadcast client: %w", err)
+	}
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		_ = client.Close()
+		return nil, fmt.Errorf("failed to create broadcast consumer: %w", err)
+	}
+	return &KafkaBroadcast{logger: logger, client: client, consumer: consumer}, nil
+}
+
+// Publish does nothing, as the tag is sent to the topic by the producer.
+func (b *KafkaBroadcast) Publish(types.UserTag) error {
+	return nil
+}
+
+// Receive consumes all partitions of the topic, including those added while it runs. Partitions added later
+// are read from their oldest offset, so their first tags are not missed.
+func (b *KafkaBroadcast) Receive(ctx context.Context, fn func(types.UserTag)) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errGrp, ctx := errgroup.WithContext(ctx)
+
+	consumed := make(map[int32]bool)
+	consumeNew := func(offset int64) error {
+		if err := b.client.RefreshMetadata(UserTagsTopic); err != nil {
+			return fmt.Errorf("failed to refresh metadata: %w", err)
+		}
+		partitions, err := b.client.Partitions(UserTagsTopic)
+		if err != nil {
+			return fmt.Errorf("failed to get partitions: %w", err)
+		}
+		for _, partition := range partitions {
+			if consumed[partition] {
+				continue
+			}
+			pc, err := b.consumer.ConsumePartition(UserTagsTopic, partition, offset)
+			if err != nil {
+				return fmt.Errorf("failed to consume partition %d: %w", partition, err)
+			}
+			consumed[partition] = true
+			errGrp.Go(func() error {
+				return b.receivePartition(ctx, pc, fn)
+			})
+		}
+		return nil
+	}
+
+	errGrp.Go(func() error {
+		ticker := time.NewTicker(broadcastPartitionsRefreshInterval)
+		defer ticker.Stop()
+
+		offset := sarama.OffsetNewest
+		for {
+			if err := consumeNew(offset); err != nil {
+				return err
+			}
+			offset = sarama.OffsetOldest
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	})
+	return errGrp.Wait()
+}
+
+func (b *KafkaBroadcast) receivePartition(ctx context.Context, pc sarama.PartitionConsumer, fn func(types.UserTag)) error {
+	defer func() {
+		if err := pc.Close(); err != nil {
+			b.logger.Error("failed to close partition consumer", zap.Error(err))
+		}
+	}()
+	for {
+		select {
+		case msg := <-pc.Messages():
+			var tag types.UserTag
+			if err := types.UnmarshalUserTag(msg.Value, &tag); err != nil {
+				b.logger.Error("failed to unmarshal broadcast message", zap.Error(err))
+				continue
+			}
+			fn(tag)
+		case err := <-pc.Errors():
+			return fmt.Errorf("failed to receive broadcast messages: %w", err)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
@@ -3,6 +3,7 @@ package messaging
 import (
 	"context"
 	"fmt"
+	"sync"
 
 	"github.com/Shopify/sarama"
 	"go.uber.org/zap"
@@ -15,6 +16,16 @@ const (
 	UserTagsConsumerGroup = "user-tags-consumer-group"
 )
 
+// Message is a consumed tag with its position in the user tags topic.
+type Message struct {
+	Tag       types.UserTag
+	Partition int32
+	Offset    int64
+	// Ack marks the message as processed, it's nil for messages which don't need it. Offsets of messages of the
+	// Consumer are committed only once they and all earlier messages of the partition are acked.
+	Ack func()
+}
+
 type UserTagsConsumer interface {
 	Receive() (<-chan types.UserTag, error)
 }
@@ -36,14 +47,14 @@ func NewConsumer(logger *zap.Logger, addresses []string) (*Consumer, error) {
 	return &Consumer{logger: logger, client: consumer}, nil
 }
 
-// Consume consumes messages and pushes them to the tags channel. It blocks until the context is cancelled or an error occurs.
+// Consume consumes messages and pushes them to the messages channel. It blocks until the context is cancelled or an error occurs.
 // Should be run in a goroutine.
-func (c *Consumer) Consume(ctx context.Context, tags chan<- types.UserTag) error {
+func (c *Consumer) Consume(ctx context.Context, messages chan<- Message) error {
 	// Following code is heavily inspired by sarama example https://github.com/Shopify/sarama/blob/main/examples/consumergroup/main.go.
 
 	handler := consumerGroupHandler{
-		logger: c.logger,
-		tags:   tags,
+		logger:   c.logger,
+		messages: messages,
 	}
 
 	for {
@@ -63,8 +74,8 @@ func (c *Consumer) Consume(ctx context.Context, tags chan<- types.UserTag) error
 }
 
 type consumerGroupHandler struct {
-	logger *zap.Logger
-	tags   chan<- types.UserTag
+	logger   *zap.Logger
+	messages chan<- Message
 }
 
 // Setup is run at the beginning of a new session, before ConsumeClaim.
@@ -81,19 +92,73 @@ func (c *consumerGroupHandler) Cleanup(_ sarama.ConsumerGroupSession) error {
 
 // ConsumeClaim must start a consumer loop of ConsumerGroupClaim's Messages().
 func (c *consumerGroupHandler) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	acks := newPartitionAcks(func(offset int64) {
+		session.MarkOffset(claim.Topic(), claim.Partition(), offset, "")
+	})
 	for {
 		select {
-		case msg := <-claim.Messages():
+		case msg, ok := <-claim.Messages():
+			if !ok {
+				return nil
+			}
 			c.logger.Debug("received message", zap.ByteString("key", msg.Key), zap.ByteString("value", msg.Value), zap.String("topic", msg.Topic), zap.Int32("partition", msg.Partition), zap.Int64("offset", msg.Offset))
+			ack := acks.add(msg.Offset)
 			var tag types.UserTag
 			if err := types.UnmarshalUserTag(msg.Value, &tag); err != nil {
 				c.logger.Error("failed to unmarshal message", zap.Error(err))
+				ack()
 				continue
 			}
-			c.tags <- tag
-			session.MarkMessage(msg, "")
+			select {
+			case c.messages <- Message{Tag: tag, Partition: msg.Partition, Offset: msg.Offset, Ack: ack}:
+			case <-session.Context().Done():
+				return nil
+			}
 		case <-session.Context().Done():
 			return nil
 		}
 	}
 }
+
+// partitionAcks tracks consumed offsets of a partition, which may be acked in any order, and marks the offset after
+// the longest acked prefix of them.
+type partitionAcks struct {
+	mark func(offset int64)
+
+	mu sync.Mutex
+	// pending are consumed offsets in order, the first of which is not acked yet.
+	pending []int64
+	acked   map[int64]bool
+}
+
+func newPartitionAcks(mark func(offset int64)) *partitionAcks {
+	return &partitionAcks{mark: mark, acked: make(map[int64]bool)}
+}
+
+// add tracks the offset, which must be greater than offsets added before, and returns the func acking it.
+func (a *partitionAcks) add(offset int64) func() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.pending = append(a.pending, offset)
+	var once sync.Once
+	return func() {
+		once.Do(func() { a.ack(offset) })
+	}
+}
+
+func (a *partitionAcks) ack(offset int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.acked[offset] = true
+	next := int64(-1)
+	for len(a.pending) > 0 && a.acked[a.pending[0]] {
+		delete(a.acked, a.pending[0])
+		next = a.pending[0] + 1
+		a.pending = a.pending[1:]
+	}
+	if next >= 0 {
+		a.mark(next)
+	}
+}
@@ -6,8 +6,10 @@ import (
 	"runtime"
 	"sort"
 	"sync"
+	"testing"
 	"time"
 
+	"github.com/stretchr/testify/assert"
 	"golang.org/x/sync/errgroup"
 
 	"github.com/TomaszDomagala/Allezon/src/pkg/types"
@@ -37,7 +39,7 @@ func (s *MessagingSuite) TestConsumer_Consume() {
 	for i := 0; i < 10; i++ {
 		tagsToSend = append(tagsToSend, types.UserTag{Cookie: fmt.Sprintf("cookie-%d", i)})
 	}
-	recTags := make(chan types.UserTag)
+	recTags := make(chan Message)
 
 	g, ctx := errgroup.WithContext(ctx)
 
@@ -62,8 +64,8 @@ func (s *MessagingSuite) TestConsumer_Consume() {
 	var tagsRec []types.UserTag
 	for i := 0; i < len(tagsToSend); i++ {
 		select {
-		case tag := <-recTags:
-			tagsRec = append(tagsRec, tag)
+		case msg := <-recTags:
+			tagsRec = append(tagsRec, msg.Tag)
 		case <-time.After(timeout):
 			s.FailNow("timed out waiting for tags")
 		}
@@ -124,13 +126,13 @@ func (s *MessagingSuite) TestConsumer_Consume_multiple_consumers() {
 
 			// Using a private channel for each consumer to
 			// register which consumer received which tag.
-			privateRecTags := make(chan types.UserTag)
+			privateRecTags := make(chan Message)
 			defer close(privateRecTags)
 
 			go func() {
-				for tag := range privateRecTags {
+				for msg := range privateRecTags {
 					consumersUsed.Store(id, true)
-					recTags <- tag
+					recTags <- msg.Tag
 				}
 			}()
 
@@ -171,3 +173,18 @@ func (s *MessagingSuite) TestConsumer_Consume_multiple_consumers() {
 
 	s.Assert().Equalf(len(consumersUsedList), consumersNum, "not all consumers were used")
 }
+
+func TestPartitionAcks(t *testing.T) {
+	var marked []int64
+	acks := newPartitionAcks(func(offset int64) { marked = append(marked, offset) })
+	ack10, ack11, ack13 := acks.add(10), acks.add(11), acks.add(13)
+
+	ack11()
+	assert.Empty(t, marked, "offset 10 is not processed yet")
+	ack10()
+	assert.Equal(t, []int64{12}, marked)
+	ack10()
+	assert.Equal(t, []int64{12}, marked, "acking again changes nothing")
+	ack13()
+	assert.Equal(t, []int64{12, 14}, marked)
+}
@@ -0,0 +1,131 @@
+package messaging
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Shopify/sarama"
+	"go.uber.org/zap"
+
+	"github.com/TomaszDomagala/Allezon/src/pkg/types"
+)
+
+// PartitionsHandler processes messages of partitions of the user tags topic assigned to a GroupConsumer. Partitions are
+// assigned again on every rebalance of the group.
+type PartitionsHandler interface {
+	// Assigned is called with the assigned partitions before they are consumed. It returns offsets to start consuming
+	// partitions at, others start at offsets committed by the group.
+	Assigned(partitions []int32) (map[int32]int64, error)
+	// Handle processes messages of the assigned partitions until messages is closed, once they are revoked. Offsets
+	// passed to commit are committed for the group. An error ends consuming.
+	Handle(messages <-chan Message, commit func(partition int32, offset int64)) error
+}
+
+// GroupConsumer consumes the user tags topic as a consumer group, each partition is consumed by a single member.
+type GroupConsumer struct {
+	logger *zap.Logger
+	client sarama.ConsumerGroup
+}
+
+func NewGroupConsumer(logger *zap.Logger, addresses []string, group string) (*GroupConsumer, error) {
+	config := sarama.NewConfig()
+	config.Consumer.Offsets.Initial = sarama.OffsetOldest
+
+	client, err := sarama.NewConsumerGroup(addresses, group, config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create consumer group %s: %w", group, err)
+	}
+	return &GroupConsumer{logger: logger, client: client}, nil
+}
+
+func (c *GroupConsumer) Close() error {
+	return c.client.Close()
+}
+
+// Consume passes messages of assigned partitions to the handler. It blocks until the context is cancelled or an error
+// occurs, including errors of the handler.
+func (c *GroupConsumer) Consume(ctx context.Context, handler PartitionsHandler) error {
+	h := &partitionsGroupHandler{logger: c.logger, handler: handler}
+	for {
+		if err := c.client.Consume(ctx, []string{UserTagsTopic}, h); err != nil {
+			return fmt.Errorf("failed to consume messages: %w", err)
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+	}
+}
+
+// partitionsGroupHandler runs PartitionsHandler.Handle for every session of the group, with messages of all claims.
+type partitionsGroupHandler struct {
+	logger  *zap.Logger
+	handler PartitionsHandler
+
+	messages chan Message
+	// stopped is closed once Handle returns, its error is in result.
+	stopped chan struct{}
+	result  chan error
+}
+
+func (h *partitionsGroupHandler) Setup(session sarama.ConsumerGroupSession) error {
+	h.messages = nil
+	partitions := session.Claims()[UserTagsTopic]
+	offsets, err := h.handler.Assigned(partitions)
+	if err != nil {
+		return err
+	}
+	for p, o := range offsets {
+		// MarkOffset only moves the offset forward and ResetOffset only backward.
+		session.MarkOffset(UserTagsTopic, p, o, "")
+		session.ResetOffset(UserTagsTopic, p, o, "")
+	}
+	h.logger.Info("partitions assigned", zap.Int32s("partitions", partitions), zap.Any("offsets", offsets))
+
+	h.messages = make(chan Message)
+	h.stopped = make(chan struct{})
+	h.result = make(chan error, 1)
+	go func() {
+		defer close(h.stopped)
+		h.result <- h.handler.Handle(h.messages, func(partition int32, offset int64) {
+			session.MarkOffset(UserTagsTopic, partition, offset, "")
+		})
+	}()
+	return nil
+}
+
+// Cleanup is run once all ConsumeClaim goroutines have exited, it waits for Handle.
+func (h *partitionsGroupHandler) Cleanup(_ sarama.ConsumerGroupSession) error {
+	if h.messages == nil {
+		return nil
+	}
+	close(h.messages)
+	return <-h.result
+}
+
+func (h *partitionsGroupHandler) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	for {
+		select {
+		case msg, ok := <-claim.Messages():
+			if !ok {
+				return nil
+			}
+			var tag types.UserTag
+			if err := types.UnmarshalUserTag(msg.Value, &tag); err != nil {
+				h.logger.Error("failed to unmarshal message", zap.Int32("partition", msg.Partition), zap.Int64("offset", msg.Offset), zap.Error(err))
+				continue
+			}
+			select {
+			case h.messages <- Message{Tag: tag, Partition: msg.Partition, Offset: msg.Offset}:
+			case <-h.stopped:
+				// Returning ends the session.
+				return nil
+			case <-session.Context().Done():
+				return nil
+			}
+		case <-h.stopped:
+			return nil
+		case <-session.Context().Done():
+			return nil
+		}
+	}
+}
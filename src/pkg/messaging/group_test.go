@@ -0,0 +1,61 @@
+package messaging
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/TomaszDomagala/Allezon/src/pkg/types"
+)
+
+// collectingHandler passes consumed cookies to the channel.
+type collectingHandler struct {
+	assigned []int32
+	cookies  chan string
+}
+
+func (h *collectingHandler) Assigned(partitions []int32) (map[int32]int64, error) {
+	h.assigned = partitions
+	return nil, nil
+}
+
+func (h *collectingHandler) Handle(messages <-chan Message, commit func(partition int32, offset int64)) error {
+	for msg := range messages {
+		h.cookies <- msg.Tag.Cookie
+		commit(msg.Partition, msg.Offset+1)
+	}
+	return nil
+}
+
+func (s *MessagingSuite) TestGroupConsumer_Consume() {
+	producer := s.newProducer()
+	for i := 0; i < 10; i++ {
+		err := producer.Send(types.UserTag{Cookie: fmt.Sprintf("cookie-%d", i)})
+		s.Require().NoErrorf(err, "failed to send tag")
+	}
+
+	consumer, err := NewGroupConsumer(s.logger, s.kafkaAddresses(), UserTagsArchiveGroup)
+	s.Require().NoErrorf(err, "failed to create group consumer")
+	defer consumer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	handler := &collectingHandler{cookies: make(chan string, 100)}
+	consumed := make(chan error, 1)
+	go func() { consumed <- consumer.Consume(ctx, handler) }()
+
+	cookies := make(map[string]bool)
+	for len(cookies) < 10 {
+		select {
+		case cookie := <-handler.cookies:
+			cookies[cookie] = true
+		case <-ctx.Done():
+			s.FailNow("tags were not consumed")
+		}
+	}
+	cancel()
+	s.Require().NoErrorf(<-consumed, "failed to consume tags")
+
+	sort.Slice(handler.assigned, func(i, j int) bool { return handler.assigned[i] < handler.assigned[j] })
+	s.Assert().Equal([]int32{0, 1, 2, 3}, handler.assigned, "the only member is assigned all partitions")
+}
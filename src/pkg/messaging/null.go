@@ -15,7 +15,17 @@ func NewNullProducer(logger *zap.Logger) UserTagsProducer {
 	return &null{logger: logger}
 }
 
+// NewNullMessageProducer returns a message producer that does nothing but log invoked methods.
+func NewNullMessageProducer(logger *zap.Logger) MessageProducer {
+	return &null{logger: logger}
+}
+
 func (n *null) Send(tag types.UserTag) error {
 	n.logger.Debug("null producer invoked", zap.String("method", "Send"), zap.Any("tag", tag))
 	return nil
 }
+
+func (n *null) SendMessage(topic string, key string, value []byte) error {
+	n.logger.Debug("null producer invoked", zap.String("method", "SendMessage"), zap.String("topic", topic), zap.String("key", key), zap.ByteString("value", value))
+	return nil
+}
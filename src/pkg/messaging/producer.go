@@ -14,6 +14,11 @@ type UserTagsProducer interface {
 	Send(tag types.UserTag) error
 }
 
+// MessageProducer sends raw messages to any topic. Messages with the same key go to the same partition.
+type MessageProducer interface {
+	SendMessage(topic string, key string, value []byte) error
+}
+
 type Producer struct {
 	logger   *zap.Logger
 	producer sarama.SyncProducer
@@ -53,3 +58,26 @@ func (p *Producer) Send(tag types.UserTag) error {
 	p.logger.Debug("kafka message sent", append(logOpts, zap.Int32("partition", partition), zap.Int64("offset", offset))...)
 	return nil
 }
+
+func (p *Producer) SendMessage(topic string, key string, value []byte) error {
+	start := time.Now()
+
+	partition, offset, err := p.producer.SendMessage(&sarama.ProducerMessage{
+		Topic: topic,
+		Key:   sarama.StringEncoder(key),
+		Value: sarama.ByteEncoder(value),
+	})
+
+	logOpts := []zap.Field{
+		zap.String("topic", topic),
+		zap.String("key", key),
+		zap.ByteString("value", value),
+		zap.Duration("duration", time.Since(start)),
+	}
+	if err != nil {
+		p.logger.Error("failed to send kafka message", append(logOpts, zap.Error(err))...)
+		return fmt.Errorf("failed to send kafka message: %w", err)
+	}
+	p.logger.Debug("kafka message sent", append(logOpts, zap.Int32("partition", partition), zap.Int64("offset", offset))...)
+	return nil
+}
@@ -1,8 +1,10 @@
 package messaging
 
 import (
+	"context"
 	"runtime"
 	"testing"
+	"time"
 
 	"github.com/Shopify/sarama"
 	"github.com/stretchr/testify/suite"
@@ -108,3 +110,37 @@ func (s *MessagingSuite) TestProducer_Send() {
 	}
 	s.Assert().Truef(foundWrittenPartition, "no partition has been written to")
 }
+
+func (s *MessagingSuite) TestKafkaBroadcast_Receive() {
+	producer := s.newProducer()
+	broadcast, err := NewKafkaBroadcast(s.logger, s.kafkaAddresses())
+	s.Require().NoErrorf(err, "failed to create broadcast")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	received := make(chan types.UserTag, 100)
+	done := make(chan error)
+	go func() {
+		done <- broadcast.Receive(ctx, func(tag types.UserTag) { received <- tag })
+	}()
+
+	tag := types.UserTag{
+		Time:   time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC),
+		Cookie: "foo",
+		Device: types.Pc,
+		Action: types.Buy,
+	}
+	// Tags sent before the broadcast consumes partitions are not received.
+	s.Require().Eventuallyf(func() bool {
+		s.Assert().NoErrorf(producer.Send(tag), "failed to send message")
+		select {
+		case got := <-received:
+			s.Assert().Equal(tag.Cookie, got.Cookie)
+			return true
+		case <-time.After(100 * time.Millisecond):
+			return false
+		}
+	}, 10*time.Second, 10*time.Millisecond, "tag was not received")
+
+	cancel()
+	s.Assert().NoErrorf(<-done, "failed to receive messages")
+}
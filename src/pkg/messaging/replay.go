@@ -0,0 +1,194 @@
+package messaging
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/TomaszDomagala/Allezon/src/pkg/types"
+)
+
+const (
+	// UserTagsReplayGroupPrefix prefixes names of consumer groups of replays, separate from UserTagsConsumerGroup.
+	UserTagsReplayGroupPrefix = "user-tags-replay-"
+	// UserTagsArchiveGroup is the consumer group of the archive of raw tags.
+	UserTagsArchiveGroup = "user-tags-archive"
+)
+
+// OffsetEnd is the end of ranges which are replayed until the context is cancelled.
+const OffsetEnd = math.MaxInt64
+
+// OffsetRange is the range [Start, End) of offsets of a partition.
+type OffsetRange struct {
+	Start int64
+	End   int64
+}
+
+// Replayer reads ranges of offsets of the user tags topic again, committing its progress as a dedicated consumer group,
+// so it doesn't affect the worker consuming the topic.
+type Replayer struct {
+	logger *zap.Logger
+	client sarama.Client
+	group  string
+}
+
+func NewReplayer(logger *zap.Logger, addresses []string, group string) (*Replayer, error) {
+	config := sarama.NewConfig()
+	config.Consumer.Return.Errors = true
+	client, err := sarama.NewClient(addresses, config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create client: %w", err)
+	}
+	return &Replayer{logger: logger, client: client, group: group}, nil
+}
+
+func (r *Replayer) Close() error {
+	return r.client.Close()
+}
+
+// OffsetsAt returns offsets of the first messages of partitions produced at or after t, or the offsets of the next
+// messages if there are none. Zero t gives the oldest offsets still in the topic.
+func (r *Replayer) OffsetsAt(t time.Time) (map[int32]int64, error) {
+	if t.IsZero() {
+		return r.offsets(sarama.OffsetOldest)
+	}
+	return r.offsets(t.UnixMilli())
+}
+
+// NewestOffsets returns offsets of the next messages of partitions.
+func (r *Replayer) NewestOffsets() (map[int32]int64, error) {
+	return r.offsets(sarama.OffsetNewest)
+}
+
+// CommittedOffsets returns offsets committed by the consumer group, the next ones it consumes. Partitions without
+// committed offsets are left out.
+func (r *Replayer) CommittedOffsets(group string) (map[int32]int64, error) {
+	partitions, err := r.client.Partitions(UserTagsTopic)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get partitions: %w", err)
+	}
+	coordinator, err := r.client.Coordinator(group)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get coordinator of group %s: %w", group, err)
+	}
+	req := &sarama.OffsetFetchRequest{Version: 1, ConsumerGroup: group}
+	for _, p := range partitions {
+		req.AddPartition(UserTagsTopic, p)
+	}
+	resp, err := coordinator.FetchOffset(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch offsets of group %s: %w", group, err)
+	}
+	offsets := make(map[int32]int64, len(partitions))
+	for _, p := range partitions {
+		block := resp.GetBlock(UserTagsTopic, p)
+		if block == nil {
+			continue
+		}
+		if block.Err != sarama.ErrNoError {
+			return nil, fmt.Errorf("failed to fetch offset of partition %d: %w", p, block.Err)
+		}
+		if block.Offset >= 0 {
+			offsets[p] = block.Offset
+		}
+	}
+	return offsets, nil
+}
+
+func (r *Replayer) offsets(at int64) (map[int32]int64, error) {
+	partitions, err := r.client.Partitions(UserTagsTopic)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get partitions: %w", err)
+	}
+	offsets := make(map[int32]int64, len(partitions))
+	for _, p := range partitions {
+		offset, err := r.client.GetOffset(UserTagsTopic, p, at)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get offset of partition %d: %w", p, err)
+		}
+		if offset == sarama.OffsetNewest {
+			if offset, err = r.client.GetOffset(UserTagsTopic, p, sarama.OffsetNewest); err != nil {
+				return nil, fmt.Errorf("failed to get offset of partition %d: %w", p, err)
+			}
+		}
+		offsets[p] = offset
+	}
+	return offsets, nil
+}
+
+// Replay pushes messages of the ranges of partitions to the messages channel, marking them as consumed by the group
+// of the replayer. It blocks until all ranges are read, the context is cancelled or an error occurs.
+func (r *Replayer) Replay(ctx context.Context, ranges map[int32]OffsetRange, messages chan<- Message) error {
+	consumer, err := sarama.NewConsumerFromClient(r.client)
+	if err != nil {
+		return fmt.Errorf("failed to create consumer: %w", err)
+	}
+	defer consumer.Close()
+	offsets, err := sarama.NewOffsetManagerFromClient(r.group, r.client)
+	if err != nil {
+		return fmt.Errorf("failed to create offset manager: %w", err)
+	}
+	// Closing the offset manager commits the last marked offsets.
+	defer offsets.Close()
+
+	g, ctx := errgroup.WithContext(ctx)
+	for p, rng := range ranges {
+		p, rng := p, rng
+		if rng.Start >= rng.End {
+			continue
+		}
+		g.Go(func() error {
+			return r.replayPartition(ctx, consumer, offsets, p, rng, messages)
+		})
+	}
+	return g.Wait()
+}
+
+func (r *Replayer) replayPartition(ctx context.Context, consumer sarama.Consumer, offsets sarama.OffsetManager, partition int32, rng OffsetRange, messages chan<- Message) error {
+	pom, err := offsets.ManagePartition(UserTagsTopic, partition)
+	if err != nil {
+		return fmt.Errorf("failed to manage offsets of partition %d: %w", partition, err)
+	}
+	defer pom.AsyncClose()
+	pc, err := consumer.ConsumePartition(UserTagsTopic, partition, rng.Start)
+	if err != nil {
+		return fmt.Errorf("failed to consume partition %d: %w", partition, err)
+	}
+	defer pc.AsyncClose()
+
+	for {
+		select {
+		case msg, ok := <-pc.Messages():
+			if !ok {
+				return fmt.Errorf("partition %d closed before offset %d", partition, rng.End)
+			}
+			// Offsets may have gaps, so the range may end without its last offset.
+			if msg.Offset >= rng.End {
+				return nil
+			}
+			var tag types.UserTag
+			if err := types.UnmarshalUserTag(msg.Value, &tag); err != nil {
+				r.logger.Error("failed to unmarshal message", zap.Int32("partition", msg.Partition), zap.Int64("offset", msg.Offset), zap.Error(err))
+			} else {
+				select {
+				case messages <- Message{Tag: tag, Partition: msg.Partition, Offset: msg.Offset}:
+				case <-ctx.Done():
+					return nil
+				}
+			}
+			pom.MarkOffset(msg.Offset+1, "")
+			if msg.Offset+1 == rng.End {
+				return nil
+			}
+		case err := <-pc.Errors():
+			return fmt.Errorf("failed to consume partition %d: %w", partition, err)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package messaging
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/TomaszDomagala/Allezon/src/pkg/types"
+)
+
+func (s *MessagingSuite) TestReplayer_Replay() {
+	producer := s.newProducer()
+	for i := 0; i < 20; i++ {
+		err := producer.Send(types.UserTag{Cookie: fmt.Sprintf("cookie-%d", i)})
+		s.Require().NoErrorf(err, "failed to send tag")
+	}
+
+	replayer, err := NewReplayer(s.logger, s.kafkaAddresses(), UserTagsReplayGroupPrefix+"test")
+	s.Require().NoErrorf(err, "failed to create replayer")
+	defer replayer.Close()
+
+	starts, err := replayer.OffsetsAt(time.Time{})
+	s.Require().NoErrorf(err, "failed to get oldest offsets")
+	ends, err := replayer.NewestOffsets()
+	s.Require().NoErrorf(err, "failed to get newest offsets")
+	s.Require().Len(ends, testTopicPartitionsNumber)
+
+	ranges := make(map[int32]OffsetRange)
+	var total int64
+	for p, end := range ends {
+		ranges[p] = OffsetRange{Start: starts[p], End: end}
+		total += end - starts[p]
+	}
+	s.Require().Equal(int64(20), total)
+
+	messages := make(chan Message, 20)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	s.Require().NoErrorf(replayer.Replay(ctx, ranges, messages), "failed to replay tags")
+	close(messages)
+
+	cookies := make(map[string]bool)
+	for msg := range messages {
+		s.Assert().Less(msg.Offset, ranges[msg.Partition].End)
+		cookies[msg.Tag.Cookie] = true
+	}
+	s.Assert().Len(cookies, 20, "all tags are replayed once")
+
+	committed, err := replayer.CommittedOffsets(UserTagsReplayGroupPrefix + "test")
+	s.Require().NoErrorf(err, "failed to get committed offsets")
+	for p, rng := range ranges {
+		if rng.Start < rng.End {
+			s.Assert().Equal(rng.End, committed[p], "the replay commits offsets of its group")
+		}
+	}
+
+	future, err := replayer.OffsetsAt(time.Now().Add(time.Hour))
+	s.Require().NoErrorf(err, "failed to get offsets")
+	s.Assert().Equal(ends, future, "offsets after the last tag are the newest ones")
+}
@@ -7,8 +7,21 @@ import (
 	"go.uber.org/zap"
 )
 
+const (
+	// RuleMatchesTopic receives JSON encoded matches of rules evaluated by the worker, keyed by cookies.
+	RuleMatchesTopic = "rule-matches"
+	// LateUserTagsTopic receives tags that arrived after the allowed lateness, encoded like in UserTagsTopic and
+	// keyed by cookies.
+	LateUserTagsTopic = "late-user-tags"
+)
+
 // Initialize creates a topic for user tags if it doesn't exist.
 func Initialize(logger *zap.Logger, addresses []string, details *sarama.TopicDetail) error {
+	return InitializeTopic(logger, addresses, UserTagsTopic, details)
+}
+
+// InitializeTopic creates the topic if it doesn't exist.
+func InitializeTopic(logger *zap.Logger, addresses []string, topic string, details *sarama.TopicDetail) error {
 	config := sarama.NewConfig()
 	admin, err := sarama.NewClusterAdmin(addresses, config)
 	if err != nil {
@@ -26,16 +39,16 @@ func Initialize(logger *zap.Logger, addresses []string, details *sarama.TopicDet
 		return fmt.Errorf("failed to list topics: %w", err)
 	}
 
-	if details, ok := topics[UserTagsTopic]; ok {
-		logger.Info("topic already exists", zap.String("topic", UserTagsTopic), zap.Int32("partitions", details.NumPartitions), zap.Int16("replication factor", details.ReplicationFactor))
+	if details, ok := topics[topic]; ok {
+		logger.Info("topic already exists", zap.String("topic", topic), zap.Int32("partitions", details.NumPartitions), zap.Int16("replication factor", details.ReplicationFactor))
 		return nil
 	}
 
-	err = admin.CreateTopic(UserTagsTopic, details, false)
+	err = admin.CreateTopic(topic, details, false)
 
 	if err != nil {
 		return fmt.Errorf("failed to create topic: %w", err)
 	}
-	logger.Info("topic created", zap.String("topic", UserTagsTopic), zap.Int32("partitions", details.NumPartitions), zap.Int16("replication factor", details.ReplicationFactor))
+	logger.Info("topic created", zap.String("topic", topic), zap.Int32("partitions", details.NumPartitions), zap.Int16("replication factor", details.ReplicationFactor))
 	return nil
 }
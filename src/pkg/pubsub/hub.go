@@ -0,0 +1,131 @@
+// Package pubsub broadcasts messages to subscribers within the process.
+package pubsub
+
+import "sync"
+
+// Hub delivers every published message to all current subscribers. Publishing never blocks,
+// messages published while the channel of a subscriber is full are dropped for that subscriber.
+type Hub[T any] struct {
+	mu     sync.Mutex
+	subs   map[chan T]struct{}
+	buffer int
+}
+
+// NewHub creates a hub whose subscribers' channels buffer up to buffer messages.
+func NewHub[T any](buffer int) *Hub[T] {
+	return &Hub[T]{
+		subs:   make(map[chan T]struct{}),
+		buffer: buffer,
+	}
+}
+
+// Subscribe returns the channel of messages published from now on and a function that cancels
+// the subscription and closes the channel.
+func (h *Hub[T]) Subscribe() (<-chan T, func()) {
+	ch := make(chan T, h.buffer)
+
+	h.mu.Lock()
+	h.subs[ch] = struct{}{}
+	h.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			h.mu.Lock()
+			defer h.mu.Unlock()
+			delete(h.subs, ch)
+			close(ch)
+		})
+	}
+}
+
+// Publish sends msg to all subscribers and returns the number of subscribers that dropped it.
+func (h *Hub[T]) Publish(msg T) (dropped int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for ch := range h.subs {
+		select {
+		case ch <- msg:
+		default:
+			dropped++
+		}
+	}
+	return dropped
+}
+
+// Subscribers returns the number of current subscribers.
+func (h *Hub[T]) Subscribers() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return len(h.subs)
+}
+
+// KeyedHub delivers messages published under a key to subscribers of that key, with the semantics of Hub.
+type KeyedHub[K comparable, T any] struct {
+	mu     sync.Mutex
+	subs   map[K]map[chan T]struct{}
+	buffer int
+}
+
+// NewKeyedHub creates a hub whose subscribers' channels buffer up to buffer messages.
+func NewKeyedHub[K comparable, T any](buffer int) *KeyedHub[K, T] {
+	return &KeyedHub[K, T]{
+		subs:   make(map[K]map[chan T]struct{}),
+		buffer: buffer,
+	}
+}
+
+// Subscribe returns the channel of messages published under any of keys from now on and a function
+// that cancels the subscription and closes the channel.
+func (h *KeyedHub[K, T]) Subscribe(keys ...K) (<-chan T, func()) {
+	ch := make(chan T, h.buffer)
+
+	h.mu.Lock()
+	for _, k := range keys {
+		if h.subs[k] == nil {
+			h.subs[k] = make(map[chan T]struct{})
+		}
+		h.subs[k][ch] = struct{}{}
+	}
+	h.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			h.mu.Lock()
+			defer h.mu.Unlock()
+			for _, k := range keys {
+				delete(h.subs[k], ch)
+				if len(h.subs[k]) == 0 {
+					delete(h.subs, k)
+				}
+			}
+			close(ch)
+		})
+	}
+}
+
+// Publish sends msg to all subscribers of key and returns the number of subscribers that dropped it.
+func (h *KeyedHub[K, T]) Publish(key K, msg T) (dropped int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for ch := range h.subs[key] {
+		select {
+		case ch <- msg:
+		default:
+			dropped++
+		}
+	}
+	return dropped
+}
+
+// Keys returns the number of keys with subscribers.
+func (h *KeyedHub[K, T]) Keys() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return len(h.subs)
+}
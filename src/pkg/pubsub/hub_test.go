@@ -0,0 +1,54 @@
+package pubsub
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHub(t *testing.T) {
+	h := NewHub[int](1)
+	first, cancelFirst := h.Subscribe()
+	second, cancelSecond := h.Subscribe()
+	defer cancelSecond()
+	assert.Equal(t, 2, h.Subscribers())
+
+	assert.Zero(t, h.Publish(1))
+	assert.Equal(t, 1, <-first)
+	assert.Equal(t, 1, <-second)
+
+	assert.Zero(t, h.Publish(2))
+	assert.Equal(t, 2, <-first)
+	assert.Equal(t, 1, h.Publish(3), "message is dropped by the subscriber with a full channel")
+	assert.Equal(t, 3, <-first)
+	assert.Equal(t, 2, <-second)
+
+	cancelFirst()
+	cancelFirst()
+	_, ok := <-first
+	assert.False(t, ok, "channel is closed after cancelling")
+	assert.Equal(t, 1, h.Subscribers())
+	assert.Zero(t, h.Publish(4))
+	assert.Equal(t, 4, <-second)
+}
+
+func TestKeyedHub(t *testing.T) {
+	h := NewKeyedHub[string, int](10)
+	foo, cancelFoo := h.Subscribe("foo")
+	both, cancelBoth := h.Subscribe("foo", "bar")
+	defer cancelBoth()
+	assert.Equal(t, 2, h.Keys())
+
+	h.Publish("bar", 1)
+	h.Publish("foo", 2)
+	h.Publish("baz", 3)
+	assert.Equal(t, 2, <-foo)
+	assert.Equal(t, 1, <-both)
+	assert.Equal(t, 2, <-both)
+
+	cancelFoo()
+	_, ok := <-foo
+	assert.False(t, ok, "channel is closed after cancelling")
+	cancelBoth()
+	assert.Zero(t, h.Keys(), "keys without subscribers are removed")
+}
@@ -36,6 +36,13 @@ type Aggregate int8
 const (
 	Sum Aggregate = iota
 	Count
+	AvgPrice
+	MinPrice
+	MaxPrice
+	UniqueCookies
+	PriceP50
+	PriceP90
+	PriceP99
 )
 
 func (a Aggregate) String() string {
@@ -44,6 +51,20 @@ func (a Aggregate) String() string {
 		return "SUM_PRICE"
 	case Count:
 		return "COUNT"
+	case AvgPrice:
+		return "AVG_PRICE"
+	case MinPrice:
+		return "MIN_PRICE"
+	case MaxPrice:
+		return "MAX_PRICE"
+	case UniqueCookies:
+		return "UNIQUE_COOKIES"
+	case PriceP50:
+		return "PRICE_P50"
+	case PriceP90:
+		return "PRICE_P90"
+	case PriceP99:
+		return "PRICE_P99"
 	default:
 		return "Unknown"
 	}
@@ -85,7 +106,7 @@ type UserTag struct {
 }
 
 func MarshalUserTag(tag *UserTag) ([]byte, error) {
-	protoTag, err := userTagIntoProto(tag)
+	protoTag, err := UserTagIntoProto(tag)
 	if err != nil {
 		return nil, fmt.Errorf("cannot marshall tag: %w", err)
 	}
@@ -106,7 +127,8 @@ func UnmarshalUserTag(data []byte, tag *UserTag) error {
 	return nil
 }
 
-func userTagIntoProto(tag *UserTag) (*pbtypes.UserTag, error) {
+// UserTagIntoProto converts the tag into its protobuf representation.
+func UserTagIntoProto(tag *UserTag) (*pbtypes.UserTag, error) {
 	var action pbtypes.Action
 
 	switch tag.Action {
@@ -72,7 +72,7 @@ func (s *IDGetterIntegrationTestsSuite) TestIDGetter() {
 	s.Require().NoErrorf(err, "could not get idgetter url")
 
 	// Create a new client without caching.
-	client := idGetter.NewPureClient(http.Client{Timeout: 5 * time.Second}, url, s.logger)
+	client := idGetter.NewPureClient(http.Client{Timeout: 5 * time.Second}, []string{url}, idGetter.DefaultPolicy(), s.logger)
 
 	calls := []struct {
 		category   string